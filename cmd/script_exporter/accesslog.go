@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/server"
+)
+
+// requestIDEnv is the environment variable that scripts get the ID of
+// the request they run for in.
+const requestIDEnv = "SCRIPT_EXPORTER_REQUEST_ID"
+
+// accessLogger writes the access log. Its lines have timestamps of
+// their own.
+var accessLogger = log.New(os.Stderr, "", 0)
+
+type requestIDKey struct{}
+
+// requestID returns the ID of a request, or "" if requests aren't
+// logged.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestEnv returns the environment variables that scripts run for a
+// request get on top of ours.
+func requestEnv(id string) []string {
+	if id == "" {
+		return nil
+	}
+	return []string{requestIDEnv + "=" + id}
+}
+
+// An accessWriter is a http.ResponseWriter that records the status
+// and size of the response for the access log.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// An accessEntry is a line of the access log in the JSON format.
+type accessEntry struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"request_id"`
+	Client    string  `json:"client"`
+	User      string  `json:"user,omitempty"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Protocol  string  `json:"protocol"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_seconds"`
+}
+
+// accessLogged logs every request to h if the access log is enabled,
+// and gives it an ID, which is sent back in the X-Request-Id header
+// and passed to the scripts that the request runs.
+func accessLogged(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := getConfig()
+		if !c.AccessLog.Active {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var b [8]byte
+		rand.Read(b[:])
+		id := hex.EncodeToString(b[:])
+		w.Header().Set("X-Request-Id", id)
+
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		h.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+
+		client := "-"
+		if ip := server.ClientIP(r, c.Access.TrustedProxies); ip != nil {
+			client = ip.String()
+		}
+		user, _, _ := r.BasicAuth()
+		if c.AccessLog.Format == config.AccessLogJSON {
+			e, _ := json.Marshal(accessEntry{
+				Time:      start.Format(time.RFC3339Nano),
+				RequestID: id,
+				Client:    client,
+				User:      user,
+				Method:    r.Method,
+				URI:       r.RequestURI,
+				Protocol:  r.Proto,
+				Status:    aw.status,
+				Bytes:     aw.bytes,
+				Duration:  time.Since(start).Seconds(),
+			})
+			accessLogger.Println(string(e))
+			return
+		}
+
+		if user == "" {
+			user = "-"
+		}
+		accessLogger.Printf("%s - %s [%s] %q %d %d %s\n", client, user, start.Format("02/Jan/2006:15:04:05 -0700"), r.Method+" "+r.RequestURI+" "+r.Proto, aw.status, aw.bytes, id)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+var adaptiveTimeouts = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "scripts",
+		Name:      "adaptive_timeout_seconds",
+		Help:      "The timeout that a script with an adaptive timeout was given by its recent runs.",
+	},
+	[]string{"script"})
+
+// recordDuration adds the duration of a successful run of a script
+// with an adaptive timeout to the recent ones in its state, and derives
+// its timeout from them once there are enough. The caller holds
+// statesMu.
+func recordDuration(st *scriptState, sc *config.ScriptConfig, d time.Duration) {
+	a := &sc.AdaptiveTimeout
+	if len(st.durations) > a.Samples {
+		st.durations, st.nextDuration = nil, 0
+	}
+	if len(st.durations) < a.Samples {
+		st.durations = append(st.durations, d)
+	} else {
+		st.durations[st.nextDuration] = d
+		st.nextDuration = (st.nextDuration + 1) % a.Samples
+	}
+	if len(st.durations) < config.MinAdaptiveSamples {
+		return
+	}
+
+	sorted := append([]time.Duration(nil), st.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(a.Percentile*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	st.adaptiveTimeout = time.Duration(float64(sorted[i]) * a.Factor)
+	adaptiveTimeouts.WithLabelValues(sc.Name).Set(clampTimeout(sc, st.adaptiveTimeout).Seconds())
+}
+
+// clampTimeout bounds an adaptive timeout by the minimum and the
+// timeout of a script.
+func clampTimeout(sc *config.ScriptConfig, d time.Duration) time.Duration {
+	if d < sc.AdaptiveTimeout.Min {
+		return sc.AdaptiveTimeout.Min
+	}
+	if d > sc.Timeout {
+		return sc.Timeout
+	}
+	return d
+}
+
+// adaptiveTimeout returns the timeout of a script, which is derived
+// from its recent runs if it has an adaptive timeout and has run often
+// enough for it.
+func adaptiveTimeout(sc *config.ScriptConfig) time.Duration {
+	if !sc.AdaptiveTimeout.Active {
+		return sc.Timeout
+	}
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	if st := states[sc.Name]; st != nil && st.adaptiveTimeout > 0 {
+		return clampTimeout(sc, st.adaptiveTimeout)
+	}
+	return sc.Timeout
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// apiScript describes a configured script and its last execution in
+// the JSON admin API. Fields about the last execution are omitted if
+// the script hasn't been run since the exporter started.
+type apiScript struct {
+	Name           string        `json:"name"`
+	Type           string        `json:"type"`
+	Command        string        `json:"command,omitempty"`
+	URL            string        `json:"url,omitempty"`
+	TimeoutSeconds float64       `json:"timeoutSeconds,omitempty"`
+	Runs           uint64        `json:"runs"`
+	LastRun        *time.Time    `json:"lastRun,omitempty"`
+	LastExitCode   *int          `json:"lastExitCode,omitempty"`
+	LastSuccess    *bool         `json:"lastSuccess,omitempty"`
+	LastError      string        `json:"lastError,omitempty"`
+	LastDuration   *float64      `json:"lastDurationSeconds,omitempty"`
+	CacheDuration  float64       `json:"cacheDurationSeconds,omitempty"`
+	CachedResults  int           `json:"cachedResults"`
+	Disabled       bool          `json:"disabled"`
+	DisabledBy     string        `json:"disabledBy,omitempty"`
+	Canary         *canaryResult `json:"canary,omitempty"`
+}
+
+// describeScript returns the admin API description of a script.
+func describeScript(s *config.ScriptConfig) apiScript {
+	as := apiScript{
+		Name:           s.Name,
+		Type:           s.Type,
+		Command:        s.Script,
+		URL:            s.URL,
+		TimeoutSeconds: s.Timeout.Seconds(),
+		CacheDuration:  s.CacheDuration.Seconds(),
+		CachedResults:  countCachedResults(s.Name),
+		DisabledBy:     disabledBy(s),
+	}
+	as.Disabled = as.DisabledBy != ""
+	if r, ok := lastCanary(s.Name); ok {
+		as.Canary = &r
+	}
+
+	if st, ok := getState(s.Name); ok {
+		lastRun := st.lastRun
+		exitCode := st.lastExitCode
+		success := st.lastError == ""
+		duration := st.lastDuration.Seconds()
+
+		as.Runs = st.runs
+		as.LastRun = &lastRun
+		as.LastExitCode = &exitCode
+		as.LastSuccess = &success
+		as.LastError = st.lastError
+		as.LastDuration = &duration
+	}
+
+	return as
+}
+
+// writeJSON writes v as the JSON response to a request.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %s\n", err.Error())
+	}
+}
+
+// scriptsAPIHandler serves /api/v1/scripts, a JSON list of all
+// configured scripts and the status of their last execution.
+func scriptsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	c := getConfig()
+	scripts := []apiScript{}
+	for i := range c.Scripts {
+		scripts = append(scripts, describeScript(&c.Scripts[i]))
+	}
+
+	writeJSON(w, map[string]interface{}{"scripts": scripts})
+}
+
+// An apiMetric is a metric family of our own metrics in the JSON
+// admin API, with the samples of histograms and summaries as in the
+// exposition format.
+type apiMetric struct {
+	Name    string      `json:"name"`
+	Help    string      `json:"help"`
+	Type    string      `json:"type"`
+	Samples []apiSample `json:"samples"`
+}
+
+type apiSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  apiValue          `json:"value"`
+}
+
+// An apiValue is the value of a sample, which is a JSON number unless
+// it is NaN or infinite, which JSON has no numbers for; those are the
+// strings "NaN", "+Inf" and "-Inf".
+type apiValue float64
+
+func (v apiValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return []byte(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+// describeMetric returns the admin API description of a metric
+// family.
+func describeMetric(mf *dto.MetricFamily) apiMetric {
+	am := apiMetric{
+		Name:    mf.GetName(),
+		Help:    mf.GetHelp(),
+		Type:    strings.ToLower(mf.GetType().String()),
+		Samples: []apiSample{},
+	}
+	for _, m := range mf.Metric {
+		sample := func(suffix string, value float64, extra ...string) {
+			labels := make(map[string]string)
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			for i := 0; i+1 < len(extra); i += 2 {
+				labels[extra[i]] = extra[i+1]
+			}
+			am.Samples = append(am.Samples, apiSample{Name: am.Name + suffix, Labels: labels, Value: apiValue(value)})
+		}
+		switch {
+		case m.Counter != nil:
+			sample("", m.Counter.GetValue())
+		case m.Gauge != nil:
+			sample("", m.Gauge.GetValue())
+		case m.Untyped != nil:
+			sample("", m.Untyped.GetValue())
+		case m.Histogram != nil:
+			for _, b := range m.Histogram.Bucket {
+				sample("_bucket", float64(b.GetCumulativeCount()), "le", fmt.Sprint(b.GetUpperBound()))
+			}
+			sample("_bucket", float64(m.Histogram.GetSampleCount()), "le", "+Inf")
+			sample("_sum", m.Histogram.GetSampleSum())
+			sample("_count", float64(m.Histogram.GetSampleCount()))
+		case m.Summary != nil:
+			for _, q := range m.Summary.Quantile {
+				sample("", q.GetValue(), "quantile", fmt.Sprint(q.GetQuantile()))
+			}
+			sample("_sum", m.Summary.GetSampleSum())
+			sample("_count", float64(m.Summary.GetSampleCount()))
+		}
+	}
+	return am
+}
+
+// metricsAPIHandler serves /api/v1/metrics.json, our own metrics and
+// the status of the last execution of every script as JSON, for
+// tools that can't read the exposition format.
+func metricsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Printf("Failed to gather metrics: %s\n", err.Error())
+	}
+	metrics := []apiMetric{}
+	for _, mf := range families {
+		metrics = append(metrics, describeMetric(mf))
+	}
+
+	c := getConfig()
+	scripts := []apiScript{}
+	for i := range c.Scripts {
+		scripts = append(scripts, describeScript(&c.Scripts[i]))
+	}
+
+	writeJSON(w, map[string]interface{}{"metrics": metrics, "scripts": scripts})
+}
+
+// scriptAPIHandler serves the API of a single script:
+//
+//	GET  /api/v1/scripts/<name>             describes the script
+//	GET  /api/v1/scripts/<name>/history     lists its recent executions
+//	POST /api/v1/scripts/<name>/disable     disables it at runtime
+//	POST /api/v1/scripts/<name>/enable      enables it again
+//	POST /api/v1/scripts/<name>/invalidate  drops its cached results
+func scriptAPIHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/scripts/"), "/")
+	sc := getConfig().GetScriptConfig(parts[0])
+	if sc == nil || len(parts) > 2 {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJSON(w, describeScript(sc))
+		return
+	}
+
+	if parts[1] == "history" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"script": sc.Name, "history": scriptHistoryRecords(sc.Name)})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch parts[1] {
+	case "disable":
+		setDisabled(sc.Name, true)
+		log.Printf("Script %s disabled through the API\n", sc.Name)
+	case "enable":
+		setDisabled(sc.Name, false)
+		log.Printf("Script %s enabled through the API\n", sc.Name)
+	case "invalidate":
+		n := invalidateResults(sc.Name)
+		log.Printf("Script %s: %d cached results invalidated through the API\n", sc.Name, n)
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, describeScript(sc))
+}
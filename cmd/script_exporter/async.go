@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// An asyncJob tracks the runs of a script in async mode for one probe
+// key. Only one run is in progress at a time, and output is the result
+// of the last completed run, which finished at finished, and served
+// records whether a probe got it yet.
+type asyncJob struct {
+	scriptName string
+	running    bool
+	served     bool
+	output     string
+	finished   time.Time
+}
+
+var (
+	asyncMu   sync.Mutex
+	asyncJobs = make(map[string]*asyncJob)
+)
+
+// asyncProbe answers a probe of a script in async mode for key without
+// waiting for the script. A completed run that no probe got yet is
+// served as is. Otherwise, a run is started unless one is in progress
+// already, and the probe gets the result of the last completed run,
+// if there is one, with script_running 1. Results are kept in dir, if
+// it isn't "", and the result kept there serves as the last completed
+// run of a new job. It also returns when the run whose result is
+// served finished, or the zero time if there is none.
+func asyncProbe(key, scriptName, dir string, probe func() (string, []outputDiagnostic, error)) (string, time.Time) {
+	asyncMu.Lock()
+	defer asyncMu.Unlock()
+
+	j := asyncJobs[key]
+	if j == nil {
+		// Probe keys come from URLs, so jobs that are done
+		// with are removed once there are many of them.
+		if len(asyncJobs) >= sweepCacheSize {
+			for k, j := range asyncJobs {
+				if !j.running && j.served {
+					delete(asyncJobs, k)
+				}
+			}
+		}
+		j = &asyncJob{scriptName: scriptName, served: true}
+		if dir != "" {
+			if p, ok := loadPersistedResult(dir, key); ok {
+				j.output, j.finished = staleOutput(p.Output, true), p.Time
+			}
+		}
+		asyncJobs[key] = j
+	}
+
+	if !j.running && !j.served {
+		j.served = true
+		return fmt.Sprintf("%s%s\n%s\n%s_running{} %d\n", j.output, scriptRunningHelp, scriptRunningType, namespace, 0), j.finished
+	}
+
+	if !j.running {
+		j.running = true
+		go func() {
+			output, diags, err := probe()
+			if err != nil {
+				log.Printf("Script %s failed: %s\n", scriptName, err.Error())
+			} else if dir != "" {
+				if err := storePersistedResult(dir, key, scriptName, output); err != nil {
+					log.Printf("Script %s: can't persist result: %s\n", scriptName, err.Error())
+				}
+			}
+			if dir != "" {
+				output = staleOutput(output, false)
+			}
+			for _, d := range diags {
+				if d.naming {
+					log.Printf("Script %s: dropping metric: %s\n", scriptName, d.reason)
+				}
+			}
+
+			asyncMu.Lock()
+			j.running, j.served, j.output, j.finished = false, false, output, time.Now()
+			asyncMu.Unlock()
+		}()
+	}
+	return fmt.Sprintf("%s%s\n%s\n%s_running{} %d\n", j.output, scriptRunningHelp, scriptRunningType, namespace, 1), j.finished
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A probeBatch is a set of identical probes that share a single
+// execution of their script. The result fields are valid once done
+// is closed.
+type probeBatch struct {
+	done   chan struct{}
+	output string
+	diags  []outputDiagnostic
+	err    error
+}
+
+var (
+	batchesMu sync.Mutex
+	batches   = make(map[string]*probeBatch)
+
+	probesCoalesced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "probes_coalesced_total",
+			Help:      "Total probes of a script answered with the result of an identical probe instead of running it.",
+		},
+		[]string{"script"})
+	queueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "scripts",
+			Name:      "queue_length",
+			Help:      "Number of probes of a script waiting for a batch window or an identical probe.",
+		},
+		[]string{"script"})
+
+	// queueWait is replaced by one with the configured buckets
+	// when the metrics are set up.
+	queueWait = newQueueWait(defaultDurationBuckets)
+)
+
+// newQueueWait returns the histogram of how long probes waited in
+// batches, with buckets.
+func newQueueWait(buckets []float64) prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "scripts",
+		Name:      "queue_wait_seconds",
+		Help:      "A histogram of how long probes waited for a batch window or an identical probe.",
+		Buckets:   buckets,
+	})
+}
+
+// waited ends the wait of a probe in a batch that started at start.
+func waited(scriptName string, wait *span, start time.Time) {
+	queueLength.WithLabelValues(scriptName).Dec()
+	queueWait.Observe(time.Since(start).Seconds())
+	wait.end(nil)
+}
+
+// batchedProbe runs probe for key, unless a batch for key is already
+// being collected, in which case it waits for that batch's result
+// instead. A new batch waits for window before running probe, so
+// that probes arriving close together (such as from a HA pair of
+// Prometheus servers) are answered with one execution. Probes that
+// arrive after the window has closed start a new batch, unless
+// singleFlight is set, in which case the batch takes further probes
+// until probe has returned. The waiting is traced within parent.
+func batchedProbe(key, scriptName string, window time.Duration, singleFlight bool, parent *span, probe func() (string, []outputDiagnostic, error)) (string, []outputDiagnostic, error) {
+	wait := parent.child("queue wait")
+	start := time.Now()
+	queueLength.WithLabelValues(scriptName).Inc()
+	batchesMu.Lock()
+	b := batches[key]
+	if b != nil {
+		batchesMu.Unlock()
+		probesCoalesced.WithLabelValues(scriptName).Inc()
+		<-b.done
+		waited(scriptName, wait, start)
+		return b.output, b.diags, b.err
+	}
+	b = &probeBatch{done: make(chan struct{})}
+	batches[key] = b
+	batchesMu.Unlock()
+
+	// The probes waiting for the batch get an error if probe
+	// panics, and the panic goes on in the probe that ran it. A
+	// single flight batch takes probes until it's done either way.
+	defer func() {
+		v := recover()
+		if v != nil {
+			b.output, b.diags, b.err = "", nil, fmt.Errorf("probe panicked: %v", v)
+		}
+		if singleFlight {
+			batchesMu.Lock()
+			delete(batches, key)
+			batchesMu.Unlock()
+		}
+		close(b.done)
+		if v != nil {
+			panic(v)
+		}
+	}()
+
+	if window > 0 {
+		time.Sleep(window)
+	}
+	waited(scriptName, wait, start)
+
+	if !singleFlight {
+		batchesMu.Lock()
+		delete(batches, key)
+		batchesMu.Unlock()
+	}
+
+	b.output, b.diags, b.err = probe()
+	return b.output, b.diags, b.err
+}
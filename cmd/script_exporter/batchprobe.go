@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// batchProbeHandler probes several scripts for one POSTed request,
+// each with its own parameters, and serves their merged output like
+// that of a group. The body is a JSON array of probes, each a JSON
+// object of parameters as in the body of a POSTed probe, with the
+// script in its 'script' (or 'module') parameter. The probes run in
+// parallel if the 'parallel' query parameter is true. Probes of the
+// same script need different labels from the URL, so that their
+// samples don't collide, and batches may have at most
+// probe.maxBatchSize probes.
+func batchProbeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Batch probes must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		http.Error(w, "Batch probes must be sent as application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, status, err := readBody(r)
+	var probes []json.RawMessage
+	if err == nil {
+		status = http.StatusBadRequest
+		if err = json.Unmarshal(body, &probes); err == nil && len(probes) == 0 {
+			err = errors.New("no probes")
+		}
+		if max := getConfig().Probe.MaxBatchSize; err == nil && len(probes) > max {
+			status, err = http.StatusRequestEntityTooLarge, fmt.Errorf("more than %d probes", max)
+		}
+	}
+	if err != nil {
+		log.Printf("Invalid request body: %s\n", err.Error())
+		http.Error(w, fmt.Sprintf("Invalid request body: %s", err.Error()), status)
+		return
+	}
+
+	client := clientID(r)
+	batch := make([]groupProbe, len(probes))
+	seen := make(map[string]int)
+	for i, raw := range probes {
+		params, err := parseJSONParams(raw)
+		if err != nil {
+			log.Printf("Invalid probe %d of batch: %s\n", i, err.Error())
+			http.Error(w, fmt.Sprintf("Invalid probe %d: %s", i, err.Error()), http.StatusBadRequest)
+			return
+		}
+		applyClientParams(client, params)
+		scriptName := params.Get("script")
+		if scriptName == "" {
+			scriptName = params.Get("module")
+		}
+		if scriptName == "" {
+			log.Printf("Script parameter is missing in probe %d of batch\n", i)
+			http.Error(w, fmt.Sprintf("Script parameter is missing in probe %d", i), http.StatusBadRequest)
+			return
+		}
+
+		// Probes of the same script are told apart by their labels
+		// from the URL, which all of their samples get.
+		labels := []parser.Label{{Name: "script", Value: scriptName}}
+		if sc := lookupScript(getConfig(), scriptName); sc != nil && sc.AllowURLLabels {
+			urlLabels, _ := parseURLLabels(params.Get("labels"))
+			for _, l := range urlLabels {
+				if l.Name != "script" {
+					labels = append(labels, l)
+				}
+			}
+		}
+		key := parser.FormatLabels(labels)
+		if j, ok := seen[key]; ok {
+			log.Printf("Probe %d of batch repeats probe %d\n", i, j)
+			http.Error(w, fmt.Sprintf("Probe %d repeats probe %d", i, j), http.StatusBadRequest)
+			return
+		}
+		seen[key] = i
+		batch[i] = groupProbe{script: scriptName, params: params, labels: labels}
+	}
+
+	parallel, _ := strconv.ParseBool(r.URL.Query().Get("parallel"))
+	groupHandler(w, r, client, batch, parallel)
+}
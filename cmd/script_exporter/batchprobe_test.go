@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchProbeHandler(t *testing.T) {
+	useConfig(t, `
+probe:
+  maxBatchSize: 2
+scripts:
+  - name: up
+    script: echo up 1
+  - name: down
+    script: echo down 0
+`)
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"one probe", "application/json", `[{"script": "up"}]`, http.StatusOK},
+		{"maxBatchSize probes", "application/json", `[{"script": "up"}, {"script": "down"}]`, http.StatusOK},
+		{"repeated probe", "application/json", `[{"script": "up"}, {"script": "up"}]`, http.StatusBadRequest},
+		{"more than maxBatchSize", "application/json", `[{"script": "up"}, {"script": "up"}, {"script": "up"}]`, http.StatusRequestEntityTooLarge},
+		{"no probes", "application/json", `[]`, http.StatusBadRequest},
+		{"invalid json", "application/json", `[{"script": "up"}`, http.StatusBadRequest},
+		{"no script", "application/json", `[{"prefix": "up"}]`, http.StatusBadRequest},
+		{"not json", "text/plain", `[{"script": "up"}]`, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/batchprobe", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			batchProbeHandler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
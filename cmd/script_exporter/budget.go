@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+var (
+	// The execution budget is a bucket of the seconds that scripts
+	// may still run, which is refilled continuously, like the
+	// buckets of rate limits.
+	budgetMu sync.Mutex
+	budget   struct {
+		seconds float64
+		last    time.Time
+	}
+
+	requestsOverBudget = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "requests_over_budget_total",
+			Help:      "Total requests to a script rejected because scripts used up the execution budget.",
+		},
+		[]string{"script"})
+)
+
+// refillBudget adds the seconds that the execution budget has earned
+// since it was last used; a new budget starts out full. It must be
+// called with budgetMu held.
+func refillBudget(c *config.Config, now time.Time) {
+	eb := c.ExecutionBudget
+	if budget.last.IsZero() {
+		budget.seconds = eb.ScriptSeconds
+	} else {
+		budget.seconds += now.Sub(budget.last).Seconds() * eb.ScriptSeconds / eb.Interval.Seconds()
+	}
+	budget.seconds = math.Min(budget.seconds, eb.ScriptSeconds)
+	budget.last = now
+}
+
+// budgetWait returns how long it takes until scripts may run again
+// within the execution budget, which is zero if they may now or there
+// is no budget.
+func budgetWait(c *config.Config, now time.Time) time.Duration {
+	eb := c.ExecutionBudget
+	if eb.ScriptSeconds == 0 {
+		return 0
+	}
+
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	refillBudget(c, now)
+	if budget.seconds > 0 {
+		return 0
+	}
+	return time.Duration(-budget.seconds / eb.ScriptSeconds * float64(eb.Interval))
+}
+
+// spendBudget takes the time that a script ran from the execution
+// budget. The budget may end up negative, since runs aren't stopped
+// when they use it up.
+func spendBudget(c *config.Config, d time.Duration) {
+	if c.ExecutionBudget.ScriptSeconds == 0 {
+		return
+	}
+
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	refillBudget(c, time.Now())
+	budget.seconds -= d.Seconds()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// A builtinCheck is a check implemented in Go, which scripts can use
+// instead of a program with the command 'builtin:<name>'. It gets the
+// arguments of the command, including parameters, and returns output
+// in the exposition format. It should give up when ctx is done.
+type builtinCheck func(ctx context.Context, args []string) (string, error)
+
+// builtinChecks are the available built-in checks, by name.
+var builtinChecks = map[string]builtinCheck{
+	"file_age":       checkFileAge,
+	"file_size":      checkFileSize,
+	"dir_count":      checkDirCount,
+	"tcp_connect":    checkTCPConnect,
+	"command_exists": checkCommandExists,
+}
+
+// isBuiltin reports whether a script is a built-in check.
+func isBuiltin(sc *config.ScriptConfig) bool {
+	return strings.HasPrefix(sc.Script, config.BuiltinPrefix)
+}
+
+// checkBuiltins checks that the built-in checks used by scripts exist
+// and are run the only way they can be.
+func checkBuiltins(c *config.Config) []error {
+	var errs []error
+	for i := range c.Scripts {
+		sc := &c.Scripts[i]
+		if !isBuiltin(sc) {
+			continue
+		}
+		name := strings.TrimPrefix(config.SplitCommand(sc.Script)[0], config.BuiltinPrefix)
+		if _, ok := builtinChecks[name]; !ok {
+			errs = append(errs, fmt.Errorf("script %s: unknown built-in check %s", sc.Name, name))
+		}
+		if sc.Type != config.TypeExec || sc.Interpreter != "" {
+			errs = append(errs, fmt.Errorf("script %s: built-in checks can't have a type or an interpreter", sc.Name))
+		}
+	}
+	return errs
+}
+
+// runBuiltin runs a built-in check command, stopping it once it has
+// run for timeout unless that is zero.
+func runBuiltin(args []string, timeout time.Duration) (string, error) {
+	check, ok := builtinChecks[strings.TrimPrefix(args[0], config.BuiltinPrefix)]
+	if !ok {
+		return "", fmt.Errorf("unknown built-in check %s", args[0])
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	output, err := check(ctx, args[1:])
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return "", &runner.TimeoutError{Timeout: timeout}
+	}
+	return output, err
+}
+
+// builtinSample formats a sample of a built-in check.
+func builtinSample(name, labelName, labelValue string, value interface{}) string {
+	return fmt.Sprintf("%s%s %v\n", name, parser.FormatLabels([]parser.Label{{Name: labelName, Value: labelValue}}), value)
+}
+
+// checkFileAge reports the time since files were last modified.
+func checkFileAge(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("file_age: no files given")
+	}
+	var b strings.Builder
+	for _, path := range args {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(builtinSample("file_age_seconds", "path", path, time.Since(fi.ModTime()).Seconds()))
+	}
+	return b.String(), nil
+}
+
+// checkFileSize reports the size of files.
+func checkFileSize(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("file_size: no files given")
+	}
+	var b strings.Builder
+	for _, path := range args {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(builtinSample("file_size_bytes", "path", path, fi.Size()))
+	}
+	return b.String(), nil
+}
+
+// checkDirCount reports the number of entries of a directory, or of
+// those that match a glob pattern if one is given.
+func checkDirCount(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return "", fmt.Errorf("dir_count: expected a directory and optionally a pattern")
+	}
+	entries, err := ioutil.ReadDir(args[0])
+	if err != nil {
+		return "", err
+	}
+	n := 0
+	for _, e := range entries {
+		if len(args) == 2 {
+			ok, err := filepath.Match(args[1], e.Name())
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				continue
+			}
+		}
+		n++
+	}
+	return builtinSample("dir_entries", "path", args[0], n), nil
+}
+
+// checkTCPConnect reports how long it takes to connect to TCP
+// addresses, and fails if any of them can't be connected to.
+func checkTCPConnect(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("tcp_connect: no addresses given")
+	}
+	var b strings.Builder
+	var d net.Dialer
+	for _, addr := range args {
+		start := time.Now()
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		b.WriteString(builtinSample("tcp_connect_duration_seconds", "address", addr, time.Since(start).Seconds()))
+	}
+	return b.String(), nil
+}
+
+// checkCommandExists reports whether commands can be found in $PATH,
+// or exist and are executable if they are paths.
+func checkCommandExists(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("command_exists: no commands given")
+	}
+	var b strings.Builder
+	for _, name := range args {
+		exists := 0
+		if _, err := exec.LookPath(name); err == nil {
+			exists = 1
+		}
+		b.WriteString(builtinSample("command_exists", "command", name, exists))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// bundleSuffix ends the names of the files of failure bundles, so
+// that pruning them leaves other files in the directory alone.
+const bundleSuffix = ".bundle.json"
+
+// A failureBundle is what is known about a failed run of a script, as
+// it is kept in the failure bundle directory: the command line and the
+// environment variables that the script gets on top of ours, when and
+// for how long it ran, and how it failed, with the start of its
+// output.
+type failureBundle struct {
+	Script          string    `json:"script"`
+	Args            []string  `json:"args"`
+	Env             []string  `json:"env,omitempty"`
+	Start           time.Time `json:"start"`
+	Duration        float64   `json:"durationSeconds"`
+	Timeout         float64   `json:"timeoutSeconds,omitempty"`
+	Attempts        int       `json:"attempts"`
+	ExitCode        int       `json:"exitCode"`
+	Error           string    `json:"error"`
+	Stdout          string    `json:"stdout"`
+	StdoutTruncated bool      `json:"stdoutTruncated,omitempty"`
+	Stderr          string    `json:"stderr"`
+	StderrTruncated bool      `json:"stderrTruncated,omitempty"`
+}
+
+// A runTrace collects the start of the standard output and error of
+// an attempt to run a script, for its failure bundle. The standard
+// error of the commands of a pipeline is written concurrently.
+type runTrace struct {
+	stdout historyOutput
+
+	mu     sync.Mutex
+	stderr historyOutput
+}
+
+// newRunTrace returns a runTrace for the configuration, or nil if
+// failure bundles aren't kept.
+func newRunTrace(c *config.Config) *runTrace {
+	if c.FailureBundles.Directory == "" {
+		return nil
+	}
+	max := c.FailureBundles.MaxOutputBytes
+	return &runTrace{stdout: historyOutput{max: max}, stderr: historyOutput{max: max}}
+}
+
+func (t *runTrace) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stderr.Write(p)
+}
+
+// reset forgets what an earlier attempt wrote.
+func (t *runTrace) reset() {
+	if t == nil {
+		return
+	}
+	t.stdout.reset()
+	t.mu.Lock()
+	t.stderr.reset()
+	t.mu.Unlock()
+}
+
+// setStdout replaces the kept standard output with the start of
+// output.
+func (t *runTrace) setStdout(output string) {
+	if t != nil {
+		t.stdout.set(output)
+	}
+}
+
+// saveFailureBundle writes the failure bundle of a run of a script for
+// a probe request to the directory of the configuration and prunes the
+// bundles there that are too many or too old.
+func saveFailureBundle(c *config.Config, sc *config.ScriptConfig, pr *probeRequest, t *runTrace, start time.Time, attempts int, err error) {
+	t.mu.Lock()
+	stderr, stderrTruncated := t.stderr.String(), t.stderr.truncated()
+	t.mu.Unlock()
+	b := failureBundle{
+		Script:          sc.Name,
+		Args:            append(sc.Command(), pr.paramValues...),
+		Env:             append(append([]string(nil), sc.Environ()...), pr.env...),
+		Start:           start,
+		Duration:        time.Since(start).Seconds(),
+		Timeout:         pr.scriptTimeout(sc).Seconds(),
+		Attempts:        attempts,
+		ExitCode:        runner.ExitCode(err),
+		Error:           err.Error(),
+		Stdout:          t.stdout.String(),
+		StdoutTruncated: t.stdout.truncated(),
+		Stderr:          stderr,
+		StderrTruncated: stderrTruncated,
+	}
+	data, jerr := json.MarshalIndent(b, "", "  ")
+	if jerr != nil {
+		log.Printf("Script %s: can't encode failure bundle: %s\n", sc.Name, jerr.Error())
+		return
+	}
+
+	dir := c.FailureBundles.Directory
+	name := url.PathEscape(sc.Name) + "-" + start.UTC().Format("20060102T150405.000000000Z") + bundleSuffix
+	if werr := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); werr != nil {
+		log.Printf("Script %s: can't write failure bundle: %s\n", sc.Name, werr.Error())
+		return
+	}
+	pruneFailureBundles(dir, c.FailureBundles.MaxBundles, c.FailureBundles.MaxAge)
+}
+
+// pruneFailureBundles removes the oldest failure bundles in dir
+// beyond the first maxBundles, and those older than maxAge unless it's
+// zero.
+func pruneFailureBundles(dir string, maxBundles int, maxAge time.Duration) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Can't prune failure bundles: %s\n", err.Error())
+		return
+	}
+	var bundles []os.FileInfo
+	for _, fi := range entries {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), bundleSuffix) {
+			bundles = append(bundles, fi)
+		}
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].ModTime().After(bundles[j].ModTime()) })
+
+	for i, fi := range bundles {
+		if i < maxBundles && (maxAge == 0 || time.Since(fi.ModTime()) <= maxAge) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			log.Printf("Can't remove failure bundle %s: %s\n", fi.Name(), err.Error())
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepCacheSize is the number of cached results above which we
+// remove expired results whenever a new one is stored. Parameters
+// come from URLs, so the number of keys isn't bounded otherwise.
+const sweepCacheSize = 1024
+
+// cachedResult is a successful probe result that can be reused.
+// stored is when the script produced it.
+type cachedResult struct {
+	scriptName string
+	output     string
+	diags      []outputDiagnostic
+	stored     time.Time
+	expires    time.Time
+}
+
+var (
+	resultsMu sync.Mutex
+	results   = make(map[string]*cachedResult)
+)
+
+// cacheKey returns the key for a probe result in the cache. The
+// client partition is only set for scripts that cache per client.
+func cacheKey(client, batch string) string {
+	return client + "\x00" + batch
+}
+
+// getCachedResult returns a cached result that hasn't expired yet.
+func getCachedResult(key string) (*cachedResult, bool) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	cr := results[key]
+	if cr == nil || time.Now().After(cr.expires) {
+		return nil, false
+	}
+	return cr, true
+}
+
+// storeCachedResult adds a probe result of a script, produced at
+// stored, to the cache for d from then.
+func storeCachedResult(key, scriptName, output string, diags []outputDiagnostic, stored time.Time, d time.Duration) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	now := time.Now()
+	if len(results) >= sweepCacheSize {
+		for k, cr := range results {
+			if now.After(cr.expires) {
+				delete(results, k)
+			}
+		}
+	}
+	results[key] = &cachedResult{scriptName: scriptName, output: output, diags: diags, stored: stored, expires: stored.Add(d)}
+}
+
+// countCachedResults returns the number of unexpired results cached
+// for a script.
+func countCachedResults(scriptName string) int {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	n := 0
+	now := time.Now()
+	for _, cr := range results {
+		if cr.scriptName == scriptName && !now.After(cr.expires) {
+			n++
+		}
+	}
+	return n
+}
+
+// invalidateResults drops the results of a script, or of all scripts
+// if scriptName is "": those that are cached, the last results of
+// async runs and those that probes outside of the windows of the
+// script serve, in memory and persisted on disk. It also makes the
+// script due if it's scheduled, so that the next probe or scheduler
+// tick runs it afresh. It returns the number of results that were
+// dropped.
+func invalidateResults(scriptName string) int {
+	matches := func(name string) bool {
+		return scriptName == "" || name == scriptName
+	}
+
+	resultsMu.Lock()
+	n := 0
+	for k, cr := range results {
+		if matches(cr.scriptName) {
+			delete(results, k)
+			n++
+		}
+	}
+	resultsMu.Unlock()
+
+	// Runs in progress are left to finish, but their jobs forget
+	// the result of the previous run.
+	asyncMu.Lock()
+	for k, j := range asyncJobs {
+		if !matches(j.scriptName) {
+			continue
+		}
+		if j.output != "" {
+			n++
+		}
+		if j.running {
+			j.served, j.output, j.finished = true, "", time.Time{}
+		} else {
+			delete(asyncJobs, k)
+		}
+	}
+	asyncMu.Unlock()
+
+	windowMu.Lock()
+	for k, wr := range windowResults {
+		if matches(wr.scriptName) {
+			delete(windowResults, k)
+			n++
+		}
+	}
+	windowMu.Unlock()
+
+	if dir := getConfig().Persistence.Directory; dir != "" {
+		n += removePersistedResults(dir, matches)
+	}
+
+	scheduleMu.Lock()
+	for name := range scheduleNext {
+		if matches(name) {
+			scheduleNext[name] = time.Time{}
+		}
+	}
+	scheduleMu.Unlock()
+	return n
+}
+
+// clientID returns the identifier of the client that made a request,
+// from the configured header or else from the common name of its TLS
+// client certificate, or "" if it can't be identified.
+func clientID(r *http.Request) string {
+	c := getConfig()
+	if c.Clients.Header != "" {
+		if id := strings.TrimSpace(r.Header.Get(c.Clients.Header)); id != "" {
+			return id
+		}
+	}
+	if c.Clients.UseCertCN && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return ""
+}
+
+// applyClientParams sets the parameter defaults pinned for a client
+// in params, for every parameter that the request didn't set itself.
+func applyClientParams(client string, params url.Values) {
+	if client == "" {
+		return
+	}
+	for k, v := range getConfig().Clients.Params[client] {
+		if params.Get(k) == "" {
+			params.Set(k, v)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInvalidateResults(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "count.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nn=$(cat \"$0.runs\" 2>/dev/null || echo 0)\nn=$((n + 1))\necho $n >\"$0.runs\"\necho runs $n\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "results"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, fmt.Sprintf(`
+persistence:
+  directory: %s
+scripts:
+  - name: count
+    script: %s
+    cacheDuration: 1h
+    persistResult: true
+`, filepath.Join(dir, "results"), script))
+	defer invalidateResults("count")
+
+	probe := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		metricsHandler(w, httptest.NewRequest(http.MethodGet, "/probe?script=count", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	persisted := func() int {
+		t.Helper()
+		files, err := filepath.Glob(filepath.Join(dir, "results", "*.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	if got := probe(); !strings.Contains(got, "runs{} 1\n") {
+		t.Fatalf("first probe = %q, want the first run", got)
+	}
+	if got := probe(); !strings.Contains(got, "runs{} 1\n") {
+		t.Errorf("second probe = %q, want the cached first run", got)
+	}
+	if n := persisted(); n != 1 {
+		t.Fatalf("%d results persisted, want 1", n)
+	}
+
+	if n := invalidateResults("other"); n != 0 {
+		t.Errorf("invalidateResults() of another script = %d, want 0", n)
+	}
+	if n := invalidateResults("count"); n != 2 {
+		t.Errorf("invalidateResults() = %d, want 2", n)
+	}
+	if n := persisted(); n != 0 {
+		t.Errorf("%d results persisted after invalidating, want 0", n)
+	}
+	// Neither the cached nor the persisted result is served again.
+	if got := probe(); !strings.Contains(got, "runs{} 2\n") {
+		t.Errorf("probe after invalidating = %q, want a new run", got)
+	}
+}
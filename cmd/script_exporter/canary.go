@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// A canaryResult is the outcome of the last canary run of a script,
+// with the command of the definition that was run.
+type canaryResult struct {
+	Time     time.Time `json:"time"`
+	Command  []string  `json:"command"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+	Rejected bool      `json:"rejected"`
+}
+
+var (
+	canaryMu      sync.Mutex
+	canaryResults = make(map[string]canaryResult)
+
+	canaryLastSuccessful = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "scripts",
+			Name:      "canary_last_successful",
+			Help:      "Whether the last canary run of a changed script was successful.",
+		},
+		[]string{"script"})
+	canaryRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "canary_runs_total",
+			Help:      "Canary runs of changed scripts on reload, by result.",
+		},
+		[]string{"script", "result"})
+)
+
+// lastCanary returns the outcome of the last canary run of a script,
+// if it had one since the exporter started.
+func lastCanary(scriptName string) (canaryResult, bool) {
+	canaryMu.Lock()
+	defer canaryMu.Unlock()
+	r, ok := canaryResults[scriptName]
+	return r, ok
+}
+
+// commandChanged reports whether a new definition of a script runs
+// something else than the old one.
+func commandChanged(old, sc *config.ScriptConfig) bool {
+	return old.Type != sc.Type || !reflect.DeepEqual(old.Command(), sc.Command()) || !reflect.DeepEqual(old.Pipeline, sc.Pipeline) || !reflect.DeepEqual(old.Args, sc.Args)
+}
+
+// runCanaries runs the canary scripts of a configuration that is about
+// to replace the running one old once, if their command changed. The
+// scripts whose run fails keep their old definition in c.
+func runCanaries(old, c *config.Config) {
+	for i := range c.Scripts {
+		sc := &c.Scripts[i]
+		if !sc.Canary {
+			continue
+		}
+		prev := old.GetScriptConfig(sc.Name)
+		if prev == nil || !commandChanged(prev, sc) {
+			continue
+		}
+
+		r := canaryResult{Time: time.Now(), Command: sc.Command()}
+		if err := runCanary(sc); err != nil {
+			log.Printf("Canary run of script %s failed, keeping its previous definition: %s\n", sc.Name, err.Error())
+			r.Error = err.Error()
+			r.Rejected = true
+			*sc = *prev
+		} else {
+			log.Printf("Canary run of script %s passed\n", sc.Name)
+			r.Success = true
+		}
+
+		result := "success"
+		canaryLastSuccessful.WithLabelValues(sc.Name).Set(1)
+		if !r.Success {
+			result = "failure"
+			canaryLastSuccessful.WithLabelValues(sc.Name).Set(0)
+		}
+		canaryRuns.WithLabelValues(sc.Name, result).Inc()
+		canaryMu.Lock()
+		canaryResults[sc.Name] = r
+		canaryMu.Unlock()
+	}
+}
+
+// runCanary runs a new definition of a script without parameters, like
+// a startup check, and returns an error if it fails or if its output
+// can't be parsed.
+func runCanary(sc *config.ScriptConfig) error {
+	args, err := templateArgs(sc, nil)
+	if err != nil {
+		return fmt.Errorf("can't render args: %s", err.Error())
+	}
+	output, diags, err := probeScript(sc, &probeRequest{paramValues: args, canary: true})
+	for _, d := range diags {
+		log.Printf("Canary run of script %s: dropping %s\n", sc.Name, d.String())
+	}
+	if err != nil {
+		return err
+	}
+	return checkExposition(output)
+}
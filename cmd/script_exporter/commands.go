@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// usage prints the usage message for script_exporter, including the
+// available commands, to stderr.
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage of %s:
+  %s [flags]
+	Start the exporter.
+  %s [flags] check-config
+	Validate the configuration file and exit.
+  %s [flags] run [-prefix prefix] [-param name=value ...] <script> [param ...]
+	Run a configured script once and print the metrics it would serve.
+  %s [flags] replay [-prefix prefix] <script> <file>
+	Format saved output of a script, from a file or - for stdin, like a
+	probe would and print the metrics it would serve.
+
+Flags:
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
+
+// checkConfigCommand validates the configuration file and reports
+// every problem found in it. It returns the exit status.
+func checkConfigCommand(file string) int {
+	c, errs := config.CheckConfig(file)
+	if c != nil {
+		errs = append(errs, checkScripts(c)...)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err.Error())
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+
+	fmt.Printf("%s: configuration is valid, %d scripts\n", file, len(c.Scripts))
+	return 0
+}
+
+// checkScripts checks what the configuration package can't check
+// about scripts, since it's only known to the runners that run them
+// or to the exporter itself.
+func checkScripts(c *config.Config) []error {
+	errs := append(checkBuiltins(c), checkStarlark(c)...)
+	errs = append(errs, checkReadiness(c)...)
+	return append(errs, checkStartupChecks(c)...)
+}
+
+// paramList is the value of the -param flag, which can be given
+// several times to set parameters of a probe request.
+type paramList url.Values
+
+func (p paramList) String() string {
+	return url.Values(p).Encode()
+}
+
+func (p paramList) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("parameter %q is not name=value", v)
+	}
+	url.Values(p).Add(kv[0], kv[1])
+	return nil
+}
+
+// runCommand executes a configured script the same way a probe does
+// and prints the exposition that would be served to stdout, and
+// diagnostics about dropped output lines to stderr. The arguments
+// after the script name are passed to it as parameter values, and
+// -param flags set the parameters that its templated arguments are
+// rendered with. It returns the exit status, which is 1 if the script
+// failed.
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Prefix for metric names, replacing the prefix of the script like the 'prefix' parameter of a probe.")
+	params := make(paramList)
+	fs.Var(params, "param", "Parameter of the probe request, as name=value, that templated arguments are rendered with; can be given several times.")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "run: no script given\n")
+		return 2
+	}
+
+	scriptName := fs.Arg(0)
+	sc := lookupScript(getConfig(), scriptName)
+	if sc == nil {
+		fmt.Fprintf(os.Stderr, "run: script %s not found\n", scriptName)
+		return 1
+	}
+
+	p := commandPrefix(sc, *prefix)
+	args, err := templateArgs(sc, url.Values(params))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "run: can't render args of script %s: %s\n", scriptName, err.Error())
+		return 1
+	}
+
+	output, diags, err := probeScript(sc, &probeRequest{prefix: p, paramValues: append(args, fs.Args()[1:]...)})
+	fmt.Print(output)
+	for _, d := range diags {
+		fmt.Fprintf(os.Stderr, "%s: dropped %s\n", scriptName, d)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: script failed: %s\n", scriptName, err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// commandPrefix returns the prefix of the metrics of a script for a
+// command, which is the one of its -prefix flag if it's given, as a
+// probe request would have it.
+func commandPrefix(sc *config.ScriptConfig, prefix string) string {
+	p := sc.Prefix
+	if prefix != "" {
+		p = prefix
+	}
+	if p != "" {
+		p = fmt.Sprintf("%s_", p)
+	}
+	return p
+}
+
+// replayCommand formats saved output of a configured script, read from
+// a file or from stdin for "-", the same way a probe formats the output
+// of a run, and prints the exposition that would be served to stdout,
+// and diagnostics about dropped output lines to stderr, so that
+// changes to the configuration can be tested against real output.
+// Output in other formats is converted first, as if the script had
+// succeeded. It returns the exit status, which is 1 if the output
+// can't be served.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Prefix for metric names, replacing the prefix of the script like the 'prefix' parameter of a probe.")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "replay: a script and a file are needed\n")
+		return 2
+	}
+
+	scriptName, file := fs.Arg(0), fs.Arg(1)
+	sc := lookupScript(getConfig(), scriptName)
+	if sc == nil {
+		fmt.Fprintf(os.Stderr, "replay: script %s not found\n", scriptName)
+		return 1
+	}
+
+	var b []byte
+	var err error
+	if file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %s\n", err.Error())
+		return 1
+	}
+
+	output, err := convertOutput(sc, string(b), nil)
+	var formatted bytes.Buffer
+	format := newOutputFormat(sc, &probeRequest{prefix: commandPrefix(sc, *prefix)}, getConfig().GetLimits(sc))
+	diags := formatOutput(strings.NewReader(output), &formatted, format)
+	if err == nil && !format.raw {
+		err = parser.Dedupe(&formatted, sc.DuplicateSeries)
+	}
+	if err == nil {
+		fmt.Print(formatted.String())
+	}
+	for _, d := range diags {
+		fmt.Fprintf(os.Stderr, "%s: dropped %s\n", scriptName, d)
+	}
+	if format.truncated {
+		fmt.Fprintf(os.Stderr, "%s: output truncated, it exceeds limits.maxSeries\n", scriptName)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: output can't be served: %s\n", scriptName, err.Error())
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings that responses can be compressed with.
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+)
+
+// negotiateEncoding picks the content coding for a response from the
+// Accept-Encoding header of its request: the supported coding with
+// the highest quality, the first one listed on ties, and none if the
+// client accepts neither.
+func negotiateEncoding(r *http.Request) string {
+	encoding, best := "", 0.0
+	for _, ae := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, err := mime.ParseMediaType(strings.TrimSpace(ae))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch coding {
+		case encodingGzip, "*":
+			coding = encodingGzip
+		case encodingBrotli:
+		default:
+			continue
+		}
+		if q > best {
+			encoding, best = coding, q
+		}
+	}
+	return encoding
+}
+
+// compressed compresses the responses of a handler with gzip or
+// brotli, if compression is enabled and the client accepts either.
+// The handler doesn't see the Accept-Encoding header then, so that
+// ones that compress on their own, like promhttp, don't do it twice.
+func compressed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !getConfig().Compression.Active {
+			h(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r)
+		if encoding == "" {
+			h(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		r.Header.Del("Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		h(cw, r)
+	}
+}
+
+// A compressWriter is a http.ResponseWriter that compresses the body
+// of the response. The compressor is started with the response, so
+// that handlers can still set headers until then. Error responses are
+// short, and are sent as they are, so that jsonErrors can still
+// rewrite them.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	w        io.WriteCloser
+	plain    bool
+}
+
+func (cw *compressWriter) start() {
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	if cw.encoding == encodingBrotli {
+		cw.w = brotli.NewWriter(cw.ResponseWriter)
+	} else {
+		cw.w = gzip.NewWriter(cw.ResponseWriter)
+	}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.w == nil && !cw.plain {
+		if status >= 400 {
+			cw.plain = true
+		} else {
+			cw.start()
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.plain {
+		return cw.ResponseWriter.Write(b)
+	}
+	if cw.w == nil {
+		cw.start()
+	}
+	return cw.w.Write(b)
+}
+
+// close flushes the compressed body, if anything was written.
+func (cw *compressWriter) close() {
+	if cw.w != nil {
+		cw.w.Close()
+	}
+}
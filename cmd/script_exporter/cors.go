@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsAllowed returns a handler that lets browser pages of the origins
+// that the running configuration allows call h. Preflight requests
+// are answered before authentication, since browsers send them
+// without credentials.
+func corsAllowed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cors := getConfig().CORS
+		origin := r.Header.Get("Origin")
+		if len(cors.AllowedOrigins) == 0 || origin == "" {
+			h(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := ""
+		for _, o := range cors.AllowedOrigins {
+			if o == "*" || o == strings.ToLower(origin) {
+				allowed = o
+				break
+			}
+		}
+		if allowed == "" {
+			h(w, r)
+			return
+		}
+		if allowed != "*" {
+			allowed = origin
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id")
+			h(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+		if cors.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/ricoberger/script_exporter/pkg/server"
+	"gopkg.in/yaml.v2"
+)
+
+// handlePprof serves the profiling data of net/http/pprof under
+// /debug/pprof/, behind the middleware of the admin endpoints.
+func handlePprof(mux *http.ServeMux, middleware ...func(http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("/debug/pprof/", server.Use(pprof.Index, middleware...))
+	mux.HandleFunc("/debug/pprof/cmdline", server.Use(pprof.Cmdline, middleware...))
+	mux.HandleFunc("/debug/pprof/profile", server.Use(pprof.Profile, middleware...))
+	mux.HandleFunc("/debug/pprof/symbol", server.Use(pprof.Symbol, middleware...))
+	mux.HandleFunc("/debug/pprof/trace", server.Use(pprof.Trace, middleware...))
+}
+
+// debugConfigHandler serves the running configuration as YAML, with
+// its secrets redacted.
+func debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := yaml.Marshal(getConfig().Sanitized())
+	if err != nil {
+		log.Printf("Can't marshal the configuration: %s\n", err.Error())
+		http.Error(w, "Can't marshal the configuration", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+}
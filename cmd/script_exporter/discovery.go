@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// discoveryTarget is a target group in the Prometheus HTTP service
+// discovery format.
+type discoveryTarget struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// discoveryHandler serves a Prometheus HTTP service discovery
+// document with one target per configured script. The target is
+// this exporter itself, as addressed by the request, and the labels
+// set the metrics path and the probe parameters, so that Prometheus
+// can scrape every script without any relabeling.
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if getConfig().TLS.Active {
+		scheme = "https"
+	}
+
+	targets := []discoveryTarget{}
+	for _, s := range getConfig().Scripts {
+		labels := map[string]string{
+			"__scheme__":       scheme,
+			"__metrics_path__": "/probe",
+			"script":           s.Name,
+		}
+
+		// Suggested parameters are only added to the 'params'
+		// list if they aren't already a fixed probe parameter.
+		var params []string
+		for k, v := range s.Discovery.Params {
+			labels["__param_"+k] = v
+			if k != "script" && k != "prefix" && k != "output" && k != "params" {
+				params = append(params, k)
+			}
+		}
+		if len(params) > 0 {
+			sort.Strings(params)
+			labels["__param_params"] = joinParams(params)
+		}
+
+		for k, v := range s.Discovery.Labels {
+			labels[k] = v
+		}
+
+		// Whatever is suggested, the target probes the script
+		// itself.
+		labels["__param_script"] = s.Name
+
+		targets = append(targets, discoveryTarget{
+			Targets: []string{r.Host},
+			Labels:  labels,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(targets); err != nil {
+		log.Printf("Failed to write service discovery response: %s\n", err.Error())
+	}
+}
+
+// joinParams returns the value of a 'params' probe parameter that
+// passes the given parameters to a script, in order.
+func joinParams(params []string) string {
+	return strings.Join(params, ",")
+}
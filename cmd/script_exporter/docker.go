@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// dockerArgs returns the docker command line that runs a script
+// command in a container: 'docker exec' for an existing container,
+// and 'docker run --rm' for a new container from an image. With
+// stdin, the standard input is passed to the script.
+func dockerArgs(dc *config.DockerConfig, args []string, stdin bool) []string {
+	var cmd []string
+	if dc.Container != "" {
+		cmd = []string{dc.Binary, "exec"}
+	} else {
+		cmd = []string{dc.Binary, "run", "--rm"}
+	}
+	if stdin {
+		cmd = append(cmd, "--interactive")
+	}
+	cmd = append(cmd, dc.Args...)
+	if dc.Container != "" {
+		cmd = append(cmd, dc.Container)
+	} else {
+		cmd = append(cmd, dc.Image)
+	}
+	return append(cmd, args...)
+}
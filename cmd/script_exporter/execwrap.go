@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// The hidden __exec__ command runs a program with process settings
+// that we can't give a child process directly, such as the umask,
+// which is shared by all threads of the exporter: we run ourselves
+// with the settings and the command line of the program, which
+// applies them and then replaces itself with the program.
+const execCommand = "__exec__"
+
+// wrapArgs returns the command line that runs a program of a script,
+// through __exec__ if the script has settings that need it.
+func wrapArgs(sc *config.ScriptConfig, args []string) []string {
+	if sc.Umask == "" && !sc.HasPriority() && !sc.Sandbox.Active {
+		return args
+	}
+
+	wrapped := []string{executable(), execCommand}
+	if sc.Umask != "" {
+		wrapped = append(wrapped, "-umask", sc.Umask)
+	}
+	if sc.Nice != nil {
+		wrapped = append(wrapped, "-nice", strconv.Itoa(*sc.Nice))
+	}
+	if sc.IOPriority != "" {
+		wrapped = append(wrapped, "-io-priority", sc.IOPriority)
+	}
+	if sc.OOMScoreAdj != nil {
+		wrapped = append(wrapped, "-oom-score-adj", strconv.Itoa(*sc.OOMScoreAdj))
+	}
+	if sb := &sc.Sandbox; sb.Active {
+		wrapped = append(wrapped, "-sandbox", "-seccomp", sb.Seccomp)
+		if sb.AllowWrites {
+			wrapped = append(wrapped, "-allow-writes")
+		}
+		if sb.Root != "" {
+			wrapped = append(wrapped, "-root", sb.Root)
+		}
+	}
+	wrapped = append(wrapped, "--")
+	return append(wrapped, args...)
+}
+
+// executable returns the path of our own program.
+func executable() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return os.Args[0]
+	}
+	return exe
+}
+
+// execCommandMain implements the hidden __exec__ command. It only
+// returns if the settings can't be applied or the program can't be
+// run, since failing to apply them would make the script compete
+// with the workloads they should protect.
+func execCommandMain(args []string) int {
+	fs := flag.NewFlagSet(execCommand, flag.ContinueOnError)
+	umask := fs.String("umask", "", "File mode creation mask, in octal.")
+	nice := fs.String("nice", "", "Nice level.")
+	ioPriority := fs.String("io-priority", "", "IO scheduling class and level.")
+	oomScoreAdj := fs.String("oom-score-adj", "", "OOM score adjustment.")
+	sandbox := fs.Bool("sandbox", false, "Set up the mounts of a sandbox.")
+	allowWrites := fs.Bool("allow-writes", false, "Keep the root file system of the sandbox writable.")
+	seccomp := fs.String("seccomp", config.SeccompNone, "Seccomp profile of the sandbox.")
+	root := fs.String("root", "", "Root directory of the sandbox.")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		return 2
+	}
+
+	// Nice levels and IO priorities belong to threads on Linux,
+	// and the program has to inherit ours.
+	runtime.LockOSThread()
+
+	if err := applyExecSettings(*umask, *nice, *ioPriority, *oomScoreAdj); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", execCommand, err)
+		return 126
+	}
+
+	// The namespaces of a sandbox are created when we're started,
+	// and its mounts and seccomp filter come last, since they
+	// restrict what we can do as well.
+	if *sandbox {
+		if err := enterSandbox(*allowWrites, *root); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: can't set up sandbox: %s\n", execCommand, err)
+			return 126
+		}
+	}
+	if *seccomp == config.SeccompDefault {
+		if err := installSeccomp(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: can't install seccomp filter: %s\n", execCommand, err)
+			return 126
+		}
+	}
+
+	err := execProgram(fs.Args())
+	fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), err)
+	return 127
+}
+
+// applyExecSettings applies the settings of an __exec__ command.
+func applyExecSettings(umask, nice, ioPriority, oomScoreAdj string) error {
+	if umask != "" {
+		mask, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid umask %s", umask)
+		}
+		setUmask(int(mask))
+	}
+	if nice != "" {
+		n, err := strconv.Atoi(nice)
+		if err != nil {
+			return fmt.Errorf("invalid nice level %s", nice)
+		}
+		if err := setNice(n); err != nil {
+			return fmt.Errorf("can't set nice level: %s", err)
+		}
+	}
+	if ioPriority != "" {
+		class, level, err := config.ParseIOPriority(ioPriority)
+		if err != nil {
+			return err
+		}
+		if err := setIOPriority(class, level); err != nil {
+			return fmt.Errorf("can't set IO priority: %s", err)
+		}
+	}
+	if oomScoreAdj != "" {
+		n, err := strconv.Atoi(oomScoreAdj)
+		if err != nil {
+			return fmt.Errorf("invalid OOM score adjustment %s", oomScoreAdj)
+		}
+		if err := setOOMScoreAdj(n); err != nil {
+			return fmt.Errorf("can't set OOM score adjustment: %s", err)
+		}
+	}
+	return nil
+}
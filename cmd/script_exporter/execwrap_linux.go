@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+// ioprioWhoProcess is IOPRIO_WHO_PROCESS, which with an ID of 0 means
+// our thread.
+const ioprioWhoProcess = 1
+
+// setIOPriority sets the IO scheduling class and level of our thread.
+func setIOPriority(class, level int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(class<<13|level))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setOOMScoreAdj sets how much more (or less) likely the OOM killer
+// is to pick us.
+func setOOMScoreAdj(n int) error {
+	return ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(n)), 0644)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+var errLinuxOnly = errors.New("only supported on linux")
+
+// setIOPriority fails, since IO priorities are Linux specific.
+func setIOPriority(class, level int) error {
+	return errLinuxOnly
+}
+
+// setOOMScoreAdj fails, since OOM score adjustments are Linux
+// specific.
+func setOOMScoreAdj(n int) error {
+	return errLinuxOnly
+}
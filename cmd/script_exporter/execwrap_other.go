@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+)
+
+var errExecUnsupported = errors.New("not supported on this platform")
+
+// setUmask does nothing, since there is no umask here.
+func setUmask(mask int) {}
+
+// setNice fails, since there are no nice levels here.
+func setNice(n int) error {
+	return errExecUnsupported
+}
+
+// execProgram fails, since we can't replace ourselves with a program
+// here.
+func execProgram(args []string) error {
+	return errExecUnsupported
+}
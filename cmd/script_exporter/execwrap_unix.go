@@ -0,0 +1,30 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setUmask sets our file mode creation mask.
+func setUmask(mask int) {
+	syscall.Umask(mask)
+}
+
+// setNice sets the nice level of our thread, which is that of the
+// whole process on most Unixes.
+func setNice(n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, n)
+}
+
+// execProgram replaces us with a program, found like exec.Command
+// finds it.
+func execProgram(args []string) error {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, os.Environ())
+}
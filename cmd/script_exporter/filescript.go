@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// staleFileError is returned by readOutputFile for files that weren't
+// modified within the maxAge of their script.
+type staleFileError struct {
+	path   string
+	age    time.Duration
+	maxAge time.Duration
+}
+
+func (e *staleFileError) Error() string {
+	return fmt.Sprintf("%s was modified %s ago, more than %s", e.path, e.age.Round(time.Second), e.maxAge)
+}
+
+// outputFilePath renders the path of the file of a script of type file
+// for the parameter values of a probe. Parameters may not contain
+// path separators, so that probes can't read files outside of where
+// the template puts them.
+func outputFilePath(sc *config.ScriptConfig, paramValues []string) (string, error) {
+	for i, v := range paramValues {
+		if v == ".." || strings.ContainsAny(v, `/\`) {
+			return "", fmt.Errorf("parameter %d may not contain path separators", i+1)
+		}
+	}
+	var b strings.Builder
+	data := struct {
+		Script string
+		Params []string
+	}{sc.Name, paramValues}
+	if err := sc.File.CompiledTemplate().Execute(&b, data); err != nil {
+		return "", err
+	}
+	return filepath.Clean(b.String()), nil
+}
+
+// readOutputFile reads the output of a script of type file, of which
+// it returns at most maxBytes bytes unless that is zero, like the
+// runners of other scripts. Files that are older than the maxAge of
+// the script fail it, and so do files in the Prometheus exposition
+// format that can't be parsed, since whatever wrote them can't be
+// told about it.
+func readOutputFile(sc *config.ScriptConfig, paramValues []string, maxBytes int64) (string, bool, error) {
+	path, err := outputFilePath(sc, paramValues)
+	if err != nil {
+		return "", false, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	if age := time.Since(fi.ModTime()); sc.File.MaxAge > 0 && age > sc.File.MaxAge {
+		return "", false, &staleFileError{path: path, age: age, maxAge: sc.File.MaxAge}
+	}
+
+	var buf bytes.Buffer
+	w := runner.NewLimitedWriter(&buf, maxBytes)
+	if _, err := io.Copy(w, f); err != nil {
+		return "", false, err
+	}
+	w.Flush()
+	output := buf.String()
+
+	if sc.Format == config.FormatPrometheus {
+		var textParser expfmt.TextParser
+		if _, err := textParser.TextToMetricFamilies(strings.NewReader(parser.StripExemplars(output))); err != nil {
+			return "", false, &parser.Error{Err: fmt.Errorf("%s: %s", path, err)}
+		}
+	}
+	return output, w.Truncated(), nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// convertOutput converts the output of a script into the Prometheus
+// exposition format with the parser of its format. The result is then
+// formatted like the output of any other script. err is the error
+// from running the script; most formats only convert the output of
+// scripts that succeeded, but some formats give meaning to exit
+// statuses.
+func convertOutput(sc *config.ScriptConfig, output string, err error) (string, error) {
+	p := parser.Lookup(sc.Format)
+	if p == nil {
+		return "", fmt.Errorf("no parser for format %s", sc.Format)
+	}
+	if sp, ok := p.(parser.StatusParser); ok {
+		converted, ok := sp.ParseStatus(sc, output, runner.ExitCode(err))
+		if !ok {
+			return "", err
+		}
+		return converted, nil
+	}
+	if err != nil {
+		return output, err
+	}
+	return p.Parse(sc, output)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// scriptGroup returns the scripts that a probe of several scripts
+// runs, given either as a comma separated list or as the name of a
+// group, and whether they run in parallel. Lists run in parallel if
+// the 'parallel' parameter is true. It returns nil for probes of a
+// single script.
+func scriptGroup(c *config.Config, scriptName string, params url.Values) ([]string, bool) {
+	if g := c.GetGroupConfig(scriptName); g != nil {
+		return g.Scripts, g.Parallel
+	}
+	if !strings.Contains(scriptName, ",") {
+		return nil, false
+	}
+
+	var names []string
+	for _, name := range strings.Split(scriptName, ",") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	parallel, _ := strconv.ParseBool(params.Get("parallel"))
+	return names, parallel
+}
+
+// A responseBuffer is a http.ResponseWriter that keeps the error
+// response that probeHTTP writes for a script of a group.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rb *responseBuffer) Header() http.Header         { return rb.header }
+func (rb *responseBuffer) WriteHeader(status int)      { rb.status = status }
+func (rb *responseBuffer) Write(b []byte) (int, error) { return rb.body.Write(b) }
+
+// A groupProbe is the probe of one script of a group, with its
+// parameters and the labels that its samples get in the merged output.
+type groupProbe struct {
+	script string
+	params url.Values
+	labels []parser.Label
+}
+
+// groupProbes returns the probes of the scripts of a group, which all
+// get the same parameters, and whose samples are labeled with the name
+// of their script.
+func groupProbes(names []string, params url.Values) []groupProbe {
+	probes := make([]groupProbe, len(names))
+	for i, name := range names {
+		probes[i] = groupProbe{script: name, params: params, labels: []parser.Label{{Name: "script", Value: name}}}
+	}
+	return probes
+}
+
+// groupHandler probes several scripts for one request and serves
+// their merged output. If the probe of any script is rejected, for
+// example because it doesn't exist or is rate limited, the whole
+// request fails with the response of the first such script.
+func groupHandler(w http.ResponseWriter, r *http.Request, client string, probes []groupProbe, parallel bool) {
+	scripts := make([]*config.ScriptConfig, len(probes))
+	outputs := make([]string, len(probes))
+	responses := make([]*responseBuffer, len(probes))
+	probe := func(i int) {
+		s := requestSpan(r).child("script")
+		s.setAttr("script", probes[i].script)
+		defer s.end(nil)
+
+		responses[i] = &responseBuffer{header: make(http.Header), status: http.StatusOK}
+		scripts[i], outputs[i], _ = probeHTTP(responses[i], r, probes[i].params, client, probes[i].script, s)
+	}
+
+	if parallel {
+		var wg sync.WaitGroup
+		for i := range probes {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				probe(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range probes {
+			probe(i)
+		}
+	}
+
+	for i, rb := range responses {
+		if rb.status != http.StatusOK {
+			for k, v := range rb.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rb.status)
+			fmt.Fprintf(w, "Script %s: %s", probes[i].script, rb.body.String())
+			return
+		}
+	}
+
+	// The merged output only keeps timestamps and exemplars for
+	// OpenMetrics if every script of the group does.
+	names := make([]string, len(probes))
+	for i := range probes {
+		names[i] = probes[i].script
+	}
+	sc := &config.ScriptConfig{Name: strings.Join(names, ",")}
+	sc.OpenMetrics.Exemplars, sc.OpenMetrics.Timestamps = true, true
+	for _, s := range scripts {
+		sc.OpenMetrics.Exemplars = sc.OpenMetrics.Exemplars && s.OpenMetrics.Exemplars
+		sc.OpenMetrics.Timestamps = sc.OpenMetrics.Timestamps && s.OpenMetrics.Timestamps
+	}
+	writeProbeOutput(w, r, sc, mergeOutputs(probes, outputs))
+}
+
+// A groupFamily is a metric family of the merged output of a group.
+type groupFamily struct {
+	help, typ string
+	samples   []string
+}
+
+// mergeOutputs merges the formatted output of several probes into one
+// exposition. Every sample gets the labels of its probe, such as a
+// 'script' label with the name of its script, unless it already has
+// them, and the samples of every metric family come together under its
+// first HELP and TYPE lines. Other comments are dropped.
+func mergeOutputs(probes []groupProbe, outputs []string) string {
+	var order []string
+	families := make(map[string]*groupFamily)
+	family := func(name string) *groupFamily {
+		f := families[name]
+		if f == nil {
+			f = &groupFamily{}
+			families[name] = f
+			order = append(order, name)
+		}
+		return f
+	}
+
+	// Types come first, since they decide the family of samples
+	// with suffixes.
+	types := make(map[string]string)
+	for _, output := range outputs {
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" && types[fields[2]] == "" {
+				types[fields[2]] = fields[3]
+			}
+		}
+	}
+
+	for i, output := range outputs {
+		for _, line := range strings.Split(output, "\n") {
+			if line == "" {
+				continue
+			}
+			if line[0] == '#' {
+				fields := strings.SplitN(line, " ", 4)
+				if len(fields) < 3 {
+					continue
+				}
+				switch f := family(fields[2]); fields[1] {
+				case "HELP":
+					if f.help == "" {
+						f.help = line
+					}
+				case "TYPE":
+					if f.typ == "" {
+						f.typ = line
+					}
+				}
+				continue
+			}
+
+			name, labeled, ok := labelSample(line, probes[i].labels)
+			if !ok {
+				continue
+			}
+			f := family(groupFamilyName(types, name))
+			f.samples = append(f.samples, labeled)
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range order {
+		f := families[name]
+		if len(f.samples) == 0 {
+			continue
+		}
+		if f.help != "" {
+			b.WriteString(f.help + "\n")
+		}
+		if f.typ != "" {
+			b.WriteString(f.typ + "\n")
+		}
+		for _, s := range f.samples {
+			b.WriteString(s + "\n")
+		}
+	}
+	return b.String()
+}
+
+// groupFamilyName returns the name of the metric family that a sample
+// belongs to, given the types of families.
+func groupFamilyName(types map[string]string, name string) string {
+	if _, ok := types[name]; ok {
+		return name
+	}
+	for typ, suffixes := range parser.TypeSuffixes {
+		for _, suffix := range suffixes {
+			if base := strings.TrimSuffix(name, suffix); base != name && types[base] == typ {
+				return base
+			}
+		}
+	}
+	return name
+}
+
+// labelSample adds labels to a formatted sample line, in front of its
+// own, except those it already has, and returns the metric name and
+// the new line. Samples without a label set, as of raw output, get
+// one.
+func labelSample(line string, add []parser.Label) (string, string, bool) {
+	sample, exemplar := parser.SplitExemplar(line)
+	i := strings.Index(sample, "{")
+	if k := strings.IndexAny(sample, " \t"); i < 0 && k > 0 {
+		sample = sample[:k] + "{}" + sample[k:]
+		i = k
+	}
+	j := strings.LastIndex(sample, "}")
+	if i <= 0 || j < i {
+		return "", "", false
+	}
+	labels, err := parser.ParseLabels(sample[i : j+1])
+	if err != nil {
+		return "", "", false
+	}
+	var missing []parser.Label
+	for _, l := range add {
+		if parser.GetLabel(labels, l.Name) == "" {
+			missing = append(missing, l)
+		}
+	}
+	labels = append(missing, labels...)
+
+	line = sample[:i] + parser.FormatLabels(labels) + sample[j+1:]
+	if exemplar != "" {
+		line += " " + exemplar
+	}
+	return sample[:i], line, true
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// grpcRunScriptPath is the path of the RunScript method of our gRPC
+// service, which mirrors /probe. The service and its messages are
+// defined in proto/script_exporter/v1/scripts.proto.
+const grpcRunScriptPath = "/script_exporter.v1.Scripts/RunScript"
+
+// gRPC status codes, of which we use those that correspond to the
+// statuses of rejected probes.
+const (
+	grpcOK                = 0
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// grpcMessageHeaderBytes is the size of the header of the messages of
+// calls: a compression flag and the length of the message.
+const grpcMessageHeaderBytes = 5
+
+// A runScriptRequest is a decoded RunScriptRequest message.
+type runScriptRequest struct {
+	script string
+	params url.Values
+	stdin  []byte
+}
+
+// grpcHandler serves RunScript calls: it probes a script like
+// metricsHandler, but reports that it started and then the result as
+// structured samples and the metadata of the run. Probes that are
+// rejected fail with the gRPC status corresponding to the HTTP status
+// of the rejection.
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost {
+		http.Error(w, "gRPC requires HTTP/2 POST requests", http.StatusBadRequest)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.URL.Path != grpcRunScriptPath {
+		grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+
+	msg, err := readGRPCMessage(r.Body, getConfig().Probe.MaxBodyBytes)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	req, err := decodeRunScriptRequest(msg)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	if req.script == "" {
+		grpcStatus(w, grpcInvalidArgument, "script is missing")
+		return
+	}
+	client := clientID(r)
+	applyClientParams(client, req.params)
+	r = r.WithContext(context.WithValue(r.Context(), requestBodyKey{}, req.stdin))
+
+	var started []byte
+	started = appendProtoBytes(started, 1, []byte(req.script))
+	started = appendProtoVarint(started, 2, uint64(time.Now().UnixNano()))
+	if err := writeGRPCMessage(w, appendProtoBytes(nil, 1, started)); err != nil {
+		return
+	}
+
+	rb := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+	_, output, ok := probeHTTP(rb, r, req.params, client, req.script, requestSpan(r))
+	if !ok || rb.status != http.StatusOK {
+		grpcStatus(w, grpcCode(rb.status), strings.TrimSpace(rb.body.String()))
+		return
+	}
+	if err := writeGRPCMessage(w, appendProtoBytes(nil, 2, encodeResult(withNodeLabels(output)))); err != nil {
+		return
+	}
+	grpcStatus(w, grpcOK, "")
+}
+
+// encodeResult encodes the output of a probe as a Result message. The
+// metadata of the run is taken from the samples that describe it.
+func encodeResult(output string) []byte {
+	var success bool
+	var duration float64
+	var exitCode int64
+	var reason string
+	var samples []byte
+	for _, s := range parseSeries(output, time.Now()) {
+		name, labels := s.labels[0].Value, s.labels[1:]
+		switch name {
+		case namespace + "_success":
+			success = s.value == 1
+			if reason == "" {
+				reason = parser.GetLabel(labels, "error")
+			}
+		case namespace + "_duration_seconds":
+			duration = s.value
+		case namespace + "_exit_code":
+			exitCode = int64(s.value)
+		case namespace + "_error":
+			reason = parser.GetLabel(labels, "reason")
+		}
+
+		var sample []byte
+		sample = appendProtoBytes(sample, 1, []byte(name))
+		for _, l := range labels {
+			var lb []byte
+			lb = appendProtoBytes(lb, 1, []byte(l.Name))
+			lb = appendProtoBytes(lb, 2, []byte(l.Value))
+			sample = appendProtoBytes(sample, 2, lb)
+		}
+		sample = appendProtoFixed64(sample, 3, math.Float64bits(s.value))
+		sample = appendProtoVarint(sample, 4, uint64(s.timestamp))
+		samples = appendProtoBytes(samples, 5, sample)
+	}
+
+	var b []byte
+	if success {
+		b = appendProtoVarint(b, 1, 1)
+	}
+	b = appendProtoFixed64(b, 2, math.Float64bits(duration))
+	b = appendProtoVarint(b, 3, uint64(exitCode))
+	if reason != "" {
+		b = appendProtoBytes(b, 4, []byte(reason))
+	}
+	return append(b, samples...)
+}
+
+// decodeRunScriptRequest decodes a RunScriptRequest message.
+func decodeRunScriptRequest(msg []byte) (*runScriptRequest, error) {
+	req := &runScriptRequest{params: make(url.Values)}
+	err := parseProtoFields(msg, func(field int, v []byte) error {
+		switch field {
+		case 1:
+			req.script = string(v)
+		case 2:
+			var name, value string
+			err := parseProtoFields(v, func(field int, v []byte) error {
+				switch field {
+				case 1:
+					name = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			req.params.Add(name, value)
+		case 3:
+			req.stdin = v
+		}
+		return nil
+	})
+	return req, err
+}
+
+// parseProtoFields calls f with the length-delimited fields of a
+// protobuf message, which are all that our messages have, and skips
+// the others.
+func parseProtoFields(b []byte, f func(field int, v []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid message")
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("invalid message")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("invalid message")
+			}
+			b = b[8:]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("invalid message")
+			}
+			b = b[4:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errors.New("invalid message")
+			}
+			if err := f(int(tag>>3), b[n:n+int(l)]); err != nil {
+				return err
+			}
+			b = b[n+int(l):]
+		default:
+			return errors.New("invalid message")
+		}
+	}
+	return nil
+}
+
+// readGRPCMessage reads the one message of the body of a call, of at
+// most max bytes.
+func readGRPCMessage(r io.Reader, max int64) ([]byte, error) {
+	var header [grpcMessageHeaderBytes]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("can't read message: %s", err)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if int64(size) > max {
+		return nil, fmt.Errorf("message exceeds %d bytes", max)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("can't read message: %s", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage writes a message of a stream and sends it
+// immediately.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	var header [grpcMessageHeaderBytes]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := w.Write(append(header[:], msg...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// grpcStatus ends a call with a status and its message, which are sent
+// as trailers.
+func grpcStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(message))
+	}
+}
+
+// grpcEncodeMessage percent-encodes a status message, as gRPC wants.
+func grpcEncodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcCode returns the gRPC status code for the HTTP status of a
+// rejected probe.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusInternalServerError:
+		return grpcInternal
+	}
+	return grpcUnknown
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// protoField is a field of a protobuf message, as decoded by
+// decodeProtoFields: varint and fixed64 fields have their value in
+// num, and length-delimited fields in bytes.
+type protoField struct {
+	field int
+	num   uint64
+	bytes []byte
+}
+
+// decodeProtoFields decodes all fields of a protobuf message, unlike
+// parseProtoFields, which only reports the length-delimited ones.
+func decodeProtoFields(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag in %x", b)
+		}
+		b = b[n:]
+		f := protoField{field: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			if f.num, n = binary.Uvarint(b); n <= 0 {
+				t.Fatalf("invalid varint in %x", b)
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				t.Fatalf("short fixed64 in %x", b)
+			}
+			f.num, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				t.Fatalf("invalid length in %x", b)
+			}
+			f.bytes, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestDecodeRunScriptRequest(t *testing.T) {
+	param := func(name, value string) []byte {
+		return appendProtoBytes(appendProtoBytes(nil, 1, []byte(name)), 2, []byte(value))
+	}
+	var msg []byte
+	msg = appendProtoBytes(msg, 1, []byte("ping"))
+	msg = appendProtoBytes(msg, 2, param("target", "a.example.com"))
+	msg = appendProtoBytes(msg, 2, param("target", "b.example.com"))
+	msg = appendProtoBytes(msg, 2, param("count", "3"))
+	msg = appendProtoBytes(msg, 3, []byte("input\n"))
+	// Unknown fields of every wire type are skipped.
+	msg = appendProtoVarint(msg, 9, 42)
+	msg = appendProtoFixed64(msg, 10, 7)
+	msg = appendProtoBytes(msg, 11, []byte("ignored"))
+
+	req, err := decodeRunScriptRequest(msg)
+	if err != nil {
+		t.Fatalf("decodeRunScriptRequest() error = %v", err)
+	}
+	if req.script != "ping" {
+		t.Errorf("script = %q, want %q", req.script, "ping")
+	}
+	if got, want := req.params["target"], []string{"a.example.com", "b.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("params[target] = %q, want %q", got, want)
+	}
+	if got := req.params.Get("count"); got != "3" {
+		t.Errorf("params[count] = %q, want %q", got, "3")
+	}
+	if string(req.stdin) != "input\n" {
+		t.Errorf("stdin = %q, want %q", req.stdin, "input\n")
+	}
+
+	if _, err := decodeRunScriptRequest(msg[:len(msg)-1]); err == nil {
+		t.Error("decodeRunScriptRequest() of a truncated message succeeded")
+	}
+}
+
+func TestEncodeResult(t *testing.T) {
+	output := "# HELP script_success Script exit status (0 = error, 1 = success).\n" +
+		"# TYPE script_success gauge\n" +
+		"script_success{} 0\n" +
+		"script_duration_seconds{} 1.5\n" +
+		"script_exit_code{} 2\n" +
+		"script_error{reason=\"exit status 2\"} 1\n" +
+		"disk_free_bytes{mount=\"/\"} 1024 1700000000000\n"
+
+	type sample struct {
+		name      string
+		labels    [][2]string
+		value     float64
+		timestamp int64
+	}
+	var success, exitCode, duration uint64
+	var reason string
+	var samples []sample
+	for _, f := range decodeProtoFields(t, encodeResult(output)) {
+		switch f.field {
+		case 1:
+			success = f.num
+		case 2:
+			duration = f.num
+		case 3:
+			exitCode = f.num
+		case 4:
+			reason = string(f.bytes)
+		case 5:
+			var s sample
+			for _, sf := range decodeProtoFields(t, f.bytes) {
+				switch sf.field {
+				case 1:
+					s.name = string(sf.bytes)
+				case 2:
+					var l [2]string
+					for _, lf := range decodeProtoFields(t, sf.bytes) {
+						l[lf.field-1] = string(lf.bytes)
+					}
+					s.labels = append(s.labels, l)
+				case 3:
+					s.value = math.Float64frombits(sf.num)
+				case 4:
+					s.timestamp = int64(sf.num)
+				}
+			}
+			samples = append(samples, s)
+		}
+	}
+
+	if success != 0 {
+		t.Errorf("success = %d, want 0", success)
+	}
+	if got := math.Float64frombits(duration); got != 1.5 {
+		t.Errorf("duration_seconds = %v, want 1.5", got)
+	}
+	if exitCode != 2 {
+		t.Errorf("exit_code = %d, want 2", exitCode)
+	}
+	if reason != "exit status 2" {
+		t.Errorf("error = %q, want %q", reason, "exit status 2")
+	}
+	if len(samples) != 5 {
+		t.Fatalf("got %d samples, want 5: %+v", len(samples), samples)
+	}
+	want := sample{name: "disk_free_bytes", labels: [][2]string{{"mount", "/"}}, value: 1024, timestamp: 1700000000000}
+	if got := samples[4]; !reflect.DeepEqual(got, want) {
+		t.Errorf("samples[4] = %+v, want %+v", got, want)
+	}
+}
+
+func TestGRPCMessageRoundTrip(t *testing.T) {
+	msg := appendProtoBytes(nil, 1, []byte("ping"))
+	w := httptest.NewRecorder()
+	// Calls are traced, and the messages of the stream have to get
+	// through the statusWriter of their span.
+	if err := writeGRPCMessage(&statusWriter{ResponseWriter: w}, msg); err != nil {
+		t.Fatalf("writeGRPCMessage() error = %v", err)
+	}
+	if !w.Flushed {
+		t.Error("writeGRPCMessage() didn't flush the message")
+	}
+
+	got, err := readGRPCMessage(bytes.NewReader(w.Body.Bytes()), 1024)
+	if err != nil {
+		t.Fatalf("readGRPCMessage() error = %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("readGRPCMessage() = %x, want %x", got, msg)
+	}
+	if _, err := readGRPCMessage(bytes.NewReader(w.Body.Bytes()), int64(len(msg)-1)); err == nil {
+		t.Error("readGRPCMessage() accepted a message larger than the limit")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// configLoaded is set once a configuration file has been loaded.
+var configLoaded atomic.Bool
+
+// healthyHandler serves /-/healthy, which only tells that we are up.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "script_exporter is Healthy.\n")
+}
+
+// readyHandler serves /-/ready. We are ready once the configuration
+// has been loaded and its startup checks passed and, if there is a
+// readiness script, while probes of it succeed.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !configLoaded.Load() {
+		http.Error(w, "script_exporter is not ready: configuration not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if err := startupCheckError(); err != nil {
+		http.Error(w, fmt.Sprintf("script_exporter is not ready: %s", err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+	if err := warmUpError(time.Now()); err != nil {
+		http.Error(w, fmt.Sprintf("script_exporter is not ready: %s", err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+
+	c := getConfig()
+	if c.Readiness.Script != "" {
+		sc := lookupScript(c, c.Readiness.Script)
+		args, err := templateArgs(sc, nil)
+		if err == nil {
+			_, _, err = probeScript(sc, &probeRequest{paramValues: append(args, c.Readiness.Params...), ignoreOutput: true})
+		}
+		if err != nil {
+			log.Printf("Readiness script %s failed: %s\n", sc.Name, err.Error())
+			http.Error(w, fmt.Sprintf("script_exporter is not ready: %s", err.Error()), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintf(w, "script_exporter is Ready.\n")
+}
+
+// checkReadiness checks that the readiness script exists, which may
+// be the built-in __self__ script.
+func checkReadiness(c *config.Config) []error {
+	if c.Readiness.Script != "" && lookupScript(c, c.Readiness.Script) == nil {
+		return []error{fmt.Errorf("readiness: script %s not found", c.Readiness.Script)}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sync"
+)
+
+// The high-frequency mode trades some memory that stays allocated
+// between probes for less garbage per probe. It's intended for
+// deployments that run hundreds of cheap scripts every few seconds,
+// where the allocations of running a script and formatting its
+// output otherwise make up a noticeable part of CPU usage.
+
+// defaultHighFrequencyGCPercent is the GOGC value used in the
+// high-frequency mode if neither the configuration nor the GOGC
+// environment variable set one.
+const defaultHighFrequencyGCPercent = 200
+
+// maxCachedRegexps bounds the number of prefixes we cache compiled
+// regular expressions for, since prefixes come from URL parameters.
+const maxCachedRegexps = 1024
+
+// maxPooledBufferBytes is the largest output buffer we put back into
+// the pool, so that a script with huge output once doesn't keep that
+// much memory allocated for good.
+const maxPooledBufferBytes = 1 << 20
+
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+	scanBufferPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, 64*1024)
+			return &b
+		},
+	}
+
+	regexpsMu    sync.Mutex
+	regexpsCache = make(map[string]*formatRegexps)
+)
+
+// putBuffer puts an output buffer back into the pool, unless it has
+// grown too large to keep.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBufferBytes {
+		bufferPool.Put(buf)
+	}
+}
+
+// formatRegexps are the regular expressions used to format output
+// for a particular prefix. Values are parsed rather than matched.
+type formatRegexps struct {
+	metric *regexp.Regexp
+}
+
+func compileFormatRegexps(prefix string) *formatRegexps {
+	return &formatRegexps{
+		metric: regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "\\w*{.*}\\s+"),
+	}
+}
+
+// getFormatRegexps returns the regular expressions for a prefix,
+// from the cache in the high-frequency mode. *regexp.Regexp is safe
+// for concurrent use, so cached ones can be shared between probes.
+func getFormatRegexps(prefix string) *formatRegexps {
+	if !getConfig().HighFrequency.Active {
+		return compileFormatRegexps(prefix)
+	}
+
+	regexpsMu.Lock()
+	defer regexpsMu.Unlock()
+	if re, ok := regexpsCache[prefix]; ok {
+		return re
+	}
+	if len(regexpsCache) >= maxCachedRegexps {
+		regexpsCache = make(map[string]*formatRegexps)
+	}
+	re := compileFormatRegexps(prefix)
+	regexpsCache[prefix] = re
+	return re
+}
+
+// setupHighFrequency applies the runtime settings of the
+// high-frequency mode. An explicit GOGC in the environment wins over
+// our default, but not over the configuration.
+func setupHighFrequency() {
+	if !getConfig().HighFrequency.Active {
+		return
+	}
+
+	gc := getConfig().HighFrequency.GCPercent
+	if gc == 0 {
+		if os.Getenv("GOGC") != "" {
+			return
+		}
+		gc = defaultHighFrequencyGCPercent
+	}
+	debug.SetGCPercent(gc)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHistorySize is the number of executions kept in the history
+// if the configuration doesn't say otherwise.
+const defaultHistorySize = 1000
+
+// defaultScriptHistorySize and defaultHistoryOutputBytes are the
+// number of executions kept for every script, and how much of their
+// output, if the configuration doesn't say otherwise.
+const (
+	defaultScriptHistorySize  = 10
+	defaultHistoryOutputBytes = 4096
+)
+
+// executionRecord describes a single execution of a script.
+type executionRecord struct {
+	Seq      uint64    `json:"seq"`
+	Script   string    `json:"script"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"durationSeconds"`
+	ExitCode int       `json:"exitCode"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+
+	// Output is the start of the standard output of the script,
+	// which is only kept in the history of the script itself.
+	Output          string `json:"output,omitempty"`
+	OutputTruncated bool   `json:"outputTruncated,omitempty"`
+}
+
+// The history is a ring buffer of the most recent executions of all
+// scripts. Every record gets a sequence number, so that exports can
+// tell which records they have already seen.
+var (
+	historyMu   sync.Mutex
+	historyRing []executionRecord
+	historyNext int
+	historySeq  uint64
+)
+
+// scriptHistory are the most recent executions of every script, with
+// their output, oldest first.
+var scriptHistory = make(map[string][]executionRecord)
+
+// historySize returns the configured size of the history.
+func historySize() int {
+	if n := getConfig().History.Size; n > 0 {
+		return n
+	}
+	return defaultHistorySize
+}
+
+// scriptHistorySize returns the configured number of executions kept
+// for every script.
+func scriptHistorySize() int {
+	if n := getConfig().History.PerScript; n > 0 {
+		return n
+	}
+	return defaultScriptHistorySize
+}
+
+// addHistory adds an execution record to the history, overwriting
+// the oldest record if it is full, and, with the output of the run,
+// to the history of its script. The ring is resized (dropping old
+// records) if its configured size changed.
+func addHistory(rec executionRecord, output *historyOutput) {
+	size := historySize()
+	scriptSize := scriptHistorySize()
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if cap(historyRing) != size {
+		old := historyRecordsLocked(0)
+		historyRing = make([]executionRecord, 0, size)
+		if len(old) > size {
+			old = old[len(old)-size:]
+		}
+		historyRing = append(historyRing, old...)
+		historyNext = len(historyRing) % size
+	}
+
+	historySeq++
+	rec.Seq = historySeq
+	if len(historyRing) < cap(historyRing) {
+		historyRing = append(historyRing, rec)
+	} else {
+		historyRing[historyNext] = rec
+	}
+	historyNext = (historyNext + 1) % cap(historyRing)
+
+	recs := scriptHistory[rec.Script]
+	if len(recs) >= scriptSize {
+		recs = append(recs[:0:0], recs[len(recs)-scriptSize+1:]...)
+	}
+	rec.Output, rec.OutputTruncated = output.String(), output.truncated()
+	scriptHistory[rec.Script] = append(recs, rec)
+}
+
+// historyRecords returns the records in the history with a sequence
+// number greater than after, oldest first.
+func historyRecords(after uint64) []executionRecord {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return historyRecordsLocked(after)
+}
+
+func historyRecordsLocked(after uint64) []executionRecord {
+	var out []executionRecord
+	n := len(historyRing)
+	start := 0
+	if n == cap(historyRing) {
+		start = historyNext
+	}
+	for i := 0; i < n; i++ {
+		r := historyRing[(start+i)%n]
+		if r.Seq > after {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// scriptHistoryRecords returns the most recent executions of a script,
+// oldest first.
+func scriptHistoryRecords(scriptName string) []executionRecord {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return append([]executionRecord{}, scriptHistory[scriptName]...)
+}
+
+// A historyOutput keeps the start of the standard output of a run of
+// a script for its history.
+type historyOutput struct {
+	max  int
+	buf  []byte
+	more bool
+}
+
+// newHistoryOutput returns a historyOutput that keeps as much of the
+// output as the configuration says.
+func newHistoryOutput() *historyOutput {
+	max := getConfig().History.MaxOutputBytes
+	if max == 0 {
+		max = defaultHistoryOutputBytes
+	}
+	return &historyOutput{max: max}
+}
+
+func (h *historyOutput) Write(p []byte) (int, error) {
+	if n := h.max - len(h.buf); n < len(p) {
+		h.buf = append(h.buf, p[:n]...)
+		h.more = true
+	} else {
+		h.buf = append(h.buf, p...)
+	}
+	return len(p), nil
+}
+
+// set replaces the kept output with the start of output.
+func (h *historyOutput) set(output string) {
+	h.reset()
+	h.Write([]byte(output))
+}
+
+// reset forgets the kept output, for a new attempt of a run.
+func (h *historyOutput) reset() {
+	h.buf, h.more = h.buf[:0], false
+}
+
+// String returns the kept output, with invalid UTF-8, as from cutting
+// it off, replaced, since it's served as JSON.
+func (h *historyOutput) String() string {
+	return strings.ToValidUTF8(string(h.buf), "\uFFFD")
+}
+
+// truncated reports whether output was discarded.
+func (h *historyOutput) truncated() bool {
+	return h.more
+}
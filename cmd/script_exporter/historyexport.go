@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// historyExportPoll is how often we check whether history export has
+// been turned on by a reload.
+const historyExportPoll = 10 * time.Second
+
+// historyExportTimeout bounds each HTTP or S3 upload.
+const historyExportTimeout = 30 * time.Second
+
+// Every destination remembers the sequence number of the last record
+// it has successfully received, so that a failing destination gets
+// the records it missed the next time (as long as they're still in
+// the history) and doesn't hold up the others.
+var historyExported = map[string]uint64{}
+
+// startHistoryExport starts periodically exporting the execution
+// history to the configured destinations. It reads the configuration
+// every time, so that reloads take effect.
+func startHistoryExport() {
+	go func() {
+		for {
+			e := getConfig().History.Export
+			if !e.Active() {
+				time.Sleep(historyExportPoll)
+				continue
+			}
+			time.Sleep(e.Interval)
+			exportHistory(&e)
+		}
+	}()
+}
+
+// exportHistory exports the new records of the history to every
+// configured destination.
+func exportHistory(e *config.HistoryExportConfig) {
+	type destination struct {
+		name string
+		send func([]byte, []executionRecord) error
+	}
+	var dests []destination
+	if e.File.Path != "" {
+		dests = append(dests, destination{"file", func(b []byte, _ []executionRecord) error { return exportHistoryFile(e, b) }})
+	}
+	if e.HTTP.URL != "" {
+		dests = append(dests, destination{"http", func(b []byte, _ []executionRecord) error { return exportHistoryHTTP(e, b) }})
+	}
+	if e.S3.Bucket != "" {
+		dests = append(dests, destination{"s3", func(b []byte, recs []executionRecord) error { return exportHistoryS3(e, b, recs[0]) }})
+	}
+
+	for _, d := range dests {
+		recs := historyRecords(historyExported[d.name])
+		if len(recs) == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, r := range recs {
+			enc.Encode(r)
+		}
+
+		if err := d.send(buf.Bytes(), recs); err != nil {
+			log.Printf("Failed to export execution history to %s: %s\n", d.name, err.Error())
+			continue
+		}
+		historyExported[d.name] = recs[len(recs)-1].Seq
+	}
+}
+
+// exportHistoryFile appends records to the export file, rotating it
+// first if it would grow beyond its maximum size. Rotated files get
+// the suffixes .1 (the newest) up to .<maxFiles>.
+func exportHistoryFile(e *config.HistoryExportConfig, data []byte) error {
+	path := e.File.Path
+	if fi, err := os.Stat(path); err == nil && e.File.MaxBytes > 0 && fi.Size()+int64(len(data)) > e.File.MaxBytes {
+		if e.File.MaxFiles == 0 {
+			os.Remove(path)
+		} else {
+			os.Remove(fmt.Sprintf("%s.%d", path, e.File.MaxFiles))
+			for i := e.File.MaxFiles - 1; i >= 1; i-- {
+				os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+			}
+			if err := os.Rename(path, path+".1"); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportHistoryHTTP posts records to the export URL.
+func exportHistoryHTTP(e *config.HistoryExportConfig, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.HTTP.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range e.HTTP.Headers {
+		req.Header.Set(k, v)
+	}
+	return doExportRequest(req)
+}
+
+// exportHistoryS3 uploads records as a new object to the S3 bucket.
+// Objects are named after the start time and sequence number of
+// their first record, so that they sort in order.
+func exportHistoryS3(e *config.HistoryExportConfig, data []byte, first executionRecord) error {
+	s3 := e.S3
+	key := fmt.Sprintf("%s%s-%d.jsonl", s3.Prefix, first.Start.UTC().Format("20060102T150405Z"), first.Seq)
+
+	// Without an endpoint we use AWS itself with virtual-hosted
+	// style URLs, otherwise path style URLs, which is what most
+	// S3 compatible services expect.
+	var u *url.URL
+	if s3.Endpoint == "" {
+		u = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", s3.Bucket, s3.Region), Path: "/" + key}
+	} else {
+		var err error
+		u, err = url.Parse(strings.TrimSuffix(s3.Endpoint, "/") + "/" + s3.Bucket + "/" + key)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	accessKey, secretKey, token := s3.AccessKeyID, s3.SecretAccessKey, s3.SessionToken
+	if accessKey == "" {
+		accessKey, secretKey, token = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+	}
+	signS3Request(req, data, s3.Region, accessKey, secretKey, token, time.Now())
+
+	return doExportRequest(req)
+}
+
+// doExportRequest makes an export request and checks its status.
+func doExportRequest(req *http.Request) error {
+	client := &http.Client{Timeout: historyExportTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpError{status: resp.Status}
+	}
+	return nil
+}
+
+// signS3Request signs a request to S3 with AWS Signature Version 4.
+func signS3Request(req *http.Request, payload []byte, region, accessKey, secretKey, token string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
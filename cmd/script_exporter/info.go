@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// infoCollector exports the configuration of every script and
+// module, so that differences between exporters stand out.
+type infoCollector struct{}
+
+var infoDesc = prometheus.NewDesc("script_info",
+	"A metric with a constant '1' value labeled by the configuration of a script.",
+	[]string{"script", "timeout", "runner", "format"}, nil)
+
+func (infoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- infoDesc
+}
+
+func (infoCollector) Collect(ch chan<- prometheus.Metric) {
+	c := getConfig()
+	info := func(sc *config.ScriptConfig) {
+		runner := sc.Type
+		if strings.HasPrefix(sc.Script, config.BuiltinPrefix) {
+			runner = "builtin"
+		}
+		timeout := strconv.FormatFloat(sc.Timeout.Seconds(), 'f', -1, 64)
+		ch <- prometheus.MustNewConstMetric(infoDesc, prometheus.GaugeValue, 1, sc.Name, timeout, runner, sc.Format)
+	}
+	for i := range c.Scripts {
+		info(&c.Scripts[i])
+	}
+	for i := range c.Modules {
+		info(c.GetModuleConfig(c.Modules[i].Name))
+	}
+}
+
+// nodeInfoCollector exports the labels about the host, so that they
+// can be joined to other metrics of the exporter. The names of its
+// labels change with the configuration, so it's unchecked.
+type nodeInfoCollector struct{}
+
+func (nodeInfoCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (nodeInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	labels := getNodeLabels()
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, len(labels))
+	values := make([]string, len(labels))
+	for i, l := range labels {
+		names[i], values[i] = l.Name, l.Value
+	}
+	desc := prometheus.NewDesc("script_node_info",
+		"A metric with a constant '1' value labeled by the labels about the host.",
+		names, nil)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+}
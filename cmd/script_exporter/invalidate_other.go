@@ -0,0 +1,6 @@
+//go:build windows || plan9
+
+package main
+
+// handleInvalidateSignals does nothing, since there is no SIGUSR1 here.
+func handleInvalidateSignals() {}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleInvalidateSignals drops all cached results, and makes all
+// scheduled scripts due, whenever we receive a SIGUSR1.
+func handleInvalidateSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			n := invalidateResults("")
+			log.Printf("%d cached results invalidated by SIGUSR1\n", n)
+		}
+	}()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// plainErrorType is the content type of the responses of http.Error,
+// which are the ones that jsonErrors rewrites.
+const plainErrorType = "text/plain; charset=utf-8"
+
+// A jsonError is the body of an error response for clients that
+// accept JSON: the HTTP status, a code for the kind of error that
+// doesn't change with the wording of the message, and the message.
+type jsonError struct {
+	Status     int    `json:"status"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfterSeconds,omitempty"`
+}
+
+// jsonErrors answers requests of clients that accept JSON with a JSON
+// body for rejected probes, so that automation can tell failures
+// apart without parsing messages. Successful responses are passed
+// through, and so are those of scrapers, which don't accept JSON.
+func jsonErrors(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsJSON(r) {
+			h(w, r)
+			return
+		}
+		jw := &jsonErrorWriter{ResponseWriter: w}
+		defer jw.finish()
+		h(jw, r)
+	}
+}
+
+// acceptsJSON reports whether the Accept header of a request lists
+// application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(strings.TrimSpace(a)); err == nil && t == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// errorCode returns the code of the errors of an HTTP status.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case http.StatusUnsupportedMediaType:
+		return "unsupported_media_type"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	return "error"
+}
+
+// A jsonErrorWriter is a http.ResponseWriter that collects the message
+// of an error response written with http.Error instead of sending it,
+// so that it can be sent as JSON.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	message     bytes.Buffer
+}
+
+func (jw *jsonErrorWriter) WriteHeader(status int) {
+	if jw.wroteHeader {
+		return
+	}
+	jw.wroteHeader = true
+	if status >= 400 && jw.Header().Get("Content-Type") == plainErrorType {
+		jw.status = status
+		return
+	}
+	jw.ResponseWriter.WriteHeader(status)
+}
+
+func (jw *jsonErrorWriter) Write(b []byte) (int, error) {
+	if !jw.wroteHeader {
+		jw.WriteHeader(http.StatusOK)
+	}
+	if jw.status != 0 {
+		return jw.message.Write(b)
+	}
+	return jw.ResponseWriter.Write(b)
+}
+
+func (jw *jsonErrorWriter) Flush() {
+	if f, ok := jw.ResponseWriter.(http.Flusher); ok && jw.status == 0 {
+		f.Flush()
+	}
+}
+
+func (jw *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return jw.ResponseWriter
+}
+
+// finish sends the collected error, if there is one.
+func (jw *jsonErrorWriter) finish() {
+	if jw.status == 0 {
+		return
+	}
+	h := jw.Header()
+	e := jsonError{Status: jw.status, Code: errorCode(jw.status), Message: strings.TrimSpace(jw.message.String())}
+	e.RetryAfter, _ = strconv.Atoi(h.Get("Retry-After"))
+	h.Set("Content-Type", "application/json")
+	h.Del("Content-Length")
+	jw.ResponseWriter.WriteHeader(jw.status)
+	json.NewEncoder(jw.ResponseWriter).Encode(struct {
+		Error jsonError `json:"error"`
+	}{e})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// kubectlArgs returns the start of a kubectl command line with the
+// connection options of a script.
+func kubectlArgs(kc *config.KubernetesConfig) []string {
+	cmd := []string{kc.Binary}
+	if kc.Kubeconfig != "" {
+		cmd = append(cmd, "--kubeconfig", kc.Kubeconfig)
+	}
+	if kc.Context != "" {
+		cmd = append(cmd, "--context", kc.Context)
+	}
+	if kc.Namespace != "" {
+		cmd = append(cmd, "--namespace", kc.Namespace)
+	}
+	return cmd
+}
+
+// kubernetesArgs returns the kubectl command line that runs a script
+// command in a pod. If pods are selected by labels, the first
+// running pod is looked up first, within timeout and until ctx is
+// done. With stdin, the standard input is passed to the script.
+func kubernetesArgs(ctx context.Context, kc *config.KubernetesConfig, args []string, stdin bool, timeout time.Duration) ([]string, error) {
+	pod := kc.Pod
+	if pod == "" {
+		var err error
+		if pod, err = selectPod(ctx, kc, timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := append(kubectlArgs(kc), "exec", pod)
+	if stdin {
+		cmd = append(cmd, "--stdin")
+	}
+	if kc.Container != "" {
+		cmd = append(cmd, "--container", kc.Container)
+	}
+	cmd = append(cmd, "--")
+	return append(cmd, args...), nil
+}
+
+// selectPod returns the name of the first running pod that matches
+// the selector of a script. Timeouts and canceled probes are returned
+// as they are, so that they are reported like those of the script.
+func selectPod(ctx context.Context, kc *config.KubernetesConfig, timeout time.Duration) (string, error) {
+	cmd := append(kubectlArgs(kc), "get", "pods",
+		"--selector", kc.Selector,
+		"--field-selector", "status.phase=Running",
+		"--output", "jsonpath={.items[*].metadata.name}")
+	output, _, err := runScriptContext(ctx, runner.Command{Args: cmd}, nil, timeout, 0, nil)
+	if err != nil {
+		if _, ok := err.(*runner.TimeoutError); ok || err == ctx.Err() {
+			return "", err
+		}
+		return "", fmt.Errorf("looking up pods for %s: %s", kc.Selector, err)
+	}
+
+	pods := strings.Fields(output)
+	if len(pods) == 0 {
+		return "", fmt.Errorf("no running pods for %s", kc.Selector)
+	}
+	return pods[0], nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// maxURLLabelValue is the maximum length of a label value given in
+// the 'labels' URL parameter.
+const maxURLLabelValue = 128
+
+// parseURLLabels parses the 'labels' URL parameter, a comma separated
+// list of name:value pairs. Since it comes from the outside, this is
+// strict: names must be valid and not reserved, and values must be
+// short and consist of printable characters other than ','.
+func parseURLLabels(s string) ([]parser.Label, error) {
+	var labels []parser.Label
+	if s == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.IndexByte(pair, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("label %q is not of the form name:value", pair)
+		}
+		name, value := pair[:i], pair[i+1:]
+		if !parser.ValidLabelName(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if len(value) > maxURLLabelValue {
+			return nil, fmt.Errorf("value of label %s is too long", name)
+		}
+		for _, c := range value {
+			if !unicode.IsPrint(c) {
+				return nil, fmt.Errorf("value of label %s contains non-printable characters", name)
+			}
+		}
+		labels = parser.SetLabel(labels, name, value)
+	}
+	return labels, nil
+}
+
+// constantLabels returns the labels that are added to every sample of
+// a script: its configured labels, sorted by name, and then the
+// labels from the URL that the configuration doesn't set.
+func constantLabels(sc *config.ScriptConfig, urlLabels []parser.Label) []parser.Label {
+	var names []string
+	for k := range sc.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var labels []parser.Label
+	for _, k := range names {
+		labels = append(labels, parser.Label{Name: k, Value: sc.Labels[k]})
+	}
+	for _, l := range urlLabels {
+		if _, ok := sc.Labels[l.Name]; !ok {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/version"
+)
+
+// landingTemplate is the default template of the landing page. It
+// can be replaced with the file named in landingPage.template.
+const landingTemplate = `<html>
+<head><title>Script Exporter</title></head>
+<body>
+<h1>Script Exporter</h1>
+<p><a href='/metrics'>Metrics</a></p>
+<p><a href='/probe'>Probe</a></p>
+<p><a href='/sd'>Service discovery</a></p>
+<p><a href='/api/v1/scripts'>Scripts</a></p>
+<h2>Scripts</h2>
+<table>
+<tr><th>Script</th><th>Command</th><th>Parameters</th><th>Last run</th><th>Status</th><th>Duration</th></tr>
+{{range .Scripts}}<tr>
+<td><a href='{{.ProbeURL}}'>{{.Name}}</a></td>
+<td><code>{{.Command}}</code></td>
+<td>{{range $k, $v := .Params}}{{$k}}={{$v}} {{end}}</td>
+{{if .Runs}}<td>{{.LastRun.Format "2006-01-02 15:04:05"}}</td>
+<td>{{if .LastError}}failed: {{.LastError}}{{else}}success{{end}}</td>
+<td>{{printf "%.3f" .LastDuration}}s</td>{{else}}<td>never</td><td></td><td></td>{{end}}
+</tr>
+{{end}}</table>
+<h2>Build</h2>
+<p><ul>
+<li>version: {{.Version}}</li>
+<li>branch: {{.Branch}}</li>
+<li>revision: {{.Revision}}</li>
+<li>go version: {{.GoVersion}}</li>
+<li>build user: {{.BuildUser}}</li>
+<li>build date: {{.BuildDate}}</li>
+</ul></p>
+</body>
+</html>
+`
+
+var defaultLandingTemplate = template.Must(template.New("landing").Parse(landingTemplate))
+
+// landingScript is what the landing page template gets to know about
+// a script.
+type landingScript struct {
+	Name         string
+	Command      string
+	Params       map[string]string
+	ProbeURL     string
+	Runs         uint64
+	LastRun      time.Time
+	LastError    string
+	LastDuration float64
+}
+
+// landingHandler serves the generated landing page, which lists all
+// configured scripts with a link to probe them and the status of
+// their last execution.
+func landingHandler(w http.ResponseWriter, r *http.Request) {
+	c := getConfig()
+
+	t := c.LandingTemplate()
+	if t == nil {
+		t = defaultLandingTemplate
+	}
+
+	var scripts []landingScript
+	for _, s := range c.Scripts {
+		command := s.Script
+		switch s.Type {
+		case config.TypeHTTP:
+			command = s.URL
+		case config.TypeStarlark:
+			command = "(starlark code)"
+		case config.TypeFile:
+			command = s.File.Path
+		}
+
+		// The link probes the script itself, like its service
+		// discovery target, whatever the suggested parameters are.
+		q := url.Values{}
+		var params []string
+		for k, v := range s.Discovery.Params {
+			q.Set(k, v)
+			if k != "script" && k != "prefix" && k != "output" && k != "params" {
+				params = append(params, k)
+			}
+		}
+		if len(params) > 0 {
+			sort.Strings(params)
+			q.Set("params", joinParams(params))
+		}
+		q.Set("script", s.Name)
+
+		ls := landingScript{
+			Name:     s.Name,
+			Command:  command,
+			Params:   s.Discovery.Params,
+			ProbeURL: "/probe?" + q.Encode(),
+		}
+		if st, ok := getState(s.Name); ok {
+			ls.Runs = st.runs
+			ls.LastRun = st.lastRun
+			ls.LastError = st.lastError
+			ls.LastDuration = st.lastDuration.Seconds()
+		}
+		scripts = append(scripts, ls)
+	}
+
+	data := map[string]interface{}{
+		"Scripts":   scripts,
+		"Version":   version.Version,
+		"Branch":    version.Branch,
+		"Revision":  version.Revision,
+		"GoVersion": version.GoVersion,
+		"BuildUser": version.BuildUser,
+		"BuildDate": version.BuildDate,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		log.Printf("Failed to render landing page: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefixes of listen addresses: unix sockets, TCP addresses that are
+// only IPv4 or only IPv6, and the addresses of a network interface.
+const (
+	unixPrefix      = "unix://"
+	tcp4Prefix      = "tcp4://"
+	tcp6Prefix      = "tcp6://"
+	interfacePrefix = "interface://"
+)
+
+// addressList is the value of a flag that can be given several
+// times, replacing its default the first time.
+type addressList struct {
+	addrs []string
+	set   bool
+}
+
+func (a *addressList) String() string {
+	return strings.Join(a.addrs, ",")
+}
+
+func (a *addressList) Set(v string) error {
+	if !a.set {
+		a.addrs, a.set = nil, true
+	}
+	a.addrs = append(a.addrs, v)
+	return nil
+}
+
+// listen listens on an address: a TCP address, of only IPv4 or IPv6
+// for tcp4:// and tcp6:// addresses, or a unix socket for
+// unix:///path addresses, which gets the file mode socketMode. A stale
+// socket left behind by a previous run is removed first. TCP
+// addresses set SO_REUSEPORT with -web.reuse-port, so that a new
+// instance can start listening before the old one stops.
+func listen(addr, socketMode string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		network := "tcp"
+		switch {
+		case strings.HasPrefix(addr, tcp4Prefix):
+			network, addr = "tcp4", strings.TrimPrefix(addr, tcp4Prefix)
+		case strings.HasPrefix(addr, tcp6Prefix):
+			network, addr = "tcp6", strings.TrimPrefix(addr, tcp6Prefix)
+		}
+		var lc net.ListenConfig
+		if *reusePort {
+			lc.Control = setReusePort
+		}
+		return lc.Listen(context.Background(), network, addr)
+	}
+
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %s", socketMode)
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// interfaceAddresses returns the addresses that an interface://name:port
+// address stands for: the port on every IPv4 and IPv6 address of the
+// network interface, as it is when we start.
+func interfaceAddresses(addr string) ([]string, error) {
+	name, port, err := net.SplitHostPort(strings.TrimPrefix(addr, interfacePrefix))
+	if err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, a := range ifaceAddrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil {
+			addrs = append(addrs, tcp4Prefix+net.JoinHostPort(ip.String(), port))
+			continue
+		}
+		host := ipnet.IP.String()
+		if ipnet.IP.IsLinkLocalUnicast() {
+			host += "%" + name
+		}
+		addrs = append(addrs, tcp6Prefix+net.JoinHostPort(host, port))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", name)
+	}
+	return addrs, nil
+}
+
+// serve serves handler over HTTP, or HTTPS if tlsConfig isn't nil, on
+// all of the addresses until serving one of them fails.
+func serve(addrs []string, socketMode string, handler http.Handler, tlsConfig *tls.Config) error {
+	var expanded []string
+	for _, addr := range addrs {
+		if !strings.HasPrefix(addr, interfacePrefix) {
+			expanded = append(expanded, addr)
+			continue
+		}
+		ifaceAddrs, err := interfaceAddresses(addr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", addr, err)
+		}
+		expanded = append(expanded, ifaceAddrs...)
+	}
+	addrs = expanded
+
+	sc := getConfig().Server
+	var conns chan struct{}
+	if sc.MaxConnections > 0 {
+		conns = make(chan struct{}, sc.MaxConnections)
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := listen(addr, socketMode)
+		if err != nil {
+			return err
+		}
+		if conns != nil {
+			l = &limitListener{Listener: l, conns: conns}
+		}
+		listeners = append(listeners, proxyListener{l})
+	}
+
+	server := &http.Server{
+		Handler:           writeTimeout(handler),
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       sc.ReadTimeout,
+		ReadHeaderTimeout: sc.ReadHeaderTimeout,
+		IdleTimeout:       sc.IdleTimeout,
+		MaxHeaderBytes:    sc.MaxHeaderBytes,
+	}
+	if *enableGRPC {
+		// gRPC clients also speak HTTP/2 without TLS.
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		server.Protocols = &protocols
+	}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if tlsConfig != nil {
+				errc <- server.ServeTLS(l, "", "")
+			} else {
+				errc <- server.Serve(l)
+			}
+		}(l)
+	}
+	return <-errc
+}
+
+// writeTimeout limits how long writing the response to a request may
+// take to the write timeout of the running configuration, which
+// depends on the timeouts of its scripts.
+func writeTimeout(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := getConfig().Server.WriteTimeout; d > 0 {
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// A limitListener is a listener that accepts connections only while
+// fewer than the capacity of conns are open, which it shares with
+// other listeners.
+type limitListener struct {
+	net.Listener
+	conns chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.conns <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.conns
+		return nil, err
+	}
+	return &limitConn{Conn: conn, conns: l.conns}, nil
+}
+
+// A limitConn is a connection of a limitListener, which makes room
+// for another one when it is closed.
+type limitConn struct {
+	net.Conn
+	conns chan struct{}
+	once  sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.conns })
+	return err
+}
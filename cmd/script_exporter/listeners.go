@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// listenerKey is the key of the name of the dedicated listener that
+// a request came in on in its context.
+type listenerKey struct{}
+
+// onListener marks the requests of a handler as coming in on the
+// dedicated listener with a name.
+func onListener(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, name)))
+	})
+}
+
+// requestListener returns the listener that a request is for, either
+// because it came in on its address or because of its Host header, or
+// nil if it's for the main listener. A dedicated listener that's gone
+// from the configuration serves nothing.
+func requestListener(r *http.Request) *config.ListenerConfig {
+	c := getConfig()
+	if name, ok := r.Context().Value(listenerKey{}).(string); ok {
+		if l := c.GetListenerConfig(name); l != nil {
+			return l
+		}
+		return &config.ListenerConfig{Name: name}
+	}
+	return c.ListenerForHost(r.Host)
+}
+
+// listenerServes reports whether a probe request may probe a script,
+// which it may unless it's for a listener that doesn't serve it.
+func listenerServes(r *http.Request, scriptName string) bool {
+	l := requestListener(r)
+	if l == nil || l.Serves(scriptName) {
+		return true
+	}
+	log.Printf("Script %s is not served by listener %s\n", scriptName, l.Name)
+	return false
+}
+
+// serveListeners starts serving the dedicated listeners of the
+// configuration that have addresses of their own, with the handlers
+// of the probe endpoints of the main listener, where grpc is nil if
+// gRPC is off. Their addresses are fixed once the server runs, like
+// the main ones.
+func serveListeners(probe, batchProbe, grpc http.HandlerFunc, tlsConfig *tls.Config) {
+	for _, l := range getConfig().Listeners {
+		if l.Address == "" {
+			continue
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/probe", probe)
+		mux.HandleFunc("/probe/", probe)
+		mux.HandleFunc("/batchprobe", batchProbe)
+		mux.HandleFunc("/-/healthy", healthyHandler)
+		mux.HandleFunc("/-/ready", readyHandler)
+		if grpc != nil {
+			mux.HandleFunc("/script_exporter.v1.Scripts/", grpc)
+		}
+		log.Printf("Listener %s listening on %s\n", l.Name, l.Address)
+		go func(name, addr string, h http.Handler) {
+			log.Fatalf("Listener %s: %s\n", name, serve([]string{addr}, *socketMode, h, tlsConfig))
+		}(l.Name, l.Address, accessLogged(onListener(l.Name, mux)))
+	}
+}
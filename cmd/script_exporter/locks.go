@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+var (
+	// locks are the named locks of scripts, each a channel that
+	// holds a value while the lock is taken, so that waiting for it
+	// can be given up on.
+	locksMu sync.Mutex
+	locks   = make(map[string]chan struct{})
+
+	// lockWait is replaced by one with the configured buckets when
+	// the metrics are set up.
+	lockWait = newLockWait(defaultDurationBuckets)
+)
+
+// lockError is returned by acquireLocks if a script couldn't get one
+// of its locks within its timeout.
+type lockError struct {
+	lock    string
+	timeout time.Duration
+}
+
+func (e *lockError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for lock %s", e.timeout, e.lock)
+}
+
+// newLockWait returns the histogram of how long scripts waited for
+// their locks, with buckets.
+func newLockWait(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "scripts",
+		Name:      "lock_wait_seconds",
+		Help:      "A histogram of how long scripts waited for a named lock.",
+		Buckets:   buckets,
+	}, []string{"lock"})
+}
+
+// namedLock returns the lock with a name, which is created when it's
+// first used.
+func namedLock(name string) chan struct{} {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	l, ok := locks[name]
+	if !ok {
+		l = make(chan struct{}, 1)
+		locks[name] = l
+	}
+	return l
+}
+
+// acquireLocks takes the locks of a script, in the order of their
+// names, so that scripts sharing several locks can't deadlock. It
+// waits at most timeout, unless that is zero, and until ctx is done,
+// and returns a function that releases the locks again.
+func acquireLocks(ctx context.Context, sc *config.ScriptConfig, timeout time.Duration) (func(), error) {
+	var held []chan struct{}
+	release := func() {
+		for _, l := range held {
+			<-l
+		}
+	}
+	if len(sc.Locks) == 0 {
+		return release, nil
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for _, name := range sc.Locks {
+		l := namedLock(name)
+		start := time.Now()
+		select {
+		case l <- struct{}{}:
+			lockWait.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			held = append(held, l)
+		case <-expired:
+			release()
+			return nil, &lockError{lock: name, timeout: timeout}
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// useConfig loads a configuration file with the given contents as the
+// running configuration until the test is done.
+func useConfig(t *testing.T, text string) *config.Config {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &config.Config{}
+	if err := c.LoadConfig(file); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	previous := getConfig()
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+	return c
+}
+
+func TestProbeScriptLocks(t *testing.T) {
+	c := useConfig(t, `
+scripts:
+  - name: holder
+    script: "true"
+    locks: [test-db]
+  - name: quick
+    script: echo up 1
+    timeout: 300ms
+    locks: [test-db]
+  - name: slow
+    script: sleep 1
+    timeout: 300ms
+    locks: [test-db]
+`)
+	holder := c.GetScriptConfig("holder")
+
+	tests := []struct {
+		name    string
+		script  string
+		hold    time.Duration
+		success bool
+		reason  string
+	}{
+		{"free lock", "quick", 0, true, ""},
+		{"released lock", "quick", 100 * time.Millisecond, true, ""},
+		{"held lock", "quick", time.Hour, false, "lock"},
+		{"released lock, then timed out", "slow", 100 * time.Millisecond, false, "timeout"},
+		// Whether it's the lock or the script that times
+		// out, the probe fails.
+		{"released lock at the timeout", "slow", 299 * time.Millisecond, false, ""},
+		{"released lock after the timeout", "quick", 300 * time.Millisecond, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.hold > 0 {
+				release, err := acquireLocks(context.Background(), holder, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				released := make(chan struct{})
+				timer := time.AfterFunc(tt.hold, func() {
+					release()
+					close(released)
+				})
+				defer func() {
+					if timer.Stop() {
+						release()
+					} else {
+						<-released
+					}
+				}()
+			}
+
+			output, _, err := probeScript(c.GetScriptConfig(tt.script), &probeRequest{})
+			if (err == nil) != tt.success {
+				t.Fatalf("probeScript() error = %v, want success %v", err, tt.success)
+			}
+			if tt.success != strings.Contains(output, "script_success{} 1\n") {
+				t.Errorf("probeScript() = %q, want success %v", output, tt.success)
+			}
+			if tt.reason != "" && !strings.Contains(output, `script_error{reason="`+tt.reason+`"} 1`) {
+				t.Errorf("probeScript() = %q, want the reason %s", output, tt.reason)
+			}
+		})
+	}
+}
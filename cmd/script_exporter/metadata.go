@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// A metadataWriter adds the configured HELP and TYPE lines of metrics
+// to the output of a script that doesn't have them. Lines are keyed
+// by their kind and metric name, as in 'TYPE foo'.
+type metadataWriter struct {
+	metadata map[string]*config.MetricMetadataConfig
+	seen     map[string]bool
+	written  map[string]bool
+}
+
+func newMetadataWriter(metadata map[string]*config.MetricMetadataConfig) *metadataWriter {
+	return &metadataWriter{metadata: metadata, seen: make(map[string]bool), written: make(map[string]bool)}
+}
+
+// comment records a comment line of the output and reports whether
+// it's kept. HELP and TYPE lines that come after the ones we wrote for
+// the same metric are dropped, since a metric can only have one of
+// each.
+func (m *metadataWriter) comment(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "#" || (fields[1] != "HELP" && fields[1] != "TYPE") {
+		return true
+	}
+	key := fields[1] + " " + fields[2]
+	if m.written[key] {
+		return false
+	}
+	m.seen[key] = true
+	return true
+}
+
+// sample writes the configured HELP and TYPE lines of the metric of a
+// sample to w, before the sample is written, unless the output had
+// them already.
+func (m *metadataWriter) sample(w *bytes.Buffer, name string) {
+	family, md := m.family(name)
+	if md == nil {
+		return
+	}
+	if key := "HELP " + family; md.Help != "" && !m.seen[key] && !m.written[key] {
+		fmt.Fprintf(w, "# HELP %s %s\n", family, parser.EscapeHelp(md.Help))
+		m.written[key] = true
+	}
+	if key := "TYPE " + family; md.Type != "" && !m.seen[key] && !m.written[key] {
+		fmt.Fprintf(w, "# TYPE %s %s\n", family, md.Type)
+		m.written[key] = true
+	}
+}
+
+// family returns the name and metadata of the metric that a sample
+// belongs to, which for histograms and summaries may have a suffix,
+// or nil if it has none.
+func (m *metadataWriter) family(name string) (string, *config.MetricMetadataConfig) {
+	if md, ok := m.metadata[name]; ok {
+		return name, md
+	}
+	for _, typ := range []string{"histogram", "summary"} {
+		for _, suffix := range parser.TypeSuffixes[typ] {
+			base := strings.TrimSuffix(name, suffix)
+			if md, ok := m.metadata[base]; ok && base != name && md.Type == typ {
+				return base, md
+			}
+		}
+	}
+	return "", nil
+}
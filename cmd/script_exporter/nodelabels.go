@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+	"gopkg.in/yaml.v2"
+)
+
+// nodeLabels are the labels about the host of the running
+// configuration, which are resolved when it is loaded.
+var nodeLabels atomic.Value
+
+func init() {
+	nodeLabels.Store([]parser.Label(nil))
+}
+
+// getNodeLabels returns the labels about the host.
+func getNodeLabels() []parser.Label {
+	return nodeLabels.Load().([]parser.Label)
+}
+
+// resolveNodeLabels returns the labels about the host that a
+// configuration asks for, from the hostname, the file and the output
+// of the command, in that order, so that later ones replace earlier
+// ones of the same name.
+func resolveNodeLabels(c *config.Config) ([]parser.Label, error) {
+	nl := &c.NodeLabels
+	var labels []parser.Label
+	if nl.Hostname != "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		labels = parser.SetLabel(labels, nl.Hostname, hostname)
+	}
+	if nl.File != "" {
+		b, err := ioutil.ReadFile(nl.File)
+		if err != nil {
+			return nil, err
+		}
+		parse := parseNodeLabels
+		switch filepath.Ext(nl.File) {
+		case ".json", ".yaml", ".yml":
+			parse = parseInventoryLabels
+		}
+		fileLabels, err := parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %s", nl.File, err)
+		}
+		for _, l := range fileLabels {
+			labels = parser.SetLabel(labels, l.Name, l.Value)
+		}
+	}
+	if nl.Command != "" {
+		output, _, err := runScript(runner.Command{Args: config.SplitCommand(nl.Command)}, nil, nl.Timeout, 64<<10, nil)
+		if err != nil {
+			return nil, fmt.Errorf("command %s: %s", nl.Command, err)
+		}
+		commandLabels, err := parseNodeLabels(output)
+		if err != nil {
+			return nil, fmt.Errorf("command %s: %s", nl.Command, err)
+		}
+		for _, l := range commandLabels {
+			labels = parser.SetLabel(labels, l.Name, l.Value)
+		}
+	}
+	return labels, nil
+}
+
+// parseNodeLabels parses labels given as name=value pairs, one per
+// line, in the style of /etc/os-release: values may be double quoted,
+// and empty lines and lines starting with '#' are ignored. Labels
+// with empty values are left out.
+func parseNodeLabels(text string) ([]parser.Label, error) {
+	var labels []parser.Label
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d is not of the form name=value", i+1)
+		}
+		name, value := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+		if !parser.ValidLabelName(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("line %d: invalid label name %q", i+1, name)
+		}
+		if strings.HasPrefix(value, `"`) {
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value", i+1)
+			}
+			value = v
+		}
+		labels = parser.SetLabel(labels, name, strings.ToValidUTF8(value, "\uFFFD"))
+	}
+	return labels, nil
+}
+
+// parseInventoryLabels parses labels given as a JSON or YAML object,
+// such as Ansible facts or an export of a CMDB, whose keys are label
+// names. Values that aren't strings, numbers or booleans, as well as
+// empty ones, are left out.
+func parseInventoryLabels(text string) ([]parser.Label, error) {
+	var inventory map[string]interface{}
+	if err := yaml.Unmarshal([]byte(text), &inventory); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(inventory))
+	for name := range inventory {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var labels []parser.Label
+	for _, name := range names {
+		var value string
+		switch v := inventory[name].(type) {
+		case string:
+			value = v
+		case int, int64, uint64, float64, bool:
+			value = fmt.Sprint(v)
+		default:
+			continue
+		}
+		if !parser.ValidLabelName(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		labels = parser.SetLabel(labels, name, strings.ToValidUTF8(value, "\uFFFD"))
+	}
+	return labels, nil
+}
+
+// withNodeLabels adds the labels about the host to every sample of
+// formatted output, except those it already has.
+func withNodeLabels(output string) string {
+	labels := getNodeLabels()
+	if len(labels) == 0 {
+		return output
+	}
+
+	var b strings.Builder
+	b.Grow(len(output) + 64)
+	for _, line := range strings.SplitAfter(output, "\n") {
+		sample := strings.TrimSuffix(line, "\n")
+		if sample == "" || sample[0] == '#' {
+			b.WriteString(line)
+			continue
+		}
+		if _, labeled, ok := labelSample(sample, labels); ok {
+			line = labeled + line[len(sample):]
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
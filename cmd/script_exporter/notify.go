@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// States of scripts in notifications
+const (
+	stateSuccess = "success"
+	stateFailure = "failure"
+)
+
+var (
+	// The success of the last scheduled run of scripts, by name.
+	notifyMu     sync.Mutex
+	notifyStates = make(map[string]bool)
+)
+
+// A notification is what the templates of notifiers are rendered
+// with.
+type notification struct {
+	Script   string
+	State    string
+	Previous string
+	Error    string
+	Time     time.Time
+}
+
+// stateName returns the state of a script in notifications.
+func stateName(success bool) string {
+	if success {
+		return stateSuccess
+	}
+	return stateFailure
+}
+
+// notifyStateChange records the result of a scheduled run of a script
+// that started at start, and tells the notifiers for the script if it
+// started failing or succeeded again. The first run of a script only
+// records its state. Notifiers are run in the background, so that
+// slow ones don't hold up the schedule.
+func notifyStateChange(c *config.Config, scriptName string, err error, start time.Time) {
+	success := err == nil
+	notifyMu.Lock()
+	previous, known := notifyStates[scriptName]
+	notifyStates[scriptName] = success
+	notifyMu.Unlock()
+	if !known || previous == success {
+		return
+	}
+
+	n := notification{Script: scriptName, State: stateName(success), Previous: stateName(previous), Time: start}
+	if err != nil {
+		n.Error = err.Error()
+	}
+	for i := range c.Notifiers {
+		nc := &c.Notifiers[i]
+		if !nc.Notifies(scriptName) {
+			continue
+		}
+		go func() {
+			if err := sendNotification(nc, n); err != nil {
+				log.Printf("Script %s: notification failed: %s\n", scriptName, err.Error())
+			}
+		}()
+	}
+}
+
+// sendNotification renders the template of a notifier and sends it to
+// its webhook, or runs its command with it as standard input.
+func sendNotification(nc *config.NotifierConfig, n notification) error {
+	var body bytes.Buffer
+	if err := nc.CompiledTemplate().Execute(&body, n); err != nil {
+		return err
+	}
+
+	if nc.Command != "" {
+		_, _, err := runScript(runner.Command{Args: config.SplitCommand(nc.Command)}, body.Bytes(), nc.Timeout, 0, nil)
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, nc.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "script_exporter")
+	for k, v := range nc.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: nc.Timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
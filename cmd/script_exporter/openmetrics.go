@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// Exposition formats that probe results can be served in.
+const (
+	formatText        = "text"
+	formatOpenMetrics = "openmetrics"
+	formatProtobuf    = "protobuf"
+)
+
+var contentTypes = map[string]string{
+	formatText:        "text/plain; version=0.0.4; charset=utf-8",
+	formatOpenMetrics: "application/openmetrics-text; version=1.0.0; charset=utf-8",
+	formatProtobuf:    string(expfmt.FmtProtoDelim),
+}
+
+// negotiateFormat picks the exposition format for a request from its
+// Accept header: the supported format with the highest quality, the
+// first one listed on ties, and the text format if there is none.
+func negotiateFormat(r *http.Request) string {
+	format, best := formatText, 0.0
+	for _, ac := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(ac))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		var f string
+		switch mt {
+		case "application/openmetrics-text":
+			f = formatOpenMetrics
+		case expfmt.ProtoType:
+			if params["proto"] != expfmt.ProtoProtocol || params["encoding"] != "delimited" {
+				continue
+			}
+			f = formatProtobuf
+		case "text/plain":
+			f = formatText
+		default:
+			continue
+		}
+		if q > best {
+			format, best = f, q
+		}
+	}
+	return format
+}
+
+// writeProbeOutput writes the output of a probe in the format that
+// the client asked for, with the labels about the host.
+func writeProbeOutput(w http.ResponseWriter, r *http.Request, sc *config.ScriptConfig, output string) {
+	format := negotiateFormat(r)
+	output = withNodeLabels(output)
+
+	// Output that the text parser doesn't accept, which the
+	// formatting of script output doesn't rule out, can't be
+	// converted to protobuf.
+	var families []string
+	var parsed map[string]*dto.MetricFamily
+	if format == formatProtobuf {
+		var err error
+		var textParser expfmt.TextParser
+		parsed, err = textParser.TextToMetricFamilies(strings.NewReader(parser.StripExemplars(output)))
+		if err != nil {
+			log.Printf("Script %s: can't convert output to protobuf: %s\n", sc.Name, err.Error())
+			format = formatText
+		}
+		for name := range parsed {
+			families = append(families, name)
+		}
+		sort.Strings(families)
+	}
+
+	w.Header().Set("Content-Type", contentTypes[format])
+	switch format {
+	case formatProtobuf:
+		enc := expfmt.NewEncoder(w, expfmt.FmtProtoDelim)
+		for _, name := range families {
+			if err := enc.Encode(parsed[name]); err != nil {
+				log.Printf("Script %s: can't write protobuf output: %s\n", sc.Name, err.Error())
+				return
+			}
+		}
+	case formatOpenMetrics:
+		fmt.Fprint(w, parser.ToOpenMetrics(output, sc.OpenMetrics.Exemplars, sc.OpenMetrics.Timestamps))
+	default:
+		fmt.Fprint(w, parser.StripExemplars(output))
+	}
+}
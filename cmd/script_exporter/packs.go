@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+const (
+	// packFetchTimeout is how long downloading an archive or a
+	// signature of a pack may take.
+	packFetchTimeout = 5 * time.Minute
+
+	// maxPackBytes is the largest archive of a pack we download,
+	// and maxSignatureBytes the largest signature.
+	maxPackBytes      = 256 * 1024 * 1024
+	maxSignatureBytes = 64 * 1024
+
+	// packSumFile is the file in the directory of an extracted
+	// pack with the SHA256 checksum of its archive, so that
+	// unchanged packs aren't extracted again.
+	packSumFile = ".sha256"
+)
+
+var (
+	// packsMu keeps packs from being fetched more than once at a
+	// time.
+	packsMu sync.Mutex
+
+	packFetchSuccessful = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "scripts",
+			Name:      "pack_last_fetch_successful",
+			Help:      "Whether the last attempt to fetch a pack of scripts was successful.",
+		},
+		[]string{"pack"})
+)
+
+// startPacks fetches the packs of the configuration in the background
+// when we start, so that we serve the scripts of packs that were
+// extracted before in the meantime.
+func startPacks(file string) {
+	if len(getConfig().Packs.Sources) == 0 {
+		return
+	}
+	go fetchPacks(file)
+}
+
+// fetchPacks fetches every pack of the running configuration, and
+// reloads the configuration file if any of them changed. It returns
+// the errors of all packs that couldn't be fetched, which keep the
+// version that was extracted before, if any.
+func fetchPacks(file string) error {
+	packsMu.Lock()
+	defer packsMu.Unlock()
+
+	c := getConfig()
+	var errs []error
+	changed := false
+	for _, p := range c.Packs.Sources {
+		ok, err := fetchPack(c, p)
+		if err != nil {
+			log.Printf("Failed to fetch pack %s: %s\n", p.Name, err.Error())
+			packFetchSuccessful.WithLabelValues(p.Name).Set(0)
+			errs = append(errs, fmt.Errorf("pack %s: %s", p.Name, err))
+			continue
+		}
+		packFetchSuccessful.WithLabelValues(p.Name).Set(1)
+		if ok {
+			log.Printf("Extracted pack %s into %s\n", p.Name, c.PackDir(p))
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := reloadConfig(file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return config.Errors(errs)
+	}
+	return nil
+}
+
+// fetchPack downloads and verifies the archive of a pack and extracts
+// it, replacing the version that was extracted before, and reports
+// whether it changed.
+func fetchPack(c *config.Config, p *config.PackConfig) (bool, error) {
+	data, err := download(p.URL, maxPackBytes)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	hexSum := hex.EncodeToString(sum[:])
+	if p.SHA256 != "" && !strings.EqualFold(hexSum, p.SHA256) {
+		return false, fmt.Errorf("checksum %s doesn't match", hexSum)
+	}
+	if keys := p.PublicKeys(); keys != nil {
+		sig, err := download(p.SignatureLocation(), maxSignatureBytes)
+		if err != nil {
+			return false, fmt.Errorf("signature: %s", err)
+		}
+		if !verifyPackSignature(keys, sum[:], sig) {
+			return false, errors.New("invalid signature")
+		}
+	}
+
+	dir := c.PackDir(p)
+	if old, err := ioutil.ReadFile(filepath.Join(dir, packSumFile)); err == nil && string(old) == hexSum {
+		return false, nil
+	}
+
+	// The pack is extracted next to its directory, which is then
+	// replaced, so that a reload never sees half of a pack.
+	if err := os.MkdirAll(c.Packs.Directory, 0755); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempDir(c.Packs.Directory, "."+p.Name+"-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return false, err
+	}
+	if err := extractPack(data, tmp, c.Packs.MaxExtractedBytes); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(tmp, config.PackFile)); err != nil {
+		return false, fmt.Errorf("archive has no %s", config.PackFile)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, packSumFile), []byte(hexSum), 0644); err != nil {
+		return false, err
+	}
+
+	old := tmp + ".old"
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	defer os.RemoveAll(old)
+	if err := os.Rename(tmp, dir); err != nil {
+		os.Rename(old, dir)
+		return false, err
+	}
+	return true, nil
+}
+
+// download fetches the document at url, of at most max bytes.
+func download(url string, max int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "script_exporter")
+	client := &http.Client{Timeout: packFetchTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, errors.New(res.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("larger than %d bytes", max)
+	}
+	return data, nil
+}
+
+// verifyPackSignature reports whether sig is a valid signature of the
+// SHA256 checksum of an archive for one of keys.
+func verifyPackSignature(keys []crypto.PublicKey, sum, sig []byte) bool {
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum, sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(k, sum, sig) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extractPack extracts a tar file, which may be gzipped, or a zip file
+// into dir. Only directories and regular files are extracted, and
+// entries outside of dir are an error, as is extracting more than max
+// bytes.
+func extractPack(data []byte, dir string, max int64) error {
+	limit := &extractLimit{max: max, left: max}
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return extractZip(data, dir, limit)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		return extractTar(zr, dir, limit)
+	default:
+		return extractTar(bytes.NewReader(data), dir, limit)
+	}
+}
+
+// An extractLimit is how many bytes extracting a pack may still
+// write, of the max of all of its files.
+type extractLimit struct {
+	max, left int64
+}
+
+func extractTar(r io.Reader, dir string, limit *extractLimit) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(dir, h.Name)
+		case tar.TypeReg:
+			err = extractFile(dir, h.Name, h.FileInfo().Mode(), tr, limit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(data []byte, dir string, limit *extractLimit) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			err = extractDir(dir, f.Name)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			if rc, err = f.Open(); err == nil {
+				err = extractFile(dir, f.Name, mode, rc, limit)
+				rc.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packPath returns where an entry of an archive is extracted in dir.
+func packPath(dir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %s in archive", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+func extractDir(dir, name string) error {
+	path, err := packPath(dir, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0755)
+}
+
+func extractFile(dir, name string, mode os.FileMode, r io.Reader, limit *extractLimit) error {
+	path, err := packPath(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	// Sizes in the headers of archives can't be trusted, so we
+	// count what we write.
+	n, err := io.Copy(f, io.LimitReader(r, limit.left+1))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if limit.left -= n; limit.left < 0 {
+		f.Close()
+		return fmt.Errorf("archive extracts to more than %d bytes", limit.max)
+	}
+	return f.Close()
+}
+
+// packsHandler fetches the packs of scripts on a POST to /-/packs,
+// like reloadHandler reloads the configuration.
+func packsHandler(file string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := fetchPacks(file); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch packs: %s", err.Error()), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// packFile is a file of an archive of a pack.
+type packFile struct {
+	name string
+	size int
+}
+
+// tarPack returns a gzipped tar file of files of zero bytes.
+func tarPack(t *testing.T, files ...packFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(f.size), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(make([]byte, f.size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipPack returns a zip file of files of zero bytes.
+func zipPack(t *testing.T, files ...packFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(make([]byte, f.size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractPack(t *testing.T) {
+	const max = 1 << 20
+	tests := []struct {
+		name    string
+		data    func(*testing.T, ...packFile) []byte
+		files   []packFile
+		wantErr string
+	}{
+		{"tar", tarPack, []packFile{{"pack.yaml", 100}, {"checks/check.sh", 1000}}, ""},
+		{"tar of exactly the limit", tarPack, []packFile{{"pack.yaml", max / 2}, {"check.sh", max / 2}}, ""},
+		{"tar of a large file", tarPack, []packFile{{"pack.yaml", 100}, {"zeros", max + 1}}, "more than 1048576 bytes"},
+		{"tar of many files", tarPack, []packFile{{"a", max / 2}, {"b", max / 2}, {"c", 1}}, "more than 1048576 bytes"},
+		{"tar outside of its directory", tarPack, []packFile{{"../pack.yaml", 100}}, "invalid path"},
+		{"zip", zipPack, []packFile{{"pack.yaml", 100}, {"checks/check.sh", 1000}}, ""},
+		{"zip of a large file", zipPack, []packFile{{"pack.yaml", 100}, {"zeros", max + 1}}, "more than 1048576 bytes"},
+		{"zip outside of its directory", zipPack, []packFile{{"/etc/pack.yaml", 100}}, "invalid path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := extractPack(tt.data(t, tt.files...), dir, max)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("extractPack() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractPack() error = %v", err)
+			}
+			for _, f := range tt.files {
+				b, err := ioutil.ReadFile(filepath.Join(dir, f.name))
+				if err != nil || len(b) != f.size {
+					t.Errorf("extracted %s has %d bytes, %v, want %d", f.name, len(b), err, f.size)
+				}
+			}
+		})
+	}
+}
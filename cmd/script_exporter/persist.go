@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// A persistedResult is the last successful result of probes of a
+// script with a key, as kept on disk.
+type persistedResult struct {
+	Script string    `json:"script"`
+	Time   time.Time `json:"time"`
+	Output string    `json:"output"`
+}
+
+// persistDir returns the directory that the results of a script are
+// kept in, or "" if they aren't.
+func persistDir(sc *config.ScriptConfig) string {
+	if !sc.PersistResult {
+		return ""
+	}
+	return getConfig().Persistence.Directory
+}
+
+// persistFile returns the file that results for a key are kept in.
+// Keys contain parameters, so they are hashed.
+func persistFile(dir, key string) string {
+	return filepath.Join(dir, fmt.Sprintf("%x.json", sha256.Sum256([]byte(key))))
+}
+
+// storePersistedResult keeps a successful result for a key on disk.
+// The file is replaced atomically, so that a crash never leaves a
+// partial result behind.
+func storePersistedResult(dir, key, scriptName, output string) error {
+	b, err := json.Marshal(persistedResult{Script: scriptName, Time: time.Now(), Output: output})
+	if err != nil {
+		return err
+	}
+	file := persistFile(dir, key)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// loadPersistedResult returns the result kept on disk for a key, if
+// there is one.
+func loadPersistedResult(dir, key string) (*persistedResult, bool) {
+	b, err := ioutil.ReadFile(persistFile(dir, key))
+	if err != nil {
+		return nil, false
+	}
+	var pr persistedResult
+	if err := json.Unmarshal(b, &pr); err != nil {
+		return nil, false
+	}
+	return &pr, true
+}
+
+// removePersistedResults removes the results kept in dir of the
+// scripts that match, and returns how many it removed. Files are named
+// after the hashes of their keys, so every result is read to find out
+// which script it is of.
+func removePersistedResults(dir string, matches func(scriptName string) bool) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var pr persistedResult
+		if err := json.Unmarshal(b, &pr); err != nil || !matches(pr.Script) {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			log.Printf("Can't remove persisted result %s: %s\n", file, err.Error())
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// staleOutput adds script_result_stale to the output of a script with
+// persisted results.
+func staleOutput(output string, stale bool) string {
+	v := 0
+	if stale {
+		v = 1
+	}
+	return fmt.Sprintf("%s%s\n%s\n%s_result_stale{} %d\n", output, scriptResultStaleHelp, scriptResultStaleType, namespace, v)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// postParams lets probe requests be POSTed, with their parameters in
+// a JSON or form body instead of the query string. The parameters of
+// the body replace those of the same name in the query string, and
+// the request is then handled as if they had all been in it. Bodies
+// of other content types carry no parameters. The body is kept in
+// the context of the request for scripts that get it on stdin.
+func postParams(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, params, status, err := parseBodyParams(r)
+		if err != nil {
+			log.Printf("Invalid request body: %s\n", err.Error())
+			http.Error(w, fmt.Sprintf("Invalid request body: %s", err.Error()), status)
+			return
+		}
+
+		q := r.URL.Query()
+		for k, v := range params {
+			q[k] = v
+		}
+		r = r.Clone(context.WithValue(r.Context(), requestBodyKey{}, body))
+		r.URL.RawQuery = q.Encode()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestBodyKey is the context key of the body of a POST request.
+type requestBodyKey struct{}
+
+// requestBody returns the body of a POST request, if it was one.
+func requestBody(r *http.Request) []byte {
+	body, _ := r.Context().Value(requestBodyKey{}).([]byte)
+	return body
+}
+
+// readBody reads the body of a request, which may be at most
+// probe.maxBodyBytes long, and on errors also returns the HTTP status
+// to fail it with.
+func readBody(r *http.Request) ([]byte, int, error) {
+	max := getConfig().Probe.MaxBodyBytes
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if int64(len(body)) > max {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", max)
+	}
+	return body, 0, nil
+}
+
+// parseBodyParams reads the body of a request and the parameters in
+// it, and on errors also returns the HTTP status to fail it with.
+func parseBodyParams(r *http.Request) ([]byte, url.Values, int, error) {
+	body, status, err := readBody(r)
+	if err != nil {
+		return nil, nil, status, err
+	}
+
+	var params url.Values
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/x-www-form-urlencoded":
+		params, err = url.ParseQuery(string(body))
+	case "application/json":
+		params, err = parseJSONParams(body)
+	}
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	return body, params, 0, nil
+}
+
+// parseJSONParams parses a JSON object of parameters. Parameters are
+// strings, numbers or booleans, and arrays of them are multi-valued
+// parameters.
+func parseJSONParams(body []byte) (url.Values, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+
+	params := make(url.Values)
+	for k, raw := range obj {
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			list = []json.RawMessage{raw}
+		}
+		for _, item := range list {
+			v, err := jsonParamValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %s", k, err)
+			}
+			params.Add(k, v)
+		}
+	}
+	return params, nil
+}
+
+// jsonParamValue returns the value of a scalar JSON parameter as a
+// string, the way it would be passed in a query string.
+func jsonParamValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(string(raw)))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("value must be a string, number or boolean")
+}
+
+// scriptStdin returns the standard input of a script for a probe
+// request, or nil if it gets none. Templates are rendered with the
+// name of the script and the parameters of the request.
+func scriptStdin(sc *config.ScriptConfig, r *http.Request, params url.Values) ([]byte, error) {
+	if sc.Stdin == nil {
+		return nil, nil
+	}
+	if sc.Stdin.Source == config.StdinBody {
+		body := requestBody(r)
+		if body == nil {
+			body = []byte{}
+		}
+		return body, nil
+	}
+
+	var b bytes.Buffer
+	data := struct {
+		Script string
+		Params url.Values
+	}{sc.Name, params}
+	if err := sc.Stdin.CompiledTemplate().Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
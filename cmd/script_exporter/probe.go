@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// outputDiagnostic describes an output line of a script that was
+// dropped while formatting the output, and why. Lines that couldn't be
+// parsed, as opposed to ones that were filtered, have parse set.
+type outputDiagnostic struct {
+	line   int
+	text   string
+	reason string
+	naming bool
+	parse  bool
+}
+
+func (d outputDiagnostic) String() string {
+	return fmt.Sprintf("line %d: %s: %q", d.line, d.reason, d.text)
+}
+
+// probeRequest holds everything about a probe request that
+// influences its output, apart from the script itself.
+type probeRequest struct {
+	prefix       string
+	paramValues  []string
+	labels       []parser.Label
+	ignoreOutput bool
+
+	// canary is set for runs of a new definition of a script that
+	// isn't served yet, which don't count as runs of the script.
+	canary bool
+
+	// stdin is the standard input of the script, if it gets any.
+	stdin []byte
+
+	// timeout is the timeout asked for by the request, which can
+	// only shorten that of the script, or zero.
+	timeout time.Duration
+
+	// span is the span of the request if it's traced, and isn't
+	// part of the key.
+	span *span
+
+	// env are environment variables that the script gets on top
+	// of ours, like the ID of the request. They aren't part of the
+	// key either.
+	env []string
+
+	// ctx is done when nobody waits for the probe any more, and
+	// the script is killed then. It's nil for probes that never
+	// are.
+	ctx context.Context
+}
+
+// context returns the context of a probe request.
+func (pr *probeRequest) context() context.Context {
+	if pr.ctx == nil {
+		return context.Background()
+	}
+	return pr.ctx
+}
+
+// key returns a key for probes of a script with this request, which
+// is the same only for probes that would produce the same output.
+// It's used to batch and cache probes.
+func (pr *probeRequest) key(scriptName string) string {
+	parts := []string{scriptName, pr.prefix, strconv.FormatBool(pr.ignoreOutput), parser.FormatLabels(pr.labels)}
+	for _, v := range pr.paramValues {
+		parts = append(parts, strconv.Quote(v))
+	}
+	if pr.stdin != nil {
+		parts = append(parts, fmt.Sprintf("%x", sha256.Sum256(pr.stdin)))
+	}
+	if pr.timeout > 0 {
+		parts = append(parts, "timeout="+pr.timeout.String())
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// scriptTimeout returns the timeout of a script for a probe request:
+// that of the script, or its adaptive timeout, unless the request asks
+// for a shorter one.
+func (pr *probeRequest) scriptTimeout(sc *config.ScriptConfig) time.Duration {
+	timeout := adaptiveTimeout(sc)
+	if pr.timeout > 0 && (timeout == 0 || pr.timeout < timeout) {
+		return pr.timeout
+	}
+	return timeout
+}
+
+// probeScript runs a script for a probe request and returns the
+// exposition that the probe serves. The exposition is valid even if
+// the script fails, in which case the error is returned as well, and
+// it contains only the success and duration metrics if the output
+// is ignored.
+func probeScript(sc *config.ScriptConfig, pr *probeRequest) (string, []outputDiagnostic, error) {
+	scriptStartTime := time.Now()
+	limits := getConfig().GetLimits(sc)
+	format := newOutputFormat(sc, pr, limits)
+	if sc.ResultChanges.Active || sc.CheckCounters || len(sc.Differential.Metrics) > 0 {
+		format.values = make(map[string]string)
+	}
+
+	formatedOutput := bufferPool.Get().(*bytes.Buffer)
+	formatedOutput.Reset()
+	defer putBuffer(formatedOutput)
+	var diags []outputDiagnostic
+	var attemptSpan *span
+	consume := func(r io.Reader) {
+		if pr.ignoreOutput && sc.Name != selfScriptName {
+			return
+		}
+		s := attemptSpan.child("parse")
+		diags = formatOutput(r, formatedOutput, format)
+		s.setAttr("diagnostics", int64(len(diags)))
+		s.end(nil)
+	}
+
+	// Failed runs are retried while there's time left, and every
+	// attempt gets what is left of the timeout, after the script
+	// got its locks.
+	var usage runner.Usage
+	history := newHistoryOutput()
+	var trace *runTrace
+	if sc.Name != selfScriptName {
+		trace = newRunTrace(getConfig())
+	}
+	var truncated bool
+	maxTimeout := pr.scriptTimeout(sc)
+	attempts, variant := 0, 0
+	var lockSpan *span
+	if len(sc.Locks) > 0 {
+		lockSpan = pr.span.child("lock")
+	}
+	release, lockErr := acquireLocks(pr.context(), sc, maxTimeout)
+	lockSpan.end(lockErr)
+	err := lockErr
+	for lockErr == nil {
+		timeout := maxTimeout
+		if timeout > 0 {
+			if timeout -= time.Since(scriptStartTime); timeout <= 0 {
+				// Waiting for the locks took all of the
+				// timeout, and the script never ran.
+				if attempts == 0 {
+					err = &runner.TimeoutError{Timeout: maxTimeout}
+					if len(sc.Locks) > 0 {
+						err = &lockError{lock: sc.Locks[len(sc.Locks)-1], timeout: maxTimeout}
+					}
+				}
+				break
+			}
+		}
+
+		attempts++
+		formatedOutput.Reset()
+		diags, format.truncated, format.dropped = nil, false, 0
+		history.reset()
+		trace.reset()
+		if format.values != nil {
+			format.values = make(map[string]string)
+		}
+		attemptSpan = pr.span.child("exec")
+		attemptSpan.setAttr("attempt", int64(attempts))
+		variant, truncated, err = runAttempt(sc, pr, timeout, limits.MaxOutputBytes, &usage, history, trace, consume)
+		attemptSpan.end(err)
+		if err == nil || attempts > sc.Retries || err == context.Canceled {
+			break
+		}
+		if maxTimeout > 0 && time.Since(scriptStartTime)+sc.RetryInterval >= maxTimeout {
+			break
+		}
+		log.Printf("Script %s failed, retrying: %s\n", sc.Name, err.Error())
+		time.Sleep(sc.RetryInterval)
+	}
+	if release != nil {
+		release()
+	}
+	if err == nil && truncated {
+		err = &outputTooLargeError{max: limits.MaxOutputBytes}
+	}
+
+	if err == nil && len(sc.Differential.Metrics) > 0 && !pr.canary {
+		diffs := differences(pr.key(sc.Name), scriptStartTime, differentialValues(sc.Differential.Metrics, format.values), sc.Differential.Mode == config.DifferentialRate)
+		writeDifferences(formatedOutput, sc, diffs)
+	}
+
+	// Scripts that repeat series or types would produce invalid
+	// exposition.
+	if err == nil && sc.Name != selfScriptName && !format.raw {
+		err = parser.Dedupe(formatedOutput, sc.DuplicateSeries)
+	}
+
+	if sc.Name == selfScriptName && err == nil && formatedOutput.String() != selfExpected {
+		err = errSelfMismatch
+	}
+
+	if !pr.canary {
+		recordRun(sc.Name, scriptStartTime, time.Since(scriptStartTime), err, history)
+	}
+	if err != nil && err != context.Canceled && trace != nil && attempts > 0 {
+		saveFailureBundle(getConfig(), sc, pr, trace, scriptStartTime, attempts, err)
+	}
+	if err != nil {
+		if !pr.canary {
+			checkFailureBudget(sc)
+		}
+		return fmt.Sprintf("%s\n%s\n%s_success{} %d\n%s\n%s\n%s_duration_seconds{} %f\n%s%s%s", scriptSuccessHelp, scriptSuccessType, namespace, 0, scriptDurationSecondsHelp, scriptDurationSecondsType, namespace, time.Since(scriptStartTime).Seconds(), failureMetrics(err), usageMetrics(&usage), attemptsMetric(sc, attempts)), nil, err
+	}
+
+	if pr.ignoreOutput {
+		return fmt.Sprintf("%s\n%s\n%s_success{} %d\n%s\n%s\n%s_duration_seconds{} %f\n%s%s", scriptSuccessHelp, scriptSuccessType, namespace, 1, scriptDurationSecondsHelp, scriptDurationSecondsType, namespace, time.Since(scriptStartTime).Seconds(), usageMetrics(&usage), attemptsMetric(sc, attempts)+variantMetric(sc, variant)), nil, nil
+	}
+
+	if !pr.canary {
+		recordDiagnostics(sc.Name, diags)
+	}
+
+	// Our own metrics about the output go before it.
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n%s_success{} %d\n%s\n%s\n%s_duration_seconds{} %f\n", scriptSuccessHelp, scriptSuccessType, namespace, 1, scriptDurationSecondsHelp, scriptDurationSecondsType, namespace, time.Since(scriptStartTime).Seconds())
+	b.WriteString(usageMetrics(&usage))
+	b.WriteString(attemptsMetric(sc, attempts))
+	b.WriteString(variantMetric(sc, variant))
+	if sc.ResultChanges.Active {
+		c := 0
+		if resultChanged(pr.key(sc.Name), format.values, sc.ResultChanges.Tolerance) {
+			c = 1
+		}
+		fmt.Fprintf(&b, "%s\n%s\n%s_result_changed{} %d\n", scriptResultChangedHelp, scriptResultChangedType, namespace, c)
+	}
+	if sc.CheckCounters {
+		c := 0
+		if series := counterDecreased(pr.key(sc.Name), counterValues(formatedOutput.String(), format.values)); series != "" {
+			log.Printf("Script %s: counter %s decreased since the previous run\n", sc.Name, strings.TrimSpace(series))
+			c = 1
+		}
+		fmt.Fprintf(&b, "%s\n%s\n%s_counter_reset_detected{} %d\n", scriptCounterResetHelp, scriptCounterResetType, namespace, c)
+	}
+	if sc.Metrics != nil {
+		fmt.Fprintf(&b, "%s\n%s\n%s_metrics_dropped_total{} %d\n", scriptMetricsDroppedHelp, scriptMetricsDroppedType, namespace, addDroppedMetrics(sc.Name, format.dropped))
+	}
+	if format.truncated {
+		log.Printf("Script %s: output truncated, it exceeds limits.maxSeries\n", sc.Name)
+		fmt.Fprintf(&b, "%s\n%s\n%s_output_truncated{} %d\n", scriptOutputTruncatedHelp, scriptOutputTruncatedType, namespace, 1)
+	}
+
+	return joinOutput(b.String(), formatedOutput), diags, nil
+}
+
+// joinOutput returns head followed by the formatted output in buf and
+// a newline. Output too large for buf to go back to the pool is moved
+// within buf instead of being copied, and the string shares the memory
+// of buf, which must not be used afterwards.
+func joinOutput(head string, buf *bytes.Buffer) string {
+	n := buf.Len()
+	if len(head)+n+1 <= maxPooledBufferBytes {
+		var b strings.Builder
+		b.Grow(len(head) + n + 1)
+		b.WriteString(head)
+		b.Write(buf.Bytes())
+		b.WriteByte('\n')
+		return b.String()
+	}
+
+	buf.WriteString(head)
+	buf.WriteByte('\n')
+	p := buf.Bytes()
+	copy(p[len(head):], p[:n])
+	copy(p, head)
+	return unsafe.String(unsafe.SliceData(p), len(p))
+}
+
+// newOutputFormat returns how the output of a script is formatted for
+// a probe request, with the given limits.
+func newOutputFormat(sc *config.ScriptConfig, pr *probeRequest, limits config.LimitsConfig) *outputFormat {
+	// The self-probe ignores prefixes and naming conventions, and
+	// fails if its output isn't formatted the way we expect.
+	if sc.Name == selfScriptName {
+		return &outputFormat{}
+	}
+	if sc.Format == config.FormatRaw {
+		return &outputFormat{raw: true}
+	}
+	return &outputFormat{
+		prefix:  pr.prefix,
+		enforce: sc.EnforcePrefix,
+		naming:  getConfig().GetNaming(sc.Name),
+		relabel: sc.Relabel,
+		metrics: sc.Metrics,
+		labels:  constantLabels(sc, pr.labels),
+
+		metadata: sc.Metadata,
+		units:    sc.UnitConversions(),
+
+		transform: sc.TransformTemplate(),
+
+		decimalComma: sc.DecimalComma,
+
+		timestamps:      sc.Timestamps,
+		maxTimestampAge: sc.MaxTimestampAge,
+
+		maxSeries: limits.MaxSeries,
+	}
+}
+
+// runAttempt runs a script once for a probe request and passes its
+// output to consume, keeping its start in history, and in trace along
+// with the start of its standard error if trace isn't nil. The output
+// of programs in the exposition format is formatted while they run, so
+// that large output is never held in memory as a whole; other output
+// is collected and converted first. If the script fails, its fallbacks
+// are tried in turn with what is left of the timeout, and the variant
+// that ran last is returned, 0 for the script itself.
+func runAttempt(sc *config.ScriptConfig, pr *probeRequest, timeout time.Duration, maxBytes int64, usage *runner.Usage, history *historyOutput, trace *runTrace, consume func(io.Reader)) (int, bool, error) {
+	start := time.Now()
+	s := &runner.Script{Config: sc, Params: pr.paramValues, Stdin: pr.stdin, Env: pr.env, Timeout: timeout, Context: pr.context(), MaxBytes: maxBytes, Usage: usage}
+	var stdout io.Writer = history
+	if trace != nil {
+		s.Stderr = trace
+		stdout = io.MultiWriter(history, &trace.stdout)
+	}
+	r := runner.Lookup(sc.Type)
+	if r == nil {
+		return 0, false, fmt.Errorf("no runner for type %s", sc.Type)
+	}
+	if st, ok := r.(runner.Streamer); ok && streamsOutput(sc) {
+		truncated, err := st.Stream(s, func(r io.Reader) {
+			r = io.TeeReader(r, stdout)
+			consume(r)
+			io.Copy(ioutil.Discard, r)
+		})
+		return 0, truncated, checkSuccess(sc, "", err)
+	}
+
+	var output string
+	var truncated bool
+	var err error
+	if sc.Name == selfScriptName {
+		output, truncated, err = runScript(runner.Command{Args: selfArgs()}, nil, timeout, maxBytes, usage)
+	} else if sc.Stream.Active {
+		output, err = streamBlock(s.Context, sc, timeout, maxBytes)
+	} else {
+		output, truncated, err = r.Run(s)
+	}
+	history.set(output)
+	trace.setStdout(output)
+	err = checkSuccess(sc, output, err)
+	variant := 0
+	for variant < len(sc.Fallbacks) && err != nil && err != context.Canceled {
+		if timeout > 0 {
+			if s.Timeout = timeout - time.Since(start); s.Timeout <= 0 {
+				break
+			}
+		}
+		variant++
+		log.Printf("Script %s failed, trying fallback %d: %s\n", sc.Name, variant, err.Error())
+		s.Config = fallbackConfig(sc, variant-1)
+		output, truncated, err = r.Run(s)
+		history.set(output)
+		trace.setStdout(output)
+		err = checkSuccess(sc, output, err)
+	}
+	output, err = convertOutput(sc, output, err)
+	if err == nil {
+		consume(strings.NewReader(output))
+	}
+	return variant, truncated, err
+}
+
+// fallbackConfig returns the configuration that runs a fallback of a
+// script: that of the script, with the fallback as its command and
+// no interpreter.
+func fallbackConfig(sc *config.ScriptConfig, i int) *config.ScriptConfig {
+	fc := *sc
+	fc.Script = sc.Fallbacks[i]
+	fc.Interpreter = ""
+	return &fc
+}
+
+// variantMetric returns which variant of a script produced the result
+// of a probe as the sample that probes serve, for scripts with
+// fallbacks.
+func variantMetric(sc *config.ScriptConfig, variant int) string {
+	if len(sc.Fallbacks) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s\n%s\n%s_variant{variant=\"%d\"} %d\n", scriptVariantHelp, scriptVariantType, namespace, variant, 1)
+}
+
+// failureMetrics returns why a probe failed, and the exit status of
+// the script if it exited with one, as the samples that failed probes
+// serve, so that alerts can tell failures apart without the logs.
+func failureMetrics(err error) string {
+	m := fmt.Sprintf("%s\n%s\n%s_error{reason=\"%s\"} %d\n", scriptErrorHelp, scriptErrorType, namespace, failureReason(err), 1)
+	if code := runner.ExitCode(err); code > 0 {
+		m += fmt.Sprintf("%s\n%s\n%s_exit_code{} %d\n", scriptExitCodeHelp, scriptExitCodeType, namespace, code)
+	}
+	return m
+}
+
+// attemptsMetric returns the number of attempts of a probe as the
+// sample that probes serve, for scripts that are retried.
+func attemptsMetric(sc *config.ScriptConfig, attempts int) string {
+	if sc.Retries == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s\n%s\n%s_attempts{} %d\n", scriptAttemptsHelp, scriptAttemptsType, namespace, attempts)
+}
+
+// streamsOutput reports whether the output of a script is formatted
+// while it runs, if its runner is a runner.Streamer. Scripts whose
+// success depends on their output need it as a whole, and so do those
+// with fallbacks, since the output of a failed run is discarded.
+func streamsOutput(sc *config.ScriptConfig) bool {
+	return sc.Name != selfScriptName && !isBuiltin(sc) && !sc.Stream.Active && len(sc.Fallbacks) == 0 && (sc.Format == config.FormatPrometheus || sc.Format == config.FormatRaw) && !sc.SuccessWhen.ChecksOutput()
+}
+
+// outputFormat holds everything that determines how the output of a
+// script is formatted.
+type outputFormat struct {
+	// raw output is passed through as it is.
+	raw bool
+
+	// prefix is prepended to the names of metrics; with enforce,
+	// only those not already starting with it are rewritten, or
+	// they are dropped.
+	prefix  string
+	enforce string
+	naming  *config.NamingConfig
+	relabel []*config.RelabelConfig
+
+	// metrics restricts the names of metrics, which formatOutput
+	// counts in dropped if it drops them.
+	metrics *config.MetricsFilterConfig
+	dropped int
+
+	// metadata is the help text and type of metrics, which
+	// formatOutput adds for metrics whose HELP or TYPE lines the
+	// output doesn't have.
+	metadata map[string]*config.MetricMetadataConfig
+
+	// units converts the samples of metrics that aren't in base
+	// units, and their HELP and TYPE lines, by name after relabeling.
+	units map[string]config.UnitConversion
+
+	// labels are added to every sample, replacing any labels of
+	// the sample with the same name.
+	labels []parser.Label
+
+	// transform replaces every sample with those it renders,
+	// unless it's nil.
+	transform *template.Template
+
+	// decimalComma rewrites a decimal comma in values to a dot.
+	decimalComma bool
+
+	// maxSeries is the maximum number of samples written, unless
+	// it's zero. formatOutput sets truncated if it dropped samples
+	// because of it.
+	maxSeries int
+	truncated bool
+
+	// timestamps is what happens to the timestamps of samples,
+	// with clamping to between maxTimestampAge ago and now.
+	timestamps      string
+	maxTimestampAge time.Duration
+
+	// If values is not nil, formatOutput records the value of
+	// every sample it writes in it, by series.
+	values map[string]string
+}
+
+// formatOutput filters, prefixes and relabels the raw output of a
+// script as it reads it, writes the metrics that will be served to
+// formatedOutput and returns diagnostics for every line that was
+// dropped.
+func formatOutput(output io.Reader, formatedOutput *bytes.Buffer, f *outputFormat) []outputDiagnostic {
+	if f.raw {
+		formatedOutput.ReadFrom(output)
+		return nil
+	}
+
+	prefix, naming := f.prefix, f.naming
+	re := getFormatRegexps(prefix)
+	regex1 := re.metric
+
+	var meta *metadataWriter
+	if len(f.metadata) > 0 {
+		meta = newMetadataWriter(f.metadata)
+	}
+
+	var diags []outputDiagnostic
+	var transformed map[string]float64
+	if f.transform != nil {
+		transformed = make(map[string]float64)
+	}
+	lineno, samples := 0, 0
+	scanner := bufio.NewScanner(output)
+	if getConfig().HighFrequency.Active {
+		sbuf := scanBufferPool.Get().(*[]byte)
+		defer scanBufferPool.Put(sbuf)
+		scanner.Buffer(*sbuf, bufio.MaxScanTokenSize)
+	}
+	for scanner.Scan() {
+		lineno++
+		metric := strings.Trim(scanner.Text(), " ")
+
+		if metric == "" {
+			// Do nothing
+		} else if metric[0:1] == "#" {
+			if len(f.units) > 0 {
+				metric = convertComment(metric, f.units)
+			}
+			if meta != nil && !meta.comment(metric) {
+				continue
+			}
+			formatedOutput.WriteString(strings.ToValidUTF8(metric, "\uFFFD"))
+			formatedOutput.WriteByte('\n')
+		} else {
+			// Metrics are put under the prefix, unless they
+			// already are and it's enforced.
+			switch {
+			case f.enforce != "" && strings.HasPrefix(metric, prefix):
+			case f.enforce == config.EnforcePrefixReject:
+				diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: fmt.Sprintf("not under the prefix %s", prefix)})
+				continue
+			default:
+				metric = prefix + metric
+			}
+
+			// Exemplars are kept apart, since the label set of
+			// the sample is matched greedily. Invalid ones
+			// would break OpenMetrics output, so they are
+			// dropped, but their samples are kept.
+			metric, exemplar := parser.SplitExemplar(metric)
+			if exemplar != "" && !parser.ValidExemplar(exemplar) {
+				exemplar = ""
+			}
+			metric = addLabelSet(metric)
+			metrics := regex1.FindAllString(metric, -1)
+			if len(metrics) != 1 {
+				diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "not of the form 'name{labels} value'", parse: true})
+				continue
+			}
+
+			// The series is the name and labels of the sample,
+			// followed by the whitespace before the value.
+			series := metrics[0]
+			name := series[:strings.Index(series, "{")]
+			if !parser.ValidMetricName(name) {
+				diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "invalid metric name", parse: true})
+				continue
+			}
+
+			// Label sets that would break the exposition, such
+			// as ones with unescaped quotes, are dropped, and
+			// invalid UTF-8 in label values is replaced.
+			labelSet := strings.TrimRight(series[len(name):], " \t")
+			labels, err := parser.ParseLabels(labelSet)
+			if err != nil {
+				diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: err.Error(), parse: true})
+				continue
+			}
+			if !utf8.ValidString(labelSet) {
+				for i := range labels {
+					labels[i].Value = strings.ToValidUTF8(labels[i].Value, "\uFFFD")
+				}
+				series = name + parser.FormatLabels(labels) + " "
+			}
+			if len(f.relabel) > 0 || len(f.labels) > 0 {
+				if len(f.relabel) > 0 {
+					var keep bool
+					name, labels, keep = parser.Relabel(name, labels, f.relabel)
+					if !keep {
+						diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "dropped by relabeling"})
+						continue
+					}
+				}
+				for _, l := range f.labels {
+					labels = parser.SetLabel(labels, l.Name, l.Value)
+				}
+				series = name + parser.FormatLabels(labels) + " "
+			}
+			conv, convert := f.units[name]
+			if convert {
+				name = conv.Name
+				series = name + parser.FormatLabels(labels) + " "
+			}
+
+			if !f.metrics.Allowed(name) {
+				f.dropped++
+				diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "not allowed by the metrics filter"})
+				continue
+			}
+
+			if naming != nil {
+				if err := naming.Check(name); err != nil {
+					diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: err.Error(), naming: true})
+					continue
+				}
+			}
+
+			value := metric[len(metrics[0]):]
+
+			// Values are parsed the way Prometheus parses them,
+			// so signs, exponents, NaN and infinities are fine.
+			fields := strings.Fields(value)
+			if len(fields) == 0 || len(fields) > 2 {
+				diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "invalid value", parse: true})
+				continue
+			}
+			if f.decimalComma && strings.Contains(fields[0], ",") {
+				fields[0] = strings.Replace(fields[0], ",", ".", 1)
+				value = strings.Join(fields, " ")
+			}
+			v, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "invalid value", parse: true})
+				continue
+			}
+			if convert {
+				v *= conv.Factor
+				fields[0] = strconv.FormatFloat(v, 'g', -1, 64)
+				value = strings.Join(fields, " ")
+			}
+
+			// Timestamps are in milliseconds.
+			if len(fields) == 2 {
+				ts, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil {
+					diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "invalid timestamp", parse: true})
+					continue
+				}
+				switch f.timestamps {
+				case config.TimestampsStrip:
+					value = fields[0]
+				case config.TimestampsClamp:
+					if c := clampTimestamp(ts, f.maxTimestampAge, time.Now()); c != ts {
+						value = fields[0] + " " + strconv.FormatInt(c, 10)
+					}
+				}
+			}
+
+			out := []outputSample{{name: name, series: series, value: value}}
+			if transformed != nil {
+				var timestamp string
+				if i := strings.IndexByte(value, ' '); i >= 0 {
+					timestamp = value[i+1:]
+				}
+				out, err = transformSample(f.transform, name, labels, v, timestamp, transformed)
+				transformed[name+parser.FormatLabels(labels)] = v
+				if err != nil {
+					diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: fmt.Sprintf("transform: %s", err)})
+					continue
+				}
+				if len(out) == 0 {
+					diags = append(diags, outputDiagnostic{line: lineno, text: metric, reason: "dropped by the transform"})
+					continue
+				}
+			}
+
+			for _, o := range out {
+				if f.maxSeries > 0 && samples >= f.maxSeries {
+					f.truncated = true
+					break
+				}
+				samples++
+				if f.values != nil {
+					f.values[o.series] = o.value
+				}
+				if meta != nil {
+					meta.sample(formatedOutput, o.name)
+				}
+				formatedOutput.WriteString(o.series)
+				formatedOutput.WriteString(o.value)
+				if exemplar != "" && o.name == name {
+					formatedOutput.WriteByte(' ')
+					formatedOutput.WriteString(exemplar)
+				}
+				formatedOutput.WriteByte('\n')
+			}
+		}
+	}
+
+	return diags
+}
+
+// addLabelSet returns a sample without labels, as in 'name value',
+// with an empty label set, which is how we write them.
+func addLabelSet(sample string) string {
+	i := strings.IndexAny(sample, " \t")
+	if i <= 0 || strings.ContainsRune(sample[:i], '{') || strings.HasPrefix(strings.TrimLeft(sample[i:], " \t"), "{") {
+		return sample
+	}
+	return sample[:i] + "{}" + sample[i:]
+}
+
+// convertComment renames the metric of a HELP or TYPE line if its
+// samples are converted to another unit.
+func convertComment(line string, units map[string]config.UnitConversion) string {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" || (fields[1] != "HELP" && fields[1] != "TYPE") {
+		return line
+	}
+	if conv, ok := units[fields[2]]; ok {
+		fields[2] = conv.Name
+		return strings.Join(fields, " ")
+	}
+	return line
+}
+
+// writeDifferences writes the changes of the samples of the metrics of
+// a script with differential output as gauges, by series.
+func writeDifferences(w *bytes.Buffer, sc *config.ScriptConfig, diffs map[string]float64) {
+	series := make([]string, 0, len(diffs))
+	for s := range diffs {
+		series = append(series, s)
+	}
+	sort.Strings(series)
+
+	family := ""
+	for _, s := range series {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			continue
+		}
+		name := sc.DifferentialName(s[:i])
+		if name != family {
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			family = name
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, s[i:], strconv.FormatFloat(diffs[s], 'g', -1, 64))
+	}
+}
+
+// clampTimestamp clamps a timestamp in milliseconds to between maxAge
+// before now and now.
+func clampTimestamp(ts int64, maxAge time.Duration, now time.Time) int64 {
+	max := now.UnixNano() / int64(time.Millisecond)
+	min := now.Add(-maxAge).UnixNano() / int64(time.Millisecond)
+	if ts > max {
+		return max
+	}
+	if ts < min {
+		return min
+	}
+	return ts
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// httpError is returned by fetchScript if the endpoint answers with
+// something other than 200.
+type httpError struct {
+	status string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %s", e.status)
+}
+
+// fetchScript gets the output of a http script by fetching its URL,
+// over its unix socket if it has one. The output then goes through
+// the same formatting as the output of an executed program, and the
+// same limit on its size applies.
+func fetchScript(sc *config.ScriptConfig, timeout time.Duration, maxBytes int64) (string, bool, error) {
+	client := &http.Client{Timeout: timeout}
+	if sc.Socket != "" {
+		socket := sc.Socket
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+
+	resp, err := client.Get(sc.URL)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false, &httpError{status: resp.Status}
+	}
+
+	var body bytes.Buffer
+	w := runner.NewLimitedWriter(&body, maxBytes)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return "", false, err
+	}
+	w.Flush()
+
+	return body.String(), w.Truncated(), nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is how long a proxy may take to send the
+	// PROXY protocol header of a connection.
+	proxyHeaderTimeout = 10 * time.Second
+
+	// maxProxyV1Header is the longest header of version 1.
+	maxProxyV1Header = 107
+)
+
+// proxyV2Signature starts headers of version 2 of the PROXY protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A proxyListener is a listener whose connections from trusted
+// proxies, and over unix sockets, start with a PROXY protocol header
+// if the running configuration wants that.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := getConfig()
+	if !c.Access.ProxyProtocol {
+		return conn, nil
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !c.Access.TrustedProxies.Contains(addr.IP) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// A proxyConn is a connection that starts with a PROXY protocol
+// header, whose address is the remote address of the connection. The
+// header is read when the connection is first used, so that slow
+// proxies don't hold up accepting connections.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once sync.Once
+	addr net.Addr
+	err  error
+}
+
+func (c *proxyConn) header() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.addr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("Invalid PROXY protocol header from %s: %s\n", c.Conn.RemoteAddr(), c.err.Error())
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.header()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client from the header, or
+// that of the proxy if the header has none.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.header()
+	if c.addr != nil {
+		return c.addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header of version 1 or 2 and
+// returns the source address in it. The address is nil for
+// connections that the proxy made itself, or that aren't over TCP.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] == 'P' {
+		return readProxyV1Header(r)
+	}
+	return readProxyV2Header(r)
+}
+
+// readProxyV1Header reads a header of version 1, which is a line like
+// "PROXY TCP4 <source> <destination> <source port> <destination port>".
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Header && !bytes.HasSuffix(line, []byte("\r\n")) {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("header is too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("no PROXY protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("invalid source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a binary header of version 2. Its TLVs are
+// skipped.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:12], proxyV2Signature) || h[12]>>4 != 2 {
+		return nil, errors.New("no PROXY protocol header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch h[12] & 0xf {
+	case 0:
+		// LOCAL: a connection of the proxy itself, such as a
+		// health check.
+		return nil, nil
+	case 1:
+	default:
+		return nil, errors.New("unknown command")
+	}
+	switch h[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("invalid source address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("invalid source address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// proxyV2Header returns a header of version 2 with the command, the
+// family and protocol byte, and the address block.
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x20|command, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+// proxyV2Addrs returns the address block of a header of version 2 for
+// a source and destination address of the same family.
+func proxyV2Addrs(src, dst net.IP, srcPort, dstPort uint16, tlvs []byte) []byte {
+	var b []byte
+	b = append(b, src...)
+	b = append(b, dst...)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	b = binary.BigEndian.AppendUint16(b, dstPort)
+	return append(b, tlvs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := proxyV2Addrs(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4(), 51234, 9469, nil)
+	ipv6 := proxyV2Addrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 51234, 9469, nil)
+	tlv := []byte{0x04, 0x00, 0x03, 'a', 'b', 'c'}
+
+	tests := []struct {
+		name    string
+		header  []byte
+		addr    string
+		wantErr bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 51234 9469\r\n"), "192.0.2.1:51234", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51234 9469\r\n"), "[2001:db8::1]:51234", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", false},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 51234"), "", true},
+		{"v1 without crlf", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 51234 9469\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n"), "", true},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 51234 9469\r\n"), "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 51234\r\n"), "", true},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2 192.0.2.2 51234 9469\r\n"), "", true},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 9469\r\n"), "", true},
+		{"no header", []byte("GET /metrics HTTP/1.1\r\n\r\n"), "", true},
+		{"empty", nil, "", true},
+		{"v2 tcp4", proxyV2Header(1, 0x11, ipv4), "192.0.2.1:51234", false},
+		{"v2 udp4", proxyV2Header(1, 0x12, ipv4), "192.0.2.1:51234", false},
+		{"v2 tcp6", proxyV2Header(1, 0x21, ipv6), "[2001:db8::1]:51234", false},
+		{"v2 with tlvs", proxyV2Header(1, 0x11, append(append([]byte(nil), ipv4...), tlv...)), "192.0.2.1:51234", false},
+		{"v2 local", proxyV2Header(0, 0x11, ipv4), "", false},
+		{"v2 local without addresses", proxyV2Header(0, 0x00, nil), "", false},
+		{"v2 unspecified family", proxyV2Header(1, 0x00, nil), "", false},
+		{"v2 unix", proxyV2Header(1, 0x31, make([]byte, 216)), "", false},
+		{"v2 unknown family", proxyV2Header(1, 0x51, ipv4), "", false},
+		{"v2 unknown command", proxyV2Header(2, 0x11, ipv4), "", true},
+		{"v2 unknown version", append(append([]byte(nil), proxyV2Signature...), 0x31, 0x11, 0, 12), "", true},
+		{"v2 wrong signature", append([]byte("\r\n\r\n\x00\r\nQUIT\r"), 0x21, 0x11, 0, 0), "", true},
+		{"v2 truncated signature", proxyV2Signature[:8], "", true},
+		{"v2 truncated addresses", proxyV2Header(1, 0x11, ipv4)[:20], "", true},
+		{"v2 short tcp4 addresses", proxyV2Header(1, 0x11, ipv4[:8]), "", true},
+		{"v2 short tcp6 addresses", proxyV2Header(1, 0x21, ipv4), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Truncated headers are the end of the connection.
+			data := tt.header
+			if !tt.wantErr {
+				data = append(append([]byte(nil), data...), "GET / HTTP/1.1\r\n"...)
+			}
+			r := bufio.NewReader(bytes.NewReader(data))
+			addr, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got string
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.addr {
+				t.Errorf("readProxyHeader() = %q, want %q", got, tt.addr)
+			}
+			// The request after the header is left to be read.
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("read after the header = %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	loopback := config.Networks{{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}}
+	other := config.Networks{{IP: net.IPv4(192, 0, 2, 0).To4(), Mask: net.CIDRMask(24, 32)}}
+
+	tests := []struct {
+		name    string
+		proxy   bool
+		trusted config.Networks
+		send    string
+		addr    string
+		read    string
+	}{
+		{"trusted proxy", true, loopback, "PROXY TCP4 192.0.2.1 127.0.0.1 51234 9469\r\nhello", "192.0.2.1:51234", "hello"},
+		{"untrusted source", true, other, "PROXY TCP4 192.0.2.1 127.0.0.1 51234 9469\r\nhello", "127.0.0.1", "PROXY TCP4"},
+		{"proxy protocol off", false, loopback, "PROXY TCP4 192.0.2.1 127.0.0.1 51234 9469\r\nhello", "127.0.0.1", "PROXY TCP4"},
+		{"local connection of the proxy", true, loopback, string(proxyV2Header(0, 0x00, nil)) + "hello", "127.0.0.1", "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config.Config{}
+			c.Access.ProxyProtocol = tt.proxy
+			c.Access.TrustedProxies = tt.trusted
+			previous := getConfig()
+			currentConfig.Store(c)
+			defer currentConfig.Store(previous)
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte(tt.send)); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := proxyListener{ln}.Accept()
+			if err != nil {
+				t.Fatalf("Accept() error = %v", err)
+			}
+			defer conn.Close()
+			if got := conn.RemoteAddr().String(); !strings.HasPrefix(got, tt.addr) {
+				t.Errorf("RemoteAddr() = %s, want %s", got, tt.addr)
+			}
+			b := make([]byte, len(tt.read))
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != tt.read {
+				t.Errorf("Read() = %q, %v, want %q", b, err, tt.read)
+			}
+		})
+	}
+}
+
+func TestProxyConnInvalidHeader(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &proxyConn{Conn: server, r: bufio.NewReader(server)}
+	defer conn.Close()
+	go client.Write([]byte("GET /metrics HTTP/1.1\r\n\r\n"))
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Read() after an invalid header succeeded")
+	}
+	if got := conn.RemoteAddr(); got != server.RemoteAddr() {
+		t.Errorf("RemoteAddr() = %v, want the address of the proxy", got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// A tokenBucket holds the tokens of a rate limit, as of the last time
+// it was used.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	// The buckets of the rate limits of scripts by name, and of
+	// the global rate limit as "".
+	rateLimitMu sync.Mutex
+	rateBuckets = make(map[string]*tokenBucket)
+
+	requestsThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "requests_throttled_total",
+			Help:      "Total requests to a script rejected by rate limits.",
+		},
+		[]string{"script"})
+)
+
+// refill adds the tokens that a bucket has earned since it was last
+// used and returns how long it takes until it has a whole one, which
+// is zero if it has one now. New buckets start out full. Since the
+// rate limit comes from the running configuration, changes to it take
+// effect on reloads.
+func (b *tokenBucket) refill(rl config.RateLimitConfig, now time.Time) time.Duration {
+	if b.last.IsZero() {
+		b.tokens = float64(rl.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rl.Rate
+	}
+	b.tokens = math.Min(b.tokens, float64(rl.Burst))
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rl.Rate * float64(time.Second))
+}
+
+// throttle takes a token for a probe request to a script from the
+// global and the script's rate limits. If either has none left, it
+// takes nothing and returns how long to wait before trying again.
+func throttle(c *config.Config, sc *config.ScriptConfig, now time.Time) time.Duration {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	var taken []*tokenBucket
+	var wait time.Duration
+	for _, l := range []struct {
+		key string
+		rl  config.RateLimitConfig
+	}{{"", c.RateLimit}, {sc.Name, sc.RateLimit}} {
+		if l.rl.Rate == 0 {
+			continue
+		}
+		b := rateBuckets[l.key]
+		if b == nil {
+			b = &tokenBucket{}
+			rateBuckets[l.key] = b
+		}
+		if w := b.refill(l.rl, now); w > wait {
+			wait = w
+		}
+		taken = append(taken, b)
+	}
+
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range taken {
+		b.tokens--
+	}
+	return 0
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+const (
+	// registryFetchTimeout is how long reading the keys of a
+	// registry may take.
+	registryFetchTimeout = 30 * time.Second
+
+	// maxRegistryBytes is the largest answer of a registry we
+	// read.
+	maxRegistryBytes = 32 * 1024 * 1024
+)
+
+var registryFetchSuccessful = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "scripts",
+		Name:      "registry_last_fetch_successful",
+		Help:      "Whether the last attempt to fetch the scripts of the registry was successful.",
+	})
+
+// startRegistry fetches the scripts of the registry of the running
+// configuration in the background, every interval of the registry,
+// and reloads the configuration file when they change. Scripts that
+// were fetched before are served in the meantime, and when the
+// registry can't be reached.
+func startRegistry(file string) {
+	go func() {
+		for {
+			r := getConfig().Registry
+			if r.Type == "" {
+				time.Sleep(30 * time.Second)
+				continue
+			}
+			changed, err := syncRegistry(file, &r)
+			if err != nil {
+				log.Printf("Failed to fetch registry %s: %s\n", r.URL, err.Error())
+				registryFetchSuccessful.Set(0)
+			} else {
+				registryFetchSuccessful.Set(1)
+				if changed {
+					log.Printf("Scripts of registry %s changed\n", r.URL)
+					reloadConfig(file)
+				}
+			}
+			time.Sleep(r.Interval)
+		}
+	}()
+}
+
+// syncRegistry reads the keys under the prefix of a registry into its
+// directory, one file per key, and reports whether any of them
+// changed, was added or was removed. The values are written to a new
+// directory next to it first, with which the configuration file has
+// to load as on a reload, and which then replaces the directory, so
+// that invalid values never replace those that were fetched before,
+// which would be loaded when the exporter starts.
+func syncRegistry(file string, r *config.RegistryConfig) (bool, error) {
+	var values map[string][]byte
+	var err error
+	switch r.Type {
+	case config.RegistryConsul:
+		values, err = fetchConsul(r)
+	case config.RegistryEtcd:
+		values, err = fetchEtcd(r)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	parent := filepath.Dir(r.Directory)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempDir(parent, "."+filepath.Base(r.Directory)+"-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return false, err
+	}
+
+	files := make(map[string]bool)
+	changed := false
+	for key, value := range values {
+		name := strings.Trim(strings.TrimPrefix(key, r.Prefix), "/")
+		if name == "" || len(value) == 0 {
+			continue
+		}
+		f := url.PathEscape(name) + config.RegistryFileSuffix
+		files[f] = true
+		if err := ioutil.WriteFile(filepath.Join(tmp, f), value, 0644); err != nil {
+			return false, err
+		}
+		if old, err := ioutil.ReadFile(filepath.Join(r.Directory, f)); err != nil || !bytes.Equal(old, value) {
+			changed = true
+		}
+	}
+	old, err := filepath.Glob(filepath.Join(r.Directory, "*"+config.RegistryFileSuffix))
+	if err != nil {
+		return false, err
+	}
+	for _, path := range old {
+		if !files[filepath.Base(path)] {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	c := &config.Config{}
+	err = c.LoadRegistryConfig(file, tmp)
+	if err == nil {
+		if errs := checkScripts(c); len(errs) > 0 {
+			err = config.Errors(errs)
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("keeping the scripts fetched before, since the configuration doesn't load with the new ones: %s", err)
+	}
+
+	prev := tmp + ".old"
+	if err := os.Rename(r.Directory, prev); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	defer os.RemoveAll(prev)
+	if err := os.Rename(tmp, r.Directory); err != nil {
+		os.Rename(prev, r.Directory)
+		return false, err
+	}
+	return true, nil
+}
+
+// fetchConsul returns the values of the keys under the prefix of a
+// Consul registry.
+func fetchConsul(r *config.RegistryConfig) (map[string][]byte, error) {
+	u := strings.TrimSuffix(r.URL, "/") + "/v1/kv/" + strings.TrimPrefix(r.Prefix, "/") + "?recurse=true"
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		req.Header.Set("X-Consul-Token", r.Token)
+	}
+	data, err := registryRequest(req)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var pairs []struct {
+		Key   string
+		Value []byte
+	}
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(pairs))
+	for _, p := range pairs {
+		values[p.Key] = p.Value
+	}
+	return values, nil
+}
+
+// fetchEtcd returns the values of the keys under the prefix of an etcd
+// registry, through the JSON gateway of its v3 API.
+func fetchEtcd(r *config.RegistryConfig) (map[string][]byte, error) {
+	body, err := json.Marshal(struct {
+		Key      []byte `json:"key"`
+		RangeEnd []byte `json:"range_end"`
+	}{[]byte(r.Prefix), prefixEnd(r.Prefix)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(r.URL, "/")+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Token != "" {
+		req.Header.Set("Authorization", r.Token)
+	}
+	data, err := registryRequest(req)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var res struct {
+		KVs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(res.KVs))
+	for _, kv := range res.KVs {
+		values[string(kv.Key)] = kv.Value
+	}
+	return values, nil
+}
+
+// prefixEnd returns the end of the range of etcd keys that start with
+// prefix, which is every key if prefix is empty.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// registryRequest makes a request to a registry and returns the body
+// of its answer, or nil if nothing was found.
+func registryRequest(req *http.Request) ([]byte, error) {
+	req.Header.Set("User-Agent", "script_exporter")
+	client := &http.Client{Timeout: registryFetchTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, errors.New(res.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRegistryBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRegistryBytes {
+		return nil, fmt.Errorf("larger than %d bytes", maxRegistryBytes)
+	}
+	return data, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// The running configuration is replaced as a whole on reload, and is
+// never modified once it has been loaded. Code that needs several
+// settings that have to be consistent with each other should call
+// getConfig() once and use the result.
+var (
+	currentConfig atomic.Value
+	reloadMu      sync.Mutex
+)
+
+// Metrics about loading the configuration, following those of
+// Prometheus itself.
+var (
+	configReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "scripts",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	configReloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "scripts",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	currentConfig.Store(&config.Config{})
+}
+
+// getConfig returns the running configuration.
+func getConfig() *config.Config {
+	return currentConfig.Load().(*config.Config)
+}
+
+// loadConfig loads the configuration file and makes it the running
+// configuration. If it can't be loaded, the running configuration
+// stays unchanged. Canary scripts whose command changed are run
+// first, and keep their running definition if that fails.
+func loadConfig(file string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	c := &config.Config{}
+	err := c.LoadConfig(file)
+	if err == nil {
+		if errs := checkScripts(c); len(errs) > 0 {
+			err = config.Errors(errs)
+		}
+	}
+	var labels []parser.Label
+	if err == nil {
+		if labels, err = resolveNodeLabels(c); err != nil {
+			err = fmt.Errorf("nodeLabels: %s", err)
+		}
+	}
+	if err != nil {
+		configReloadSuccessful.Set(0)
+		return err
+	}
+
+	runCanaries(getConfig(), c)
+	nodeLabels.Store(labels)
+	currentConfig.Store(c)
+	configLoaded.Store(true)
+	setupHighFrequency()
+	stopResidents()
+	restartWorkers(c)
+	runStartupChecks(c)
+	configReloadSuccessful.Set(1)
+	configReloadSuccessTime.SetToCurrentTime()
+	return nil
+}
+
+// reloadConfig reloads the configuration file and logs the outcome.
+func reloadConfig(file string) error {
+	if err := loadConfig(file); err != nil {
+		log.Printf("Failed to reload configuration: %s\n", err.Error())
+		return err
+	}
+
+	log.Printf("Reloaded configuration from %s\n", file)
+	return nil
+}
+
+// handleReloadSignals reloads the configuration file whenever we
+// receive a SIGHUP.
+func handleReloadSignals(file string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			reloadConfig(file)
+		}
+	}()
+}
+
+// reloadHandler reloads the configuration file on a POST to /-/reload,
+// following the convention of Prometheus itself.
+func reloadHandler(file string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := reloadConfig(file); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to reload configuration: %s", err.Error()), http.StatusInternalServerError)
+		}
+	}
+}
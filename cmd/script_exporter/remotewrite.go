@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// remoteWriteQueueSize bounds the number of results waiting to be
+// sent, so that an unreachable endpoint can't make us use up memory.
+const remoteWriteQueueSize = 100
+
+var remoteWriteQueue = make(chan []byte, remoteWriteQueueSize)
+
+// staleNaN is the value of staleness markers: the NaN that Prometheus
+// writes to mark a series that ended.
+const staleNaN = 0x7ff0000000000002
+
+// remoteWriteSeries are the series of the last run of every script
+// whose results were sent, by their formatted label sets, so that we
+// can mark the ones that vanish as stale.
+var (
+	remoteWriteSeriesMu sync.Mutex
+	remoteWriteSeries   = make(map[string]map[string][]parser.Label)
+)
+
+// A rwSeries is a sample for remote write, with its labels sorted
+// by name and including the metric name as __name__.
+type rwSeries struct {
+	labels    []parser.Label
+	value     float64
+	timestamp int64
+}
+
+// startRemoteWrite starts sending queued results to the remote write
+// endpoint. It reads the configuration for every request, so that
+// reloads take effect.
+func startRemoteWrite() {
+	go func() {
+		for body := range remoteWriteQueue {
+			sendRemoteWrite(&getConfig().RemoteWrite, body)
+		}
+	}()
+}
+
+// queueRemoteWrite converts the output of a run of a script to a
+// remote write request and queues it for sending, with staleness
+// markers for the series of the previous run that this one doesn't
+// have, like Prometheus adds when it scrapes. Results are dropped if
+// the queue is full.
+func queueRemoteWrite(scriptName, output string, start time.Time) {
+	rw := &getConfig().RemoteWrite
+	series := parseSeries(output, start)
+	for i := range series {
+		labels := series[i].labels
+		if parser.GetLabel(labels, "script") == "" {
+			labels = append(labels, parser.Label{Name: "script", Value: scriptName})
+		}
+		for name, value := range rw.ExternalLabels {
+			if parser.GetLabel(labels, name) == "" {
+				labels = append(labels, parser.Label{Name: name, Value: value})
+			}
+		}
+		sort.SliceStable(labels, func(a, b int) bool { return labels[a].Name < labels[b].Name })
+		series[i].labels = labels
+	}
+
+	current := make(map[string][]parser.Label, len(series))
+	for _, s := range series {
+		current[parser.FormatLabels(s.labels)] = s.labels
+	}
+	remoteWriteSeriesMu.Lock()
+	previous := remoteWriteSeries[scriptName]
+	remoteWriteSeries[scriptName] = current
+	remoteWriteSeriesMu.Unlock()
+
+	queueSeries(scriptName, append(series, staleMarkers(previous, current, start)...))
+}
+
+// queueStaleMarkers queues staleness markers for all series of the
+// last run of a script whose results were sent, and forgets them, for
+// scripts that aren't run any more.
+func queueStaleMarkers(scriptName string, now time.Time) {
+	remoteWriteSeriesMu.Lock()
+	previous := remoteWriteSeries[scriptName]
+	delete(remoteWriteSeries, scriptName)
+	remoteWriteSeriesMu.Unlock()
+
+	if stale := staleMarkers(previous, nil, now); len(stale) > 0 {
+		queueSeries(scriptName, stale)
+	}
+}
+
+// staleMarkers returns staleness markers at now for the series of
+// previous that aren't in current.
+func staleMarkers(previous, current map[string][]parser.Label, now time.Time) []rwSeries {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	var stale []rwSeries
+	for key, labels := range previous {
+		if _, ok := current[key]; !ok {
+			stale = append(stale, rwSeries{labels: labels, value: math.Float64frombits(staleNaN), timestamp: ts})
+		}
+	}
+	return stale
+}
+
+// queueSeries queues a remote write request with the series of a
+// script for sending, or drops it if the queue is full.
+func queueSeries(scriptName string, series []rwSeries) {
+	select {
+	case remoteWriteQueue <- snappyEncode(encodeWriteRequest(series)):
+	default:
+		log.Printf("Remote write queue is full, dropping results of script %s\n", scriptName)
+	}
+}
+
+// parseSeries parses formatted probe output into series. Samples
+// without a timestamp get the given time.
+func parseSeries(output string, now time.Time) []rwSeries {
+	var series []rwSeries
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		sample, _ := parser.SplitExemplar(line)
+		i := strings.Index(sample, "{")
+		j := strings.LastIndex(sample, "}")
+		if i <= 0 || j < i {
+			continue
+		}
+		labels, err := parser.ParseLabels(sample[i : j+1])
+		if err != nil {
+			continue
+		}
+		rest := strings.Fields(sample[j+1:])
+		if len(rest) == 0 || len(rest) > 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(rest[0], 64)
+		if err != nil {
+			continue
+		}
+		ts := now.UnixNano() / int64(time.Millisecond)
+		if len(rest) == 2 {
+			if ts, err = strconv.ParseInt(rest[1], 10, 64); err != nil {
+				continue
+			}
+		}
+
+		labels = append([]parser.Label{{Name: "__name__", Value: sample[:i]}}, labels...)
+		series = append(series, rwSeries{labels: labels, value: value, timestamp: ts})
+	}
+	return series
+}
+
+// sendRemoteWrite sends a remote write request, retrying it with
+// exponential backoff if the endpoint fails or asks us to.
+func sendRemoteWrite(rw *config.RemoteWriteConfig, body []byte) {
+	if rw.URL == "" {
+		return
+	}
+
+	backoff := rw.MinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := postRemoteWrite(rw, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= rw.MaxRetries {
+			log.Printf("Remote write failed, dropping results: %s\n", err.Error())
+			return
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > rw.MaxBackoff {
+			backoff = rw.MaxBackoff
+		}
+	}
+}
+
+// postRemoteWrite makes a single remote write request. It reports
+// whether the request may be retried if it failed, which is the case
+// for server errors and when we are rate limited.
+func postRemoteWrite(rw *config.RemoteWriteConfig, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, rw.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "script_exporter")
+	for k, v := range rw.Headers {
+		req.Header.Set(k, v)
+	}
+	if rw.BasicAuth.Username != "" {
+		req.SetBasicAuth(rw.BasicAuth.Username, rw.BasicAuth.Password)
+	}
+	if rw.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rw.BearerToken)
+	}
+
+	client := &http.Client{Timeout: rw.Timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		err := fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+		return res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return false, nil
+}
+
+// encodeWriteRequest encodes series as a remote write WriteRequest
+// protobuf message:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []rwSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = appendProtoBytes(lb, 1, []byte(l.Name))
+			lb = appendProtoBytes(lb, 2, []byte(l.Value))
+			ts = appendProtoBytes(ts, 1, lb)
+		}
+
+		var sb []byte
+		sb = binary.AppendUvarint(sb, 1<<3|1)
+		sb = binary.LittleEndian.AppendUint64(sb, math.Float64bits(s.value))
+		sb = binary.AppendUvarint(sb, 2<<3|0)
+		sb = binary.AppendUvarint(sb, uint64(s.timestamp))
+		ts = appendProtoBytes(ts, 2, sb)
+
+		req = appendProtoBytes(req, 1, ts)
+	}
+	return req
+}
+
+// appendProtoBytes appends a length-delimited protobuf field.
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// snappyEncode encodes data in the snappy block format that remote
+// write requires. It only writes literals, which doesn't compress the
+// data but is valid snappy, and saves us a dependency.
+func snappyEncode(data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 65536 {
+			n = 65536
+		}
+		switch {
+		case n <= 60:
+			b = append(b, byte(n-1)<<2)
+		case n <= 1<<8:
+			b = append(b, 60<<2, byte(n-1))
+		default:
+			b = append(b, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		b = append(b, data[:n]...)
+		data = data[n:]
+	}
+	return b
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// The runners of the built-in script types. Scripts of the types that
+// run commands are all run by a commandRunner, which knows how to run
+// them from their type.
+func init() {
+	for _, t := range []string{config.TypeExec, config.TypeDocker, config.TypeKubernetes, config.TypeSSH} {
+		runner.Register(t, commandRunner{})
+	}
+	runner.Register(config.TypeHTTP, runner.Func(func(s *runner.Script) (string, bool, error) {
+		return fetchScript(s.Config, s.Timeout, s.MaxBytes)
+	}))
+	runner.Register(config.TypeStarlark, runner.Func(func(s *runner.Script) (string, bool, error) {
+		output, err := runStarlark(s.Config, s.Params, s.Stdin, s.Timeout, s.MaxBytes)
+		return output, false, err
+	}))
+	runner.Register(config.TypeFile, runner.Func(func(s *runner.Script) (string, bool, error) {
+		return readOutputFile(s.Config, s.Params, s.MaxBytes)
+	}))
+}
+
+// A commandRunner runs scripts that are command lines, and the
+// built-in checks.
+type commandRunner struct{}
+
+func (commandRunner) Run(s *runner.Script) (string, bool, error) {
+	if isBuiltin(s.Config) {
+		args, err := scriptArgs(s.Context, s.Config, s.Params, s.Timeout)
+		if err != nil {
+			return "", false, err
+		}
+		output, err := runBuiltin(args, s.Timeout)
+		return output, false, err
+	}
+
+	c, timeout, err := probeCommand(s)
+	if err != nil {
+		return "", false, err
+	}
+	return runScriptContext(s.Context, c, s.Stdin, timeout, s.MaxBytes, s.Usage)
+}
+
+func (commandRunner) Stream(s *runner.Script, consume func(io.Reader)) (bool, error) {
+	c, timeout, err := probeCommand(s)
+	if err != nil {
+		return false, err
+	}
+	return streamScript(s.Context, c, s.Stdin, timeout, s.MaxBytes, s.Usage, consume)
+}
+
+// probeCommand returns the command that runs a script for a probe,
+// and what is left of the timeout of the probe once it's known where
+// to run it, which for kubernetes scripts takes looking up a pod.
+func probeCommand(s *runner.Script) (runner.Command, time.Duration, error) {
+	start := time.Now()
+	c, err := scriptCommand(s.Context, s.Config, s.Params, s.Timeout)
+	if err != nil {
+		return runner.Command{}, 0, err
+	}
+	timeout := s.Timeout
+	if timeout > 0 {
+		if timeout -= time.Since(start); timeout <= 0 {
+			return runner.Command{}, 0, &runner.TimeoutError{Timeout: s.Timeout}
+		}
+	}
+	c.Env = append(c.Env, s.Env...)
+	c.Stderr = s.Stderr
+	return c, timeout, nil
+}
+
+// scriptArgs returns the command line that runs a script with
+// parameters, depending on its type and whether it's run with sudo.
+// Finding out where to run the script may involve running other
+// commands, within timeout and until ctx is done, which can fail.
+func scriptArgs(ctx context.Context, sc *config.ScriptConfig, paramValues []string, timeout time.Duration) ([]string, error) {
+	args := append(sc.Command(), paramValues...)
+	if sudo := sc.SudoArgs(); sudo != nil {
+		args = append(sudo, args...)
+	}
+	switch sc.Type {
+	case config.TypeDocker:
+		return dockerArgs(sc.Docker, args, sc.Stdin != nil), nil
+	case config.TypeKubernetes:
+		return kubernetesArgs(ctx, sc.Kubernetes, args, sc.Stdin != nil, timeout)
+	case config.TypeSSH:
+		return sshArgs(sc.SSH, args, sc.Stdin != nil), nil
+	}
+	return args, nil
+}
+
+// templateArgs renders the templated arguments of a script with the
+// parameters of a probe request, followed by those of its paramsToArgs.
+// Since every template becomes one argument, parameters can't add
+// arguments of their own; to keep them from being taken as options,
+// an argument may only start with '-' if its template does, and none
+// may contain control characters.
+func templateArgs(sc *config.ScriptConfig, params url.Values) ([]string, error) {
+	templates := sc.ArgTemplates()
+	if len(templates) == 0 {
+		return paramArgs(sc, params)
+	}
+
+	data := make(map[string]string, len(params))
+	for name, values := range params {
+		if len(values) > 0 {
+			data[name] = values[0]
+		}
+	}
+
+	args := make([]string, 0, len(templates))
+	for i, t := range templates {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		arg := b.String()
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(sc.Args[i], "-") {
+			return nil, fmt.Errorf("argument %d may not start with '-'", i+1)
+		}
+		if strings.IndexFunc(arg, unicode.IsControl) >= 0 {
+			return nil, fmt.Errorf("argument %d contains control characters", i+1)
+		}
+		args = append(args, arg)
+	}
+	mapped, err := paramArgs(sc, params)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, mapped...), nil
+}
+
+// paramArgs returns the arguments that the paramsToArgs of a script
+// map the parameters of a probe request to, after checking their
+// values.
+func paramArgs(sc *config.ScriptConfig, params url.Values) ([]string, error) {
+	var args []string
+	for _, p := range sc.ParamsToArgs {
+		values := params[p.Param]
+		if len(values) == 0 && p.Required {
+			return nil, fmt.Errorf("parameter %s is missing", p.Param)
+		}
+		for _, v := range values {
+			if !p.Matches(v) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+				return nil, fmt.Errorf("invalid value for parameter %s", p.Param)
+			}
+			switch {
+			case p.Flag == "":
+				args = append(args, v)
+			case strings.HasSuffix(p.Flag, "="):
+				args = append(args, p.Flag+v)
+			default:
+				args = append(args, p.Flag, v)
+			}
+		}
+	}
+	return args, nil
+}
+
+// scriptCommand returns the command that runs a script with
+// parameters, and with the environment variables of the script, like
+// scriptArgs with ctx and timeout.
+// Programs of scripts with process settings that we can't apply to
+// them directly are started through the __exec__ command.
+func scriptCommand(ctx context.Context, sc *config.ScriptConfig, paramValues []string, timeout time.Duration) (runner.Command, error) {
+	args, err := scriptArgs(ctx, sc, paramValues, timeout)
+	if err != nil {
+		return runner.Command{}, err
+	}
+	c := runner.Command{Args: wrapArgs(sc, args), Dir: sc.Cwd, Attr: sandboxProcAttr(&sc.Sandbox), KillSignal: sc.Kill.Signal, KillGrace: sc.Kill.GracePeriod}
+	// The environment of the script is copied, since runs add to it.
+	c.Env = append([]string(nil), sc.Environ()...)
+	for _, stage := range sc.PipelineStages() {
+		c.Stages = append(c.Stages, wrapArgs(sc, stage))
+	}
+	return c, nil
+}
+
+// runScript runs a command with runner.Run, pooled in the
+// high-frequency mode.
+func runScript(c runner.Command, stdin []byte, timeout time.Duration, maxBytes int64, usage *runner.Usage) (string, bool, error) {
+	return runScriptContext(context.Background(), c, stdin, timeout, maxBytes, usage)
+}
+
+// runScriptContext is runScript with runner.RunContext.
+func runScriptContext(ctx context.Context, c runner.Command, stdin []byte, timeout time.Duration, maxBytes int64, usage *runner.Usage) (string, bool, error) {
+	c.Pooled = getConfig().HighFrequency.Active
+	return runner.RunContext(ctx, c, stdin, timeout, maxBytes, usage)
+}
+
+// streamScript runs a command with runner.StreamContext, pooled in the
+// high-frequency mode.
+func streamScript(ctx context.Context, c runner.Command, stdin []byte, timeout time.Duration, maxBytes int64, usage *runner.Usage, consume func(io.Reader)) (bool, error) {
+	c.Pooled = getConfig().HighFrequency.Active
+	return runner.StreamContext(ctx, c, stdin, timeout, maxBytes, usage, consume)
+}
+
+// outputTooLargeError is the error of a run of a script whose output
+// was cut off at limits.maxOutputBytes.
+type outputTooLargeError struct {
+	max int64
+}
+
+func (e *outputTooLargeError) Error() string {
+	return fmt.Sprintf("output exceeds limits.maxOutputBytes of %d bytes", e.max)
+}
+
+// failureReason classifies the error from running a script for our
+// failure metrics. Scripts that exited with a non-zero status, or
+// couldn't be run at all, have failed to execute.
+func failureReason(err error) string {
+	if err == context.Canceled {
+		return "aborted"
+	}
+	switch err.(type) {
+	case *runner.TimeoutError:
+		return "timeout"
+	case *parser.Error:
+		return "parse_error"
+	case *outputTooLargeError:
+		return "output_too_large"
+	case *successError:
+		return "success_criteria"
+	case *staleFileError:
+		return "stale"
+	case *lockError:
+		return "lock"
+	}
+	return "exec_failed"
+}
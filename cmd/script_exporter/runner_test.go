@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+func TestFailureReason(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 1").Run()
+	notFound := exec.Command("./does-not-exist").Run()
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"exit status", exitErr, "exec_failed"},
+		{"exit status of a runner", &runner.ExitStatusError{Status: 2}, "exec_failed"},
+		{"program not found", notFound, "exec_failed"},
+		{"other error", errors.New("connection refused"), "exec_failed"},
+		{"timeout", &runner.TimeoutError{Timeout: time.Second}, "timeout"},
+		{"parse error", &parser.Error{Err: errors.New("invalid line")}, "parse_error"},
+		{"output too large", &outputTooLargeError{max: 1024}, "output_too_large"},
+		{"success criteria", &successError{reason: "output doesn't match"}, "success_criteria"},
+		{"lock", &lockError{lock: "db", timeout: time.Second}, "lock"},
+		{"aborted", context.Canceled, "aborted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err); got != tt.want {
+				t.Errorf("failureReason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
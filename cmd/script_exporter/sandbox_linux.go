@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+// sandboxProcAttr returns the process attributes that start a program
+// in the namespaces of a sandbox, or nil if there is none. Since only
+// root can create them otherwise, the program also gets a user
+// namespace of its own if we aren't root, in which it is root.
+func sandboxProcAttr(sb *config.SandboxConfig) *syscall.SysProcAttr {
+	if !sb.Active {
+		return nil
+	}
+
+	attr := &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS}
+	if !sb.AllowNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if os.Getuid() != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+	return attr
+}
+
+// enterSandbox sets up the mounts of a sandbox in our mount
+// namespace: all mounts become read-only, unless writes are allowed,
+// and /tmp a private tmpfs. With a root, /tmp is that of the root, if
+// it has one, and then the root becomes our root directory.
+func enterSandbox(allowWrites bool, root string) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("can't make mounts private: %s", err)
+	}
+
+	if !allowWrites {
+		mounts, err := mountPoints()
+		if err != nil {
+			return err
+		}
+		for _, mp := range mounts {
+			if err := remountReadOnly(mp); err != nil {
+				return fmt.Errorf("can't make %s read-only: %s", mp, err)
+			}
+		}
+	}
+
+	tmp := filepath.Join(root, "/tmp")
+	if fi, err := os.Stat(tmp); root == "" || (err == nil && fi.IsDir()) {
+		if err := unix.Mount("tmpfs", tmp, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("can't mount %s: %s", tmp, err)
+		}
+	}
+
+	if root != "" {
+		if err := unix.Chroot(root); err != nil {
+			return fmt.Errorf("can't change root to %s: %s", root, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountPoints returns our mount points, parents before their
+// children.
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 {
+			mounts = append(mounts, unescapeMountPoint(fields[4]))
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPoint undoes the octal escapes of spaces and other
+// special characters in mount points in mountinfo.
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountFlags maps the flags of statfs to those of mount that have to
+// be kept when remounting, since they may be locked in a user
+// namespace.
+var mountFlags = []struct{ st, ms uintptr }{
+	{unix.ST_NOSUID, unix.MS_NOSUID},
+	{unix.ST_NODEV, unix.MS_NODEV},
+	{unix.ST_NOEXEC, unix.MS_NOEXEC},
+	{unix.ST_NOATIME, unix.MS_NOATIME},
+	{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+	{unix.ST_RELATIME, unix.MS_RELATIME},
+}
+
+// remountReadOnly makes a mount read-only, keeping its other flags.
+func remountReadOnly(mp string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mp, &st); err != nil {
+		return err
+	}
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	for _, f := range mountFlags {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	return unix.Mount("", mp, "", flags, "")
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// sandboxProcAttr returns nil, since sandboxes need Linux.
+func sandboxProcAttr(sb *config.SandboxConfig) *syscall.SysProcAttr {
+	return nil
+}
+
+// enterSandbox fails, since sandboxes need Linux.
+func enterSandbox(allowWrites bool, root string) error {
+	return errors.New("only supported on linux")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// scheduleTick is how often we check for scheduled scripts that are
+// due to run.
+const scheduleTick = time.Second
+
+var (
+	scheduleMu      sync.Mutex
+	scheduleNext    = make(map[string]time.Time)
+	scheduleRunning = make(map[string]bool)
+
+	// scheduleRan has the scripts whose first scheduled run has
+	// finished.
+	scheduleRan = make(map[string]bool)
+
+	scheduledRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "scheduled_runs_total",
+			Help:      "Total scheduled runs of a script by result.",
+		},
+		[]string{"script", "result"})
+)
+
+// startScheduler starts running the scripts that have a schedule. It
+// reads the configuration every time, so that reloads take effect.
+func startScheduler() {
+	go func() {
+		for {
+			time.Sleep(scheduleTick)
+			now := time.Now()
+			runDueScripts(now)
+			retireScripts(now)
+		}
+	}()
+}
+
+// runDueScripts starts every scheduled script that is due, unless it's
+// outside of its windows. A script that is still running when it's due
+// again is skipped, and then runs as soon as it has finished. Scripts
+// that were just scheduled are due at once, or after a random part of
+// their warm-up jitter.
+func runDueScripts(now time.Time) {
+	c := getConfig()
+	for i := range c.Scripts {
+		sc := &c.Scripts[i]
+		if sc.Schedule.Interval <= 0 || disabledBy(sc) != "" || !sc.InWindow(now) {
+			continue
+		}
+
+		scheduleMu.Lock()
+		if _, ok := scheduleNext[sc.Name]; !ok && sc.Schedule.WarmUp.Jitter > 0 {
+			scheduleNext[sc.Name] = now.Add(time.Duration(rand.Int63n(int64(sc.Schedule.WarmUp.Jitter))))
+		}
+		if scheduleRunning[sc.Name] || now.Before(scheduleNext[sc.Name]) {
+			scheduleMu.Unlock()
+			continue
+		}
+		scheduleRunning[sc.Name] = true
+		scheduleNext[sc.Name] = now.Add(sc.Schedule.Interval)
+		scheduleMu.Unlock()
+
+		go func() {
+			runScheduled(c, sc, now)
+
+			scheduleMu.Lock()
+			delete(scheduleRunning, sc.Name)
+			scheduleRan[sc.Name] = true
+			scheduleMu.Unlock()
+		}()
+	}
+}
+
+// warmUpError returns an error if a scheduled script whose first run
+// the exporter's readiness waits for hasn't finished it. Scripts that
+// can't run now, because they are disabled or outside of their
+// windows, aren't waited for.
+func warmUpError(now time.Time) error {
+	c := getConfig()
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	for i := range c.Scripts {
+		sc := &c.Scripts[i]
+		if !sc.Schedule.WarmUp.Ready || sc.Schedule.Interval <= 0 || disabledBy(sc) != "" || !sc.InWindow(now) {
+			continue
+		}
+		if !scheduleRan[sc.Name] {
+			return fmt.Errorf("scheduled script %s has not run yet", sc.Name)
+		}
+	}
+	return nil
+}
+
+// retireScripts cleans up after scripts that were scheduled but
+// aren't any more, because they were removed, disabled or lost their
+// schedule: their series are marked stale for remote write and their
+// textfile is removed, so that their last results don't linger in
+// downstream databases. Scripts that are still running are retired
+// once they have finished.
+func retireScripts(now time.Time) {
+	c := getConfig()
+	var retired []string
+	scheduleMu.Lock()
+	for name := range scheduleNext {
+		if sc := c.GetScriptConfig(name); sc != nil && sc.Schedule.Interval > 0 && disabledBy(sc) == "" {
+			continue
+		}
+		if !scheduleRunning[name] {
+			delete(scheduleNext, name)
+			delete(scheduleRan, name)
+			retired = append(retired, name)
+		}
+	}
+	scheduleMu.Unlock()
+
+	for _, name := range retired {
+		queueStaleMarkers(name, now)
+		if c.Textfile.Directory != "" {
+			if err := removeTextfile(c.Textfile.Directory, name); err != nil {
+				log.Printf("Script %s: can't remove textfile: %s\n", name, err.Error())
+			}
+		}
+	}
+}
+
+// runScheduled runs a scheduled script, sends its results to the
+// configured outputs and tells notifiers if its state changed.
+func runScheduled(c *config.Config, sc *config.ScriptConfig, start time.Time) {
+	// Scheduled runs have no request parameters to render templated
+	// arguments with, so only templates that don't need any work.
+	args, err := templateArgs(sc, nil)
+	if err != nil {
+		log.Printf("Scheduled script %s: can't render args: %s\n", sc.Name, err.Error())
+		scheduledRuns.WithLabelValues(sc.Name, stateFailure).Inc()
+		return
+	}
+	pr := &probeRequest{paramValues: append(args, sc.Schedule.Params...)}
+	output, diags, err := probeScript(sc, pr)
+	if err != nil {
+		log.Printf("Scheduled script %s failed: %s\n", sc.Name, err.Error())
+	}
+	scheduledRuns.WithLabelValues(sc.Name, stateName(err == nil)).Inc()
+	notifyStateChange(c, sc.Name, err, start)
+	for _, d := range diags {
+		if d.naming {
+			log.Printf("Script %s: dropping metric: %s\n", sc.Name, d.reason)
+		}
+	}
+
+	output = withNodeLabels(output)
+	if c.RemoteWrite.URL != "" {
+		queueRemoteWrite(sc.Name, output, start)
+	}
+	if c.Textfile.Directory != "" {
+		if err := writeTextfile(c.Textfile.Directory, sc.Name, output); err != nil {
+			log.Printf("Script %s: can't write textfile: %s\n", sc.Name, err.Error())
+		}
+	}
+}
@@ -4,18 +4,21 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/server"
 	"github.com/ricoberger/script_exporter/pkg/version"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,28 +31,55 @@ const (
 	scriptSuccessType         = "# TYPE script_success gauge"
 	scriptDurationSecondsHelp = "# HELP script_duration_seconds Script execution time, in seconds."
 	scriptDurationSecondsType = "# TYPE script_duration_seconds gauge"
+	scriptResultChangedHelp   = "# HELP script_result_changed Whether any sample value changed since the previous run (1 = changed)."
+	scriptResultChangedType   = "# TYPE script_result_changed gauge"
+	scriptCounterResetHelp    = "# HELP script_counter_reset_detected Whether any counter decreased since the previous run (1 = decreased)."
+	scriptCounterResetType    = "# TYPE script_counter_reset_detected gauge"
+	scriptDisabledHelp        = "# HELP script_disabled Script is disabled and was not run (1 = disabled)."
+	scriptDisabledType        = "# TYPE script_disabled gauge"
+	scriptSkippedHelp         = "# HELP script_skipped Script is outside of its windows and was not run (1 = skipped)."
+	scriptSkippedType         = "# TYPE script_skipped gauge"
+	scriptRunningHelp         = "# HELP script_running Script is still running and the result is that of its previous run, if any (1 = running)."
+	scriptRunningType         = "# TYPE script_running gauge"
+	scriptResultStaleHelp     = "# HELP script_result_stale Result was kept on disk by a previous run of the exporter (1 = stale)."
+	scriptResultStaleType     = "# TYPE script_result_stale gauge"
+	scriptResultAgeHelp       = "# HELP script_result_age_seconds Time since the script produced the result, in seconds."
+	scriptResultAgeType       = "# TYPE script_result_age_seconds gauge"
+	scriptOutputTruncatedHelp = "# HELP script_output_truncated Script output exceeded the limits and was truncated (1 = truncated)."
+	scriptOutputTruncatedType = "# TYPE script_output_truncated gauge"
+	scriptAttemptsHelp        = "# HELP script_attempts Number of times the script was run for the probe, including retries."
+	scriptAttemptsType        = "# TYPE script_attempts gauge"
+	scriptVariantHelp         = "# HELP script_variant Command that produced the result, 0 for the script and n for its nth fallback (1 = produced it)."
+	scriptVariantType         = "# TYPE script_variant gauge"
+	scriptMetricsDroppedHelp  = "# HELP script_metrics_dropped_total Total metrics dropped because the script may not emit them."
+	scriptMetricsDroppedType  = "# TYPE script_metrics_dropped_total counter"
+	scriptErrorHelp           = "# HELP script_error Why the script failed, as in scripts_failures_total (1 = failed for the reason)."
+	scriptErrorType           = "# TYPE script_error gauge"
+	scriptExitCodeHelp        = "# HELP script_exit_code Exit status of the script that failed."
+	scriptExitCodeType        = "# TYPE script_exit_code gauge"
+	scriptNotFoundHelp        = "# HELP script_not_found The probed script doesn't exist (1 = not found)."
+	scriptNotFoundType        = "# TYPE script_not_found gauge"
 )
 
-var (
-	exporterConfig config.Config
+// listenAddresses are the addresses of the -web.listen-address flag.
+var listenAddresses = addressList{addrs: []string{":9469"}}
+
+func init() {
+	flag.Var(&listenAddresses, "web.listen-address", "Address to listen on for web interface and telemetry; may be given several times. unix:///path listens on a unix socket, tcp4://address and tcp6://address only on IPv4 or IPv6, and interface://name:port on the addresses of a network interface.")
+}
 
-	listenAddress = flag.String("web.listen-address", ":9469", "Address to listen on for web interface and telemetry.")
+var (
+	socketMode    = flag.String("web.socket-mode", "0660", "File mode of unix sockets that are listened on, in octal.")
 	showVersion   = flag.Bool("version", false, "Show version information.")
 	createToken   = flag.Bool("create-token", false, "Create bearer token for authentication.")
 	configFile    = flag.String("config.file", "config.yaml", "Configuration file in YAML format.")
+	watchConfigs  = flag.Bool("config.watch", false, "Reload the configuration file automatically when it changes.")
+	watchDebounce = flag.Duration("config.watch-debounce", time.Second, "How long to wait for further changes before reloading the configuration file.")
+	enablePprof   = flag.Bool("web.enable-pprof", false, "Serve Go profiling data under /debug/pprof/, with the authentication of the admin endpoints.")
+	reusePort     = flag.Bool("web.reuse-port", false, "Set SO_REUSEPORT on TCP listeners, so that another instance can listen on the same addresses.")
+	enableGRPC    = flag.Bool("web.enable-grpc", false, "Serve the gRPC probe API, with the authentication of the probe endpoint.")
 )
 
-func runScript(args []string) (string, error) {
-	var output []byte
-	var err error
-	output, err = exec.Command(args[0], args[1:]...).Output()
-	if err != nil {
-		return "", err
-	}
-
-	return string(output), nil
-}
-
 // instrumentScript wraps the underlying http.Handler with Prometheus
 // instrumentation to produce per-script metrics on the number of
 // requests in flight, the number of requests in total, and the
@@ -57,7 +87,7 @@ func runScript(args []string) (string, error) {
 // parameter are not instrumented (and will probably be rejected).
 func instrumentScript(obs prometheus.ObserverVec, cnt *prometheus.CounterVec, g *prometheus.GaugeVec, next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sn := r.URL.Query().Get("script")
+		sn := requestScriptName(r)
 		if sn == "" {
 			// Rather than make up a fake script label, such
 			// as "NONE", we let the request fall through without
@@ -78,86 +108,332 @@ func instrumentScript(obs prometheus.ObserverVec, cnt *prometheus.CounterVec, g
 	})
 }
 
+// parseTimeout parses the timeout parameter of a probe request, which
+// is a duration such as '10s' or a number of seconds like the
+// X-Prometheus-Scrape-Timeout-Seconds header.
+func parseTimeout(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		f, ferr := strconv.ParseFloat(v, 64)
+		if ferr != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("%q is not a duration", v)
+		}
+		d = time.Duration(f * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q is not positive", v)
+	}
+	return d, nil
+}
+
+// requestScriptName returns the name of the script a probe request
+// is for, either from its path (/probe/<script>) or from its 'script'
+// query parameter, or for modules its 'module' parameter. The path
+// takes precedence, since reverse proxy ACLs may be written against
+// it; a conflicting parameter makes the request invalid and we
+// return "". A path of just /probe/ is treated like /probe.
+func requestScriptName(r *http.Request) string {
+	q := r.URL.Query().Get("script")
+	if q == "" {
+		q = r.URL.Query().Get("module")
+	}
+	if !strings.HasPrefix(r.URL.Path, "/probe/") {
+		return q
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/probe/")
+	if p == "" {
+		return q
+	}
+	if q != "" && q != p {
+		return ""
+	}
+	return p
+}
+
 func metricsHandler(w http.ResponseWriter, r *http.Request) {
-	// Get script from url parameter
+	// Get script from url path or parameter, and apply the
+	// parameter defaults pinned for the client
 	params := r.URL.Query()
-	scriptName := params.Get("script")
+	client := clientID(r)
+	applyClientParams(client, params)
+	scriptName := requestScriptName(r)
+	if scriptName == "" && strings.HasPrefix(r.URL.Path, "/probe/") {
+		log.Printf("Script parameter conflicts with path\n")
+		http.Error(w, "Script parameter conflicts with path", http.StatusBadRequest)
+		return
+	}
 	if scriptName == "" {
 		log.Printf("Script parameter is missing\n")
 		http.Error(w, "Script parameter is missing", http.StatusBadRequest)
 		return
 	}
 
-	// Get prefix from url parameter
-	prefix := params.Get("prefix")
+	// Several scripts, or a group of them, may be probed together
+	if names, parallel := scriptGroup(getConfig(), scriptName, params); names != nil {
+		groupHandler(w, r, client, groupProbes(names, params), parallel)
+		return
+	}
+
+	if sc, output, ok := probeHTTP(w, r, params, client, scriptName, requestSpan(r)); ok {
+		writeProbeOutput(w, r, sc, output)
+	}
+}
+
+// unknownScript answers the probe of a script that doesn't exist as
+// the configuration says, like probeHTTP. Serving a failed probe
+// lets Prometheus record the failure as data rather than as a failed
+// scrape.
+func unknownScript(w http.ResponseWriter, scriptName string) (*config.ScriptConfig, string, bool) {
+	switch getConfig().Probe.UnknownScript {
+	case config.UnknownScriptNotFound:
+		w.Header().Set("Content-Type", contentTypes[formatText])
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s\n%s\n%s_not_found{} %d\n", scriptNotFoundHelp, scriptNotFoundType, namespace, 1)
+	case config.UnknownScriptMetric:
+		return &config.ScriptConfig{Name: scriptName}, fmt.Sprintf("%s\n%s\n%s_success{error=\"unknown_script\"} %d\n", scriptSuccessHelp, scriptSuccessType, namespace, 0), true
+	default:
+		http.Error(w, "Script not found", http.StatusBadRequest)
+	}
+	return nil, "", false
+}
+
+// probeHTTP probes a script for a probe request and returns the
+// output to serve. If the request is invalid or may not be served, it
+// writes the error response and returns false instead.
+func probeHTTP(w http.ResponseWriter, r *http.Request, params url.Values, client, scriptName string, span *span) (*config.ScriptConfig, string, bool) {
+	// Get parameters; parameters with several values become as
+	// many arguments
+	var paramValues []string
+	for _, scriptParams := range params["params"] {
+		if scriptParams == "" {
+			continue
+		}
+		for _, p := range strings.Split(scriptParams, ",") {
+			if len(params[p]) == 0 {
+				paramValues = append(paramValues, "")
+			}
+			paramValues = append(paramValues, params[p]...)
+		}
+	}
+
+	// Get script
+	sc := lookupScript(getConfig(), scriptName)
+	if sc == nil {
+		log.Printf("Script not found\n")
+		return unknownScript(w, scriptName)
+	}
+
+	// Scripts that a dedicated listener doesn't serve don't exist
+	// for it
+	if !listenerServes(r, scriptName) {
+		return unknownScript(w, scriptName)
+	}
+
+	// Disabled scripts are deliberately not an error, so that
+	// alerts can tell maintenance apart from failure.
+	if disabledBy(sc) != "" {
+		return sc, fmt.Sprintf("%s\n%s\n%s_disabled{} %d\n", scriptDisabledHelp, scriptDisabledType, namespace, 1), true
+	}
+
+	// Rate limits protect the host from too many probes
+	if wait := throttle(getConfig(), sc, time.Now()); wait > 0 {
+		log.Printf("Script %s: too many requests\n", sc.Name)
+		requestsThrottled.WithLabelValues(sc.Name).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return nil, "", false
+	}
+
+	// Get prefix from url parameter, if the script allows it
+	prefix := sc.Prefix
+	if sc.AllowURLPrefix && params.Get("prefix") != "" {
+		prefix = params.Get("prefix")
+	}
 	if prefix != "" {
 		prefix = fmt.Sprintf("%s_", prefix)
 	}
 
-	// Get parameters
-	var paramValues []string
-	scriptParams := params.Get("params")
-	if scriptParams != "" {
-		paramValues = strings.Split(scriptParams, ",")
+	// Get constant labels from url parameter, if the script allows it
+	var urlLabels []parser.Label
+	if sc.AllowURLLabels {
+		var err error
+		urlLabels, err = parseURLLabels(params.Get("labels"))
+		if err != nil {
+			log.Printf("Invalid labels parameter: %s\n", err.Error())
+			http.Error(w, fmt.Sprintf("Invalid labels parameter: %s", err.Error()), http.StatusBadRequest)
+			return nil, "", false
+		}
+	}
 
-		for i, p := range paramValues {
-			paramValues[i] = params.Get(p)
+	// Get the timeout from url parameter, which can only shorten
+	// that of the script
+	var timeout time.Duration
+	if v := params.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = parseTimeout(v); err != nil {
+			log.Printf("Invalid timeout parameter: %s\n", err.Error())
+			http.Error(w, fmt.Sprintf("Invalid timeout parameter: %s", err.Error()), http.StatusBadRequest)
+			return nil, "", false
 		}
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	scriptStartTime := time.Now()
+	// Get the standard input of the script
+	stdin, err := scriptStdin(sc, r, params)
+	if err != nil {
+		log.Printf("Script %s: can't render stdin: %s\n", sc.Name, err.Error())
+		http.Error(w, fmt.Sprintf("Can't render stdin: %s", err.Error()), http.StatusBadRequest)
+		return nil, "", false
+	}
 
-	// Get and run script
-	script := exporterConfig.GetScript(scriptName)
-	if script == "" {
-		log.Printf("Script not found\n")
-		http.Error(w, "Script not found", http.StatusBadRequest)
-		return
+	// Scripts that map parameters to arguments themselves don't
+	// take arbitrary ones
+	if len(sc.ParamsToArgs) > 0 && len(paramValues) > 0 {
+		log.Printf("Script %s: params parameter given\n", sc.Name)
+		http.Error(w, "The script doesn't take the params parameter", http.StatusBadRequest)
+		return nil, "", false
 	}
 
-	output, err := runScript(append(strings.Split(script, " "), paramValues...))
+	// Templated arguments come before the values of the params
+	// parameter
+	args, err := templateArgs(sc, params)
 	if err != nil {
-		log.Printf("Script failed: %s\n", err.Error())
-		fmt.Fprintf(w, "%s\n%s\n%s_success{} %d\n%s\n%s\n%s_duration_seconds{} %f\n", scriptSuccessHelp, scriptSuccessType, namespace, 0, scriptDurationSecondsHelp, scriptDurationSecondsType, namespace, time.Since(scriptStartTime).Seconds())
-		return
+		log.Printf("Script %s: can't render args: %s\n", sc.Name, err.Error())
+		http.Error(w, fmt.Sprintf("Can't render args: %s", err.Error()), http.StatusBadRequest)
+		return nil, "", false
 	}
 
-	// Get ignore output parameter and only return success and duration seconds if 'true'
-	outputParam := params.Get("output")
-	if outputParam == "ignore" {
-		fmt.Fprintf(w, "%s\n%s\n%s_success{} %d\n%s\n%s\n%s_duration_seconds{} %f\n", scriptSuccessHelp, scriptSuccessType, namespace, 1, scriptDurationSecondsHelp, scriptDurationSecondsType, namespace, time.Since(scriptStartTime).Seconds())
-		return
+	// Run script; if the output parameter is 'ignore', only success
+	// and duration seconds are returned. Identical probes may be
+	// batched together if the script has a batch window or is
+	// single flight.
+	pr := &probeRequest{
+		prefix:       prefix,
+		paramValues:  append(args, paramValues...),
+		labels:       urlLabels,
+		ignoreOutput: params.Get("output") == "ignore",
+		stdin:        stdin,
+		timeout:      timeout,
+		span:         span,
+		env:          requestEnv(requestID(r)),
+	}
+	pr.span.setAttr("script", sc.Name)
+	probe := func() (string, []outputDiagnostic, error) {
+		return probeScript(sc, pr)
+	}
+
+	key := pr.key(scriptName)
+	if sc.Async {
+		// Runs outlive the request, so they aren't part of its
+		// trace
+		pr.span.setAttr("async", true)
+		pr.span = nil
+		output, finished := asyncProbe(key, scriptName, persistDir(sc), probe)
+		if finished.IsZero() {
+			return sc, output, true
+		}
+		return agedResult(w, sc, output, time.Since(finished))
+	}
+
+	ckey := cacheKey("", key)
+	if sc.CachePerClient {
+		ckey = cacheKey(client, key)
 	}
+	dir := persistDir(sc)
+
+	// Outside of its windows, a script isn't run, and probes get
+	// its last result instead.
+	if !sc.InWindow(time.Now()) {
+		pr.span.setAttr("skipped", true)
+		return sc, skippedResult(ckey, dir), true
+	}
+
+	if sc.CacheDuration > 0 {
+		if cr, ok := getCachedResult(ckey); ok {
+			pr.span.setAttr("cached", true)
+			return agedResult(w, sc, cr.output, time.Since(cr.stored))
+		}
 
-	// Format output
-	regex1, _ := regexp.Compile("^" + prefix + "\\w*{.*}\\s+")
-	regex2, _ := regexp.Compile("^" + prefix + "\\w*{.*}\\s+[0-9|\\.]*")
-
-	var formatedOutput string
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	for scanner.Scan() {
-		metric := strings.Trim(scanner.Text(), " ")
-
-		if metric == "" {
-			// Do nothing
-		} else if metric[0:1] == "#" {
-			formatedOutput += fmt.Sprintf("%s\n", metric)
-		} else {
-			metric = fmt.Sprintf("%s%s", prefix, metric)
-			metrics := regex1.FindAllString(metric, -1)
-			if len(metrics) == 1 {
-				value := strings.Replace(metric[len(metrics[0]):], ",", ".", -1)
-				if regex2.MatchString(metrics[0] + value) {
-					formatedOutput += fmt.Sprintf("%s%s\n", metrics[0], value)
-				}
+		// After a restart, the result that the previous run
+		// kept on disk is as good as a cached one until it
+		// expires.
+		if dir != "" {
+			if p, ok := loadPersistedResult(dir, ckey); ok && time.Since(p.Time) < sc.CacheDuration {
+				output := staleOutput(p.Output, true)
+				storeCachedResult(ckey, scriptName, output, nil, p.Time, sc.CacheDuration)
+				pr.span.setAttr("cached", true)
+				return agedResult(w, sc, output, time.Since(p.Time))
 			}
 		}
 	}
 
-	fmt.Fprintf(w, "%s\n%s\n%s_success{} %d\n%s\n%s\n%s_duration_seconds{} %f\n%s\n", scriptSuccessHelp, scriptSuccessType, namespace, 1, scriptDurationSecondsHelp, scriptDurationSecondsType, namespace, time.Since(scriptStartTime).Seconds(), formatedOutput)
+	// Scripts that used up the execution budget protect the host
+	// from further runs, but not from serving cached results.
+	if wait := budgetWait(getConfig(), time.Now()); wait > 0 {
+		log.Printf("Script %s: execution budget exhausted\n", sc.Name)
+		requestsOverBudget.WithLabelValues(sc.Name).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Execution budget exhausted", http.StatusServiceUnavailable)
+		return nil, "", false
+	}
+
+	var output string
+	var diags []outputDiagnostic
+	if sc.BatchWindow > 0 || sc.SingleFlight {
+		output, diags, err = batchedProbe(key, scriptName, sc.BatchWindow, sc.SingleFlight, pr.span, probe)
+	} else {
+		// Runs for this request alone are killed if its client
+		// goes away, such as Prometheus after a scrape timeout.
+		pr.ctx = r.Context()
+		output, diags, err = probe()
+	}
+	pr.span.setAttr("success", err == nil)
+	if err != nil {
+		log.Printf("Script failed: %s\n", err.Error())
+	} else if dir != "" {
+		if err := storePersistedResult(dir, ckey, scriptName, output); err != nil {
+			log.Printf("Script %s: can't persist result: %s\n", scriptName, err.Error())
+		}
+	}
+	if dir != "" {
+		output = staleOutput(output, false)
+	}
+	if err == nil && sc.CacheDuration > 0 {
+		storeCachedResult(ckey, scriptName, output, diags, time.Now(), sc.CacheDuration)
+	}
+	if err == nil && len(sc.Windows) > 0 {
+		storeWindowResult(ckey, scriptName, output, time.Now())
+	}
+	for _, d := range diags {
+		if d.naming {
+			log.Printf("Script %s: dropping metric: %s\n", scriptName, d.reason)
+		}
+	}
+
+	return agedResult(w, sc, output, 0)
 }
 
+// agedResult returns the output of a probe of a script whose results
+// may be old, cached or async ones, with script_result_age_seconds.
+// If the result is older than the maxAge of an async script, it writes
+// the error response and returns false instead.
+func agedResult(w http.ResponseWriter, sc *config.ScriptConfig, output string, age time.Duration) (*config.ScriptConfig, string, bool) {
+	if sc.CacheDuration == 0 && !sc.Async {
+		return sc, output, true
+	}
+	if sc.MaxAge > 0 && age > sc.MaxAge {
+		log.Printf("Script %s: result is %s old, older than its maxAge\n", sc.Name, age.Round(time.Second))
+		http.Error(w, "Result is too old", http.StatusServiceUnavailable)
+		return nil, "", false
+	}
+	return sc, fmt.Sprintf("%s%s\n%s\n%s_result_age_seconds{} %f\n", output, scriptResultAgeHelp, scriptResultAgeType, namespace, age.Seconds()), true
+}
+
+// defaultDurationBuckets are the histogram buckets of our duration
+// metrics, in seconds, unless the configuration has others. Scripts
+// can take a lot longer than typical HTTP requests.
+var defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
 // setupMetrics creates and registers our internal Prometheus metrics,
 // and then wraps up a http.HandlerFunc into a http.Handler that
 // properly counts all of the metrics when a request happens.
@@ -166,7 +442,16 @@ func metricsHandler(w http.ResponseWriter, r *http.Request) {
 //
 // We use the 'scripts' namespace for our internal metrics so that
 // they don't collide with the 'script' namespace for probe results.
+//
+// Durations are histograms, so that they can be aggregated across
+// instances. Their buckets are fixed when the metrics are created and
+// don't change on reloads.
 func setupMetrics(h http.HandlerFunc) http.Handler {
+	buckets := getConfig().InternalMetrics.DurationBuckets
+	if len(buckets) == 0 {
+		buckets = defaultDurationBuckets
+	}
+
 	// Broad metrics provided by promhttp, namespaced into
 	// 'http' to make what they're about clear from their
 	// names.
@@ -177,12 +462,12 @@ func setupMetrics(h http.HandlerFunc) http.Handler {
 			Help:      "Total requests for scripts by HTTP result code and method.",
 		},
 		[]string{"code", "method"})
-	rdur := prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Namespace:  "http",
-			Name:       "requests_duration_seconds",
-			Help:       "A summary of request durations by HTTP result code and method.",
-			Objectives: map[float64]float64{0.25: 0.05, 0.5: 0.05, 0.75: 0.02, 0.9: 0.01, 0.99: 0.001, 1.0: 0.001},
+	rdur := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "http",
+			Name:      "requests_duration_seconds",
+			Help:      "A histogram of request durations by HTTP result code and method.",
+			Buckets:   buckets,
 		},
 		[]string{"code", "method"})
 
@@ -202,13 +487,12 @@ func setupMetrics(h http.HandlerFunc) http.Handler {
 			Help:      "Number of requests in flight to a script",
 		},
 		[]string{"script"})
-	sdur := prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Namespace:  "scripts",
-			Name:       "duration_seconds",
-			Help:       "A summary of request durations to a script",
-			Objectives: map[float64]float64{0.25: 0.05, 0.5: 0.05, 0.75: 0.02, 0.9: 0.01, 0.99: 0.001, 1.0: 0.001},
-			//Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	sdur := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "scripts",
+			Name:      "duration_seconds",
+			Help:      "A histogram of request durations to a script",
+			Buckets:   buckets,
 		},
 		[]string{"script"},
 	)
@@ -224,7 +508,10 @@ func setupMetrics(h http.HandlerFunc) http.Handler {
 	)
 	buildInfo.WithLabelValues(version.Version, version.Revision, version.Branch, version.GoVersion, version.BuildDate, version.BuildUser).Set(1)
 
-	prometheus.MustRegister(rdur, reqs, sreqs, sif, sdur, buildInfo)
+	queueWait = newQueueWait(buckets)
+	lockWait = newLockWait(buckets)
+
+	prometheus.MustRegister(rdur, reqs, sreqs, sif, sdur, buildInfo, disabledCollector{}, infoCollector{}, nodeInfoCollector{}, scriptFailures, scriptAborted, scriptLastSuccess, scriptParseErrors, scriptLinesDropped, configReloadSuccessful, configReloadSuccessTime, packFetchSuccessful, registryFetchSuccessful, canaryLastSuccessful, canaryRuns, workerStarts, requestsThrottled, requestsOverBudget, probesCoalesced, queueLength, queueWait, lockWait, scheduledRuns, adaptiveTimeouts)
 
 	// We don't use InstrumentHandlerInFlight, because that
 	// duplicates what we're doing on a per-script basis. The
@@ -238,6 +525,7 @@ func setupMetrics(h http.HandlerFunc) http.Handler {
 
 func main() {
 	// Parse command-line flags
+	flag.Usage = usage
 	flag.Parse()
 
 	// Show version information
@@ -251,15 +539,42 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Print the output of the self-probe, or run a program of a
+	// script with its process settings
+	if flag.Arg(0) == selfCommand {
+		os.Exit(selfCommandMain())
+	}
+	if flag.Arg(0) == execCommand {
+		os.Exit(execCommandMain(flag.Args()[1:]))
+	}
+
+	// Validate configuration file
+	if flag.Arg(0) == "check-config" {
+		os.Exit(checkConfigCommand(*configFile))
+	}
+
 	// Load configuration file
-	err := exporterConfig.LoadConfig(*configFile)
+	err := loadConfig(*configFile)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	// Run a script once, or format saved output of one
+	switch flag.Arg(0) {
+	case "":
+	case "run":
+		os.Exit(runCommand(flag.Args()[1:]))
+	case "replay":
+		os.Exit(replayCommand(flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	// Create bearer token
 	if *createToken {
-		token, err := createJWT()
+		token, err := server.CreateJWT(getConfig())
 		if err != nil {
 			log.Fatalf("Bearer token could not be created: %s\n", err.Error())
 		}
@@ -271,37 +586,73 @@ func main() {
 	// Start exporter
 	fmt.Printf("Starting server %s\n", version.Info())
 	fmt.Printf("Build context %s\n", version.BuildContext())
-	fmt.Printf("script_exporter listening on %s\n", *listenAddress)
-
-	// If authentication is required, it protects the ability to
-	// run scripts, which is the most potentially dangerous thing,
-	// but not our internal metrics (or the main page HTML). All
-	// of our Prometheus metrics about probes are created before
-	// any authentication is checked and possibly rejected.
-	http.Handle("/probe", setupMetrics(use(metricsHandler, auth)))
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-		<head><title>Script Exporter</title></head>
-		<body>
-		<h1>Script Exporter</h1>
-		<p><a href='/metrics'>Metrics</a></p>
-		<p><a href='/probe'>Probe</a></p>
-		<p><ul>
-		<li>version: ` + version.Version + `</li>
-		<li>branch: ` + version.Branch + `</li>
-		<li>revision: ` + version.Revision + `</li>
-		<li>go version: ` + version.GoVersion + `</li>
-		<li>build user: ` + version.BuildUser + `</li>
-		<li>build date: ` + version.BuildDate + `</li>
-		</ul></p>
-		</body>
-		</html>`))
-	})
-
-	if exporterConfig.TLS.Active {
-		log.Fatalln(http.ListenAndServeTLS(*listenAddress, exporterConfig.TLS.Crt, exporterConfig.TLS.Key, nil))
-	} else {
-		log.Fatalln(http.ListenAndServe(*listenAddress, nil))
+	fmt.Printf("script_exporter listening on %s\n", strings.Join(listenAddresses.addrs, ", "))
+
+	// If authentication is required, it protects the endpoints
+	// that the configuration picks, by default the ability to run
+	// scripts, which is the most potentially dangerous thing, and
+	// the admin endpoints. The health and readiness checks and the
+	// main page HTML are always open. All of our Prometheus metrics
+	// about probes are created before any authentication is
+	// checked and possibly rejected. The bodies of POSTed probes,
+	// which are bounded, are read first.
+	//
+	// Access restrictions by client address come before all of
+	// that, and then the answers to CORS preflight requests.
+	//
+	// We use our own ServeMux, since importing net/http/pprof
+	// registers its handlers on the default one, without any
+	// authentication.
+	a := server.NewAuth(getConfig)
+	mux := http.NewServeMux()
+	probeHandler := server.Use(postParams(setupMetrics(server.Use(metricsHandler, a.For(config.EndpointProbe)))).ServeHTTP, compressed, traced, corsAllowed, a.RestrictTo(server.ProbeNetworks), jsonErrors)
+	mux.HandleFunc("/probe", probeHandler)
+	mux.HandleFunc("/probe/", probeHandler)
+	batchHandler := server.Use(batchProbeHandler, a.For(config.EndpointProbe), compressed, traced, corsAllowed, a.RestrictTo(server.ProbeNetworks), jsonErrors)
+	mux.HandleFunc("/batchprobe", batchHandler)
+	mux.HandleFunc("/metrics", server.Use(promhttp.Handler().ServeHTTP, a.For(config.EndpointMetrics), compressed, a.RestrictTo(server.MetricsNetworks)))
+	mux.HandleFunc("/sd", server.Use(discoveryHandler, a.For(config.EndpointDiscovery)))
+	mux.HandleFunc("/-/healthy", healthyHandler)
+	mux.HandleFunc("/-/ready", readyHandler)
+	mux.HandleFunc("/api/v1/scripts", server.Use(scriptsAPIHandler, a.For(config.EndpointAdmin), corsAllowed, a.RestrictTo(server.AdminNetworks)))
+	mux.HandleFunc("/api/v1/scripts/", server.Use(scriptAPIHandler, a.For(config.EndpointAdmin), corsAllowed, a.RestrictTo(server.AdminNetworks)))
+	mux.HandleFunc("/api/v1/metrics.json", server.Use(metricsAPIHandler, a.For(config.EndpointAdmin), corsAllowed, a.RestrictTo(server.AdminNetworks)))
+	mux.HandleFunc("/-/reload", server.Use(reloadHandler(*configFile), a.For(config.EndpointAdmin), corsAllowed, a.RestrictTo(server.AdminNetworks)))
+	mux.HandleFunc("/-/packs", server.Use(packsHandler(*configFile), a.For(config.EndpointAdmin), corsAllowed, a.RestrictTo(server.AdminNetworks)))
+	mux.HandleFunc("/debug/config", server.Use(debugConfigHandler, a.For(config.EndpointAdmin), corsAllowed, a.RestrictTo(server.AdminNetworks)))
+	var grpcProbeHandler http.HandlerFunc
+	if *enableGRPC {
+		grpcProbeHandler = server.Use(grpcHandler, a.For(config.EndpointProbe), traced, a.RestrictTo(server.ProbeNetworks))
+		mux.HandleFunc("/script_exporter.v1.Scripts/", grpcProbeHandler)
+	}
+	if *enablePprof {
+		handlePprof(mux, a.For(config.EndpointAdmin), corsAllowed, a.RestrictTo(server.AdminNetworks))
+	}
+	handleReloadSignals(*configFile)
+	handleShutdownSignals()
+	handleInvalidateSignals()
+	if *watchConfigs {
+		if err := watchConfig(*configFile, *watchDebounce); err != nil {
+			log.Fatalf("Can't watch the configuration file: %s\n", err.Error())
+		}
+	}
+	startHistoryExport()
+	startPacks(*configFile)
+	startRegistry(*configFile)
+	startScheduler()
+	startRemoteWrite()
+	startTracing()
+	mux.HandleFunc("/", landingHandler)
+
+	// The TLS settings are fixed once the server runs, but renewed
+	// certificates are picked up.
+	var tlsConfig *tls.Config
+	if exporterConfig := getConfig(); exporterConfig.TLS.Active {
+		tlsConfig, err = serverTLSConfig(exporterConfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
+	serveListeners(probeHandler, batchHandler, grpcProbeHandler, tlsConfig)
+	log.Fatalln(serve(listenAddresses.addrs, *socketMode, accessLogged(mux), tlsConfig))
 }
@@ -0,0 +1,13 @@
+//go:build !linux || (!amd64 && !arm64)
+
+package main
+
+import (
+	"errors"
+)
+
+// installSeccomp fails, since we only have seccomp filters for Linux
+// on amd64 and arm64.
+func installSeccomp() error {
+	return errors.New("not supported on this platform")
+}
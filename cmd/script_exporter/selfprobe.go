@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// The __self__ pseudo-script checks the whole probe pipeline: it
+// spawns a process (ourselves, running the hidden __self__ command
+// so that it works without any particular programs on the host),
+// formats its canned output and compares the result with what we
+// expect. A wedged exec subsystem then shows up as a failed or
+// timed out probe, even when /metrics still responds.
+const (
+	selfScriptName = "__self__"
+	selfCommand    = "__self__"
+	selfTimeout    = 10 * time.Second
+)
+
+// selfOutput is what the __self__ command prints. The second sample
+// is invalid and must be dropped by the formatting.
+const selfOutput = `# HELP self_check Canned self-probe metric.
+# TYPE self_check gauge
+self_check{check="pipeline"} 1
+self_check_invalid 1
+`
+
+// selfExpected is how selfOutput must look after formatting.
+const selfExpected = `# HELP self_check Canned self-probe metric.
+# TYPE self_check gauge
+self_check{check="pipeline"} 1
+`
+
+var errSelfMismatch = errors.New("self-probe output was not formatted as expected")
+
+// selfScriptConfig returns the configuration of the __self__ script.
+func selfScriptConfig() *config.ScriptConfig {
+	return &config.ScriptConfig{
+		Name:    selfScriptName,
+		Type:    config.TypeExec,
+		Timeout: selfTimeout,
+	}
+}
+
+// selfArgs returns the command that the __self__ script runs.
+func selfArgs() []string {
+	return []string{executable(), selfCommand}
+}
+
+// selfCommandMain implements the hidden __self__ command.
+func selfCommandMain() int {
+	fmt.Print(selfOutput)
+	return 0
+}
+
+// lookupScript returns the configuration of a script, including the
+// built-in __self__ script and the scripts of modules, or nil if there
+// is no such script.
+func lookupScript(c *config.Config, scriptName string) *config.ScriptConfig {
+	if scriptName == selfScriptName {
+		return selfScriptConfig()
+	}
+	if sc := c.GetScriptConfig(scriptName); sc != nil {
+		return sc
+	}
+	return c.GetModuleConfig(scriptName)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// handleShutdownSignals exits on a SIGTERM or SIGINT, once the scripts
+// that are running have been killed the way they are killed when they
+// time out: with their kill.signal, and their process group once the
+// kill.gracePeriod has passed. Otherwise scripts that run in process
+// groups of their own would outlive us. A second signal makes us exit
+// without waiting for them.
+func handleShutdownSignals() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-c
+		log.Printf("Received %s, stopping running scripts\n", sig)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-c
+			cancel()
+		}()
+		stopResidents()
+		if err := runner.Stop(ctx); err != nil {
+			log.Printf("Exiting without waiting for running scripts\n")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+}
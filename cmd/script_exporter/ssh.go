@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// sshArgs returns the ssh command line that runs a script command on
+// another host. ssh never asks for passwords and, without stdin, gets
+// no standard input. The remote shell splits the command line again,
+// so every argument is quoted for it.
+func sshArgs(sc *config.SSHConfig, args []string, stdin bool) []string {
+	cmd := []string{sc.Binary, "-o", "BatchMode=yes"}
+	if !stdin {
+		cmd = append(cmd, "-n")
+	}
+	if sc.Port != 0 {
+		cmd = append(cmd, "-p", strconv.Itoa(sc.Port))
+	}
+	if sc.User != "" {
+		cmd = append(cmd, "-l", sc.User)
+	}
+	if sc.IdentityFile != "" {
+		cmd = append(cmd, "-i", sc.IdentityFile)
+	}
+	cmd = append(cmd, sc.Args...)
+
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return append(cmd, sc.Host, strings.Join(quoted, " "))
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
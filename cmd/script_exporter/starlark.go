@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// starlarkOptions are the Starlark language options for scripts,
+// which allow the usual conveniences of Python.
+var starlarkOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+	Recursion:       true,
+}
+
+// starlarkPredeclared are the names that Starlark code of scripts
+// can use besides the Starlark built-ins, with dummy values. The
+// values for a run are made by starlarkRun.
+var starlarkPredeclared = starlark.StringDict{
+	"params":    starlark.None,
+	"stdin":     starlark.None,
+	"run":       starlark.None,
+	"read_file": starlark.None,
+	"metric":    starlark.None,
+}
+
+// checkStarlark checks that the code of Starlark scripts compiles.
+func checkStarlark(c *config.Config) []error {
+	var errs []error
+	for i := range c.Scripts {
+		sc := &c.Scripts[i]
+		if sc.Type != config.TypeStarlark {
+			continue
+		}
+		if _, _, err := starlark.SourceProgramOptions(starlarkOptions, sc.Name, sc.Starlark.Code, starlarkPredeclared.Has); err != nil {
+			errs = append(errs, fmt.Errorf("script %s: starlark: %s", sc.Name, err))
+		}
+	}
+	return errs
+}
+
+// A starlarkRun is a run of the Starlark code of a script, and
+// collects the metrics it emits.
+type starlarkRun struct {
+	deadline time.Time
+	maxBytes int64
+
+	output strings.Builder
+	seen   map[string]bool
+}
+
+// runStarlark runs the Starlark code of a script with parameters and
+// stdin, and returns the metrics it emitted in the exposition format.
+// The code is stopped once it has run for timeout, unless that is
+// zero, and programs that it runs have what is left of it.
+func runStarlark(sc *config.ScriptConfig, paramValues []string, stdin []byte, timeout time.Duration, maxBytes int64) (string, error) {
+	sr := &starlarkRun{maxBytes: maxBytes, seen: make(map[string]bool)}
+
+	thread := &starlark.Thread{
+		Name: sc.Name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("Script %s: %s\n", sc.Name, msg)
+		},
+	}
+	if timeout > 0 {
+		sr.deadline = time.Now().Add(timeout)
+		timer := time.AfterFunc(timeout, func() { thread.Cancel("timeout") })
+		defer timer.Stop()
+	}
+
+	var params []starlark.Value
+	for _, v := range paramValues {
+		params = append(params, starlark.String(v))
+	}
+	predeclared := starlark.StringDict{
+		"params":    starlark.Tuple(params),
+		"stdin":     starlark.String(stdin),
+		"run":       starlark.NewBuiltin("run", sr.run),
+		"read_file": starlark.NewBuiltin("read_file", sr.readFile),
+		"metric":    starlark.NewBuiltin("metric", sr.metric),
+	}
+
+	_, err := starlark.ExecFileOptions(starlarkOptions, thread, sc.Name, sc.Starlark.Code, predeclared)
+	if err != nil {
+		if !sr.deadline.IsZero() && !time.Now().Before(sr.deadline) {
+			return "", &runner.TimeoutError{Timeout: timeout}
+		}
+		return "", err
+	}
+	return sr.output.String(), nil
+}
+
+// run runs a program, as run(program, *args), and returns a struct
+// with its stdout and exit status. Failing to run it is an error, but
+// a non-zero exit status isn't.
+func (sr *starlarkRun) run(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", fn.Name())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: no program given", fn.Name())
+	}
+	var cmd []string
+	for _, a := range args {
+		s, ok := starlark.AsString(a)
+		if !ok {
+			return nil, fmt.Errorf("%s: arguments must be strings, not %s", fn.Name(), a.Type())
+		}
+		cmd = append(cmd, s)
+	}
+
+	var timeout time.Duration
+	if !sr.deadline.IsZero() {
+		if timeout = time.Until(sr.deadline); timeout <= 0 {
+			return nil, fmt.Errorf("%s: out of time", fn.Name())
+		}
+	}
+	output, _, err := runScript(runner.Command{Args: cmd}, nil, timeout, sr.maxBytes, nil)
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"stdout": starlark.String(output),
+		"status": starlark.MakeInt(runner.ExitCode(err)),
+	}), nil
+}
+
+// readFile returns the contents of a file, as read_file(path).
+func (sr *starlarkRun) readFile(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &path); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+	}
+	return starlark.String(data), nil
+}
+
+// metric emits a sample, as metric(name, value, labels={}, help="",
+// type=""). The help and type of a metric are written with its first
+// sample.
+func (sr *starlarkRun) metric(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name, help, typ string
+	var value starlark.Value
+	var labels *starlark.Dict
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "value", &value, "labels?", &labels, "help?", &help, "type?", &typ); err != nil {
+		return nil, err
+	}
+
+	var v float64
+	switch x := value.(type) {
+	case starlark.Bool:
+		if x {
+			v = 1
+		}
+	default:
+		f, ok := starlark.AsFloat(value)
+		if !ok {
+			return nil, fmt.Errorf("%s: value must be a number, not %s", fn.Name(), value.Type())
+		}
+		v = f
+	}
+
+	var ls []parser.Label
+	if labels != nil {
+		for _, item := range labels.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("%s: label names must be strings", fn.Name())
+			}
+			lv, ok := starlark.AsString(item[1])
+			if !ok {
+				lv = item[1].String()
+			}
+			ls = append(ls, parser.Label{Name: k, Value: lv})
+		}
+		sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+	}
+
+	if !sr.seen[name] {
+		sr.seen[name] = true
+		if help != "" {
+			fmt.Fprintf(&sr.output, "# HELP %s %s\n", name, parser.EscapeHelp(help))
+		}
+		if typ != "" {
+			fmt.Fprintf(&sr.output, "# TYPE %s %s\n", name, typ)
+		}
+	}
+	fmt.Fprintf(&sr.output, "%s%s %s\n", name, parser.FormatLabels(ls), strconv.FormatFloat(v, 'g', -1, 64))
+	return starlark.None, nil
+}
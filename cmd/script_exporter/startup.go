@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+var (
+	// The outcome of the startup checks of the running
+	// configuration. startupGeneration tells checks of a replaced
+	// configuration, which may still be running, to drop their
+	// outcome.
+	startupMu         sync.Mutex
+	startupGeneration int
+	startupErr        = errors.New("startup checks not run yet")
+)
+
+// startupCheckError returns why the startup checks of the running
+// configuration haven't passed, or nil if they have.
+func startupCheckError() error {
+	startupMu.Lock()
+	defer startupMu.Unlock()
+	return startupErr
+}
+
+// runStartupChecks runs the startup checks of a configuration that
+// was just loaded in the background, one after the other. Until all
+// of them passed, the exporter isn't ready.
+func runStartupChecks(c *config.Config) {
+	startupMu.Lock()
+	startupGeneration++
+	generation := startupGeneration
+	startupErr = nil
+	if len(c.StartupChecks) > 0 {
+		startupErr = errors.New("startup checks running")
+	}
+	startupMu.Unlock()
+	if len(c.StartupChecks) == 0 {
+		return
+	}
+
+	go func() {
+		var err error
+		for _, check := range c.StartupChecks {
+			if err = runStartupCheck(c, check); err != nil {
+				log.Printf("Startup check %s failed: %s\n", check.Script, err.Error())
+				err = fmt.Errorf("startup check %s failed: %s", check.Script, err.Error())
+				break
+			}
+		}
+		if err == nil {
+			log.Printf("Startup checks passed\n")
+		}
+
+		startupMu.Lock()
+		defer startupMu.Unlock()
+		if generation == startupGeneration {
+			startupErr = err
+		}
+	}()
+}
+
+// runStartupCheck runs one startup check. It fails if the script
+// fails or if its formatted output can't be parsed in the Prometheus
+// text format. Lines of output that were dropped are logged, except
+// for the self-probe, which drops some on purpose.
+func runStartupCheck(c *config.Config, check config.StartupCheckConfig) error {
+	sc := lookupScript(c, check.Script)
+	args, err := templateArgs(sc, nil)
+	if err != nil {
+		return fmt.Errorf("can't render args: %s", err.Error())
+	}
+	output, diags, err := probeScript(sc, &probeRequest{paramValues: append(args, check.Params...)})
+	if sc.Name != selfScriptName {
+		for _, d := range diags {
+			log.Printf("Startup check %s: dropping %s\n", sc.Name, d.String())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return checkExposition(output)
+}
+
+// checkExposition returns an error if the exposition of a probe can't
+// be parsed in the Prometheus text format.
+func checkExposition(output string) error {
+	var textParser expfmt.TextParser
+	if _, err := textParser.TextToMetricFamilies(strings.NewReader(parser.StripExemplars(output))); err != nil {
+		return fmt.Errorf("can't parse output: %s", err.Error())
+	}
+	return nil
+}
+
+// checkStartupChecks checks that the scripts of startup checks
+// exist.
+func checkStartupChecks(c *config.Config) []error {
+	var errs []error
+	for _, check := range c.StartupChecks {
+		if lookupScript(c, check.Script) == nil {
+			errs = append(errs, fmt.Errorf("startupChecks: script %s not found", check.Script))
+		}
+	}
+	return errs
+}
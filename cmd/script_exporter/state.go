@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// scriptState is what we remember about the executions of a script.
+type scriptState struct {
+	runs         uint64
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastExitCode int
+	lastError    string
+
+	// failingSince is the start of the first of the current
+	// run of failures, or zero if the last run succeeded.
+	failingSince time.Time
+
+	// metricsDropped counts the metrics dropped by the metrics
+	// filter of the script.
+	metricsDropped uint64
+
+	// durations are those of the recent successful runs of a
+	// script with an adaptive timeout, the oldest one at
+	// nextDuration once there are as many as it keeps, and
+	// adaptiveTimeout is the timeout they give, before it's
+	// bounded by the configuration.
+	durations       []time.Duration
+	nextDuration    int
+	adaptiveTimeout time.Duration
+}
+
+var (
+	statesMu sync.Mutex
+	states   = make(map[string]*scriptState)
+
+	// Scripts that were disabled at runtime, with the reason
+	// ("admin" or "failure_budget"). This is kept separately from
+	// the configuration, so it survives reloads.
+	runtimeDisabled = make(map[string]string)
+
+	// The sample values of the previous run of scripts with
+	// change detection, by script and parameters.
+	previousValues = make(map[string]map[string]string)
+
+	// The counter values of the previous run of scripts with
+	// counter checks, by script and parameters.
+	previousCounters = make(map[string]map[string]float64)
+
+	// The values of the previous run of scripts with differential
+	// output, by script and parameters.
+	previousDifferentials = make(map[string]differentialRun)
+)
+
+// A differentialRun is when a run of a script with differential output
+// started and the values of the samples of its metrics, by series.
+type differentialRun struct {
+	start  time.Time
+	values map[string]float64
+}
+
+// Metrics about the runs of scripts, which are registered with our
+// other internal metrics.
+var (
+	scriptFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "failures_total",
+			Help:      "Total failed runs of a script, by reason",
+		},
+		[]string{"script", "reason"})
+	scriptAborted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "aborted_total",
+			Help:      "Total runs of a script that were killed because the probe request was canceled",
+		},
+		[]string{"script"})
+	scriptParseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "parse_errors_total",
+			Help:      "Total output lines of a script that were dropped because they couldn't be parsed",
+		},
+		[]string{"script"})
+	scriptLinesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "lines_dropped_total",
+			Help:      "Total output lines of a script that were dropped while formatting its output, for any reason",
+		},
+		[]string{"script"})
+	scriptLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "scripts",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "When the last successful run of a script finished, as a Unix timestamp",
+		},
+		[]string{"script"})
+)
+
+// maxPreviousValues bounds the number of previous results we keep for
+// change detection, since parameters come from URLs.
+const maxPreviousValues = 1024
+
+// addDroppedMetrics adds n metrics dropped by the metrics filter of a
+// script to its count of them, and returns the new count.
+func addDroppedMetrics(scriptName string, n int) uint64 {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	st := states[scriptName]
+	if st == nil {
+		st = &scriptState{}
+		states[scriptName] = st
+	}
+	st.metricsDropped += uint64(n)
+	return st.metricsDropped
+}
+
+// recordDiagnostics counts the output lines of a script that were
+// dropped while formatting its output.
+func recordDiagnostics(scriptName string, diags []outputDiagnostic) {
+	if len(diags) == 0 {
+		return
+	}
+	parseErrors := 0
+	for _, d := range diags {
+		if d.parse {
+			parseErrors++
+		}
+	}
+	scriptLinesDropped.WithLabelValues(scriptName).Add(float64(len(diags)))
+	if parseErrors > 0 {
+		scriptParseErrors.WithLabelValues(scriptName).Add(float64(parseErrors))
+	}
+}
+
+// recordRun records the result of an execution of a script, and the
+// output kept for its history.
+func recordRun(scriptName string, start time.Time, duration time.Duration, err error, output *historyOutput) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	st := states[scriptName]
+	if st == nil {
+		st = &scriptState{}
+		states[scriptName] = st
+	}
+	st.runs++
+	spendBudget(getConfig(), duration)
+	st.lastRun = start
+	st.lastDuration = duration
+	st.lastExitCode = runner.ExitCode(err)
+	st.lastError = ""
+	if err != nil {
+		st.lastError = err.Error()
+		if st.failingSince.IsZero() {
+			st.failingSince = start
+		}
+		scriptFailures.WithLabelValues(scriptName, failureReason(err)).Inc()
+		if err == context.Canceled {
+			scriptAborted.WithLabelValues(scriptName).Inc()
+		}
+	} else {
+		st.failingSince = time.Time{}
+		scriptLastSuccess.WithLabelValues(scriptName).Set(float64(start.Add(duration).UnixNano()) / 1e9)
+		if sc := lookupScript(getConfig(), scriptName); sc != nil && sc.AdaptiveTimeout.Active {
+			recordDuration(st, sc, duration)
+		}
+	}
+
+	addHistory(executionRecord{
+		Script:   scriptName,
+		Start:    start,
+		Duration: duration.Seconds(),
+		ExitCode: st.lastExitCode,
+		Success:  err == nil,
+		Error:    st.lastError,
+	}, output)
+}
+
+// getState returns a copy of the state of a script, and whether it
+// has been run at all.
+func getState(scriptName string) (scriptState, bool) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	st := states[scriptName]
+	if st == nil {
+		return scriptState{}, false
+	}
+	return *st, true
+}
+
+// setDisabled disables or re-enables a script at runtime. A script
+// that is enabled again gets its full failure budget back.
+func setDisabled(scriptName string, disabled bool) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	if disabled {
+		runtimeDisabled[scriptName] = "admin"
+	} else {
+		delete(runtimeDisabled, scriptName)
+		if st := states[scriptName]; st != nil {
+			st.failingSince = time.Time{}
+		}
+	}
+}
+
+// checkFailureBudget disables a script if it has been failing for
+// longer than its failure budget.
+func checkFailureBudget(sc *config.ScriptConfig) {
+	if sc.FailureBudget <= 0 {
+		return
+	}
+
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	st := states[sc.Name]
+	if st == nil || st.failingSince.IsZero() || runtimeDisabled[sc.Name] != "" {
+		return
+	}
+	if since := time.Since(st.failingSince); since >= sc.FailureBudget {
+		runtimeDisabled[sc.Name] = "failure_budget"
+		log.Printf("Script %s has been failing for %s, longer than its failure budget of %s; disabling it until it is enabled through the API\n", sc.Name, since.Round(time.Second), sc.FailureBudget)
+	}
+}
+
+// disabledBy returns why a script is disabled, "config", "admin" or
+// "failure_budget", or "" if the script is enabled. The configuration
+// takes precedence, since a script disabled there can't be enabled
+// through the API.
+func disabledBy(sc *config.ScriptConfig) string {
+	if sc.Disabled {
+		return "config"
+	}
+
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	return runtimeDisabled[sc.Name]
+}
+
+// disabledCollector exports which scripts are disabled, and why.
+type disabledCollector struct{}
+
+var disabledDesc = prometheus.NewDesc("scripts_disabled",
+	"Script is disabled, by reason (1 = disabled).",
+	[]string{"script", "reason"}, nil)
+
+func (disabledCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- disabledDesc
+}
+
+func (disabledCollector) Collect(ch chan<- prometheus.Metric) {
+	c := getConfig()
+	for i := range c.Scripts {
+		sc := &c.Scripts[i]
+		if reason := disabledBy(sc); reason != "" {
+			ch <- prometheus.MustNewConstMetric(disabledDesc, prometheus.GaugeValue, 1, sc.Name, reason)
+		}
+	}
+}
+
+// resultChanged remembers the sample values of a run and reports
+// whether they differ from those of the previous run with the same
+// key. Numeric values only count as changed if they differ by more
+// than tolerance; other values, and series that appear or vanish,
+// always do. The first run is never reported as changed.
+func resultChanged(key string, values map[string]string, tolerance float64) bool {
+	statesMu.Lock()
+	prev, ok := previousValues[key]
+	if !ok && len(previousValues) >= maxPreviousValues {
+		previousValues = make(map[string]map[string]string)
+	}
+	previousValues[key] = values
+	statesMu.Unlock()
+
+	if !ok {
+		return false
+	}
+	if len(prev) != len(values) {
+		return true
+	}
+	for series, v := range values {
+		pv, ok := prev[series]
+		if !ok {
+			return true
+		}
+		if pv == v {
+			continue
+		}
+		a, err1 := strconv.ParseFloat(sampleValue(pv), 64)
+		b, err2 := strconv.ParseFloat(sampleValue(v), 64)
+		if err1 != nil || err2 != nil || math.Abs(a-b) > tolerance {
+			return true
+		}
+	}
+	return false
+}
+
+// counterValues returns the values of the samples of counters among
+// the values of the samples of formatted output, by series. Counters
+// are the metric families with a TYPE line that says so.
+func counterValues(output string, values map[string]string) map[string]float64 {
+	types := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+		}
+	}
+
+	counters := make(map[string]float64)
+	for series, v := range values {
+		name := strings.TrimSpace(series)
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name = name[:i]
+		}
+		if types[groupFamilyName(types, name)] != "counter" {
+			continue
+		}
+		if f, err := strconv.ParseFloat(sampleValue(v), 64); err == nil {
+			counters[series] = f
+		}
+	}
+	return counters
+}
+
+// counterDecreased remembers the counter values of a run and returns
+// a series whose value is lower than in the previous run with the same
+// key, or "" if there is none. Counters that appear or vanish don't
+// count.
+func counterDecreased(key string, counters map[string]float64) string {
+	statesMu.Lock()
+	prev, ok := previousCounters[key]
+	if !ok && len(previousCounters) >= maxPreviousValues {
+		previousCounters = make(map[string]map[string]float64)
+	}
+	previousCounters[key] = counters
+	statesMu.Unlock()
+
+	for series, v := range counters {
+		if pv, ok := prev[series]; ok && v < pv {
+			return series
+		}
+	}
+	return ""
+}
+
+// differentialValues returns the values of the samples of metrics
+// among the values of the samples of formatted output, by series.
+func differentialValues(metrics []string, values map[string]string) map[string]float64 {
+	wanted := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		wanted[m] = true
+	}
+
+	selected := make(map[string]float64)
+	for series, v := range values {
+		series = strings.TrimSpace(series)
+		name := series
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name = name[:i]
+		}
+		if !wanted[name] {
+			continue
+		}
+		if f, err := strconv.ParseFloat(sampleValue(v), 64); err == nil {
+			selected[series] = f
+		}
+	}
+	return selected
+}
+
+// differences remembers the values of a run that started at start and
+// returns how much each of them changed since the previous run with
+// the same key, per second if rate is set. A value lower than the
+// previous one is taken to have started again from zero, like counters
+// that were reset. Series without a previous value are left out, so
+// there are none for the first run.
+func differences(key string, start time.Time, values map[string]float64, rate bool) map[string]float64 {
+	statesMu.Lock()
+	prev, ok := previousDifferentials[key]
+	if !ok && len(previousDifferentials) >= maxPreviousValues {
+		previousDifferentials = make(map[string]differentialRun)
+	}
+	previousDifferentials[key] = differentialRun{start: start, values: values}
+	statesMu.Unlock()
+
+	diffs := make(map[string]float64)
+	elapsed := start.Sub(prev.start).Seconds()
+	if !ok || (rate && elapsed <= 0) {
+		return diffs
+	}
+	for series, v := range values {
+		pv, ok := prev.values[series]
+		if !ok {
+			continue
+		}
+		d := v - pv
+		if d < 0 {
+			d = v
+		}
+		if rate {
+			d /= elapsed
+		}
+		diffs[series] = d
+	}
+	return diffs
+}
+
+// sampleValue returns the value of a sample from the rest of its
+// line, without any timestamp.
+func sampleValue(s string) string {
+	f := strings.Fields(s)
+	if len(f) == 0 {
+		return ""
+	}
+	return f[0]
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// maxStreamLine is the longest line of output of a streaming script
+// that we read; longer lines end the script.
+const maxStreamLine = 1024 * 1024
+
+// A resident is the process of a streaming script, which stays
+// running between probes, and the latest complete block of output it
+// wrote. updated is closed, and replaced, whenever a block is
+// complete or the process exits.
+type resident struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	block   string
+	have    bool
+	err     error
+	updated chan struct{}
+}
+
+var (
+	residentsMu sync.Mutex
+	residents   = make(map[string]*resident)
+)
+
+// streamBlock returns the latest block of output of a streaming
+// script, starting its process if it isn't running yet. If there is
+// no block yet, it waits for one for at most timeout, unless that is
+// zero, and until ctx is done.
+func streamBlock(ctx context.Context, sc *config.ScriptConfig, timeout time.Duration, maxBytes int64) (string, error) {
+	r, err := startResident(sc, maxBytes)
+	if err != nil {
+		return "", err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for waiting := true; !r.have && waiting; {
+		updated := r.updated
+		r.mu.Unlock()
+		select {
+		case <-updated:
+		case <-expired:
+			waiting = false
+		case <-ctx.Done():
+			waiting = false
+		}
+		r.mu.Lock()
+	}
+	if !r.have {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if r.err != nil {
+			return "", fmt.Errorf("no complete output yet, last run: %s", r.err)
+		}
+		return "", errors.New("no complete output yet")
+	}
+	return r.block, nil
+}
+
+// startResident returns the resident process of a streaming script,
+// starting it if there is none.
+func startResident(sc *config.ScriptConfig, maxBytes int64) (*resident, error) {
+	residentsMu.Lock()
+	defer residentsMu.Unlock()
+	if r := residents[sc.Name]; r != nil {
+		return r, nil
+	}
+
+	c, err := scriptCommand(context.Background(), sc, nil, sc.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.Attr = residentProcAttr(c.Attr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &resident{cancel: cancel, updated: make(chan struct{})}
+	residents[sc.Name] = r
+	go r.run(ctx, sc.Name, c, sc.Stream, maxBytes)
+	return r, nil
+}
+
+// stopResidents stops the processes of all streaming scripts, which
+// are started again by their next probe. It's called on reloads, so
+// that they pick up changes of the configuration.
+func stopResidents() {
+	residentsMu.Lock()
+	defer residentsMu.Unlock()
+	for name, r := range residents {
+		r.cancel()
+		delete(residents, name)
+	}
+}
+
+// run runs the process of a streaming script until ctx is done,
+// starting it again whenever it exits. The last block of a process
+// that exited isn't served any more.
+func (r *resident) run(ctx context.Context, scriptName string, c runner.Command, st config.StreamConfig, maxBytes int64) {
+	for {
+		err := r.runOnce(ctx, c, st.Delimiter, maxBytes)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		log.Printf("Streaming script %s stopped, restarting it: %s\n", scriptName, err.Error())
+
+		r.mu.Lock()
+		r.block, r.have, r.err = "", false, err
+		r.notify()
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(st.RestartDelay):
+		}
+	}
+}
+
+// runOnce runs the process of a streaming script once, keeping every
+// complete block of output it writes, until it exits.
+func (r *resident) runOnce(ctx context.Context, c runner.Command, delimiter string, maxBytes int64) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		r.readBlocks(pr, delimiter, maxBytes)
+		io.Copy(ioutil.Discard, pr)
+		close(done)
+	}()
+
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Args = c.Args
+	cmd.Dir = c.Dir
+	cmd.SysProcAttr = c.Attr
+	cmd.Stdout = pw
+	cmd.WaitDelay = runner.WaitDelay
+	err := runner.Pipeline(ctx, cmd, c)
+	pw.Close()
+	<-done
+	return err
+}
+
+// readBlocks reads the output of a streaming script and keeps every
+// block that ends with a delimiter line as the latest one. Blocks
+// longer than maxBytes, unless it's zero, are dropped.
+func (r *resident) readBlocks(output io.Reader, delimiter string, maxBytes int64) {
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64*1024), maxStreamLine)
+
+	var b strings.Builder
+	tooLong := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line != delimiter {
+			if maxBytes > 0 && int64(b.Len()+len(line)+1) > maxBytes {
+				tooLong = true
+				continue
+			}
+			b.WriteString(line)
+			b.WriteByte('\n')
+			continue
+		}
+
+		if tooLong {
+			log.Printf("Dropping block of streaming script output, it exceeds the limits\n")
+		} else {
+			r.mu.Lock()
+			r.block, r.have, r.err = b.String(), true, nil
+			r.notify()
+			r.mu.Unlock()
+		}
+		b.Reset()
+		tooLong = false
+	}
+}
+
+// notify wakes up probes waiting for a block. It must be called with
+// r.mu held.
+func (r *resident) notify() {
+	close(r.updated)
+	r.updated = make(chan struct{})
+}
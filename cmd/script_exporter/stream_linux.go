@@ -0,0 +1,15 @@
+package main
+
+import "syscall"
+
+// residentProcAttr makes the processes of streaming scripts get
+// killed when we exit, so that a restarted exporter doesn't end up
+// with two of them. The signal is sent when the thread that started
+// the process exits, which Go threads normally don't.
+func residentProcAttr(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+	attr.Pdeathsig = syscall.SIGKILL
+	return attr
+}
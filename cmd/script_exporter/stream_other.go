@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// residentProcAttr returns the attributes unchanged, since only Linux
+// can kill processes when their parent exits.
+func residentProcAttr(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	return attr
+}
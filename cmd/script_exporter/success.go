@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// successError is the error of a run of a script that didn't meet
+// its success criteria.
+type successError struct {
+	reason string
+}
+
+func (e *successError) Error() string {
+	return "success criteria not met: " + e.reason
+}
+
+// checkSuccess applies the success criteria of a script to the result
+// of a run and returns the error of the run according to them. The
+// exit statuses of scripts in formats that give meaning to them, such
+// as those of Nagios plugins, are their results, so exit codes don't
+// apply to them.
+func checkSuccess(sc *config.ScriptConfig, output string, err error) error {
+	sw := sc.SuccessWhen
+	if sw == nil {
+		return err
+	}
+
+	_, statuses := parser.Lookup(sc.Format).(parser.StatusParser)
+	_, exited := err.(*exec.ExitError)
+	if _, ok := err.(*runner.ExitStatusError); ok {
+		exited = true
+	}
+	if (exited || err == nil) && len(sw.ExitCodes) > 0 && !statuses {
+		code := runner.ExitCode(err)
+		err = &successError{fmt.Sprintf("exit status %d", code)}
+		for _, c := range sw.ExitCodes {
+			if c == code {
+				err = nil
+				break
+			}
+		}
+	}
+	if err != nil || !sw.ChecksOutput() {
+		return err
+	}
+
+	if re := sw.OutputMatchesRegexp(); re != nil && !re.MatchString(output) {
+		return &successError{fmt.Sprintf("output doesn't match %q", sw.OutputMatches)}
+	}
+	if re := sw.OutputNotMatchesRegexp(); re != nil && re.MatchString(output) {
+		return &successError{fmt.Sprintf("output matches %q", sw.OutputNotMatches)}
+	}
+	if sw.MinLines > 0 {
+		lines := 0
+		for _, line := range strings.Split(output, "\n") {
+			if strings.TrimSpace(line) != "" {
+				lines++
+			}
+		}
+		if lines < sw.MinLines {
+			return &successError{fmt.Sprintf("%d lines of output, expected at least %d", lines, sw.MinLines)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// writeTextfile writes the output of a run of a script to a file in
+// the format of the node_exporter textfile collector. The output is
+// validated by parsing it, every series gets a 'script' label, unless
+// it has one already, and timestamps are dropped, since the textfile
+// collector doesn't accept them. The file is replaced atomically, so
+// that the collector never sees a partial file.
+func writeTextfile(dir, scriptName, output string) error {
+	var textParser expfmt.TextParser
+	families, err := textParser.TextToMetricFamilies(strings.NewReader(parser.StripExemplars(output)))
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		mf := families[name]
+		for _, m := range mf.Metric {
+			m.TimestampMs = nil
+			m.Label = addScriptLabel(m.Label, scriptName)
+		}
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return err
+		}
+	}
+
+	file := textfilePath(dir, scriptName)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeTextfile removes the file of a script that isn't run any
+// more, so that the collector doesn't serve its last results forever.
+func removeTextfile(dir, scriptName string) error {
+	err := os.Remove(textfilePath(dir, scriptName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// textfilePath returns the file that the results of a script are
+// written to. The collector only reads files ending in '.prom'.
+func textfilePath(dir, scriptName string) string {
+	return filepath.Join(dir, url.PathEscape(scriptName)+".prom")
+}
+
+// addScriptLabel adds a 'script' label to label pairs that don't have
+// one, keeping them sorted by name.
+func addScriptLabel(labels []*dto.LabelPair, scriptName string) []*dto.LabelPair {
+	for _, l := range labels {
+		if l.GetName() == "script" {
+			return labels
+		}
+	}
+
+	name, value := "script", scriptName
+	labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels
+}
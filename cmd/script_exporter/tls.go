@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/server"
+)
+
+// certCheckInterval is how often we check at most whether the server
+// certificate has changed on disk.
+const certCheckInterval = 10 * time.Second
+
+// A certReloader serves the server certificate, and loads it again
+// when its files change, such as when it's renewed. If the changed
+// files can't be loaded, for example because only one of them has
+// been replaced yet, it keeps serving the previous certificate.
+type certReloader struct {
+	crt, key string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader loads the certificate and key from their files.
+func newCertReloader(crt, key string) (*certReloader, error) {
+	cr := &certReloader{crt: crt, key: key}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// load loads the certificate from its files.
+func (cr *certReloader) load() error {
+	modTime := cr.filesModTime()
+	cert, err := tls.LoadX509KeyPair(cr.crt, cr.key)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the time the certificate files were modified
+// last.
+func (cr *certReloader) filesModTime() time.Time {
+	var t time.Time
+	for _, file := range []string{cr.crt, cr.key} {
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// getCertificate is the tls.Config GetCertificate function.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if now := time.Now(); now.Sub(cr.lastCheck) >= certCheckInterval {
+		cr.lastCheck = now
+		if !cr.filesModTime().Equal(cr.modTime) {
+			if err := cr.load(); err != nil {
+				log.Printf("Failed to reload TLS certificate: %s\n", err.Error())
+			} else {
+				log.Printf("Reloaded TLS certificate from %s\n", cr.crt)
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server with
+// the settings of a configuration, which serves a certReloader's
+// certificate.
+func serverTLSConfig(c *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if c.TLS.ClientCA != "" {
+		var err error
+		if tlsConfig, err = server.ClientCATLSConfig(c.TLS.ClientCA); err != nil {
+			return nil, err
+		}
+	}
+
+	cr, err := newCertReloader(c.TLS.Crt, c.TLS.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.GetCertificate = cr.getCertificate
+
+	if c.TLS.MinVersion != "" {
+		tlsConfig.MinVersion = config.TLSVersions[c.TLS.MinVersion]
+	}
+	for _, name := range c.TLS.CipherSuites {
+		id, _ := config.TLSCipherSuite(name)
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	for _, name := range c.TLS.CurvePreferences {
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, config.TLSCurves[name])
+	}
+	return tlsConfig, nil
+}
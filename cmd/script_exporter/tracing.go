@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/version"
+)
+
+// Finished spans are queued and sent in batches, when there are
+// traceBatchSize of them or every traceFlushInterval. Spans are
+// dropped if the queue is full, so that an unreachable collector
+// can't slow down probes.
+const (
+	traceQueueSize     = 1000
+	traceBatchSize     = 100
+	traceFlushInterval = 5 * time.Second
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	statusCodeError  = 2
+)
+
+var traceQueue = make(chan *span, traceQueueSize)
+
+// An attribute of a span has a string, bool or int64 value.
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// A span is an OpenTelemetry span. Only sampled spans exist; a nil
+// *span stands for one that isn't traced, and all methods do nothing
+// on it.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	finish   time.Time
+	attrs    []attribute
+	err      error
+}
+
+// spanKey is the context key of the span of a request.
+type spanKey struct{}
+
+// traced returns middleware that traces requests, continuing the
+// trace of W3C trace context headers.
+func traced(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := startRequestSpan(r)
+		if s == nil {
+			h(w, r)
+			return
+		}
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+
+		s.setAttr("http.response.status_code", int64(sw.status))
+		var err error
+		if sw.status >= 500 {
+			err = fmt.Errorf("%s", http.StatusText(sw.status))
+		}
+		s.end(err)
+	}
+}
+
+// requestSpan returns the span of a traced request, or nil.
+func requestSpan(r *http.Request) *span {
+	s, _ := r.Context().Value(spanKey{}).(*span)
+	return s
+}
+
+// startRequestSpan starts the server span of a request, if it's
+// sampled.
+func startRequestSpan(r *http.Request) *span {
+	t := &getConfig().Tracing
+	if t.Endpoint == "" {
+		return nil
+	}
+
+	s := &span{name: "probe", kind: spanKindServer, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		if mrand.Float64() >= t.SamplingFraction {
+			return nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// parseTraceparent parses a W3C traceparent header, of the form
+// 00-<trace id>-<parent id>-<flags>.
+func parseTraceparent(h string) ([16]byte, [8]byte, bool, bool) {
+	var traceID [16]byte
+	var parentID [8]byte
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return traceID, parentID, false, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if traceID == ([16]byte{}) || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// child starts a span within s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{traceID: s.traceID, parentID: s.spanID, name: name, kind: spanKindInternal, start: time.Now()}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, attribute{key: key, value: value})
+	}
+}
+
+// end ends a span, which failed if err isn't nil, and queues it for
+// sending.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.finish = time.Now()
+	s.err = err
+	select {
+	case traceQueue <- s:
+	default:
+	}
+}
+
+// A statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// startTracing starts sending queued spans to the OTLP endpoint. It
+// reads the configuration for every request, so that reloads take
+// effect.
+func startTracing() {
+	go func() {
+		var batch []*span
+		tick := time.NewTicker(traceFlushInterval)
+		for {
+			select {
+			case s := <-traceQueue:
+				if batch = append(batch, s); len(batch) < traceBatchSize {
+					continue
+				}
+			case <-tick.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			if err := sendTraces(&getConfig().Tracing, batch); err != nil {
+				log.Printf("Sending traces failed, dropping %d spans: %s\n", len(batch), err.Error())
+			}
+			batch = nil
+		}
+	}()
+}
+
+// sendTraces sends spans to the OTLP endpoint in a single request.
+func sendTraces(t *config.TracingConfig, spans []*span) error {
+	if t.Endpoint == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint, bytes.NewReader(encodeTraces(spans)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "script_exporter")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: t.Timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+// encodeTraces encodes spans as an OTLP ExportTraceServiceRequest
+// protobuf message:
+//
+//	message ExportTraceServiceRequest { repeated ResourceSpans resource_spans = 1; }
+//	message ResourceSpans { Resource resource = 1; repeated ScopeSpans scope_spans = 2; }
+//	message Resource { repeated KeyValue attributes = 1; }
+//	message ScopeSpans { InstrumentationScope scope = 1; repeated Span spans = 2; }
+//	message InstrumentationScope { string name = 1; string version = 2; }
+func encodeTraces(spans []*span) []byte {
+	var resource []byte
+	resource = appendProtoBytes(resource, 1, encodeAttribute(attribute{"service.name", "script_exporter"}))
+	resource = appendProtoBytes(resource, 1, encodeAttribute(attribute{"service.version", version.Version}))
+
+	var scope []byte
+	scope = appendProtoBytes(scope, 1, []byte("script_exporter"))
+	scope = appendProtoBytes(scope, 2, []byte(version.Version))
+
+	var ss []byte
+	ss = appendProtoBytes(ss, 1, scope)
+	for _, s := range spans {
+		ss = appendProtoBytes(ss, 2, encodeSpan(s))
+	}
+
+	var rs []byte
+	rs = appendProtoBytes(rs, 1, resource)
+	rs = appendProtoBytes(rs, 2, ss)
+	return appendProtoBytes(nil, 1, rs)
+}
+
+// encodeSpan encodes a span as an OTLP Span protobuf message:
+//
+//	message Span {
+//	  bytes trace_id = 1; bytes span_id = 2; bytes parent_span_id = 4;
+//	  string name = 5; SpanKind kind = 6;
+//	  fixed64 start_time_unix_nano = 7; fixed64 end_time_unix_nano = 8;
+//	  repeated KeyValue attributes = 9; Status status = 15;
+//	}
+//	message Status { string message = 2; StatusCode code = 3; }
+func encodeSpan(s *span) []byte {
+	var b []byte
+	b = appendProtoBytes(b, 1, s.traceID[:])
+	b = appendProtoBytes(b, 2, s.spanID[:])
+	if s.parentID != ([8]byte{}) {
+		b = appendProtoBytes(b, 4, s.parentID[:])
+	}
+	b = appendProtoBytes(b, 5, []byte(s.name))
+	b = appendProtoVarint(b, 6, uint64(s.kind))
+	b = appendProtoFixed64(b, 7, uint64(s.start.UnixNano()))
+	b = appendProtoFixed64(b, 8, uint64(s.finish.UnixNano()))
+	for _, a := range s.attrs {
+		b = appendProtoBytes(b, 9, encodeAttribute(a))
+	}
+	if s.err != nil {
+		var st []byte
+		st = appendProtoBytes(st, 2, []byte(s.err.Error()))
+		st = appendProtoVarint(st, 3, statusCodeError)
+		b = appendProtoBytes(b, 15, st)
+	}
+	return b
+}
+
+// encodeAttribute encodes an attribute as an OTLP KeyValue protobuf
+// message:
+//
+//	message KeyValue { string key = 1; AnyValue value = 2; }
+//	message AnyValue { oneof value { string string_value = 1; bool bool_value = 2; int64 int_value = 3; } }
+func encodeAttribute(a attribute) []byte {
+	var v []byte
+	switch x := a.value.(type) {
+	case string:
+		v = appendProtoBytes(v, 1, []byte(x))
+	case bool:
+		var n uint64
+		if x {
+			n = 1
+		}
+		v = appendProtoVarint(v, 2, n)
+	case int64:
+		v = appendProtoVarint(v, 3, uint64(x))
+	}
+
+	var kv []byte
+	kv = appendProtoBytes(kv, 1, []byte(a.key))
+	return appendProtoBytes(kv, 2, v)
+}
+
+// appendProtoVarint appends a varint protobuf field.
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|0)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendProtoFixed64 appends a fixed64 protobuf field.
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
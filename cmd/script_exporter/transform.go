@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ricoberger/script_exporter/pkg/parser"
+)
+
+// transformData is what the transform of a script renders a sample
+// with. Samples are the values of the samples of the output before
+// it, as they were before the transform, by name and label set, such
+// as `used_bytes{disk="sda"}`.
+type transformData struct {
+	Name     string
+	Labels   map[string]string
+	LabelSet string
+	Value    float64
+	Samples  map[string]float64
+}
+
+// An outputSample is a sample that formatOutput writes, with the
+// series and the whitespace before its value.
+type outputSample struct {
+	name   string
+	series string
+	value  string
+}
+
+// transformSample renders a sample with the transform of its script
+// and returns the samples of its lines, which get the timestamp of
+// the sample, if any, unless they have one of their own.
+func transformSample(t *template.Template, name string, labels []parser.Label, value float64, timestamp string, samples map[string]float64) ([]outputSample, error) {
+	data := transformData{
+		Name:     name,
+		Labels:   make(map[string]string, len(labels)),
+		LabelSet: parser.FormatLabels(labels),
+		Value:    value,
+		Samples:  samples,
+	}
+	for _, l := range labels {
+		data.Labels[l.Name] = l.Value
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return nil, err
+	}
+
+	var out []outputSample
+	for _, line := range strings.Split(b.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s, err := parseTransformed(addLabelSet(line), timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", line, err)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// parseTransformed checks a sample that a transform yielded, as in
+// 'name{labels} value [timestamp]'.
+func parseTransformed(line, timestamp string) (outputSample, error) {
+	i, j := strings.Index(line, "{"), strings.LastIndex(line, "}")
+	if i < 0 || j < i {
+		return outputSample{}, errors.New("not of the form 'name{labels} value'")
+	}
+	name := line[:i]
+	if !parser.ValidMetricName(name) {
+		return outputSample{}, errors.New("invalid metric name")
+	}
+	labels, err := parser.ParseLabels(line[i : j+1])
+	if err != nil {
+		return outputSample{}, err
+	}
+	fields := strings.Fields(line[j+1:])
+	if len(fields) == 0 || len(fields) > 2 {
+		return outputSample{}, errors.New("invalid value")
+	}
+	if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+		return outputSample{}, errors.New("invalid value")
+	}
+	if len(fields) == 2 {
+		if _, err := strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return outputSample{}, errors.New("invalid timestamp")
+		}
+	} else if timestamp != "" {
+		fields = append(fields, timestamp)
+	}
+	return outputSample{name: name, series: name + parser.FormatLabels(labels) + " ", value: strings.Join(fields, " ")}, nil
+}
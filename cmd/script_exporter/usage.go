@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+const (
+	scriptCPUSecondsHelp = "# HELP script_cpu_seconds CPU time used by the script, in seconds, by mode."
+	scriptCPUSecondsType = "# TYPE script_cpu_seconds gauge"
+	scriptMaxRSSHelp     = "# HELP script_max_rss_bytes Maximum resident set size of the script, in bytes."
+	scriptMaxRSSType     = "# TYPE script_max_rss_bytes gauge"
+)
+
+// usageMetrics returns the resource usage of a run as the samples
+// that probes serve, or nothing for scripts that aren't programs we
+// ran.
+func usageMetrics(u *runner.Usage) string {
+	if !u.Known {
+		return ""
+	}
+	s := fmt.Sprintf("%s\n%s\n%s_cpu_seconds{mode=\"user\"} %f\n%s_cpu_seconds{mode=\"system\"} %f\n", scriptCPUSecondsHelp, scriptCPUSecondsType, namespace, u.UserTime, namespace, u.SystemTime)
+	if u.MaxRSS > 0 {
+		s += fmt.Sprintf("%s\n%s\n%s_max_rss_bytes{} %d\n", scriptMaxRSSHelp, scriptMaxRSSType, namespace, u.MaxRSS)
+	}
+	return s
+}
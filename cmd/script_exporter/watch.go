@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// watchConfig reloads the configuration file automatically whenever
+// it or its scriptFiles change, once there have been no further
+// changes for debounce. We watch the directories of the files rather
+// than the files, since editors and Kubernetes ConfigMaps replace
+// files instead of writing to them.
+func watchConfig(file string, debounce time.Duration) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	watched := make(map[string]bool)
+	watch := func(c *config.Config) {
+		for _, dir := range watchDirs(file, c) {
+			if watched[dir] {
+				continue
+			}
+			if err := w.Add(dir); err != nil {
+				log.Printf("Can't watch %s for configuration changes: %s\n", dir, err.Error())
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watch(getConfig())
+
+	go func() {
+		var reload <-chan time.Time
+		for {
+			select {
+			case ev := <-w.Events:
+				if ev.Op != fsnotify.Chmod && isConfigFile(file, getConfig(), ev.Name) {
+					reload = time.After(debounce)
+				}
+			case err := <-w.Errors:
+				log.Printf("Error watching for configuration changes: %s\n", err.Error())
+			case <-reload:
+				reload = nil
+				reloadConfig(file)
+				watch(getConfig())
+			}
+		}
+	}()
+	return nil
+}
+
+// watchDirs returns the directories that the configuration file and
+// the scriptFiles of a configuration are in.
+func watchDirs(file string, c *config.Config) []string {
+	dirs := []string{filepath.Dir(file)}
+	for _, pattern := range scriptFilePatterns(file, c) {
+		dir := filepath.Dir(pattern)
+		// Directories with globs in them can't be watched.
+		if !strings.ContainsAny(dir, `*?[`) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// isConfigFile reports whether a changed file is part of the
+// configuration: the configuration file, one of its scriptFiles, or
+// the data of a Kubernetes ConfigMap volume, which is swapped out
+// through entries starting with '..'.
+func isConfigFile(file string, c *config.Config, name string) bool {
+	if filepath.Clean(name) == filepath.Clean(file) || strings.HasPrefix(filepath.Base(name), "..") {
+		return true
+	}
+	for _, pattern := range scriptFilePatterns(file, c) {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptFilePatterns returns the scriptFiles patterns of a
+// configuration relative to the working directory, the way they are
+// loaded.
+func scriptFilePatterns(file string, c *config.Config) []string {
+	var patterns []string
+	for _, pattern := range c.ScriptFiles {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// windowResult is the last successful result of a probe of a script
+// with windows, which probes outside of them serve.
+type windowResult struct {
+	scriptName string
+	output     string
+	stored     time.Time
+}
+
+var (
+	windowMu      sync.Mutex
+	windowResults = make(map[string]windowResult)
+)
+
+// storeWindowResult keeps the result of a probe of a script for key,
+// produced at stored. Like the cache, it's bounded, by forgetting the oldest result
+// once it's full.
+func storeWindowResult(key, scriptName, output string, stored time.Time) {
+	windowMu.Lock()
+	defer windowMu.Unlock()
+
+	if _, ok := windowResults[key]; !ok && len(windowResults) >= sweepCacheSize {
+		var oldest string
+		for k, wr := range windowResults {
+			if oldest == "" || wr.stored.Before(windowResults[oldest].stored) {
+				oldest = k
+			}
+		}
+		delete(windowResults, oldest)
+	}
+	windowResults[key] = windowResult{scriptName: scriptName, output: output, stored: stored}
+}
+
+// skippedResult returns what a probe of a script outside of its
+// windows serves: the last successful result for key, from memory or
+// else the one persisted in dir, if there is one, with its age, and
+// script_skipped.
+func skippedResult(key, dir string) string {
+	skipped := fmt.Sprintf("%s\n%s\n%s_skipped{} %d\n", scriptSkippedHelp, scriptSkippedType, namespace, 1)
+
+	windowMu.Lock()
+	wr, ok := windowResults[key]
+	windowMu.Unlock()
+	if !ok && dir != "" {
+		if p, found := loadPersistedResult(dir, key); found {
+			wr, ok = windowResult{scriptName: p.Script, output: staleOutput(p.Output, true), stored: p.Time}, true
+			storeWindowResult(key, wr.scriptName, wr.output, wr.stored)
+		}
+	}
+	if !ok {
+		return skipped
+	}
+	return fmt.Sprintf("%s%s%s\n%s\n%s_result_age_seconds{} %f\n", wr.output, skipped, scriptResultAgeHelp, scriptResultAgeType, namespace, time.Since(wr.stored).Seconds())
+}
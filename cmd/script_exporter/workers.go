@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ricoberger/script_exporter/pkg/config"
+	"github.com/ricoberger/script_exporter/pkg/runner"
+)
+
+// maxWorkerResponseBytes is the largest response of a worker we read
+// for a script without limits.maxOutputBytes.
+const maxWorkerResponseBytes = 64 * 1024 * 1024
+
+// A workerRequest is what a worker gets for every script it runs, as
+// one line of JSON on its standard input: the path and the contents of
+// the script, its arguments, its standard input and the environment
+// variables it gets on top of those of the worker.
+type workerRequest struct {
+	Script string   `json:"script"`
+	Body   string   `json:"body"`
+	Args   []string `json:"args"`
+	Stdin  string   `json:"stdin,omitempty"`
+	Env    []string `json:"env,omitempty"`
+}
+
+// A workerResponse is what a worker answers with once the script has
+// run, as one line of JSON on its standard output: the output of the
+// script and its exit status.
+type workerResponse struct {
+	Output   string `json:"output"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// A worker is a running process of a worker pool.
+type worker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	runs   int
+}
+
+// A workerPool keeps the processes of a worker pool. Every worker
+// holds a token while it exists, so that there are never more than
+// the size of the pool, and idle has those that wait for a script.
+type workerPool struct {
+	config config.WorkerPoolConfig
+	tokens chan struct{}
+	idle   chan *worker
+
+	mu     sync.Mutex
+	closed bool
+}
+
+var (
+	workersMu   sync.Mutex
+	workerPools = make(map[string]*workerPool)
+
+	workerStarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "scripts",
+			Name:      "worker_starts_total",
+			Help:      "Processes of worker pools that were started.",
+		},
+		[]string{"pool"})
+)
+
+// The runner of scripts of type worker.
+func init() {
+	runner.Register(config.TypeWorker, runner.Func(runWorkerScript))
+}
+
+// restartWorkers replaces the worker pools with those of a
+// configuration that was just loaded, which start their processes in
+// the background. The processes of the old pools are stopped once
+// they are done with the scripts they are running.
+func restartWorkers(c *config.Config) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for name, p := range workerPools {
+		p.close()
+		delete(workerPools, name)
+	}
+	for _, pc := range c.Workers {
+		p := &workerPool{config: pc, tokens: make(chan struct{}, pc.Size), idle: make(chan *worker, pc.Size)}
+		workerPools[pc.Name] = p
+		go p.fill()
+	}
+}
+
+// getWorkerPool returns the worker pool with a name, or nil.
+func getWorkerPool(name string) *workerPool {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	return workerPools[name]
+}
+
+// fill starts the processes of a pool that are missing.
+func (p *workerPool) fill() {
+	for {
+		select {
+		case p.tokens <- struct{}{}:
+		default:
+			return
+		}
+		w, err := p.start()
+		if err != nil {
+			log.Printf("Worker pool %s: %s\n", p.config.Name, err.Error())
+			<-p.tokens
+			return
+		}
+		p.release(w, true)
+	}
+}
+
+// start starts a process of a pool.
+func (p *workerPool) start() (*worker, error) {
+	args := config.SplitCommand(p.config.Command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = residentProcAttr(nil)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	workerStarts.WithLabelValues(p.config.Name).Inc()
+	return &worker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// acquire returns an idle process of a pool, starting one if the pool
+// isn't full, and waits for one until ctx is done otherwise.
+func (p *workerPool) acquire(ctx context.Context) (*worker, error) {
+	select {
+	case w := <-p.idle:
+		return w, nil
+	default:
+	}
+	select {
+	case w := <-p.idle:
+		return w, nil
+	case p.tokens <- struct{}{}:
+		w, err := p.start()
+		if err != nil {
+			<-p.tokens
+			return nil, fmt.Errorf("worker pool %s: %s", p.config.Name, err)
+		}
+		return w, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release returns a process to its pool once it ran a script, or stops
+// it if it's no good any more, it ran the most scripts it may, or the
+// pool was closed.
+func (p *workerPool) release(w *worker, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok && !p.closed && (p.config.MaxRuns == 0 || w.runs < p.config.MaxRuns) {
+		p.idle <- w
+		return
+	}
+	w.stop()
+	<-p.tokens
+}
+
+// close stops the idle processes of a pool, and makes the others stop
+// once they are released.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for {
+		select {
+		case w := <-p.idle:
+			w.stop()
+		default:
+			return
+		}
+	}
+}
+
+// stop stops a process of a worker pool, which should exit once its
+// standard input is closed, and is killed otherwise.
+func (w *worker) stop() {
+	w.stdin.Close()
+	done := make(chan struct{})
+	go func() {
+		w.cmd.Wait()
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(runner.WaitDelay):
+			w.cmd.Process.Kill()
+		}
+	}()
+}
+
+// run sends a script to a process and returns its response, reading
+// at most max bytes of it.
+func (w *worker) run(req *workerRequest, max int64) (*workerResponse, error) {
+	w.runs++
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.stdin.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	var line []byte
+	for {
+		chunk, err := w.stdout.ReadSlice('\n')
+		line = append(line, chunk...)
+		if int64(len(line)) > max {
+			return nil, fmt.Errorf("response larger than %d bytes", max)
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+	var res workerResponse
+	if err := json.Unmarshal(line, &res); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	return &res, nil
+}
+
+// runWorkerScript runs a script of type worker in a process of its
+// pool. A process that doesn't answer before the timeout is killed.
+func runWorkerScript(s *runner.Script) (string, bool, error) {
+	sc := s.Config
+	p := getWorkerPool(sc.Worker)
+	if p == nil {
+		return "", false, fmt.Errorf("worker pool %s not running", sc.Worker)
+	}
+	path := sc.Script
+	if sc.Cwd != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(sc.Cwd, path)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	w, err := p.acquire(ctx)
+	if err == context.DeadlineExceeded {
+		return "", false, &runner.TimeoutError{Timeout: s.Timeout}
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	max := int64(maxWorkerResponseBytes)
+	if s.MaxBytes > 0 {
+		max = 2*s.MaxBytes + 4096
+	}
+	req := &workerRequest{Script: path, Body: string(body), Args: append([]string{}, s.Params...), Stdin: string(s.Stdin), Env: append(append([]string(nil), sc.Environ()...), s.Env...)}
+	type result struct {
+		res *workerResponse
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := w.run(req, max)
+		done <- result{res, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		w.cmd.Process.Kill()
+		<-done
+		p.release(w, false)
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", false, &runner.TimeoutError{Timeout: s.Timeout}
+		}
+		return "", false, ctx.Err()
+	}
+	p.release(w, r.err == nil)
+	if r.err != nil {
+		return "", false, fmt.Errorf("worker pool %s: %s", sc.Worker, r.err)
+	}
+
+	var out strings.Builder
+	lw := runner.NewLimitedWriter(&out, s.MaxBytes)
+	lw.Write([]byte(r.res.Output))
+	lw.Flush()
+	if r.res.ExitCode != 0 {
+		err = &runner.ExitStatusError{Status: r.res.ExitCode}
+	}
+	return out.String(), lw.Truncated(), err
+}
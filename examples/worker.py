@@ -0,0 +1,35 @@
+#!/usr/bin/env python3
+# A worker for worker pools of the script_exporter: it runs the Python
+# scripts it gets on its standard input, one JSON request per line,
+# and answers every one with their output and exit status.
+
+import contextlib
+import io
+import json
+import os
+import sys
+import traceback
+
+for line in sys.stdin:
+    req = json.loads(line)
+    out = io.StringIO()
+    code = 0
+    env = dict(os.environ)
+    for kv in req.get("env") or []:
+        k, _, v = kv.partition("=")
+        os.environ[k] = v
+    sys.argv = [req["script"]] + (req.get("args") or [])
+    sys.stdin = io.StringIO(req.get("stdin", ""))
+    try:
+        with contextlib.redirect_stdout(out):
+            exec(compile(req["body"], req["script"], "exec"), {"__name__": "__main__"})
+    except SystemExit as e:
+        code = e.code if isinstance(e.code, int) else (0 if e.code is None else 1)
+    except Exception:
+        traceback.print_exc()
+        code = 1
+    os.environ.clear()
+    os.environ.update(env)
+    sys.stdin = sys.__stdin__
+    sys.__stdout__.write(json.dumps({"output": out.getvalue(), "exitCode": code}) + "\n")
+    sys.__stdout__.flush()
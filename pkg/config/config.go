@@ -1,7 +1,31 @@
 package config
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	htmltemplate "html/template"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -12,40 +36,3848 @@ type Config struct {
 		Active bool   `yaml:"active"`
 		Crt    string `yaml:"crt"`
 		Key    string `yaml:"key"`
+
+		// ClientCA is a file of CA certificates that client
+		// certificates are verified against, if clients present
+		// one.
+		ClientCA string `yaml:"clientCA"`
+
+		// MinVersion, CipherSuites and CurvePreferences restrict
+		// the TLS connections we accept, by the names in
+		// TLSVersions, crypto/tls and TLSCurves; by default,
+		// those of crypto/tls are used.
+		MinVersion       string   `yaml:"minVersion"`
+		CipherSuites     []string `yaml:"cipherSuites"`
+		CurvePreferences []string `yaml:"curvePreferences"`
 	} `yaml:"tls"`
 
-	BasicAuth struct {
-		Active   bool   `yaml:"active"`
-		Username string `yaml:"username"`
-		Password string `yaml:"password"`
-	} `yaml:"basicAuth"`
+	// Secrets can also be read from files, given by the keys
+	// ending in File, so that they don't have to be in the
+	// configuration file.
+	BasicAuth struct {
+		Active       bool   `yaml:"active"`
+		Username     string `yaml:"username"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"passwordFile"`
+	} `yaml:"basicAuth"`
+
+	BearerAuth struct {
+		Active         bool   `yaml:"active"`
+		SigningKey     string `yaml:"signingKey"`
+		SigningKeyFile string `yaml:"signingKeyFile"`
+
+		// SigningKeys are further HMAC keys that tokens may be
+		// signed with, so that keys can be rotated. Tokens that
+		// we create are signed with SigningKey.
+		SigningKeys []string `yaml:"signingKeys"`
+
+		// Tokens signed with RSA or ECDSA keys are verified with
+		// the public keys in the PEM file PublicKeyFile, and with
+		// those of the JSON Web Key Set at JWKSURL, which is
+		// fetched again every JWKSRefresh.
+		PublicKeyFile string        `yaml:"publicKeyFile"`
+		JWKSURL       string        `yaml:"jwksURL"`
+		JWKSRefresh   time.Duration `yaml:"jwksRefresh"`
+	} `yaml:"bearerAuth"`
+
+	// OAuth2 validates bearer tokens issued by an OpenID Connect
+	// Issuer, which are JSON Web Tokens for the Audience, or with
+	// the RFC 7662 IntrospectionURL, authenticated as ClientID.
+	// Tokens must have all of the Scopes. Introspected tokens are
+	// remembered for CacheDuration.
+	OAuth2 struct {
+		Active           bool          `yaml:"active"`
+		Issuer           string        `yaml:"issuer"`
+		Audience         string        `yaml:"audience"`
+		Scopes           []string      `yaml:"scopes"`
+		IntrospectionURL string        `yaml:"introspectionURL"`
+		ClientID         string        `yaml:"clientID"`
+		ClientSecret     string        `yaml:"clientSecret"`
+		ClientSecretFile string        `yaml:"clientSecretFile"`
+		CacheDuration    time.Duration `yaml:"cacheDuration"`
+	} `yaml:"oauth2"`
+
+	// AuthEndpoints are the endpoints that need authentication,
+	// when it's active. By default, probes and the admin endpoints
+	// do.
+	AuthEndpoints []string `yaml:"authEndpoints"`
+
+	// Access restricts the clients that may use the probe, metrics
+	// and admin endpoints by their address, before they are
+	// authenticated. Empty lists allow everyone.
+	Access struct {
+		// TrustedProxies are the reverse proxies whose
+		// X-Forwarded-For headers tell the client address.
+		TrustedProxies Networks `yaml:"trustedProxies"`
+
+		// With ProxyProtocol, connections from trusted proxies
+		// and over unix sockets start with a PROXY protocol
+		// header, which has the address of the client.
+		ProxyProtocol bool `yaml:"proxyProtocol"`
+
+		Probe   Networks `yaml:"probe"`
+		Metrics Networks `yaml:"metrics"`
+		Admin   Networks `yaml:"admin"`
+	} `yaml:"access"`
+
+	// AccessLog logs every request in the common log format or as
+	// JSON, with an ID that scripts run for it get too.
+	AccessLog struct {
+		Active bool   `yaml:"active"`
+		Format string `yaml:"format"`
+	} `yaml:"accessLog"`
+
+	// Readiness configures /-/ready. With a Script, the exporter
+	// is only ready while probes of it with Params succeed.
+	Readiness struct {
+		Script string   `yaml:"script"`
+		Params []string `yaml:"params"`
+	} `yaml:"readiness"`
+
+	// CORS lets browser pages from AllowedOrigins ("*" for any)
+	// call the probe and admin endpoints with AllowedMethods and
+	// AllowedHeaders. Preflight requests are cached for MaxAge.
+	CORS struct {
+		AllowedOrigins []string      `yaml:"allowedOrigins"`
+		AllowedMethods []string      `yaml:"allowedMethods"`
+		AllowedHeaders []string      `yaml:"allowedHeaders"`
+		MaxAge         time.Duration `yaml:"maxAge"`
+	} `yaml:"cors"`
+
+	// Compression compresses the responses of /probe and /metrics
+	// for clients that accept it.
+	Compression struct {
+		Active bool `yaml:"active"`
+	} `yaml:"compression"`
+
+	// HighFrequency tunes the exporter for scraping many cheap
+	// scripts very frequently.
+	HighFrequency struct {
+		Active    bool `yaml:"active"`
+		GCPercent int  `yaml:"gcPercent"`
+	} `yaml:"highFrequency"`
+
+	// Clients configures how scraping clients are identified, and
+	// the parameter defaults that are pinned per client.
+	Clients struct {
+		Header    string                       `yaml:"header"`
+		UseCertCN bool                         `yaml:"useCertCN"`
+		Params    map[string]map[string]string `yaml:"params"`
+	} `yaml:"clients"`
+
+	// LandingPage configures the page served on /.
+	LandingPage struct {
+		Template string `yaml:"template"`
+
+		template *htmltemplate.Template
+	} `yaml:"landingPage"`
+
+	// History configures the ring buffer of recent executions and
+	// its periodic export, and the recent executions kept for every
+	// script, with up to MaxOutputBytes of their output.
+	History struct {
+		Size           int                 `yaml:"size"`
+		PerScript      int                 `yaml:"perScript"`
+		MaxOutputBytes int                 `yaml:"maxOutputBytes"`
+		Export         HistoryExportConfig `yaml:"export"`
+	} `yaml:"history"`
+
+	// RemoteWrite configures sending the results of scheduled
+	// scripts to a remote write endpoint.
+	RemoteWrite RemoteWriteConfig `yaml:"remoteWrite"`
+
+	// Notifiers are told when scheduled scripts start failing or
+	// succeed again.
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+
+	// Tracing configures sending traces of probes to an
+	// OpenTelemetry collector.
+	Tracing TracingConfig `yaml:"tracing"`
+
+	// Textfile configures writing the results of scheduled scripts
+	// to files for the node_exporter textfile collector.
+	Textfile struct {
+		Directory string `yaml:"directory"`
+	} `yaml:"textfile"`
+
+	// NodeLabels configures labels about the host that are added to
+	// every series the exporter emits.
+	NodeLabels NodeLabelsConfig `yaml:"nodeLabels"`
+
+	// Persistence configures keeping the last successful results
+	// of scripts with persistResult in Directory, so that they
+	// survive restarts.
+	Persistence struct {
+		Directory string `yaml:"directory"`
+	} `yaml:"persistence"`
+
+	// FailureBundles configures keeping what is known about failed
+	// runs of scripts in Directory, for postmortems: at most
+	// MaxBundles of them, none older than MaxAge if it's set, with up
+	// to MaxOutputBytes of standard output and error each.
+	FailureBundles struct {
+		Directory      string        `yaml:"directory"`
+		MaxBundles     int           `yaml:"maxBundles"`
+		MaxAge         time.Duration `yaml:"maxAge"`
+		MaxOutputBytes int           `yaml:"maxOutputBytes"`
+	} `yaml:"failureBundles"`
+
+	// InternalMetrics configures the metrics about the exporter
+	// itself on /metrics.
+	InternalMetrics struct {
+		DurationBuckets []float64 `yaml:"durationBuckets"`
+	} `yaml:"internalMetrics"`
+
+	// Probe configures probe requests. MaxBodyBytes bounds the
+	// body of POST requests, which carry parameters, MaxBatchSize
+	// the number of probes of a batch probe, and UnknownScript is
+	// the response to probes of scripts that don't exist.
+	Probe struct {
+		MaxBodyBytes  int64  `yaml:"maxBodyBytes"`
+		MaxBatchSize  int    `yaml:"maxBatchSize"`
+		UnknownScript string `yaml:"unknownScript"`
+	} `yaml:"probe"`
+
+	// Server holds the timeouts and limits of the HTTP server.
+	Server ServerConfig `yaml:"server"`
+
+	// Limits bound the output of all scripts, unless a script has
+	// its own.
+	Limits LimitsConfig `yaml:"limits"`
+
+	// RateLimit bounds the rate of probe requests for all scripts
+	// together.
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+
+	// ExecutionBudget bounds the total time that all scripts run
+	// together, to ScriptSeconds seconds per Interval on average,
+	// which is a minute by default. Zero ScriptSeconds means no
+	// limit.
+	ExecutionBudget struct {
+		ScriptSeconds float64       `yaml:"scriptSeconds"`
+		Interval      time.Duration `yaml:"interval"`
+	} `yaml:"executionBudget"`
+
+	// Naming holds the naming conventions that apply to the
+	// metrics emitted by all scripts, unless a script has its own.
+	Naming *NamingConfig `yaml:"naming"`
+
+	// Defaults are settings of all scripts, including those of
+	// ScriptFiles, that don't have their own.
+	Defaults DefaultsConfig `yaml:"defaults"`
+
+	// Variables are values that the args and labels of scripts
+	// refer to as '{{ var "name" }}', so that the same
+	// configuration fits several environments with only the
+	// variables changed.
+	Variables map[string]string `yaml:"variables"`
+
+	Scripts []ScriptConfig `yaml:"scripts"`
+
+	// ScriptFiles are glob patterns of further files with scripts,
+	// relative to the directory of the configuration file. Their
+	// scripts are added to Scripts when the configuration is
+	// loaded.
+	ScriptFiles []string `yaml:"scriptFiles"`
+
+	// Packs are downloaded archives of scripts, which are extracted
+	// into a directory named after the pack in Directory, relative
+	// to the directory of the configuration file and "packs" by
+	// default. The scripts of the packs that have been extracted are
+	// added to Scripts when the configuration is loaded. Packs
+	// whose files add up to more than MaxExtractedBytes aren't
+	// extracted.
+	Packs struct {
+		Directory         string        `yaml:"directory"`
+		MaxExtractedBytes int64         `yaml:"maxExtractedBytes"`
+		Sources           []*PackConfig `yaml:"sources"`
+	} `yaml:"packs"`
+
+	// Registry is a key-value store that further scripts are
+	// fetched from, which are kept in files in its Directory and
+	// added to Scripts when the configuration is loaded.
+	Registry RegistryConfig `yaml:"registry"`
+
+	// Groups are named sets of scripts that a single probe runs
+	// together, with the name of the group as its script.
+	Groups []GroupConfig `yaml:"groups"`
+
+	// Listeners serve the probes of some scripts only, on addresses
+	// of their own or for requests with their Host headers.
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	// Modules are scripts together with how their output is parsed,
+	// their timeout and their success criteria, probed by the name
+	// of the module, like the modules of blackbox_exporter.
+	Modules []ModuleConfig `yaml:"modules"`
+
+	// Workers are pools of interpreters that run the scripts of
+	// type worker.
+	Workers []WorkerPoolConfig `yaml:"workers"`
+
+	// StartupChecks are scripts that are run whenever a
+	// configuration is loaded. The exporter isn't ready until all
+	// of them succeed with output in the Prometheus format.
+	StartupChecks []StartupCheckConfig `yaml:"startupChecks"`
+
+	bearerPublicKeys []crypto.PublicKey
+
+	// registryDir, if it's set, is read instead of the directory of
+	// the registry, by LoadRegistryConfig.
+	registryDir string
+}
+
+// DefaultsConfig holds the defaults of settings of scripts, so that
+// large configurations don't repeat them for every script. Env is
+// merged with the environment variables of scripts, whose values win;
+// the prefix isn't used for scripts with raw output.
+type DefaultsConfig struct {
+	Timeout time.Duration     `yaml:"timeout"`
+	Env     map[string]string `yaml:"env"`
+	Prefix  string            `yaml:"prefix"`
+	Format  string            `yaml:"format"`
+}
+
+// apply fills in the defaults of the settings of a script.
+func (d *DefaultsConfig) apply(s *ScriptConfig) {
+	if s.Timeout == 0 {
+		s.Timeout = d.Timeout
+	}
+	if s.Format == "" {
+		s.Format = d.Format
+	}
+	if s.Prefix == "" && s.Format != FormatRaw {
+		s.Prefix = d.Prefix
+	}
+	for name, value := range d.Env {
+		if _, ok := s.Env[name]; !ok {
+			if s.Env == nil {
+				s.Env = make(map[string]string)
+			}
+			s.Env[name] = value
+		}
+	}
+}
+
+// GroupConfig is a group of scripts that are probed together, one
+// after the other or in parallel.
+type GroupConfig struct {
+	Name     string   `yaml:"name"`
+	Scripts  []string `yaml:"scripts"`
+	Parallel bool     `yaml:"parallel"`
+}
+
+// ListenerConfig is a listener that only serves probes of Scripts,
+// which are scripts, modules or groups, whose scripts it serves too.
+// It serves the probe endpoints and the health and readiness checks on
+// Address, if it's set, and probes on the other addresses whose Host
+// header is one of Hosts.
+type ListenerConfig struct {
+	Name    string   `yaml:"name"`
+	Address string   `yaml:"address"`
+	Hosts   []string `yaml:"hosts"`
+	Scripts []string `yaml:"scripts"`
+
+	scripts map[string]bool
+}
+
+// Serves reports whether the listener serves probes of a script or
+// module.
+func (l *ListenerConfig) Serves(name string) bool {
+	return l.scripts[name]
+}
+
+// Endpoints that can require authentication
+const (
+	EndpointProbe     = "probe"
+	EndpointMetrics   = "metrics"
+	EndpointAdmin     = "admin"
+	EndpointDiscovery = "discovery"
+)
+
+// Formats of the access log
+const (
+	AccessLogCommon = "common"
+	AccessLogJSON   = "json"
+)
+
+// StartupCheckConfig is a script that is run with Params when a
+// configuration is loaded.
+type StartupCheckConfig struct {
+	Script string   `yaml:"script"`
+	Params []string `yaml:"params"`
+}
+
+// ModuleConfig is a module: a script whose arguments, format,
+// timeout and success criteria are replaced by those of the module
+// that are set.
+type ModuleConfig struct {
+	Name        string         `yaml:"name"`
+	Script      string         `yaml:"script"`
+	Args        []string       `yaml:"args"`
+	Format      string         `yaml:"format"`
+	JSON        *JSONConfig    `yaml:"json"`
+	Timeout     time.Duration  `yaml:"timeout"`
+	SuccessWhen *SuccessConfig `yaml:"successWhen"`
+
+	script ScriptConfig
+}
+
+// scriptFile is the content of a file of ScriptFiles.
+type scriptFile struct {
+	Scripts []ScriptConfig `yaml:"scripts"`
+}
+
+// Types of registries
+const (
+	RegistryConsul = "consul"
+	RegistryEtcd   = "etcd"
+)
+
+// RegistryConfig is a Consul or etcd key-value store at URL, of Type,
+// whose keys under Prefix hold scripts in the format of the files of
+// ScriptFiles. It's read with Token, if it's set, every Interval, and
+// the values of the keys are kept in Directory, relative to the
+// directory of the configuration file and "registry" by default, one
+// file per key.
+type RegistryConfig struct {
+	Type      string        `yaml:"type"`
+	URL       string        `yaml:"url"`
+	Prefix    string        `yaml:"prefix"`
+	Token     string        `yaml:"token"`
+	TokenFile string        `yaml:"tokenFile"`
+	Interval  time.Duration `yaml:"interval"`
+	Directory string        `yaml:"directory"`
+}
+
+// RegistryFileSuffix ends the names of the files in the directory of a
+// registry that hold the values of keys.
+const RegistryFileSuffix = ".yaml"
+
+// PackFile is the file of a pack with its scripts, in the format of
+// the files of ScriptFiles.
+const PackFile = "pack.yaml"
+
+// PackConfig is a pack of scripts: a tar file, which may be gzipped,
+// or a zip file of scripts and their PackFile, which is downloaded
+// from URL. Packs are only extracted if the SHA256 checksum of the
+// archive is SHA256, if that is set, and if its signature, downloaded
+// from SignatureURL, or the URL with '.sig' appended, is valid for one
+// of the keys of PublicKeyFile, if that is set. Signatures are RSA
+// PKCS #1 v1.5 or ECDSA signatures of the SHA256 checksum, as made by
+// 'openssl dgst -sha256 -sign'.
+type PackConfig struct {
+	Name          string `yaml:"name"`
+	URL           string `yaml:"url"`
+	SHA256        string `yaml:"sha256"`
+	SignatureURL  string `yaml:"signatureURL"`
+	PublicKeyFile string `yaml:"publicKeyFile"`
+
+	publicKeys []crypto.PublicKey
+}
+
+// PublicKeys returns the keys of PublicKeyFile, or nil if the pack
+// isn't signed.
+func (p *PackConfig) PublicKeys() []crypto.PublicKey {
+	return p.publicKeys
+}
+
+// SignatureLocation returns the URL of the signature of a pack.
+func (p *PackConfig) SignatureLocation() string {
+	if p.SignatureURL != "" {
+		return p.SignatureURL
+	}
+	return p.URL + ".sig"
+}
+
+// PackDir returns the directory that a pack is extracted into.
+func (c *Config) PackDir(p *PackConfig) string {
+	return filepath.Join(c.Packs.Directory, p.Name)
+}
+
+// packNameRE matches the names of packs, which are the names of their
+// directories.
+var packNameRE = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// sha256RE matches SHA256 checksums in hex.
+var sha256RE = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// Networks is a list of networks in CIDR notation, or of single IP
+// addresses.
+type Networks []*net.IPNet
+
+// UnmarshalYAML parses the networks of a list.
+func (n *Networks) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+
+	*n = nil
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid network %s", s)
+		}
+		*n = append(*n, ipnet)
+	}
+	return nil
+}
+
+// MarshalYAML returns the networks in CIDR notation.
+func (n Networks) MarshalYAML() (interface{}, error) {
+	var list []string
+	for _, ipnet := range n {
+		list = append(list, ipnet.String())
+	}
+	return list, nil
+}
+
+// Contains reports whether an address is in any of the networks.
+func (n Networks) Contains(ip net.IP) bool {
+	for _, ipnet := range n {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSVersions are the TLS versions for tls.minVersion, by name.
+var TLSVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// TLSCurves are the curves for tls.curvePreferences, by name.
+var TLSCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// TLSCipherSuite returns the ID of the cipher suite with a name, as
+// crypto/tls names them. Only secure cipher suites can be used.
+func TLSCipherSuite(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// HistoryExportConfig configures the periodic export of execution
+// records in JSONL format to a file, a HTTP endpoint or a S3 bucket.
+type HistoryExportConfig struct {
+	Interval time.Duration `yaml:"interval"`
+
+	File struct {
+		Path     string `yaml:"path"`
+		MaxBytes int64  `yaml:"maxBytes"`
+		MaxFiles int    `yaml:"maxFiles"`
+	} `yaml:"file"`
+
+	HTTP struct {
+		URL     string            `yaml:"url"`
+		Headers map[string]string `yaml:"headers"`
+	} `yaml:"http"`
+
+	S3 struct {
+		Bucket          string `yaml:"bucket"`
+		Region          string `yaml:"region"`
+		Endpoint        string `yaml:"endpoint"`
+		Prefix          string `yaml:"prefix"`
+		AccessKeyID     string `yaml:"accessKeyID"`
+		SecretAccessKey string `yaml:"secretAccessKey"`
+		SessionToken    string `yaml:"sessionToken"`
+
+		SecretAccessKeyFile string `yaml:"secretAccessKeyFile"`
+		SessionTokenFile    string `yaml:"sessionTokenFile"`
+	} `yaml:"s3"`
+}
+
+// LimitsConfig bounds the output of scripts: the bytes read from
+// them and the number of samples served. Output beyond the limits is
+// dropped. Zero means the default, which is 1 MiB of output and no
+// limit on samples for the global limits and the global limit for
+// the limits of scripts, and a negative value means no limit.
+type LimitsConfig struct {
+	MaxOutputBytes int64 `yaml:"maxOutputBytes"`
+	MaxSeries      int   `yaml:"maxSeries"`
+}
+
+// ServerConfig holds the timeouts and limits of the HTTP server, as in
+// net/http, which are fixed when the exporter starts, except for
+// WriteTimeout. ReadHeaderTimeout defaults to 10 seconds, ReadTimeout
+// to a minute and IdleTimeout to two minutes. WriteTimeout must be
+// longer than the timeout of every script, and defaults to a minute
+// more than the longest one, or no limit if a script has none.
+// MaxConnections bounds the connections that are open at a time; zero
+// means no limit.
+type ServerConfig struct {
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+	MaxHeaderBytes    int           `yaml:"maxHeaderBytes"`
+	MaxConnections    int           `yaml:"maxConnections"`
+}
+
+// validate checks the timeouts and limits of the server and fills in
+// the defaults, given the scripts that it runs.
+func (sc *ServerConfig) validate(scripts []*ScriptConfig) error {
+	if sc.ReadTimeout < 0 || sc.ReadHeaderTimeout < 0 || sc.WriteTimeout < 0 || sc.IdleTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if sc.MaxHeaderBytes < 0 || sc.MaxConnections < 0 {
+		return fmt.Errorf("maxHeaderBytes and maxConnections must not be negative")
+	}
+	if sc.ReadHeaderTimeout == 0 {
+		sc.ReadHeaderTimeout = 10 * time.Second
+	}
+	if sc.ReadTimeout == 0 {
+		sc.ReadTimeout = time.Minute
+	}
+	if sc.IdleTimeout == 0 {
+		sc.IdleTimeout = 2 * time.Minute
+	}
+
+	// The script with the longest timeout is the first one without
+	// any.
+	var longest *ScriptConfig
+	for _, s := range scripts {
+		if s.Timeout == 0 {
+			longest = s
+			break
+		}
+		if longest == nil || s.Timeout > longest.Timeout {
+			longest = s
+		}
+	}
+	switch {
+	case longest == nil:
+	case sc.WriteTimeout == 0:
+		if longest.Timeout != 0 {
+			sc.WriteTimeout = longest.Timeout + time.Minute
+		}
+	case longest.Timeout == 0 || longest.Timeout >= sc.WriteTimeout:
+		return fmt.Errorf("writeTimeout must be longer than the timeout of script %s", longest.Name)
+	}
+	return nil
+}
+
+// RateLimitConfig is a token bucket rate limit: Rate requests per
+// second on average, with bursts of up to Burst requests. A zero
+// Rate means no limit, and Burst defaults to Rate rounded up.
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// validate checks a rate limit and fills in its default burst.
+func (rl *RateLimitConfig) validate() error {
+	if rl.Rate < 0 || rl.Burst < 0 {
+		return fmt.Errorf("rate and burst must not be negative")
+	}
+	if rl.Rate > 0 && rl.Burst == 0 {
+		rl.Burst = int(math.Ceil(rl.Rate))
+	}
+	return nil
+}
+
+// defaultMaxOutputBytes is the default limit on the output of
+// scripts.
+const defaultMaxOutputBytes = 1 << 20
+
+// defaultMaxExtractedBytes is the default limit on the size of the
+// files of a pack.
+const defaultMaxExtractedBytes = 1 << 30
+
+// defaultMaxBodyBytes is the default limit on the body of POST probe
+// requests.
+const defaultMaxBodyBytes = 64 << 10
+
+// defaultMaxBatchSize is the default limit on the number of probes of
+// a batch probe.
+const defaultMaxBatchSize = 100
+
+// TracingConfig configures an OTLP/HTTP endpoint for traces, such as
+// http://localhost:4318/v1/traces. Probes are traced if the request
+// says that its trace is sampled, and otherwise with a probability of
+// SamplingFraction, as in Prometheus itself.
+type TracingConfig struct {
+	Endpoint         string            `yaml:"endpoint"`
+	Timeout          time.Duration     `yaml:"timeout"`
+	Headers          map[string]string `yaml:"headers"`
+	SamplingFraction float64           `yaml:"samplingFraction"`
+}
+
+// RemoteWriteConfig configures a Prometheus remote write endpoint.
+// Failed requests are retried MaxRetries times, waiting from
+// MinBackoff to MaxBackoff, doubling the wait for every retry.
+type RemoteWriteConfig struct {
+	URL     string            `yaml:"url"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Headers map[string]string `yaml:"headers"`
+
+	BasicAuth struct {
+		Username     string `yaml:"username"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"passwordFile"`
+	} `yaml:"basicAuth"`
+	BearerToken     string `yaml:"bearerToken"`
+	BearerTokenFile string `yaml:"bearerTokenFile"`
+
+	// ExternalLabels are added to every series, unless it has a
+	// label of the same name.
+	ExternalLabels map[string]string `yaml:"externalLabels"`
+
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	MaxRetries int           `yaml:"maxRetries"`
+}
+
+// NodeLabelsConfig describes the labels about the host: Hostname is
+// the name of a label whose value is the hostname, and File and
+// Command are a file and a command, run within Timeout, whose output
+// has further labels, one name=value pair per line, or a JSON or YAML
+// object for files with such an extension. Labels from the
+// command take precedence over those from the file, and both over the
+// hostname.
+type NodeLabelsConfig struct {
+	Hostname string        `yaml:"hostname"`
+	File     string        `yaml:"file"`
+	Command  string        `yaml:"command"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// NotifierConfig describes a notifier: a webhook that gets a POST
+// request to URL for state changes of scheduled scripts, or a command
+// that is run for them, with the rendered Template as the body of the
+// request or its standard input. Scripts restricts the notifier to
+// those scripts, if it's set.
+type NotifierConfig struct {
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Command  string            `yaml:"command"`
+	Template string            `yaml:"template"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Scripts  []string          `yaml:"scripts"`
+
+	template *template.Template
+}
+
+// defaultNotifierTemplate is the template of notifiers that don't
+// have one, a JSON object.
+const defaultNotifierTemplate = `{"script": {{ json .Script }}, "state": {{ json .State }}, "previous": {{ json .Previous }}, "error": {{ json .Error }}, "time": {{ json .Time }}}`
+
+// compile checks a notifier and parses its template, which has a
+// json function that encodes its argument as JSON.
+func (n *NotifierConfig) compile() error {
+	if (n.URL == "") == (n.Command == "") {
+		return fmt.Errorf("exactly one of url and command must be set")
+	}
+	if u, err := url.Parse(n.URL); n.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+		return fmt.Errorf("invalid url %s", n.URL)
+	}
+	if n.Command != "" && len(SplitCommand(n.Command)) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	if n.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if n.Timeout == 0 {
+		n.Timeout = 10 * time.Second
+	}
+	if n.Template == "" {
+		n.Template = defaultNotifierTemplate
+	}
+
+	funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}}
+	t, err := template.New("notifier").Funcs(funcs).Option("missingkey=zero").Parse(n.Template)
+	if err != nil {
+		return fmt.Errorf("template: %s", err)
+	}
+	n.template = t
+	return nil
+}
+
+// CompiledTemplate returns the parsed template of a notifier.
+func (n *NotifierConfig) CompiledTemplate() *template.Template {
+	return n.template
+}
+
+// Notifies reports whether the notifier is told about a script.
+func (n *NotifierConfig) Notifies(scriptName string) bool {
+	if len(n.Scripts) == 0 {
+		return true
+	}
+	for _, name := range n.Scripts {
+		if name == scriptName {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether any export destination is configured.
+func (h *HistoryExportConfig) Active() bool {
+	return h.File.Path != "" || h.HTTP.URL != "" || h.S3.Bucket != ""
+}
+
+// Output formats
+const (
+	FormatPrometheus  = "prometheus"
+	FormatJSON        = "json"
+	FormatNagios      = "nagios"
+	FormatInflux      = "influx"
+	FormatStatsd      = "statsd"
+	FormatOpenMetrics = "openmetrics"
+	FormatRaw         = "raw"
+)
+
+// RegisterFormat makes an output format known, so that configurations
+// may use it. Programs using the packages register the formats of
+// their own parsers this way. Registering a built-in format changes
+// nothing.
+func RegisterFormat(name string) {
+	switch name {
+	case FormatPrometheus, FormatJSON, FormatNagios, FormatInflux, FormatStatsd, FormatOpenMetrics, FormatRaw:
+		return
+	}
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registeredFormats[name] = true
+}
+
+// registeredFormat reports whether an output format was registered
+// with RegisterFormat.
+func registeredFormat(name string) bool {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	return registeredFormats[name]
+}
+
+// How probes of scripts that don't exist are answered: with a 400
+// error, with a 404 error whose body has a script_not_found metric, or
+// with a successful response that has a failed script_success metric.
+const (
+	UnknownScriptBadRequest = "badRequest"
+	UnknownScriptNotFound   = "notFound"
+	UnknownScriptMetric     = "metric"
+)
+
+// How the timestamps of samples are handled.
+const (
+	TimestampsHonor = "honor"
+	TimestampsStrip = "strip"
+	TimestampsClamp = "clamp"
+)
+
+// defaultMaxTimestampAge is how old timestamps may be by default
+// before they are clamped.
+const defaultMaxTimestampAge = time.Hour
+
+// How series that scripts emit several times are handled: the first
+// or the last sample is kept, the samples are summed up, or the probe
+// fails.
+const (
+	DuplicateSeriesFirst = "first"
+	DuplicateSeriesLast  = "last"
+	DuplicateSeriesSum   = "sum"
+	DuplicateSeriesFail  = "fail"
+)
+
+// How metrics outside of the prefix of a script are handled with
+// EnforcePrefix.
+const (
+	EnforcePrefixRewrite = "rewrite"
+	EnforcePrefixReject  = "reject"
+)
+
+// JSONConfig maps the JSON output of a script to metrics.
+type JSONConfig struct {
+	Metrics []JSONMetricConfig `yaml:"metrics"`
+}
+
+// JSONMetricConfig maps values in JSON output to a metric. Path
+// selects one or more values in the output; Value and the Labels are
+// then paths relative to each selected value, and an empty Value
+// uses the selected value itself.
+type JSONMetricConfig struct {
+	Name   string            `yaml:"name"`
+	Help   string            `yaml:"help"`
+	Type   string            `yaml:"type"`
+	Path   string            `yaml:"path"`
+	Value  string            `yaml:"value"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// ValidLabelName reports whether name is a valid Prometheus label
+// name.
+func ValidLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidMetricName reports whether name is a valid Prometheus metric
+// name.
+func ValidMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// sudoUserRE matches user names and the '#<uid>' form of sudo, and
+// nothing that sudo could take for an option.
+var sudoUserRE = regexp.MustCompile(`^(#[0-9]+|[a-zA-Z0-9_][a-zA-Z0-9_.-]*\$?)$`)
+
+// Script types
+const (
+	// TypeExec scripts are programs that are executed, which is
+	// the default.
+	TypeExec = "exec"
+	// TypeHTTP scripts fetch metrics from a local HTTP endpoint
+	// instead of executing a program.
+	TypeHTTP = "http"
+	// TypeDocker scripts are executed in a container, either an
+	// existing one or one that is started just for them.
+	TypeDocker = "docker"
+	// TypeKubernetes scripts are executed in a pod.
+	TypeKubernetes = "kubernetes"
+	// TypeStarlark scripts are Starlark code in the configuration,
+	// which the exporter runs itself.
+	TypeStarlark = "starlark"
+	// TypeSSH scripts are executed on another host with ssh.
+	TypeSSH = "ssh"
+	// TypeFile scripts are files that another program, such as a
+	// cron job, writes the output of a script to, which the
+	// exporter only reads.
+	TypeFile = "file"
+	// TypeWorker scripts are files whose contents are sent to a
+	// running interpreter of a worker pool, which runs them.
+	TypeWorker = "worker"
+)
+
+// registeredTypes and registeredFormats are the script types and
+// output formats that programs using the packages added with
+// RegisterType and RegisterFormat.
+var (
+	registeredMu      sync.Mutex
+	registeredTypes   = make(map[string]bool)
+	registeredFormats = make(map[string]bool)
+)
+
+// RegisterType makes a script type known, so that configurations may
+// use it. Programs using the packages register the types of their own
+// runners this way; scripts of such types can't use the settings that
+// only the built-in types support, but may have options. Registering a
+// built-in type changes nothing.
+func RegisterType(name string) {
+	switch name {
+	case TypeExec, TypeHTTP, TypeDocker, TypeKubernetes, TypeStarlark, TypeSSH, TypeFile, TypeWorker:
+		return
+	}
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registeredTypes[name] = true
+}
+
+// registeredType reports whether a script type was registered with
+// RegisterType.
+func registeredType(name string) bool {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	return registeredTypes[name]
+}
+
+// WorkerPoolConfig is a pool of up to Size processes of Command, an
+// interpreter with a program that runs the scripts it gets on its
+// standard input one after the other; they're started when the
+// configuration is loaded and kept running, and replaced after MaxRuns
+// scripts unless that's zero.
+type WorkerPoolConfig struct {
+	Name    string `yaml:"name"`
+	Command string `yaml:"command"`
+	Size    int    `yaml:"size"`
+	MaxRuns int    `yaml:"maxRuns"`
+}
+
+// DockerConfig describes how a script of type docker is run. Exactly
+// one of Container, an existing container to execute the script in,
+// and Image, to run the script in a new container, must be set. Args
+// are added to the 'docker exec' or 'docker run' command line, and
+// Binary is the docker command, by default "docker".
+type DockerConfig struct {
+	Container string   `yaml:"container"`
+	Image     string   `yaml:"image"`
+	Args      []string `yaml:"args"`
+	Binary    string   `yaml:"binary"`
+}
+
+// KubernetesConfig describes how a script of type kubernetes is run
+// with kubectl. Exactly one of Pod, the name of the pod, and Selector,
+// a label selector of which the first running pod is used, must be
+// set. Namespace, Kubeconfig and Context default to those of kubectl,
+// which uses the in-cluster configuration if there's no kubeconfig
+// file, and Binary is the kubectl command, by default "kubectl".
+type KubernetesConfig struct {
+	Namespace  string `yaml:"namespace"`
+	Pod        string `yaml:"pod"`
+	Selector   string `yaml:"selector"`
+	Container  string `yaml:"container"`
+	Kubeconfig string `yaml:"kubeconfig"`
+	Context    string `yaml:"context"`
+	Binary     string `yaml:"binary"`
+}
+
+// SSHConfig describes how a script of type ssh is run. The script
+// command is run on Host, as User and with IdentityFile as the key if
+// they are set, and with Port unless that is zero; ssh must be able to
+// log in without asking for anything. Args are added to the ssh
+// command line, and Binary is the ssh command, by default "ssh".
+type SSHConfig struct {
+	Host         string   `yaml:"host"`
+	User         string   `yaml:"user"`
+	Port         int      `yaml:"port"`
+	IdentityFile string   `yaml:"identityFile"`
+	Args         []string `yaml:"args"`
+	Binary       string   `yaml:"binary"`
+}
+
+// ParamArgConfig maps a parameter of probe requests to arguments of a
+// script: every value of Param becomes an argument, after Flag unless
+// that is empty, or joined to it if Flag ends in '='. Values must
+// match Pattern, if it's set, as a whole, and only start with '-' if
+// it allows that. Required parameters must be given.
+type ParamArgConfig struct {
+	Param    string `yaml:"param"`
+	Flag     string `yaml:"flag"`
+	Pattern  string `yaml:"pattern"`
+	Required bool   `yaml:"required"`
+
+	pattern *regexp.Regexp
+}
+
+// Matches reports whether v is a valid value of the parameter.
+func (p *ParamArgConfig) Matches(v string) bool {
+	if p.pattern == nil {
+		return !strings.HasPrefix(v, "-")
+	}
+	return p.pattern.MatchString(v)
+}
+
+// FileConfig describes where the output of a script of type file is
+// read from. Path is a Go template of the name of the script and the
+// parameter values of the probe, and the file must have been modified
+// within MaxAge, unless that is zero.
+type FileConfig struct {
+	Path   string        `yaml:"path"`
+	MaxAge time.Duration `yaml:"maxAge"`
+
+	template *template.Template
+}
+
+// CompiledTemplate returns the parsed template of the path.
+func (f *FileConfig) CompiledTemplate() *template.Template {
+	return f.template
+}
+
+// StarlarkConfig holds the code of a script of type starlark.
+type StarlarkConfig struct {
+	Code string `yaml:"code"`
+}
+
+// ScriptConfig represents a single script in the configuration file
+type ScriptConfig struct {
+	Name   string        `yaml:"name"`
+	Script string        `yaml:"script"`
+	Type   string        `yaml:"type"`
+	Naming *NamingConfig `yaml:"naming"`
+
+	// Interpreter is the command that the script is run with, such
+	// as 'python3' or 'powershell.exe -File', instead of running it
+	// directly.
+	Interpreter string `yaml:"interpreter"`
+
+	// Pipeline are further commands, split like the script, that
+	// the output of the script is fed through one after the other;
+	// the output of the last one is parsed.
+	Pipeline []string `yaml:"pipeline"`
+
+	// Fallbacks are further commands, split like the script, that
+	// are tried one after the other if the script fails, such as a
+	// slow but portable version of a check that prefers a native
+	// tool. They are run like the script, but without the
+	// interpreter.
+	Fallbacks []string `yaml:"fallbacks"`
+
+	// Args are templates of arguments that the script gets before
+	// those of the 'params' parameter. They are rendered with the
+	// first value of every parameter of the probe request, as in
+	// '{{ .target }}', and the variables of the configuration, and
+	// each becomes exactly one argument.
+	Args []string `yaml:"args"`
+
+	// ParamsToArgs map parameters of probe requests to arguments,
+	// which come after the args. Scripts with them don't take the
+	// arguments of the 'params' parameter.
+	ParamsToArgs []*ParamArgConfig `yaml:"paramsToArgs"`
+
+	// Cwd is the directory that the script runs in, instead of
+	// ours, and Umask its file mode creation mask, in octal.
+	Cwd   string `yaml:"cwd"`
+	Umask string `yaml:"umask"`
+
+	// Env are environment variables that the script gets on top of
+	// ours.
+	Env map[string]string `yaml:"env"`
+
+	// Nice, IOPriority and OOMScoreAdj lower the priority of the
+	// script, so that heavy checks don't compete with the workloads
+	// of the host. IOPriority is 'idle', or 'best-effort' or
+	// 'realtime' with an optional level, as in 'best-effort:7'.
+	Nice        *int   `yaml:"nice"`
+	IOPriority  string `yaml:"ioPriority"`
+	OOMScoreAdj *int   `yaml:"oomScoreAdj"`
+
+	// Sandbox restricts what the script can do, on Linux.
+	Sandbox SandboxConfig `yaml:"sandbox"`
+
+	// Kill makes killing the script, when it times out or its probe
+	// is canceled, gentler.
+	Kill KillConfig `yaml:"kill"`
+
+	// Sudo runs the script with sudo, as root or as SudoUser, which
+	// implies Sudo.
+	Sudo     bool   `yaml:"sudo"`
+	SudoUser string `yaml:"sudoUser"`
+
+	// Limits replace the global limits on the output of the
+	// script, where they are set.
+	Limits LimitsConfig `yaml:"limits"`
+
+	// RateLimit bounds the rate of probe requests for the script,
+	// in addition to the global rate limit.
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+
+	// Docker is how scripts of type docker are run.
+	Docker *DockerConfig `yaml:"docker"`
+
+	// Kubernetes is how scripts of type kubernetes are run.
+	Kubernetes *KubernetesConfig `yaml:"kubernetes"`
+
+	// Starlark is the code of scripts of type starlark.
+	Starlark *StarlarkConfig `yaml:"starlark"`
+
+	// SSH is how scripts of type ssh are run.
+	SSH *SSHConfig `yaml:"ssh"`
+
+	// File is where the output of scripts of type file is read
+	// from.
+	File *FileConfig `yaml:"file"`
+
+	// Worker is the name of the worker pool that runs scripts of
+	// type worker.
+	Worker string `yaml:"worker"`
+
+	// Options are settings for the runner of a script of a type
+	// that was registered with RegisterType.
+	Options map[string]string `yaml:"options"`
+
+	// Format is the format of the script's output. Output in
+	// formats other than the Prometheus exposition format is
+	// converted to it before it's formatted.
+	Format string `yaml:"format"`
+
+	// JSON describes how to map JSON output to metrics.
+	JSON *JSONConfig `yaml:"json"`
+
+	// Prefix is the namespace of the metrics of the script,
+	// which is prepended to their names as '<prefix>_'. With
+	// EnforcePrefix, only metrics that aren't already in the
+	// namespace are rewritten into it, or they are rejected. If
+	// AllowURLPrefix is set, probes may replace the prefix with
+	// the 'prefix' URL parameter.
+	Prefix         string `yaml:"prefix"`
+	EnforcePrefix  string `yaml:"enforcePrefix"`
+	AllowURLPrefix bool   `yaml:"allowURLPrefix"`
+
+	// Labels are added to every sample the script emits; their
+	// values are templates of the variables of the configuration. If
+	// AllowURLLabels is set, probes may add further labels with
+	// the 'labels' URL parameter.
+	Labels         map[string]string `yaml:"labels"`
+	AllowURLLabels bool              `yaml:"allowURLLabels"`
+
+	// Relabel rules are applied to every metric the script emits,
+	// in order.
+	Relabel []*RelabelConfig `yaml:"relabel"`
+
+	// Metrics restricts the metrics the script may emit, after
+	// relabeling.
+	Metrics *MetricsFilterConfig `yaml:"metrics"`
+
+	// Metadata is the help text and type of metrics, by name after
+	// prefixing and relabeling, for scripts that print samples
+	// without HELP and TYPE lines.
+	Metadata map[string]*MetricMetadataConfig `yaml:"metadata"`
+
+	// Units are the units that the values of metrics are in, by
+	// name after prefixing and relabeling, for scripts that don't
+	// use base units. Their values are converted to seconds or bytes
+	// and their names get the matching suffix.
+	Units map[string]string `yaml:"units"`
+
+	// DuplicateSeries is what happens to series that the script
+	// emits several times.
+	DuplicateSeries string `yaml:"duplicateSeries"`
+
+	// DecimalComma accepts sample values with a decimal comma, as
+	// printed in some locales, and rewrites it to a dot.
+	DecimalComma bool `yaml:"decimalComma"`
+
+	// ResultChanges makes probes report whether any sample value
+	// changed by more than Tolerance since the previous run.
+	ResultChanges struct {
+		Active    bool    `yaml:"active"`
+		Tolerance float64 `yaml:"tolerance"`
+	} `yaml:"resultChanges"`
+
+	// CheckCounters makes probes report whether any counter in the
+	// output decreased since the previous run.
+	CheckCounters bool `yaml:"checkCounters"`
+
+	// Transform is a template that every sample of the output is
+	// rendered with after it has been formatted, which yields the
+	// samples that replace it, one per line, or none to drop it.
+	Transform string `yaml:"transform"`
+
+	// Differential makes probes also serve how much the samples of
+	// Metrics changed since the previous run, per second with Mode
+	// rate, for scripts that only print cumulative totals.
+	Differential struct {
+		Metrics []string `yaml:"metrics"`
+		Mode    string   `yaml:"mode"`
+	} `yaml:"differential"`
+
+	// Canary runs the script once when a reload changes its
+	// command, before the new definition is served, and keeps the
+	// previous definition if the run fails or its output can't be
+	// parsed.
+	Canary bool `yaml:"canary"`
+
+	// Disabled scripts stay configured but are not run; probes
+	// for them report that they are disabled.
+	Disabled bool `yaml:"disabled"`
+
+	// URL and Socket are used by scripts of type http. If Socket
+	// is set, the request for URL is made over that unix socket.
+	URL    string `yaml:"url"`
+	Socket string `yaml:"socket"`
+
+	// BatchWindow is how long the first probe for a script waits
+	// for further identical probes before the script is run once
+	// for all of them.
+	BatchWindow time.Duration `yaml:"batchWindow"`
+
+	// MaxAge is how old the result of an async script may be for a
+	// probe to be served it; older results fail the probe.
+	MaxAge time.Duration `yaml:"maxAge"`
+
+	// PersistResult keeps the last successful results of the
+	// script on disk, for async scripts and those with a cache
+	// duration.
+	PersistResult bool `yaml:"persistResult"`
+
+	// SingleFlight makes probes that arrive while the script runs
+	// for an identical probe wait for its result instead of running
+	// the script again.
+	SingleFlight bool `yaml:"singleFlight"`
+
+	// Stream keeps the script running between probes, which serve
+	// the latest block of output that it wrote.
+	Stream StreamConfig `yaml:"stream"`
+
+	// Async makes probes of the script return the result of its
+	// last completed run instead of waiting for it, for scripts
+	// that take longer than a scrape may.
+	Async bool `yaml:"async"`
+
+	// CacheDuration is how long successful results of the script
+	// are reused for further probes with the same parameters. If
+	// CachePerClient is set, every scraping client gets its own
+	// cached results.
+	CacheDuration  time.Duration `yaml:"cacheDuration"`
+	CachePerClient bool          `yaml:"cachePerClient"`
+
+	// Timeout is how long the script may run before it is killed;
+	// zero means no limit.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// AdaptiveTimeout shortens the timeout to what recent runs of
+	// the script took.
+	AdaptiveTimeout AdaptiveTimeoutConfig `yaml:"adaptiveTimeout"`
+
+	// Timestamps is what happens to the timestamps of samples:
+	// they are passed through, stripped, or clamped to between
+	// MaxTimestampAge ago and now.
+	Timestamps      string        `yaml:"timestamps"`
+	MaxTimestampAge time.Duration `yaml:"maxTimestampAge"`
+
+	// OpenMetrics controls what of the output of the script is
+	// passed through when probes are served in the OpenMetrics
+	// format, which is the only one to support exemplars.
+	OpenMetrics struct {
+		Exemplars  bool `yaml:"exemplars"`
+		Timestamps bool `yaml:"timestamps"`
+	} `yaml:"openMetrics"`
+
+	// Stdin is what the script gets on its standard input; it
+	// gets nothing if it's not set.
+	Stdin *StdinConfig `yaml:"stdin"`
+
+	argTemplates    []*template.Template
+	transform       *template.Template
+	environ         []string
+	unitConversions map[string]UnitConversion
+
+	// Retries is how often a failed run of the script is retried
+	// for a probe, waiting RetryInterval in between, as long as
+	// that fits into the timeout.
+	Retries       int           `yaml:"retries"`
+	RetryInterval time.Duration `yaml:"retryInterval"`
+
+	// Locks are the names of locks that the script holds while it
+	// runs, so that scripts sharing a lock never run at the same
+	// time.
+	Locks []string `yaml:"locks"`
+
+	// Windows are when the script may run, in local time: ranges
+	// of the day such as '22:00-06:00', or cron expressions, whose
+	// minutes it may run in. It may run at any time if there are
+	// none.
+	Windows []string `yaml:"windows"`
+	windows []window
+
+	// SuccessWhen are further criteria for the script to be
+	// successful, for scripts whose exit status doesn't tell.
+	SuccessWhen *SuccessConfig `yaml:"successWhen"`
+
+	// FailureBudget is how long the script may fail continuously
+	// before it is disabled automatically, until it's enabled
+	// again through the admin API; zero means forever.
+	FailureBudget time.Duration `yaml:"failureBudget"`
+
+	// Schedule runs the script periodically on its own, with the
+	// given parameters, and sends the results to the configured
+	// outputs, such as remote write. Its first run, after the
+	// exporter started or the script was scheduled, is delayed by
+	// up to WarmUp.Jitter, and with WarmUp.Ready the exporter isn't
+	// ready until it has finished.
+	Schedule struct {
+		Interval time.Duration `yaml:"interval"`
+		Params   []string      `yaml:"params"`
+		WarmUp   struct {
+			Jitter time.Duration `yaml:"jitter"`
+			Ready  bool          `yaml:"ready"`
+		} `yaml:"warmUp"`
+	} `yaml:"schedule"`
+
+	// Discovery holds what the service discovery endpoint
+	// suggests for probes of this script.
+	Discovery struct {
+		Params map[string]string `yaml:"params"`
+		Labels map[string]string `yaml:"labels"`
+	} `yaml:"discovery"`
+}
+
+// AdaptiveTimeoutConfig derives the timeout of a script from its
+// recent runs: Percentile of the durations of its last Samples
+// successful runs, times Factor, but at least Min and at most the
+// timeout of the script, which applies until it has run successfully
+// MinAdaptiveSamples times.
+type AdaptiveTimeoutConfig struct {
+	Active     bool          `yaml:"active"`
+	Percentile float64       `yaml:"percentile"`
+	Factor     float64       `yaml:"factor"`
+	Min        time.Duration `yaml:"min"`
+	Samples    int           `yaml:"samples"`
+}
+
+// MinAdaptiveSamples is the number of successful runs that an
+// adaptive timeout is derived from at least.
+const MinAdaptiveSamples = 10
+
+// A window is a time of the day from start to end, in minutes after
+// midnight, which wraps around midnight if end is before start, or,
+// if cron is set, the minutes that match a cron expression: the bits
+// of its minute, hour, day of the month, month and day of the week
+// fields.
+type window struct {
+	start, end int
+	cron       *[5]uint64
+
+	// Like in cron, a time matches either the day of the month or
+	// the day of the week if both are restricted.
+	anyDOM, anyDOW bool
+}
+
+// cronRanges are the smallest and largest values of the fields of
+// cron expressions; 7 is another Sunday.
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseWindow parses a window, a time range such as '08:00-18:00' or
+// a cron expression with five fields.
+func parseWindow(text string) (window, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 5 {
+		var w window
+		w.cron = new([5]uint64)
+		for i, f := range fields {
+			bits, err := parseCronField(f, cronRanges[i][0], cronRanges[i][1])
+			if err != nil {
+				return w, fmt.Errorf("invalid window %q: %s", text, err)
+			}
+			w.cron[i] = bits
+		}
+		if w.cron[4]&(1<<7) != 0 {
+			w.cron[4] |= 1
+		}
+		w.anyDOM, w.anyDOW = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+		return w, nil
+	}
+
+	start, end, ok := strings.Cut(text, "-")
+	if len(fields) != 1 || !ok {
+		return window{}, fmt.Errorf("invalid window %q: not a time range or a cron expression", text)
+	}
+	var w window
+	var err error
+	if w.start, err = parseClock(start); err == nil {
+		w.end, err = parseClock(end)
+	}
+	if err != nil {
+		return w, fmt.Errorf("invalid window %q: %s", text, err)
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day, from 00:00 to 24:00, into minutes
+// after midnight.
+func parseClock(text string) (int, error) {
+	if text == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", text)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseCronField parses a field of a cron expression, a list of
+// values, ranges and steps such as '*/15' or '1-5', into the bits of
+// the values it matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", s)
+			}
+			part, step = r, n
+		}
+		lo, hi := min, max
+		if part != "*" {
+			l, h, isRange := strings.Cut(part, "-")
+			var err error
+			if lo, err = strconv.Atoi(l); err != nil {
+				return 0, fmt.Errorf("invalid value %q", l)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(h); err != nil {
+					return 0, fmt.Errorf("invalid value %q", h)
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// contains reports whether t is in the window.
+func (w window) contains(t time.Time) bool {
+	if w.cron == nil {
+		m := t.Hour()*60 + t.Minute()
+		if w.end < w.start {
+			return m >= w.start || m < w.end
+		}
+		return m >= w.start && m < w.end
+	}
+
+	has := func(i, v int) bool { return w.cron[i]&(1<<uint(v)) != 0 }
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	switch {
+	case w.anyDOM && w.anyDOW:
+		return true
+	case w.anyDOM:
+		return dow
+	case w.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
+
+// InWindow reports whether the script may run at t, because it has no
+// windows or t is in one of them.
+func (s *ScriptConfig) InWindow(t time.Time) bool {
+	if len(s.windows) == 0 {
+		return true
+	}
+	t = t.Local()
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sources of the standard input of scripts
+const (
+	StdinBody     = "body"
+	StdinTemplate = "template"
+)
+
+// StdinConfig describes the standard input of a script: the body of
+// the probe request, or Template rendered with the request.
+type StdinConfig struct {
+	Source   string `yaml:"source"`
+	Template string `yaml:"template"`
+
+	template *template.Template
+}
+
+// compile checks the standard input of a script and parses its
+// template.
+func (s *StdinConfig) compile() error {
+	switch s.Source {
+	case StdinBody:
+	case StdinTemplate:
+		t, err := template.New("stdin").Option("missingkey=zero").Parse(s.Template)
+		if err != nil {
+			return fmt.Errorf("template: %s", err)
+		}
+		s.template = t
+	default:
+		return fmt.Errorf("unknown source %q", s.Source)
+	}
+	return nil
+}
+
+// CompiledTemplate returns the parsed template of a standard input
+// with source template.
+func (s *StdinConfig) CompiledTemplate() *template.Template {
+	return s.template
+}
+
+// MetricMetadataConfig is the help text and type of a metric, which
+// are added to the output of a script if it doesn't have them.
+type MetricMetadataConfig struct {
+	Help string `yaml:"help"`
+	Type string `yaml:"type"`
+}
+
+// A unit is a unit that values of metrics can be in: the base unit of
+// its quantity, the factor that converts values to it and the suffixes
+// of metric names that say a value is in it.
+type unit struct {
+	base     string
+	factor   float64
+	suffixes []string
+}
+
+// units are the units that values can be converted from, by the names
+// that the configuration uses for them. Decimal prefixes are powers of
+// 1000, binary ones powers of 1024.
+var units = map[string]unit{
+	"ns":      {"seconds", 1e-9, []string{"ns", "nanoseconds"}},
+	"us":      {"seconds", 1e-6, []string{"us", "microseconds"}},
+	"ms":      {"seconds", 1e-3, []string{"ms", "millis", "milliseconds"}},
+	"s":       {"seconds", 1, []string{"s", "secs", "seconds"}},
+	"minutes": {"seconds", 60, []string{"m", "min", "mins", "minutes"}},
+	"hours":   {"seconds", 3600, []string{"h", "hours"}},
+	"days":    {"seconds", 86400, []string{"d", "days"}},
+	"bits":    {"bytes", 1.0 / 8, []string{"bits"}},
+	"B":       {"bytes", 1, []string{"b", "bytes"}},
+	"KB":      {"bytes", 1e3, []string{"kb", "kilobytes"}},
+	"MB":      {"bytes", 1e6, []string{"mb", "megabytes"}},
+	"GB":      {"bytes", 1e9, []string{"gb", "gigabytes"}},
+	"TB":      {"bytes", 1e12, []string{"tb", "terabytes"}},
+	"KiB":     {"bytes", 1 << 10, []string{"kib", "kibibytes"}},
+	"MiB":     {"bytes", 1 << 20, []string{"mib", "mebibytes"}},
+	"GiB":     {"bytes", 1 << 30, []string{"gib", "gibibytes"}},
+	"TiB":     {"bytes", 1 << 40, []string{"tib", "tebibytes"}},
+}
+
+// A UnitConversion is how the samples of a metric in some unit are
+// converted to the base unit: their name is replaced with Name and
+// their value multiplied by Factor.
+type UnitConversion struct {
+	Name   string
+	Factor float64
+}
+
+// convertedName returns the name of a metric in unit u once it's
+// converted to the base unit, which replaces the suffix for u, if the
+// name has one, and comes before _total for counters.
+func convertedName(name string, u unit) string {
+	total := strings.HasSuffix(name, "_total")
+	name = strings.TrimSuffix(name, "_total")
+	lower := strings.ToLower(name)
+	for _, suffix := range u.suffixes {
+		if strings.HasSuffix(lower, "_"+suffix) {
+			name = name[:len(name)-len(suffix)-1]
+			break
+		}
+	}
+	name += "_" + u.base
+	if total {
+		name += "_total"
+	}
+	return name
+}
+
+// MetricsFilterConfig restricts the metrics a script may emit by
+// name: names must match one of Allow, if there are any, and none of
+// Deny. Both are regular expressions that have to match the whole
+// name, so plain metric names match exactly.
+type MetricsFilterConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	allow, deny []*regexp.Regexp
+}
+
+func (m *MetricsFilterConfig) compile() error {
+	m.allow, m.deny = nil, nil
+	for _, l := range []struct {
+		key      string
+		patterns []string
+		res      *[]*regexp.Regexp
+	}{{"allow", m.Allow, &m.allow}, {"deny", m.Deny, &m.deny}} {
+		for _, p := range l.patterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				return fmt.Errorf("%s: %s", l.key, err)
+			}
+			*l.res = append(*l.res, re)
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether a script may emit a metric, which it always
+// may without a filter.
+func (m *MetricsFilterConfig) Allowed(name string) bool {
+	if m == nil {
+		return true
+	}
+	for _, re := range m.deny {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(m.allow) == 0 {
+		return true
+	}
+	for _, re := range m.allow {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SuccessConfig are the criteria for a run of a script to be
+// successful. All criteria that are set have to be met.
+type SuccessConfig struct {
+	// ExitCodes are the exit statuses that count as success,
+	// instead of only 0.
+	ExitCodes []int `yaml:"exitCodes"`
+
+	// OutputMatches must match the output of the script, and
+	// OutputNotMatches must not.
+	OutputMatches    string `yaml:"outputMatches"`
+	OutputNotMatches string `yaml:"outputNotMatches"`
+
+	// MinLines is the minimum number of non-empty lines of output.
+	MinLines int `yaml:"minLines"`
+
+	outputMatches    *regexp.Regexp
+	outputNotMatches *regexp.Regexp
+}
+
+// compile compiles the regular expressions of the criteria and
+// checks them.
+func (s *SuccessConfig) compile() error {
+	var err error
+	if s.OutputMatches != "" {
+		if s.outputMatches, err = regexp.Compile(s.OutputMatches); err != nil {
+			return fmt.Errorf("outputMatches: %s", err)
+		}
+	}
+	if s.OutputNotMatches != "" {
+		if s.outputNotMatches, err = regexp.Compile(s.OutputNotMatches); err != nil {
+			return fmt.Errorf("outputNotMatches: %s", err)
+		}
+	}
+	if s.MinLines < 0 {
+		return fmt.Errorf("minLines must not be negative")
+	}
+	return nil
+}
+
+// ChecksOutput reports whether the criteria look at the output of the
+// script.
+func (s *SuccessConfig) ChecksOutput() bool {
+	return s != nil && (s.outputMatches != nil || s.outputNotMatches != nil || s.MinLines > 0)
+}
+
+// OutputMatchesRegexp and OutputNotMatchesRegexp return the compiled
+// regular expressions of the criteria, or nil if they aren't set.
+func (s *SuccessConfig) OutputMatchesRegexp() *regexp.Regexp {
+	return s.outputMatches
+}
+
+func (s *SuccessConfig) OutputNotMatchesRegexp() *regexp.Regexp {
+	return s.outputNotMatches
+}
+
+// BuiltinPrefix starts the commands of scripts that are checks built
+// into the exporter instead of programs.
+const BuiltinPrefix = "builtin:"
+
+// Command returns the command line that runs the script, without its
+// parameters: the interpreter, if any, and the script command.
+func (s *ScriptConfig) Command() []string {
+	var cmd []string
+	if s.Interpreter != "" {
+		cmd = SplitCommand(s.Interpreter)
+	}
+	return append(cmd, SplitCommand(s.Script)...)
+}
+
+// Delimiter of the blocks of streaming scripts if the configuration
+// doesn't have one, which ends OpenMetrics output anyway.
+const defaultStreamDelimiter = "# EOF"
+
+// StreamConfig describes a script that stays running and writes
+// complete blocks of output from time to time, each ending with a
+// Delimiter line. RestartDelay is how long we wait to start it again
+// once it has exited.
+type StreamConfig struct {
+	Active       bool          `yaml:"active"`
+	Delimiter    string        `yaml:"delimiter"`
+	RestartDelay time.Duration `yaml:"restartDelay"`
+}
+
+// SandboxConfig runs a script in Linux namespaces of its own, without
+// network access, with a read-only root file system and a private
+// /tmp, and with a seccomp filter that denies system calls that
+// scripts have no business making. AllowNetwork and AllowWrites lift
+// the first two restrictions. With a Root, the script runs with that
+// directory as its root directory.
+type SandboxConfig struct {
+	Active       bool   `yaml:"active"`
+	AllowNetwork bool   `yaml:"allowNetwork"`
+	AllowWrites  bool   `yaml:"allowWrites"`
+	Seccomp      string `yaml:"seccomp"`
+	Root         string `yaml:"root"`
+}
+
+// KillConfig describes how a script is killed: with a GracePeriod,
+// it first gets Signal, SIGTERM by default, and its process group is
+// only killed GracePeriod later, so that it can clean up after itself.
+type KillConfig struct {
+	Signal      string        `yaml:"signal"`
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+// KillSignals are the signals that scripts can get first when they
+// are killed.
+var KillSignals = []string{"SIGTERM", "SIGINT", "SIGHUP", "SIGQUIT", "SIGUSR1", "SIGUSR2"}
+
+// Seccomp profiles of sandboxes.
+const (
+	SeccompDefault = "default"
+	SeccompNone    = "none"
+)
+
+// SudoArgs returns the command line that prefixes the command of the
+// script if it's run with sudo, or nil. sudo never asks for a
+// password, since nobody could enter it.
+func (s *ScriptConfig) SudoArgs() []string {
+	if !s.Sudo && s.SudoUser == "" {
+		return nil
+	}
+	args := []string{"sudo", "-n"}
+	if s.SudoUser != "" {
+		args = append(args, "-u", s.SudoUser)
+	}
+	return append(args, "--")
+}
+
+// RunsCommand reports whether the script runs the command line of a
+// program, here or elsewhere, rather than being a built-in check or
+// something that the exporter evaluates itself.
+func (s *ScriptConfig) RunsCommand() bool {
+	switch s.Type {
+	case TypeExec, TypeDocker, TypeKubernetes, TypeSSH:
+		return !strings.HasPrefix(s.Script, BuiltinPrefix)
+	}
+	return false
+}
+
+// HasPriority reports whether the script has any of the priority
+// settings.
+func (s *ScriptConfig) HasPriority() bool {
+	return s.Nice != nil || s.IOPriority != "" || s.OOMScoreAdj != nil
+}
+
+// IO scheduling classes of IOPriority, as numbered by Linux.
+const (
+	IOPriorityRealtime   = 1
+	IOPriorityBestEffort = 2
+	IOPriorityIdle       = 3
+)
+
+// ParseIOPriority parses an IO priority into its scheduling class and
+// level: 'idle', or 'best-effort' or 'realtime' with an optional
+// level from 0 (the highest) to 7, which is 4 if it isn't given.
+func ParseIOPriority(s string) (int, int, error) {
+	name, level := s, 4
+	if i := strings.Index(s, ":"); i >= 0 {
+		name = s[:i]
+		l, err := strconv.Atoi(s[i+1:])
+		if err != nil || l < 0 || l > 7 || name == "idle" {
+			return 0, 0, fmt.Errorf("invalid ioPriority %s", s)
+		}
+		level = l
+	}
+
+	switch name {
+	case "idle":
+		return IOPriorityIdle, 0, nil
+	case "best-effort":
+		return IOPriorityBestEffort, level, nil
+	case "realtime":
+		return IOPriorityRealtime, level, nil
+	}
+	return 0, 0, fmt.Errorf("invalid ioPriority %s", s)
+}
+
+// PipelineStages returns the command lines of the pipeline of the
+// script.
+func (s *ScriptConfig) PipelineStages() [][]string {
+	var stages [][]string
+	for _, p := range s.Pipeline {
+		stages = append(stages, SplitCommand(p))
+	}
+	return stages
+}
+
+// TransformTemplate returns the parsed transform of the samples of the
+// script, or nil if it has none.
+func (s *ScriptConfig) TransformTemplate() *template.Template {
+	return s.transform
+}
+
+// transformFuncs are the functions of transforms besides those of
+// text/template, for arithmetic on the values of samples.
+var transformFuncs = template.FuncMap{
+	"add": func(a, b float64) float64 { return a + b },
+	"sub": func(a, b float64) float64 { return a - b },
+	"mul": func(a, b float64) float64 { return a * b },
+	"div": func(a, b float64) float64 { return a / b },
+}
+
+// ArgTemplates returns the parsed templates of the arguments of the
+// script.
+func (s *ScriptConfig) ArgTemplates() []*template.Template {
+	return s.argTemplates
+}
+
+// Environ returns the environment variables of the script as
+// 'NAME=value', sorted by name.
+func (s *ScriptConfig) Environ() []string {
+	return s.environ
+}
+
+// Modes of differential output
+const (
+	DifferentialDelta = "delta"
+	DifferentialRate  = "rate"
+)
+
+// DifferentialName returns the name of the metric with the changes of
+// the samples of a metric of differential output, which gets the
+// suffix of the mode in place of any _total.
+func (s *ScriptConfig) DifferentialName(name string) string {
+	return strings.TrimSuffix(name, "_total") + "_" + s.Differential.Mode
+}
+
+// UnitConversions returns how the samples of the metrics with units
+// are converted, by name.
+func (s *ScriptConfig) UnitConversions() map[string]UnitConversion {
+	return s.unitConversions
+}
+
+// SplitCommand splits a command into arguments at every space, except
+// for spaces within double quotes, which are removed, so that paths
+// with spaces can be given; backslashes have no special meaning,
+// since they separate Windows paths.
+func SplitCommand(command string) []string {
+	var args []string
+	var arg strings.Builder
+	quoted := false
+	for _, r := range command {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			args = append(args, arg.String())
+			arg.Reset()
+		default:
+			arg.WriteRune(r)
+		}
+	}
+	return append(args, arg.String())
+}
+
+// NamingConfig describes the conventions that the names of emitted
+// metrics have to follow. Metrics which violate them are dropped
+// from the output of a probe.
+type NamingConfig struct {
+	RequiredPrefix string   `yaml:"requiredPrefix"`
+	ForbiddenWords []string `yaml:"forbiddenWords"`
+	MaxNameLength  int      `yaml:"maxNameLength"`
+
+	requiredPrefix *regexp.Regexp
+}
+
+// Relabel actions, with the same meaning as in Prometheus
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelHashMod   = "hashmod"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+// RelabelConfig is a relabeling rule for the metrics of a script. It
+// follows the semantics of Prometheus' relabel_config, including
+// the use of __name__ for the metric name.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"sourceLabels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"targetLabel"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	regex       *regexp.Regexp
+	separator   string
+	replacement string
+}
+
+// compile fills in the defaults of a relabeling rule and checks it.
+func (r *RelabelConfig) compile() error {
+	if r.Action == "" {
+		r.Action = RelabelReplace
+	}
+	r.separator = ";"
+	if r.Separator != nil {
+		r.separator = *r.Separator
+	}
+	r.replacement = "$1"
+	if r.Replacement != nil {
+		r.replacement = *r.Replacement
+	}
+
+	expr := "(.*)"
+	if r.Regex != nil {
+		expr = *r.Regex
+	}
+	// Like in Prometheus, the regular expression is anchored on
+	// both ends.
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return fmt.Errorf("regex: %s", err)
+	}
+	r.regex = re
+
+	switch r.Action {
+	case RelabelReplace:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("targetLabel is required for action %s", r.Action)
+		}
+	case RelabelHashMod:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("targetLabel is required for action %s", r.Action)
+		}
+		if r.Modulus == 0 {
+			return fmt.Errorf("modulus is required for action %s", r.Action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("sourceLabels are required for action %s", r.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("unknown action %s", r.Action)
+	}
+
+	return nil
+}
+
+// Regexp returns the compiled regular expression of the rule.
+func (r *RelabelConfig) Regexp() *regexp.Regexp {
+	return r.regex
+}
+
+// SeparatorString returns the separator used to join source labels.
+func (r *RelabelConfig) SeparatorString() string {
+	return r.separator
+}
+
+// ReplacementString returns the replacement of the rule.
+func (r *RelabelConfig) ReplacementString() string {
+	return r.replacement
+}
+
+// Errors are all the problems found in a configuration file.
+type Errors []error
+
+// Error returns the problems one per line.
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LoadConfig reads the configuration file and umarshal the data into the config struct
+//
+// Unknown or misplaced keys are errors, like invalid settings. If
+// there are any problems, all of them are returned as Errors.
+func (c *Config) LoadConfig(file string) error {
+	errs, err := c.load(file)
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return Errors(errs)
+	}
+	return nil
+}
+
+// LoadRegistryConfig is LoadConfig, but reads the scripts of the
+// registry from dir instead of its directory, so that values that were
+// just fetched from the registry can be checked before they replace
+// those that were fetched before.
+func (c *Config) LoadRegistryConfig(file, dir string) error {
+	c.registryDir = dir
+	return c.LoadConfig(file)
+}
+
+// load strictly decodes a configuration file, with the files of its
+// ScriptFiles, and validates it. It returns every problem it found,
+// or an error if the file can't be decoded at all.
+func (c *Config) load(file string) ([]error, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = expandEnv(data); err != nil {
+		return nil, err
+	}
+
+	// UnmarshalStrict still decodes everything it can if there
+	// are unknown keys, which are reported with their line, so we
+	// can continue to check the rest. Unknown keys of anchors are
+	// reported for every alias of the anchor, but we only need to
+	// hear about them once.
+	var errs []error
+	err = yaml.UnmarshalStrict(data, c)
+	if terr, ok := err.(*yaml.TypeError); ok {
+		seen := make(map[string]bool)
+		for _, e := range terr.Errors {
+			if !seen[e] {
+				errs = append(errs, fmt.Errorf("%s", e))
+			}
+			seen[e] = true
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	errs = append(errs, c.loadScriptFiles(file)...)
+	errs = append(errs, c.loadPacks(file)...)
+	errs = append(errs, c.loadRegistry(file)...)
+
+	return append(errs, c.validate()...), nil
+}
+
+// variableFuncs returns the template function that the args and
+// labels of scripts use to refer to the variables of the
+// configuration.
+func (c *Config) variableFuncs() template.FuncMap {
+	return template.FuncMap{"var": func(name string) (string, error) {
+		v, ok := c.Variables[name]
+		if !ok {
+			return "", fmt.Errorf("variable %s is not defined", name)
+		}
+		return v, nil
+	}}
+}
+
+// expandVariables renders a template of the variables of the
+// configuration, such as the value of a label of a script.
+func (c *Config) expandVariables(text string) (string, error) {
+	t, err := template.New("").Funcs(c.variableFuncs()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, nil); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// checkVariables checks that the variables that a template refers to
+// by name are defined, so that mistakes in args, which are only
+// rendered when scripts run, are found when the configuration is
+// loaded.
+func (c *Config) checkVariables(node parse.Node) error {
+	var nodes []parse.Node
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			nodes = n.Nodes
+		}
+	case *parse.ActionNode:
+		nodes = []parse.Node{n.Pipe}
+	case *parse.IfNode:
+		nodes = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		nodes = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		nodes = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.TemplateNode:
+		nodes = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				nodes = append(nodes, cmd)
+			}
+		}
+	case *parse.CommandNode:
+		if len(n.Args) == 2 {
+			ident, ok1 := n.Args[0].(*parse.IdentifierNode)
+			name, ok2 := n.Args[1].(*parse.StringNode)
+			if ok1 && ok2 && ident.Ident == "var" {
+				if _, ok := c.Variables[name.Text]; !ok {
+					return fmt.Errorf("variable %s is not defined", name.Text)
+				}
+			}
+		}
+		nodes = n.Args
+	}
+	for _, n := range nodes {
+		if err := c.checkVariables(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envRE matches references to environment variables, ${NAME}, and
+// escaped ones, $${NAME}. Other uses of '$', such as the $1 of
+// relabeling replacements, are left alone.
+var envRE = regexp.MustCompile(`\$(\$?)\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// envNameRE matches the names of environment variables of scripts.
+var envNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// expandEnv replaces references to environment variables in data with
+// their values, and escaped references with unescaped ones. Undefined
+// variables are an error, since they are probably mistakes.
+func expandEnv(data []byte) ([]byte, error) {
+	var err error
+	data = envRE.ReplaceAllFunc(data, func(ref []byte) []byte {
+		m := envRE.FindSubmatch(ref)
+		if len(m[1]) > 0 {
+			return ref[1:]
+		}
+		v, ok := os.LookupEnv(string(m[2]))
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[2])
+		}
+		return []byte(v)
+	})
+	return data, err
+}
+
+// defaultJWKSRefresh is how often the JSON Web Key Set of bearer
+// authentication is fetched by default.
+const defaultJWKSRefresh = time.Hour
+
+// defaultIntrospectionCache is how long introspected tokens are
+// remembered by default.
+const defaultIntrospectionCache = time.Minute
+
+// readPublicKeys reads the RSA and ECDSA public keys in a PEM file,
+// as public keys or in certificates.
+func readPublicKeys(file string) ([]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("%s: only RSA and ECDSA keys are supported", file)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", file)
+	}
+	return keys, nil
+}
+
+// BearerPublicKeys returns the public keys of publicKeyFile that
+// bearer tokens are verified with.
+func (c *Config) BearerPublicKeys() []crypto.PublicKey {
+	return c.bearerPublicKeys
+}
+
+// LandingTemplate returns the template of the landing page, as it
+// was read when the configuration was loaded, or nil if the default
+// page is used.
+func (c *Config) LandingTemplate() *htmltemplate.Template {
+	return c.LandingPage.template
+}
+
+// AuthRequired reports whether requests to endpoint need to be
+// authenticated.
+func (c *Config) AuthRequired(endpoint string) bool {
+	for _, e := range c.AuthEndpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// A secret is a setting with a secret, which may be read from file.
+type secret struct {
+	secret     *string
+	file, name string
+}
+
+// secrets returns the secrets of the configuration.
+func (c *Config) secrets() []secret {
+	return []secret{
+		{&c.BasicAuth.Password, c.BasicAuth.PasswordFile, "basicAuth: password"},
+		{&c.Registry.Token, c.Registry.TokenFile, "registry: token"},
+		{&c.BearerAuth.SigningKey, c.BearerAuth.SigningKeyFile, "bearerAuth: signingKey"},
+		{&c.OAuth2.ClientSecret, c.OAuth2.ClientSecretFile, "oauth2: clientSecret"},
+		{&c.RemoteWrite.BasicAuth.Password, c.RemoteWrite.BasicAuth.PasswordFile, "remoteWrite: basicAuth: password"},
+		{&c.RemoteWrite.BearerToken, c.RemoteWrite.BearerTokenFile, "remoteWrite: bearerToken"},
+		{&c.History.Export.S3.SecretAccessKey, c.History.Export.S3.SecretAccessKeyFile, "history: export: s3: secretAccessKey"},
+		{&c.History.Export.S3.SessionToken, c.History.Export.S3.SessionTokenFile, "history: export: s3: sessionToken"},
+	}
+}
+
+// Redacted replaces secrets in sanitized configurations.
+const Redacted = "<secret>"
+
+// Sanitized returns a copy of the configuration that can be shown,
+// with its secrets and the values of HTTP headers, which may carry
+// credentials, replaced by Redacted.
+func (c *Config) Sanitized() *Config {
+	s := *c
+	for _, sec := range s.secrets() {
+		if *sec.secret != "" {
+			*sec.secret = Redacted
+		}
+	}
+	if len(s.BearerAuth.SigningKeys) > 0 {
+		s.BearerAuth.SigningKeys = make([]string, len(c.BearerAuth.SigningKeys))
+		for i := range s.BearerAuth.SigningKeys {
+			s.BearerAuth.SigningKeys[i] = Redacted
+		}
+	}
+	s.RemoteWrite.Headers = redactHeaders(s.RemoteWrite.Headers)
+	s.History.Export.HTTP.Headers = redactHeaders(s.History.Export.HTTP.Headers)
+	s.Tracing.Headers = redactHeaders(s.Tracing.Headers)
+	return &s
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	r := make(map[string]string, len(headers))
+	for k := range headers {
+		r[k] = Redacted
+	}
+	return r
+}
+
+// readSecret sets a secret to the content of file, without a trailing
+// newline, if file is set. Setting both is an error.
+func readSecret(secret *string, file, name string) error {
+	if file == "" {
+		return nil
+	}
+	if *secret != "" {
+		return fmt.Errorf("%s and %sFile are mutually exclusive", name, name)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%sFile: %s", name, err)
+	}
+	*secret = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
+
+// loadScriptFiles adds the scripts of the files matching ScriptFiles,
+// in the order of the patterns and then of file names, decoding them
+// strictly. It returns every problem it found; files that can be
+// decoded partially still contribute their scripts.
+func (c *Config) loadScriptFiles(file string) []error {
+	var errs []error
+	dir := filepath.Dir(file)
+	for _, pattern := range c.ScriptFiles {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("scriptFiles: %s: %s", pattern, err))
+			continue
+		}
+
+		for _, f := range files {
+			scripts, ferrs := readScriptFile(f)
+			errs = append(errs, ferrs...)
+			c.Scripts = append(c.Scripts, scripts...)
+		}
+	}
+	return errs
+}
+
+// readScriptFile reads the scripts of a file of ScriptFiles, and
+// returns them along with every problem in the file.
+func readScriptFile(f string) ([]ScriptConfig, []error) {
+	data, err := ioutil.ReadFile(f)
+	if err == nil {
+		data, err = expandEnv(data)
+	}
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %s", f, err)}
+	}
+	var errs []error
+	var sf scriptFile
+	err = yaml.UnmarshalStrict(data, &sf)
+	if terr, ok := err.(*yaml.TypeError); ok {
+		for _, e := range terr.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s", f, e))
+		}
+	} else if err != nil {
+		return nil, []error{fmt.Errorf("%s: %s", f, err)}
+	}
+	return sf.Scripts, errs
+}
+
+// loadPacks adds the scripts of the packs that have been extracted to
+// Scripts. Packs that haven't been downloaded yet are skipped. Their
+// scripts run in the directory of their pack unless they have a cwd,
+// so that they can refer to the files of the pack by relative paths.
+func (c *Config) loadPacks(file string) []error {
+	if c.Packs.Directory == "" {
+		c.Packs.Directory = "packs"
+	}
+	if !filepath.IsAbs(c.Packs.Directory) {
+		c.Packs.Directory = filepath.Join(filepath.Dir(file), c.Packs.Directory)
+	}
+
+	var errs []error
+	for _, p := range c.Packs.Sources {
+		if p == nil || !packNameRE.MatchString(p.Name) {
+			continue
+		}
+		f := filepath.Join(c.PackDir(p), PackFile)
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			continue
+		}
+		scripts, ferrs := readScriptFile(f)
+		errs = append(errs, ferrs...)
+		for i := range scripts {
+			if scripts[i].Cwd == "" {
+				scripts[i].Cwd = c.PackDir(p)
+			}
+		}
+		c.Scripts = append(c.Scripts, scripts...)
+	}
+	return errs
+}
+
+// loadRegistry adds the scripts of the keys of the registry that have
+// been fetched to Scripts. Keys that haven't been fetched yet are
+// missing.
+func (c *Config) loadRegistry(file string) []error {
+	r := &c.Registry
+	if r.Type == "" {
+		return nil
+	}
+	if r.Directory == "" {
+		r.Directory = "registry"
+	}
+	if !filepath.IsAbs(r.Directory) {
+		r.Directory = filepath.Join(filepath.Dir(file), r.Directory)
+	}
+
+	dir := r.Directory
+	if c.registryDir != "" {
+		dir = c.registryDir
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+RegistryFileSuffix))
+	if err != nil {
+		return []error{fmt.Errorf("registry: %s", err)}
+	}
+	var errs []error
+	for _, f := range files {
+		scripts, ferrs := readScriptFile(f)
+		errs = append(errs, ferrs...)
+		c.Scripts = append(c.Scripts, scripts...)
+	}
+	return errs
+}
+
+// CheckConfig strictly loads a configuration file and returns it
+// along with every problem that could be found in it: unknown or
+// misplaced keys, invalid settings such as bad regular expressions,
+// and scripts whose programs do not exist or are not executable.
+func CheckConfig(file string) (*Config, []error) {
+	c := &Config{}
+	errs, err := c.load(file)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	for _, s := range c.Scripts {
+		if s.Name == "" {
+			continue
+		}
+
+		// validate reports scripts without the settings of their
+		// type, and there's nothing to check for them.
+		if (s.Type == TypeDocker && s.Docker == nil) || (s.Type == TypeKubernetes && s.Kubernetes == nil) || (s.Type == TypeSSH && s.SSH == nil) || (s.Type == TypeWorker && c.GetWorkerPoolConfig(s.Worker) == nil) {
+			continue
+		}
+		if root := s.Sandbox.Root; root != "" {
+			// Programs are run in the root directory of the
+			// sandbox, where only those given by absolute paths
+			// can be checked.
+			programs := append([]string{s.Script, s.Interpreter}, s.Pipeline...)
+			for _, p := range append(programs, s.Fallbacks...) {
+				if args := SplitCommand(p); len(args) > 0 && filepath.IsAbs(args[0]) {
+					if _, err := os.Stat(filepath.Join(root, args[0])); err != nil {
+						errs = append(errs, fmt.Errorf("script %s: %s", s.Name, err))
+					}
+				}
+			}
+			continue
+		}
+		program := s.Script
+		switch s.Type {
+		case TypeDocker:
+			program = s.Docker.Binary
+		case TypeKubernetes:
+			program = s.Kubernetes.Binary
+		case TypeSSH:
+			program = s.SSH.Binary
+		case TypeWorker:
+			program = c.GetWorkerPoolConfig(s.Worker).Command
+			if _, err := os.Stat(inDir(s.Cwd, s.Script)); err != nil {
+				errs = append(errs, fmt.Errorf("script %s: %s", s.Name, err))
+			}
+		default:
+			if s.Interpreter != "" {
+				program = s.Interpreter
+				if _, err := os.Stat(inDir(s.Cwd, SplitCommand(s.Script)[0])); err != nil {
+					errs = append(errs, fmt.Errorf("script %s: %s", s.Name, err))
+				}
+			}
+		}
+		if s.Type != TypeHTTP && s.Type != TypeStarlark && s.Type != TypeFile && !registeredType(s.Type) && !strings.HasPrefix(program, BuiltinPrefix) {
+			if err := checkProgram(program, s.Cwd); err != nil {
+				errs = append(errs, fmt.Errorf("script %s: %s", s.Name, err))
+			}
+		}
+		if sudo := s.SudoArgs(); sudo != nil {
+			if err := checkSudo(sudo, s.Command(), s.Cwd); err != nil {
+				errs = append(errs, fmt.Errorf("script %s: %s", s.Name, err))
+			}
+		}
+		for j, p := range s.Pipeline {
+			if err := checkProgram(p, s.Cwd); err != nil {
+				errs = append(errs, fmt.Errorf("script %s: pipeline stage %d: %s", s.Name, j+1, err))
+			}
+		}
+		if s.Type == TypeExec {
+			for j, f := range s.Fallbacks {
+				if err := checkProgram(f, s.Cwd); err != nil {
+					errs = append(errs, fmt.Errorf("script %s: fallback %d: %s", s.Name, j+1, err))
+				}
+			}
+		}
+	}
+	for i, n := range c.Notifiers {
+		if n.Command == "" {
+			continue
+		}
+		if err := checkProgram(n.Command, ""); err != nil {
+			errs = append(errs, fmt.Errorf("notifiers: notifier %d: %s", i+1, err))
+		}
+	}
+
+	return c, errs
+}
+
+// checkProgram checks that the program of a script command exists
+// and is executable. Programs without a '/' are looked up in $PATH,
+// the same way they will be when the script is run, and other
+// relative paths in dir, if it isn't "". Windows has no executable
+// permission, so there we leave it to exec.LookPath, which checks the
+// extension instead.
+func checkProgram(script, dir string) error {
+	program := SplitCommand(script)[0]
+	if program == "" {
+		return fmt.Errorf("no program given")
+	}
+
+	if runtime.GOOS == "windows" {
+		_, err := exec.LookPath(program)
+		return err
+	}
+
+	if !strings.Contains(program, "/") {
+		_, err := exec.LookPath(program)
+		return err
+	}
+
+	program = inDir(dir, program)
+	fi, err := os.Stat(program)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", program)
+	}
+
+	return nil
+}
+
+// checkSudo checks that sudo lets us run a command without a
+// password, as far as it can be checked without the parameters of
+// probes. It's checked for the user that checks the configuration.
+func checkSudo(sudo, command []string, dir string) error {
+	if err := checkProgram(sudo[0], ""); err != nil {
+		return err
+	}
+	args := append([]string{"-n", "-l"}, sudo[2:]...)
+	cmd := exec.Command(sudo[0], append(args, command...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("sudo doesn't allow running %s without a password: %s", strings.Join(command, " "), msg)
+	}
+	return nil
+}
+
+// inDir returns a relative path as seen from dir, if it isn't "".
+func inDir(dir, path string) string {
+	if dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// checkLocalURL checks that the URL of a http script is one on this
+// host, since the exporter is meant to be a front-end for local
+// metric emitters and not a general proxy.
+func checkLocalURL(rawurl, socket string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("url: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url: scheme must be http or https")
+	}
+	if socket != "" {
+		return nil
+	}
+
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("url: host %s is not a loopback address, use a socket instead", host)
+}
+
+// validate checks the loaded configuration for errors that can be
+// detected before any script is run, and prepares derived values
+// such as compiled regular expressions. It returns every problem it
+// finds: the first one of the settings of the server, of the settings
+// of all scripts, and of every script, module, group and notifier.
+func (c *Config) validate() []error {
+	var errs []error
+	if err := c.validateServer(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateSettings(); err != nil {
+		errs = append(errs, err)
+	}
+	for i := range c.Scripts {
+		c.Defaults.apply(&c.Scripts[i])
+	}
+
+	// Modules are validated like scripts, as copies of their script
+	// with the settings of the module.
+	modules := make(map[string]bool)
+	scripts := make([]*ScriptConfig, 0, len(c.Scripts)+len(c.Modules))
+	for i := range c.Scripts {
+		scripts = append(scripts, &c.Scripts[i])
+	}
+	for i := range c.Modules {
+		if err := c.validateModule(&c.Modules[i], modules); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		scripts = append(scripts, &c.Modules[i].script)
+	}
+
+	pools := make(map[string]bool)
+	for i := range c.Workers {
+		if err := c.validateWorkerPool(&c.Workers[i], pools); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Scripts are found by their name, which must be unique.
+	seen := make(map[string]bool)
+	for _, s := range scripts {
+		switch {
+		case s.Name == "":
+			errs = append(errs, fmt.Errorf("script with command %q has no name", s.Script))
+			continue
+		case seen[s.Name]:
+			errs = append(errs, fmt.Errorf("script %s: defined more than once", s.Name))
+		}
+		seen[s.Name] = true
+		if err := c.validateScript(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.Server.validate(scripts); err != nil {
+		errs = append(errs, fmt.Errorf("server: %s", err))
+	}
+
+	groups := make(map[string]bool)
+	for i := range c.Groups {
+		if err := c.validateGroup(&c.Groups[i], groups, modules); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	listeners := make(map[string]bool)
+	for i := range c.Listeners {
+		if err := c.validateListener(&c.Listeners[i], listeners, modules); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for i := range c.Notifiers {
+		if err := c.validateNotifier(i, &c.Notifiers[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// validateServer checks the settings of the server: secrets,
+// authentication, CORS, the access log and TLS.
+func (c *Config) validateServer() error {
+	for _, s := range c.secrets() {
+		if err := readSecret(s.secret, s.file, s.name); err != nil {
+			return err
+		}
+	}
+
+	if b := &c.BearerAuth; b.Active {
+		if b.SigningKey == "" && len(b.SigningKeys) == 0 && b.PublicKeyFile == "" && b.JWKSURL == "" {
+			return fmt.Errorf("bearerAuth: signingKey, signingKeys, publicKeyFile or jwksURL is required")
+		}
+		for _, k := range b.SigningKeys {
+			if k == "" {
+				return fmt.Errorf("bearerAuth: signingKeys must not be empty")
+			}
+		}
+		if b.PublicKeyFile != "" {
+			keys, err := readPublicKeys(b.PublicKeyFile)
+			if err != nil {
+				return fmt.Errorf("bearerAuth: publicKeyFile: %s", err)
+			}
+			c.bearerPublicKeys = keys
+		}
+		if u, err := url.Parse(b.JWKSURL); b.JWKSURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+			return fmt.Errorf("bearerAuth: invalid jwksURL %s", b.JWKSURL)
+		}
+		if b.JWKSRefresh < 0 {
+			return fmt.Errorf("bearerAuth: jwksRefresh must not be negative")
+		}
+		if b.JWKSRefresh == 0 {
+			b.JWKSRefresh = defaultJWKSRefresh
+		}
+	}
+
+	if o := &c.OAuth2; o.Active {
+		if c.BearerAuth.Active {
+			return fmt.Errorf("oauth2: can't be combined with bearerAuth")
+		}
+		if (o.Issuer == "") == (o.IntrospectionURL == "") {
+			return fmt.Errorf("oauth2: exactly one of issuer and introspectionURL is required")
+		}
+		for _, v := range []struct{ name, url string }{{"issuer", o.Issuer}, {"introspectionURL", o.IntrospectionURL}} {
+			if u, err := url.Parse(v.url); v.url != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+				return fmt.Errorf("oauth2: invalid %s %s", v.name, v.url)
+			}
+		}
+		if o.Issuer != "" && o.Audience == "" {
+			return fmt.Errorf("oauth2: audience is required with an issuer")
+		}
+		for _, scope := range o.Scopes {
+			if scope == "" || strings.ContainsAny(scope, " \t") {
+				return fmt.Errorf("oauth2: invalid scope %q", scope)
+			}
+		}
+		if o.CacheDuration < 0 {
+			return fmt.Errorf("oauth2: cacheDuration must not be negative")
+		}
+		if o.CacheDuration == 0 {
+			o.CacheDuration = defaultIntrospectionCache
+		}
+	}
+
+	if c.AuthEndpoints == nil {
+		c.AuthEndpoints = []string{EndpointProbe, EndpointAdmin}
+	}
+	for _, e := range c.AuthEndpoints {
+		switch e {
+		case EndpointProbe, EndpointMetrics, EndpointAdmin, EndpointDiscovery:
+		default:
+			return fmt.Errorf("authEndpoints: unknown endpoint %s", e)
+		}
+	}
+
+	if cors := &c.CORS; len(cors.AllowedOrigins) > 0 {
+		for i, o := range cors.AllowedOrigins {
+			if o == "*" {
+				continue
+			}
+			u, err := url.Parse(o)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+				return fmt.Errorf("cors: invalid origin %s", o)
+			}
+			cors.AllowedOrigins[i] = strings.ToLower(u.Scheme + "://" + u.Host)
+		}
+		if len(cors.AllowedMethods) == 0 {
+			cors.AllowedMethods = []string{"GET", "POST"}
+		}
+		for i, m := range cors.AllowedMethods {
+			cors.AllowedMethods[i] = strings.ToUpper(m)
+		}
+		if len(cors.AllowedHeaders) == 0 {
+			cors.AllowedHeaders = []string{"Authorization", "Content-Type"}
+		}
+		if cors.MaxAge < 0 {
+			return fmt.Errorf("cors: maxAge must not be negative")
+		}
+	}
+
+	switch c.AccessLog.Format {
+	case "":
+		c.AccessLog.Format = AccessLogCommon
+	case AccessLogCommon, AccessLogJSON:
+	default:
+		return fmt.Errorf("accessLog: unknown format %s", c.AccessLog.Format)
+	}
+
+	for client, params := range c.Clients.Params {
+		if _, ok := params["script"]; ok {
+			return fmt.Errorf("clients: params for %s: the script can't be pinned", client)
+		}
+	}
+	if c.TLS.ClientCA != "" && !c.TLS.Active {
+		return fmt.Errorf("tls: clientCA requires tls to be active")
+	}
+	if _, ok := TLSVersions[c.TLS.MinVersion]; c.TLS.MinVersion != "" && !ok {
+		return fmt.Errorf("tls: unknown minVersion %s", c.TLS.MinVersion)
+	}
+	for _, name := range c.TLS.CipherSuites {
+		if _, ok := TLSCipherSuite(name); !ok {
+			return fmt.Errorf("tls: unknown or insecure cipher suite %s", name)
+		}
+	}
+	for _, name := range c.TLS.CurvePreferences {
+		if _, ok := TLSCurves[name]; !ok {
+			return fmt.Errorf("tls: unknown curve %s", name)
+		}
+	}
+
+	return nil
+}
+
+// validateSettings checks the settings that apply to all scripts and
+// the outputs of their results.
+func (c *Config) validateSettings() error {
+	if c.Naming != nil {
+		if err := c.Naming.compile(); err != nil {
+			return fmt.Errorf("naming: %s", err)
+		}
+	}
+
+	for name := range c.Variables {
+		if !envNameRE.MatchString(name) {
+			return fmt.Errorf("variables: invalid name %q", name)
+		}
+	}
+
+	if c.History.Size < 0 || c.History.PerScript < 0 || c.History.MaxOutputBytes < 0 {
+		return fmt.Errorf("history: size, perScript and maxOutputBytes must not be negative")
+	}
+	if e := &c.History.Export; e.Active() {
+		if e.Interval <= 0 {
+			return fmt.Errorf("history: export: interval must be positive")
+		}
+		if e.File.MaxBytes < 0 || e.File.MaxFiles < 0 {
+			return fmt.Errorf("history: export: file: maxBytes and maxFiles must not be negative")
+		}
+		if e.S3.Bucket != "" && e.S3.Region == "" {
+			return fmt.Errorf("history: export: s3: region is required")
+		}
+	}
+
+	for i, b := range c.InternalMetrics.DurationBuckets {
+		if i > 0 && b <= c.InternalMetrics.DurationBuckets[i-1] {
+			return fmt.Errorf("internalMetrics: durationBuckets must be in increasing order")
+		}
+	}
+
+	if c.Limits.MaxOutputBytes == 0 {
+		c.Limits.MaxOutputBytes = defaultMaxOutputBytes
+	}
+
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rateLimit: %s", err)
+	}
+	if eb := &c.ExecutionBudget; eb.ScriptSeconds != 0 || eb.Interval != 0 {
+		if eb.ScriptSeconds < 0 || eb.Interval < 0 {
+			return fmt.Errorf("executionBudget: scriptSeconds and interval must not be negative")
+		}
+		if eb.Interval == 0 {
+			eb.Interval = time.Minute
+		}
+	}
+
+	if c.Probe.MaxBodyBytes < 0 {
+		return fmt.Errorf("probe: maxBodyBytes must not be negative")
+	}
+	if c.Probe.MaxBodyBytes == 0 {
+		c.Probe.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if c.Probe.MaxBatchSize < 0 {
+		return fmt.Errorf("probe: maxBatchSize must not be negative")
+	}
+	if c.Probe.MaxBatchSize == 0 {
+		c.Probe.MaxBatchSize = defaultMaxBatchSize
+	}
+	switch c.Probe.UnknownScript {
+	case "":
+		c.Probe.UnknownScript = UnknownScriptBadRequest
+	case UnknownScriptBadRequest, UnknownScriptNotFound, UnknownScriptMetric:
+	default:
+		return fmt.Errorf("probe: unknown unknownScript %s", c.Probe.UnknownScript)
+	}
+
+	if rw := &c.RemoteWrite; rw.URL != "" {
+		if u, err := url.Parse(rw.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("remoteWrite: invalid url %s", rw.URL)
+		}
+		if rw.Timeout < 0 || rw.MinBackoff < 0 || rw.MaxBackoff < 0 || rw.MaxRetries < 0 {
+			return fmt.Errorf("remoteWrite: timeout, backoffs and maxRetries must not be negative")
+		}
+		if rw.Timeout == 0 {
+			rw.Timeout = 30 * time.Second
+		}
+		if rw.MinBackoff == 0 {
+			rw.MinBackoff = time.Second
+		}
+		if rw.MaxBackoff == 0 {
+			rw.MaxBackoff = 30 * time.Second
+		}
+		if rw.MaxRetries == 0 {
+			rw.MaxRetries = 3
+		}
+		for name := range rw.ExternalLabels {
+			if !ValidLabelName(name) {
+				return fmt.Errorf("remoteWrite: invalid external label name %s", name)
+			}
+		}
+	}
+
+	nl := &c.NodeLabels
+	if nl.Hostname != "" && (!ValidLabelName(nl.Hostname) || strings.HasPrefix(nl.Hostname, "__")) {
+		return fmt.Errorf("nodeLabels: invalid hostname label name %s", nl.Hostname)
+	}
+	if nl.Command != "" && len(SplitCommand(nl.Command)) == 0 {
+		return fmt.Errorf("nodeLabels: empty command")
+	}
+	if nl.Timeout < 0 {
+		return fmt.Errorf("nodeLabels: timeout must not be negative")
+	}
+	if nl.Timeout == 0 {
+		nl.Timeout = 10 * time.Second
+	}
+
+	if t := &c.Tracing; t.Endpoint != "" {
+		if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("tracing: invalid endpoint %s", t.Endpoint)
+		}
+		if t.Timeout < 0 {
+			return fmt.Errorf("tracing: timeout must not be negative")
+		}
+		if t.Timeout == 0 {
+			t.Timeout = 10 * time.Second
+		}
+		if t.SamplingFraction < 0 || t.SamplingFraction > 1 {
+			return fmt.Errorf("tracing: samplingFraction must be between 0 and 1")
+		}
+	}
+
+	if dir := c.Textfile.Directory; dir != "" {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("textfile: directory %s doesn't exist", dir)
+		}
+	}
+	if dir := c.Persistence.Directory; dir != "" {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("persistence: directory %s doesn't exist", dir)
+		}
+	}
+	if r := &c.Registry; r.Type != "" {
+		if r.Type != RegistryConsul && r.Type != RegistryEtcd {
+			return fmt.Errorf("registry: unknown type %s", r.Type)
+		}
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("registry: invalid url %q", r.URL)
+		}
+		if r.Interval < 0 {
+			return fmt.Errorf("registry: interval must not be negative")
+		}
+		if r.Interval == 0 {
+			r.Interval = 30 * time.Second
+		}
+	}
+	if fb := &c.FailureBundles; fb.Directory != "" {
+		if fi, err := os.Stat(fb.Directory); err != nil || !fi.IsDir() {
+			return fmt.Errorf("failureBundles: directory %s doesn't exist", fb.Directory)
+		}
+		if fb.MaxBundles < 0 || fb.MaxAge < 0 || fb.MaxOutputBytes < 0 {
+			return fmt.Errorf("failureBundles: maxBundles, maxAge and maxOutputBytes must not be negative")
+		}
+		if fb.MaxBundles == 0 {
+			fb.MaxBundles = 100
+		}
+		if fb.MaxOutputBytes == 0 {
+			fb.MaxOutputBytes = 64 << 10
+		}
+	}
+
+	if c.Defaults.Timeout < 0 {
+		return fmt.Errorf("defaults: timeout must not be negative")
+	}
+
+	if c.LandingPage.Template != "" {
+		t, err := htmltemplate.ParseFiles(c.LandingPage.Template)
+		if err != nil {
+			return fmt.Errorf("landingPage: %s", err)
+		}
+		c.LandingPage.template = t
+	}
+
+	return c.validatePacks()
+}
+
+// validatePacks checks the packs and reads their public keys.
+func (c *Config) validatePacks() error {
+	if c.Packs.MaxExtractedBytes < 0 {
+		return fmt.Errorf("packs: maxExtractedBytes must not be negative")
+	}
+	if c.Packs.MaxExtractedBytes == 0 {
+		c.Packs.MaxExtractedBytes = defaultMaxExtractedBytes
+	}
+	names := make(map[string]bool)
+	for i, p := range c.Packs.Sources {
+		if p == nil || !packNameRE.MatchString(p.Name) {
+			return fmt.Errorf("packs: pack %d: invalid name", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("packs: pack %s: defined more than once", p.Name)
+		}
+		names[p.Name] = true
+		if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("packs: pack %s: invalid url %s", p.Name, p.URL)
+		}
+		if p.SHA256 == "" && p.PublicKeyFile == "" {
+			return fmt.Errorf("packs: pack %s: sha256 or publicKeyFile is required", p.Name)
+		}
+		if p.SHA256 != "" && !sha256RE.MatchString(p.SHA256) {
+			return fmt.Errorf("packs: pack %s: invalid sha256 %s", p.Name, p.SHA256)
+		}
+		if p.PublicKeyFile != "" {
+			keys, err := readPublicKeys(p.PublicKeyFile)
+			if err != nil {
+				return fmt.Errorf("packs: pack %s: publicKeyFile: %s", p.Name, err)
+			}
+			p.publicKeys = keys
+		}
+	}
+	return nil
+}
+
+// validateModule checks a module and makes its script, given the
+// names of the modules before it, and adds its name to them.
+func (c *Config) validateModule(m *ModuleConfig, modules map[string]bool) error {
+	base := c.GetScriptConfig(m.Script)
+	switch {
+	case m.Name == "" || strings.Contains(m.Name, ",") || strings.HasPrefix(m.Name, "__"):
+		return fmt.Errorf("module %q: invalid name", m.Name)
+	case modules[m.Name] || c.GetScriptConfig(m.Name) != nil:
+		return fmt.Errorf("module %s: name is already used", m.Name)
+	case base == nil:
+		return fmt.Errorf("module %s: unknown script %s", m.Name, m.Script)
+	}
+	modules[m.Name] = true
+
+	m.script = *base
+	m.script.Name = m.Name
+	if len(m.Args) > 0 {
+		m.script.Args = m.Args
+	}
+	if m.Format != "" {
+		m.script.Format, m.script.JSON = m.Format, m.JSON
+	}
+	if m.Timeout != 0 {
+		m.script.Timeout = m.Timeout
+	}
+	if m.SuccessWhen != nil {
+		m.script.SuccessWhen = m.SuccessWhen
+	}
+
+	return nil
+}
 
-	BearerAuth struct {
-		Active     bool   `yaml:"active"`
-		SigningKey string `yaml:"signingKey"`
-	} `yaml:"bearerAuth"`
+// validateScript checks a script, or the script of a module.
+func (c *Config) validateScript(s *ScriptConfig) error {
+	if strings.HasPrefix(s.Name, "__") {
+		return fmt.Errorf("script %s: names starting with '__' are reserved", s.Name)
+	}
+	if s.ResultChanges.Tolerance < 0 {
+		return fmt.Errorf("script %s: resultChanges.tolerance must not be negative", s.Name)
+	}
+	if s.CacheDuration < 0 {
+		return fmt.Errorf("script %s: cacheDuration must not be negative", s.Name)
+	}
+	if s.Schedule.Interval < 0 {
+		return fmt.Errorf("script %s: schedule.interval must not be negative", s.Name)
+	}
+	if w := s.Schedule.WarmUp; w.Jitter != 0 || w.Ready {
+		switch {
+		case s.Schedule.Interval == 0:
+			return fmt.Errorf("script %s: schedule.warmUp needs schedule.interval", s.Name)
+		case w.Jitter < 0 || w.Jitter > s.Schedule.Interval:
+			return fmt.Errorf("script %s: schedule.warmUp.jitter must be between 0 and schedule.interval", s.Name)
+		}
+	}
+	if s.FailureBudget < 0 {
+		return fmt.Errorf("script %s: failureBudget must not be negative", s.Name)
+	}
+	if s.Retries < 0 || s.RetryInterval < 0 {
+		return fmt.Errorf("script %s: retries and retryInterval must not be negative", s.Name)
+	}
+	if a := &s.AdaptiveTimeout; a.Active {
+		if a.Percentile == 0 {
+			a.Percentile = 0.99
+		}
+		if a.Factor == 0 {
+			a.Factor = 2
+		}
+		if a.Samples == 0 {
+			a.Samples = 100
+		}
+		switch {
+		case s.Timeout == 0:
+			return fmt.Errorf("script %s: adaptiveTimeout requires a timeout", s.Name)
+		case a.Percentile <= 0 || a.Percentile > 1:
+			return fmt.Errorf("script %s: adaptiveTimeout.percentile must be between 0 and 1", s.Name)
+		case a.Factor < 1:
+			return fmt.Errorf("script %s: adaptiveTimeout.factor must be at least 1", s.Name)
+		case a.Min < 0 || a.Min > s.Timeout:
+			return fmt.Errorf("script %s: adaptiveTimeout.min must be between 0 and the timeout", s.Name)
+		case a.Samples < MinAdaptiveSamples:
+			return fmt.Errorf("script %s: adaptiveTimeout.samples must be at least %d", s.Name, MinAdaptiveSamples)
+		}
+	}
+	s.windows = nil
+	for _, text := range s.Windows {
+		w, err := parseWindow(text)
+		if err != nil {
+			return fmt.Errorf("script %s: %s", s.Name, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	if len(s.windows) > 0 && (s.Async || s.Stream.Active) {
+		return fmt.Errorf("script %s: windows can't be combined with async or stream", s.Name)
+	}
+	sort.Strings(s.Locks)
+	for j, l := range s.Locks {
+		switch {
+		case l == "":
+			return fmt.Errorf("script %s: empty lock name", s.Name)
+		case j > 0 && l == s.Locks[j-1]:
+			return fmt.Errorf("script %s: duplicate lock %s", s.Name, l)
+		}
+	}
+	if err := s.RateLimit.validate(); err != nil {
+		return fmt.Errorf("script %s: rateLimit: %s", s.Name, err)
+	}
+	if s.BatchWindow < 0 {
+		return fmt.Errorf("script %s: batchWindow must not be negative", s.Name)
+	}
+	if s.Async && (s.BatchWindow > 0 || s.CacheDuration > 0) {
+		return fmt.Errorf("script %s: async can't be combined with batchWindow or cacheDuration", s.Name)
+	}
+	if s.MaxAge < 0 {
+		return fmt.Errorf("script %s: maxAge must not be negative", s.Name)
+	}
+	if s.MaxAge > 0 && !s.Async {
+		return fmt.Errorf("script %s: maxAge requires async", s.Name)
+	}
+	if s.PersistResult {
+		switch {
+		case c.Persistence.Directory == "":
+			return fmt.Errorf("script %s: persistResult requires persistence.directory", s.Name)
+		case !s.Async && s.CacheDuration == 0:
+			return fmt.Errorf("script %s: persistResult requires async or cacheDuration", s.Name)
+		}
+	}
+	switch s.Type {
+	case "", TypeExec:
+		s.Type = TypeExec
+	case TypeHTTP:
+		if err := checkLocalURL(s.URL, s.Socket); err != nil {
+			return fmt.Errorf("script %s: %s", s.Name, err)
+		}
+	case TypeDocker:
+		if s.Docker == nil || (s.Docker.Container == "") == (s.Docker.Image == "") {
+			return fmt.Errorf("script %s: type docker requires either docker.container or docker.image", s.Name)
+		}
+		if s.Docker.Binary == "" {
+			s.Docker.Binary = "docker"
+		}
+	case TypeKubernetes:
+		if s.Kubernetes == nil || (s.Kubernetes.Pod == "") == (s.Kubernetes.Selector == "") {
+			return fmt.Errorf("script %s: type kubernetes requires either kubernetes.pod or kubernetes.selector", s.Name)
+		}
+		if s.Kubernetes.Binary == "" {
+			s.Kubernetes.Binary = "kubectl"
+		}
+	case TypeStarlark:
+		if s.Starlark == nil || s.Starlark.Code == "" {
+			return fmt.Errorf("script %s: type starlark requires starlark.code", s.Name)
+		}
+	case TypeSSH:
+		switch {
+		case s.SSH == nil || s.SSH.Host == "":
+			return fmt.Errorf("script %s: type ssh requires ssh.host", s.Name)
+		case strings.HasPrefix(s.SSH.Host, "-") || strings.HasPrefix(s.SSH.User, "-"):
+			return fmt.Errorf("script %s: ssh.host and ssh.user may not start with '-'", s.Name)
+		case s.SSH.Port < 0 || s.SSH.Port > 65535:
+			return fmt.Errorf("script %s: invalid ssh.port %d", s.Name, s.SSH.Port)
+		}
+		if s.SSH.Binary == "" {
+			s.SSH.Binary = "ssh"
+		}
+	case TypeWorker:
+		switch {
+		case s.Script == "":
+			return fmt.Errorf("script %s: type worker requires a script", s.Name)
+		case c.GetWorkerPoolConfig(s.Worker) == nil:
+			return fmt.Errorf("script %s: unknown worker pool %q", s.Name, s.Worker)
+		}
+	case TypeFile:
+		switch {
+		case s.File == nil || s.File.Path == "":
+			return fmt.Errorf("script %s: type file requires file.path", s.Name)
+		case s.File.MaxAge < 0:
+			return fmt.Errorf("script %s: file.maxAge must not be negative", s.Name)
+		}
+		t, err := template.New("path").Funcs(c.variableFuncs()).Option("missingkey=zero").Parse(s.File.Path)
+		if err == nil {
+			err = c.checkVariables(t.Tree.Root)
+		}
+		if err != nil {
+			return fmt.Errorf("script %s: file.path: %s", s.Name, err)
+		}
+		s.File.template = t
+	default:
+		if !registeredType(s.Type) {
+			return fmt.Errorf("script %s: unknown type %s", s.Name, s.Type)
+		}
+	}
+	if len(s.Options) > 0 && !registeredType(s.Type) {
+		return fmt.Errorf("script %s: options are only supported for registered types", s.Name)
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("script %s: timeout must not be negative", s.Name)
+	}
+	if st := &s.Stream; st.Active {
+		switch {
+		case !s.RunsCommand():
+			return fmt.Errorf("script %s: stream is not supported for type %s", s.Name, s.Type)
+		case s.Async || s.Stdin != nil || len(s.Args) > 0 || s.Retries > 0:
+			return fmt.Errorf("script %s: stream can't be combined with async, stdin, args or retries", s.Name)
+		case st.RestartDelay < 0:
+			return fmt.Errorf("script %s: stream.restartDelay must not be negative", s.Name)
+		}
+		if st.Delimiter == "" {
+			st.Delimiter = defaultStreamDelimiter
+		}
+		if st.RestartDelay == 0 {
+			st.RestartDelay = time.Second
+		}
+	}
+	if (s.Cwd != "" || s.Umask != "" || s.HasPriority() || s.Sandbox.Active) && (s.Type != TypeExec || strings.HasPrefix(s.Script, BuiltinPrefix)) {
+		return fmt.Errorf("script %s: cwd, umask, priorities and sandboxes are not supported for type %s", s.Name, s.Type)
+	}
+	if s.SudoArgs() != nil {
+		switch {
+		case s.Type != TypeExec || strings.HasPrefix(s.Script, BuiltinPrefix):
+			return fmt.Errorf("script %s: sudo is not supported for type %s", s.Name, s.Type)
+		case runtime.GOOS == "windows":
+			return fmt.Errorf("script %s: sudo is not supported on windows", s.Name)
+		case s.Sandbox.Active:
+			return fmt.Errorf("script %s: sudo can't be used in a sandbox", s.Name)
+		case s.SudoUser != "" && !sudoUserRE.MatchString(s.SudoUser):
+			return fmt.Errorf("script %s: invalid sudoUser %s", s.Name, s.SudoUser)
+		}
+	}
+	if k := &s.Kill; k.Signal != "" || k.GracePeriod != 0 {
+		switch {
+		case !s.RunsCommand():
+			return fmt.Errorf("script %s: kill is not supported for type %s", s.Name, s.Type)
+		case runtime.GOOS == "windows":
+			return fmt.Errorf("script %s: kill is not supported on windows", s.Name)
+		case k.GracePeriod <= 0:
+			return fmt.Errorf("script %s: kill: gracePeriod must be positive", s.Name)
+		}
+		if k.Signal == "" {
+			k.Signal = "SIGTERM"
+		}
+		known := false
+		for _, sig := range KillSignals {
+			known = known || k.Signal == sig
+		}
+		if !known {
+			return fmt.Errorf("script %s: kill: unknown signal %s", s.Name, k.Signal)
+		}
+	}
+	if sb := &s.Sandbox; sb.Active {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("script %s: sandbox is only supported on linux", s.Name)
+		}
+		switch sb.Seccomp {
+		case "":
+			sb.Seccomp = SeccompDefault
+		case SeccompDefault, SeccompNone:
+		default:
+			return fmt.Errorf("script %s: sandbox: unknown seccomp %s", s.Name, sb.Seccomp)
+		}
+		if sb.Seccomp == SeccompDefault && runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+			return fmt.Errorf("script %s: sandbox: seccomp is not supported on %s", s.Name, runtime.GOARCH)
+		}
+		if sb.Root != "" {
+			if fi, err := os.Stat(sb.Root); err != nil || !fi.IsDir() || !filepath.IsAbs(sb.Root) {
+				return fmt.Errorf("script %s: sandbox: root %s isn't an absolute path of a directory", s.Name, sb.Root)
+			}
+			if s.Cwd != "" {
+				return fmt.Errorf("script %s: sandbox: cwd can't be combined with root", s.Name)
+			}
+		}
+	} else if sb.Root != "" {
+		return fmt.Errorf("script %s: sandbox: root requires an active sandbox", s.Name)
+	}
+	if s.Cwd != "" {
+		if fi, err := os.Stat(s.Cwd); err != nil || !fi.IsDir() {
+			return fmt.Errorf("script %s: cwd %s doesn't exist", s.Name, s.Cwd)
+		}
+	}
+	if s.Umask != "" {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("script %s: umask is not supported on windows", s.Name)
+		}
+		if m, err := strconv.ParseUint(s.Umask, 8, 32); err != nil || m > 0777 {
+			return fmt.Errorf("script %s: invalid umask %s", s.Name, s.Umask)
+		}
+	}
+	if s.Nice != nil {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("script %s: nice is not supported on windows", s.Name)
+		}
+		if *s.Nice < -20 || *s.Nice > 19 {
+			return fmt.Errorf("script %s: nice must be between -20 and 19", s.Name)
+		}
+	}
+	if s.IOPriority != "" || s.OOMScoreAdj != nil {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("script %s: ioPriority and oomScoreAdj are only supported on linux", s.Name)
+		}
+		if _, _, err := ParseIOPriority(s.IOPriority); s.IOPriority != "" && err != nil {
+			return fmt.Errorf("script %s: %s", s.Name, err)
+		}
+		if s.OOMScoreAdj != nil && (*s.OOMScoreAdj < -1000 || *s.OOMScoreAdj > 1000) {
+			return fmt.Errorf("script %s: oomScoreAdj must be between -1000 and 1000", s.Name)
+		}
+	}
+	if len(s.Fallbacks) > 0 {
+		switch {
+		case !s.RunsCommand():
+			return fmt.Errorf("script %s: fallbacks are not supported for type %s", s.Name, s.Type)
+		case s.Stream.Active:
+			return fmt.Errorf("script %s: fallbacks can't be combined with stream", s.Name)
+		}
+		for j, f := range s.Fallbacks {
+			switch {
+			case strings.TrimSpace(f) == "":
+				return fmt.Errorf("script %s: fallback %d is empty", s.Name, j+1)
+			case strings.HasPrefix(f, BuiltinPrefix):
+				return fmt.Errorf("script %s: fallback %d can't be a built-in check", s.Name, j+1)
+			}
+		}
+	}
+	if len(s.Pipeline) > 0 {
+		if !s.RunsCommand() {
+			return fmt.Errorf("script %s: pipeline is not supported for type %s", s.Name, s.Type)
+		}
+		for j, p := range s.Pipeline {
+			if strings.TrimSpace(p) == "" {
+				return fmt.Errorf("script %s: pipeline stage %d is empty", s.Name, j+1)
+			}
+		}
+	}
+	s.environ = nil
+	for name, value := range s.Env {
+		if !envNameRE.MatchString(name) {
+			return fmt.Errorf("script %s: invalid env name %q", s.Name, name)
+		}
+		s.environ = append(s.environ, name+"="+value)
+	}
+	sort.Strings(s.environ)
+	if len(s.Args) > 0 {
+		if !s.RunsCommand() {
+			return fmt.Errorf("script %s: args are not supported for type %s", s.Name, s.Type)
+		}
+		s.argTemplates = nil
+		for j, a := range s.Args {
+			t, err := template.New(fmt.Sprintf("arg %d", j+1)).Funcs(c.variableFuncs()).Option("missingkey=error").Parse(a)
+			if err == nil {
+				err = c.checkVariables(t.Tree.Root)
+			}
+			if err != nil {
+				return fmt.Errorf("script %s: args: %s", s.Name, err)
+			}
+			s.argTemplates = append(s.argTemplates, t)
+		}
+	}
+	if len(s.ParamsToArgs) > 0 && !s.RunsCommand() {
+		return fmt.Errorf("script %s: paramsToArgs are not supported for type %s", s.Name, s.Type)
+	}
+	for j, p := range s.ParamsToArgs {
+		if p == nil || p.Param == "" {
+			return fmt.Errorf("script %s: paramsToArgs %d: param is missing", s.Name, j+1)
+		}
+		p.pattern = nil
+		if p.Pattern != "" {
+			if _, err := regexp.Compile(p.Pattern); err != nil {
+				return fmt.Errorf("script %s: paramsToArgs %s: %s", s.Name, p.Param, err)
+			}
+			p.pattern = regexp.MustCompile("^(?:" + p.Pattern + ")$")
+		}
+	}
+	if s.Naming != nil {
+		if err := s.Naming.compile(); err != nil {
+			return fmt.Errorf("script %s: naming: %s", s.Name, err)
+		}
+	}
+	if s.Stdin != nil {
+		if s.Type == TypeHTTP || s.Type == TypeFile {
+			return fmt.Errorf("script %s: stdin is not supported for type %s", s.Name, s.Type)
+		}
+		if err := s.Stdin.compile(); err != nil {
+			return fmt.Errorf("script %s: stdin: %s", s.Name, err)
+		}
+	}
+	if s.Transform != "" {
+		t, err := template.New("transform").Funcs(transformFuncs).Option("missingkey=zero").Parse(s.Transform)
+		if err != nil {
+			return fmt.Errorf("script %s: transform: %s", s.Name, err)
+		}
+		s.transform = t
+	}
+	if s.SuccessWhen != nil {
+		if err := s.SuccessWhen.compile(); err != nil {
+			return fmt.Errorf("script %s: successWhen: %s", s.Name, err)
+		}
+	}
+	switch s.Format {
+	case "", FormatPrometheus:
+		s.Format = FormatPrometheus
+	case FormatNagios, FormatInflux, FormatStatsd, FormatOpenMetrics:
+	case FormatRaw:
+		if s.Prefix != "" || len(s.Labels) > 0 || s.AllowURLLabels || len(s.Relabel) > 0 || s.Metrics != nil || len(s.Metadata) > 0 || len(s.Units) > 0 || s.Transform != "" || s.ResultChanges.Active || s.CheckCounters || len(s.Differential.Metrics) > 0 || s.DecimalComma {
+			return fmt.Errorf("script %s: format raw can't be combined with prefix, labels, relabel, metrics, metadata, units, transform, resultChanges, checkCounters, differential or decimalComma", s.Name)
+		}
+	case FormatJSON:
+		if s.JSON == nil || len(s.JSON.Metrics) == 0 {
+			return fmt.Errorf("script %s: format json requires json metrics", s.Name)
+		}
+		for _, m := range s.JSON.Metrics {
+			if !ValidMetricName(m.Name) {
+				return fmt.Errorf("script %s: json: invalid metric name %q", s.Name, m.Name)
+			}
+			switch m.Type {
+			case "", "gauge", "counter", "untyped":
+			default:
+				return fmt.Errorf("script %s: json: metric %s: unknown type %s", s.Name, m.Name, m.Type)
+			}
+			for name := range m.Labels {
+				if !ValidLabelName(name) {
+					return fmt.Errorf("script %s: json: metric %s: invalid label name %s", s.Name, m.Name, name)
+				}
+			}
+		}
+	default:
+		if !registeredFormat(s.Format) {
+			return fmt.Errorf("script %s: unknown format %s", s.Name, s.Format)
+		}
+	}
+	if s.Prefix != "" && !ValidMetricName(s.Prefix) {
+		return fmt.Errorf("script %s: invalid prefix %s", s.Name, s.Prefix)
+	}
+	switch s.Timestamps {
+	case "":
+		s.Timestamps = TimestampsHonor
+	case TimestampsHonor, TimestampsStrip, TimestampsClamp:
+	default:
+		return fmt.Errorf("script %s: unknown timestamps %s", s.Name, s.Timestamps)
+	}
+	if s.MaxTimestampAge < 0 {
+		return fmt.Errorf("script %s: maxTimestampAge must not be negative", s.Name)
+	}
+	if s.MaxTimestampAge == 0 {
+		s.MaxTimestampAge = defaultMaxTimestampAge
+	}
+	switch s.DuplicateSeries {
+	case "":
+		s.DuplicateSeries = DuplicateSeriesFirst
+	case DuplicateSeriesFirst, DuplicateSeriesLast, DuplicateSeriesSum, DuplicateSeriesFail:
+	default:
+		return fmt.Errorf("script %s: unknown duplicateSeries %s", s.Name, s.DuplicateSeries)
+	}
+	switch s.EnforcePrefix {
+	case "", EnforcePrefixRewrite, EnforcePrefixReject:
+	default:
+		return fmt.Errorf("script %s: unknown enforcePrefix %s", s.Name, s.EnforcePrefix)
+	}
+	labels := make(map[string]string, len(s.Labels))
+	for name, value := range s.Labels {
+		if !ValidLabelName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("script %s: invalid label name %s", s.Name, name)
+		}
+		value, err := c.expandVariables(value)
+		if err != nil {
+			return fmt.Errorf("script %s: label %s: %s", s.Name, name, err)
+		}
+		labels[name] = value
+	}
+	if len(s.Labels) > 0 {
+		s.Labels = labels
+	}
+	for j, r := range s.Relabel {
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("script %s: relabel rule %d: %s", s.Name, j+1, err)
+		}
+	}
+	if s.Metrics != nil {
+		if err := s.Metrics.compile(); err != nil {
+			return fmt.Errorf("script %s: metrics: %s", s.Name, err)
+		}
+	}
+	for name, m := range s.Metadata {
+		switch {
+		case !ValidMetricName(name):
+			return fmt.Errorf("script %s: metadata: invalid metric name %q", s.Name, name)
+		case m == nil || (m.Help == "" && m.Type == ""):
+			return fmt.Errorf("script %s: metadata: metric %s needs help or type", s.Name, name)
+		}
+		switch m.Type {
+		case "", "counter", "gauge", "histogram", "summary", "untyped":
+		default:
+			return fmt.Errorf("script %s: metadata: metric %s: unknown type %s", s.Name, name, m.Type)
+		}
+	}
+	s.unitConversions = nil
+	for name, u := range s.Units {
+		if !ValidMetricName(name) {
+			return fmt.Errorf("script %s: units: invalid metric name %q", s.Name, name)
+		}
+		unit, ok := units[u]
+		if !ok {
+			return fmt.Errorf("script %s: units: metric %s: unknown unit %s", s.Name, name, u)
+		}
+		if s.unitConversions == nil {
+			s.unitConversions = make(map[string]UnitConversion)
+		}
+		s.unitConversions[name] = UnitConversion{Name: convertedName(name, unit), Factor: unit.factor}
+	}
+	if d := &s.Differential; len(d.Metrics) > 0 || d.Mode != "" {
+		switch d.Mode {
+		case "":
+			d.Mode = DifferentialDelta
+		case DifferentialDelta, DifferentialRate:
+		default:
+			return fmt.Errorf("script %s: differential: unknown mode %s", s.Name, d.Mode)
+		}
+		if len(d.Metrics) == 0 {
+			return fmt.Errorf("script %s: differential: no metrics", s.Name)
+		}
+		for _, name := range d.Metrics {
+			if !ValidMetricName(name) {
+				return fmt.Errorf("script %s: differential: invalid metric name %q", s.Name, name)
+			}
+		}
+	}
+	if err := c.checkNaming(s); err != nil {
+		return fmt.Errorf("script %s: naming: %s", s.Name, err)
+	}
 
-	Scripts []struct {
-		Name   string `yaml:"name"`
-		Script string `yaml:"script"`
-	} `yaml:"scripts"`
+	return nil
 }
 
-// LoadConfig reads the configuration file and umarshal the data into the config struct
-func (c *Config) LoadConfig(file string) error {
-	data, err := ioutil.ReadFile(file)
-	if err != nil {
-		return err
+// checkNaming checks the names that the configuration of a script
+// gives to metrics against the naming conventions that apply to it:
+// its prefix, the metrics it has metadata for, and the names of unit
+// conversions and of differential output.
+func (c *Config) checkNaming(s *ScriptConfig) error {
+	n := s.Naming
+	if n == nil {
+		n = c.Naming
+	}
+	if n == nil {
+		return nil
 	}
 
-	err = yaml.Unmarshal(data, &c)
-	if err != nil {
-		return err
+	if s.Prefix != "" {
+		if err := n.checkPrefix(s.Prefix); err != nil {
+			return err
+		}
+	}
+	var names []string
+	for name := range s.Metadata {
+		names = append(names, name)
+	}
+	for _, u := range s.unitConversions {
+		names = append(names, u.Name)
+	}
+	sort.Strings(names)
+	for _, name := range s.Differential.Metrics {
+		names = append(names, s.DifferentialName(name))
+	}
+	for _, name := range names {
+		if err := n.Check(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateGroup checks a group, given the names of the groups before
+// it and of all modules, and adds its name to the groups.
+func (c *Config) validateGroup(g *GroupConfig, groups, modules map[string]bool) error {
+	switch {
+	case g.Name == "" || strings.Contains(g.Name, ",") || strings.HasPrefix(g.Name, "__"):
+		return fmt.Errorf("group %q: invalid name", g.Name)
+	case groups[g.Name] || modules[g.Name] || c.GetScriptConfig(g.Name) != nil:
+		return fmt.Errorf("group %s: name is already used", g.Name)
+	case len(g.Scripts) == 0:
+		return fmt.Errorf("group %s: no scripts", g.Name)
+	}
+	groups[g.Name] = true
+	for _, name := range g.Scripts {
+		if c.GetScriptConfig(name) == nil && !modules[name] && name != "__self__" {
+			return fmt.Errorf("group %s: unknown script %s", g.Name, name)
+		}
+	}
+
+	return nil
+}
+
+// validateListener checks a listener, given the names of the listeners
+// before it and of all modules, and adds its name to the listeners.
+func (c *Config) validateListener(l *ListenerConfig, listeners, modules map[string]bool) error {
+	switch {
+	case l.Name == "":
+		return fmt.Errorf("listener with address %q has no name", l.Address)
+	case listeners[l.Name]:
+		return fmt.Errorf("listener %s: defined more than once", l.Name)
+	case l.Address == "" && len(l.Hosts) == 0:
+		return fmt.Errorf("listener %s: needs an address or hosts", l.Name)
+	case len(l.Scripts) == 0:
+		return fmt.Errorf("listener %s: no scripts", l.Name)
+	}
+	listeners[l.Name] = true
+	for _, h := range l.Hosts {
+		if h == "" || strings.ContainsAny(h, ":/ ") {
+			return fmt.Errorf("listener %s: invalid host %q", l.Name, h)
+		}
+	}
+
+	l.scripts = make(map[string]bool)
+	for _, name := range l.Scripts {
+		switch {
+		case c.GetGroupConfig(name) != nil:
+			for _, member := range c.GetGroupConfig(name).Scripts {
+				l.scripts[member] = true
+			}
+		case c.GetScriptConfig(name) != nil || modules[name] || name == "__self__":
+		default:
+			return fmt.Errorf("listener %s: unknown script %s", l.Name, name)
+		}
+		l.scripts[name] = true
+	}
+
+	return nil
+}
+
+// validateWorkerPool checks a worker pool, given the names of the
+// pools before it.
+func (c *Config) validateWorkerPool(p *WorkerPoolConfig, pools map[string]bool) error {
+	switch {
+	case p.Name == "":
+		return fmt.Errorf("worker pool with command %q has no name", p.Command)
+	case pools[p.Name]:
+		return fmt.Errorf("worker pool %s: defined more than once", p.Name)
+	case len(SplitCommand(p.Command)) == 0:
+		return fmt.Errorf("worker pool %s: no command", p.Name)
+	case p.Size < 0 || p.MaxRuns < 0:
+		return fmt.Errorf("worker pool %s: size and maxRuns must not be negative", p.Name)
+	}
+	pools[p.Name] = true
+	if p.Size == 0 {
+		p.Size = 2
+	}
+	return nil
+}
+
+// validateNotifier checks the i-th notifier.
+func (c *Config) validateNotifier(i int, n *NotifierConfig) error {
+	if err := n.compile(); err != nil {
+		return fmt.Errorf("notifiers: notifier %d: %s", i+1, err)
+	}
+	for _, name := range n.Scripts {
+		if c.GetScriptConfig(name) == nil {
+			return fmt.Errorf("notifiers: notifier %d: unknown script %s", i+1, name)
+		}
+	}
+
+	return nil
+}
+
+// compile checks the naming conventions themselves for mistakes and
+// compiles the required prefix pattern.
+func (n *NamingConfig) compile() error {
+	if n.MaxNameLength < 0 {
+		return fmt.Errorf("maxNameLength must not be negative")
+	}
+
+	for _, w := range n.ForbiddenWords {
+		if w == "" || strings.Contains(w, "_") {
+			return fmt.Errorf("forbidden word %q must be non-empty and must not contain '_'", w)
+		}
+	}
+
+	if n.RequiredPrefix != "" {
+		// The pattern is anchored at the start of the name,
+		// since it is a prefix.
+		re, err := regexp.Compile("^(?:" + n.RequiredPrefix + ")")
+		if err != nil {
+			return fmt.Errorf("requiredPrefix: %s", err)
+		}
+		n.requiredPrefix = re
+	}
+
+	return nil
+}
+
+// Check returns an error describing the first naming convention
+// that a metric name violates, or nil if it follows all of them.
+// Forbidden words are matched case-insensitively against the
+// '_'-separated components of the name.
+func (n *NamingConfig) Check(name string) error {
+	if n.MaxNameLength > 0 && len(name) > n.MaxNameLength {
+		return fmt.Errorf("metric name %s is longer than %d characters", name, n.MaxNameLength)
+	}
+
+	if n.requiredPrefix != nil && !n.requiredPrefix.MatchString(name) {
+		return fmt.Errorf("metric name %s does not start with required prefix %s", name, n.RequiredPrefix)
+	}
+
+	if w := n.forbiddenWord(name); w != "" {
+		return fmt.Errorf("metric name %s contains forbidden word %s", name, w)
+	}
+
+	return nil
+}
+
+// checkPrefix returns an error if the naming conventions rule out
+// every metric under a prefix, because it contains a forbidden word
+// or leaves no room for names.
+func (n *NamingConfig) checkPrefix(prefix string) error {
+	if n.MaxNameLength > 0 && len(prefix)+2 > n.MaxNameLength {
+		return fmt.Errorf("prefix %s leaves no room for metric names of at most %d characters", prefix, n.MaxNameLength)
+	}
+
+	if w := n.forbiddenWord(prefix); w != "" {
+		return fmt.Errorf("prefix %s contains forbidden word %s", prefix, w)
 	}
 
 	return nil
 }
 
+// forbiddenWord returns the first forbidden word that is a component
+// of a name, or "" if there is none.
+func (n *NamingConfig) forbiddenWord(name string) string {
+	for _, part := range strings.Split(name, "_") {
+		for _, w := range n.ForbiddenWords {
+			if strings.EqualFold(part, w) {
+				return w
+			}
+		}
+	}
+	return ""
+}
+
 // GetScript returns a script for a given name
 func (c *Config) GetScript(scriptName string) string {
 	for _, script := range c.Scripts {
@@ -56,3 +3888,112 @@ func (c *Config) GetScript(scriptName string) string {
 
 	return ""
 }
+
+// GetScriptConfig returns the configuration of a script for a given
+// name, or nil if there is no such script
+func (c *Config) GetScriptConfig(scriptName string) *ScriptConfig {
+	for i := range c.Scripts {
+		if c.Scripts[i].Name == scriptName {
+			return &c.Scripts[i]
+		}
+	}
+
+	return nil
+}
+
+// GetGroupConfig returns the configuration of a group for a given
+// name, or nil if there is no such group
+func (c *Config) GetGroupConfig(groupName string) *GroupConfig {
+	for i := range c.Groups {
+		if c.Groups[i].Name == groupName {
+			return &c.Groups[i]
+		}
+	}
+
+	return nil
+}
+
+// GetWorkerPoolConfig returns the configuration of a worker pool for
+// a given name, or nil if there is no such pool
+func (c *Config) GetWorkerPoolConfig(poolName string) *WorkerPoolConfig {
+	for i := range c.Workers {
+		if c.Workers[i].Name == poolName {
+			return &c.Workers[i]
+		}
+	}
+
+	return nil
+}
+
+// GetListenerConfig returns the configuration of a listener for a
+// given name, or nil if there is no such listener
+func (c *Config) GetListenerConfig(listenerName string) *ListenerConfig {
+	for i := range c.Listeners {
+		if c.Listeners[i].Name == listenerName {
+			return &c.Listeners[i]
+		}
+	}
+
+	return nil
+}
+
+// ListenerForHost returns the configuration of the listener whose
+// hosts include the host of a Host header, or nil if there is none.
+func (c *Config) ListenerForHost(host string) *ListenerConfig {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for i := range c.Listeners {
+		for _, h := range c.Listeners[i].Hosts {
+			if strings.EqualFold(h, host) {
+				return &c.Listeners[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetModuleConfig returns the configuration of the script of a module
+// for a given name, with the settings of the module applied, or nil if
+// there is no such module
+func (c *Config) GetModuleConfig(moduleName string) *ScriptConfig {
+	for i := range c.Modules {
+		if c.Modules[i].Name == moduleName {
+			return &c.Modules[i].script
+		}
+	}
+
+	return nil
+}
+
+// GetLimits returns the limits on the output of a script, where zero
+// means no limit.
+func (c *Config) GetLimits(sc *ScriptConfig) LimitsConfig {
+	l := c.Limits
+	if sc.Limits.MaxOutputBytes != 0 {
+		l.MaxOutputBytes = sc.Limits.MaxOutputBytes
+	}
+	if sc.Limits.MaxSeries != 0 {
+		l.MaxSeries = sc.Limits.MaxSeries
+	}
+	if l.MaxOutputBytes < 0 {
+		l.MaxOutputBytes = 0
+	}
+	if l.MaxSeries < 0 {
+		l.MaxSeries = 0
+	}
+	return l
+}
+
+// GetNaming returns the naming conventions which apply to the
+// metrics of a given script, or nil if there are none.
+func (c *Config) GetNaming(scriptName string) *NamingConfig {
+	for _, script := range c.Scripts {
+		if script.Name == scriptName && script.Naming != nil {
+			return script.Naming
+		}
+	}
+
+	return c.Naming
+}
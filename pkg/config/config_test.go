@@ -0,0 +1,379 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadConfig loads a configuration file with the given contents.
+func loadConfig(t *testing.T, text string) (*Config, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{}
+	return c, c.LoadConfig(file)
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"minimal", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+`, ""},
+		{"unknown key", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    comand: ping
+`, "field comand not found"},
+		{"reserved name", `
+scripts:
+  - name: __ping
+    script: ping -c 1 localhost
+`, "script __ping: names starting with '__' are reserved"},
+		{"negative cache duration", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    cacheDuration: -1s
+`, "script ping: cacheDuration must not be negative"},
+		{"negative retries", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    retries: -1
+`, "script ping: retries and retryInterval must not be negative"},
+		{"warm-up without interval", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    schedule:
+      warmUp:
+        jitter: 10s
+`, "script ping: schedule.warmUp needs schedule.interval"},
+		{"adaptive timeout without timeout", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    adaptiveTimeout:
+      active: true
+`, "script ping: adaptiveTimeout requires a timeout"},
+		{"adaptive timeout percentile", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    timeout: 10s
+    adaptiveTimeout:
+      active: true
+      percentile: 1.5
+`, "script ping: adaptiveTimeout.percentile must be between 0 and 1"},
+		{"windows", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    windows: ["08:00-18:00", "*/5 * * * 1-5"]
+`, ""},
+		{"invalid window", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    windows: ["08:00-25:00"]
+`, `script ping: invalid window "08:00-25:00"`},
+		{"windows of async scripts", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    async: true
+    windows: ["08:00-18:00"]
+`, "script ping: windows can't be combined with async or stream"},
+		{"duplicate lock", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    locks: [network, network]
+`, "script ping: duplicate lock network"},
+		{"empty lock", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    locks: [""]
+`, "script ping: empty lock name"},
+		{"async with cache duration", `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    async: true
+    cacheDuration: 1m
+`, "script ping: async can't be combined with batchWindow or cacheDuration"},
+		{"oauth2 with bearer auth", `
+bearerAuth:
+  active: true
+  signingKey: secret
+oauth2:
+  active: true
+  introspectionURL: https://idp.example.com/introspect
+`, "oauth2: can't be combined with bearerAuth"},
+		{"oauth2 without issuer or introspection", `
+oauth2:
+  active: true
+`, "oauth2: exactly one of issuer and introspectionURL is required"},
+		{"oauth2 issuer without audience", `
+oauth2:
+  active: true
+  issuer: https://idp.example.com
+`, "oauth2: audience is required with an issuer"},
+		{"oauth2 invalid scope", `
+oauth2:
+  active: true
+  introspectionURL: https://idp.example.com/introspect
+  scopes: ["probe metrics"]
+`, `oauth2: invalid scope "probe metrics"`},
+		{"oauth2 invalid url", `
+oauth2:
+  active: true
+  introspectionURL: idp.example.com/introspect
+`, "oauth2: invalid introspectionURL idp.example.com/introspect"},
+		{"negative pack limit", `
+packs:
+  maxExtractedBytes: -1
+`, "packs: maxExtractedBytes must not be negative"},
+		{"negative batch size", `
+probe:
+  maxBatchSize: -1
+`, "probe: maxBatchSize must not be negative"},
+		{"invalid network", `
+access:
+  probe: [10.0.0.0/33]
+`, "invalid network 10.0.0.0/33"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(t, tt.config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	_, err := loadConfig(t, `
+scripts:
+  - name: ping
+    script: ping -c 1 localhost
+    cacheDuration: -1s
+  - name: __curl
+    script: curl localhost
+`)
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("LoadConfig() error = %v, want two Errors", err)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    window
+		wantErr bool
+	}{
+		{text: "08:00-18:00", want: window{start: 8 * 60, end: 18 * 60}},
+		{text: "22:30-06:15", want: window{start: 22*60 + 30, end: 6*60 + 15}},
+		{text: "00:00-24:00", want: window{start: 0, end: 24 * 60}},
+		{text: "08:00", wantErr: true},
+		{text: "8-18", wantErr: true},
+		{text: "08:00-24:01", wantErr: true},
+		{text: "08:00 - 18:00", wantErr: true},
+		{text: "* * * * *", want: window{cron: &[5]uint64{1<<60 - 1, 1<<24 - 1, 1<<32 - 2, 1<<13 - 2, 1<<8 - 1}, anyDOM: true, anyDOW: true}},
+		{text: "0 9 1 * *", want: window{cron: &[5]uint64{1, 1 << 9, 1 << 1, 1<<13 - 2, 1<<8 - 1}, anyDOW: true}},
+		// 7 is another Sunday.
+		{text: "0 0 * * 7", want: window{cron: &[5]uint64{1, 1, 1<<32 - 2, 1<<13 - 2, 1<<7 | 1}, anyDOM: true}},
+		{text: "* * * *", wantErr: true},
+		{text: "60 * * * *", wantErr: true},
+		{text: "* 24 * * *", wantErr: true},
+		{text: "* * 0 * *", wantErr: true},
+		{text: "* * * 13 *", wantErr: true},
+		{text: "* * * * 8", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := parseWindow(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseWindow() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field   string
+		want    uint64
+		wantErr bool
+	}{
+		{field: "*", want: 1<<24 - 1},
+		{field: "5", want: 1 << 5},
+		{field: "1,3,5", want: 1<<1 | 1<<3 | 1<<5},
+		{field: "9-17", want: 1<<18 - 1<<9},
+		{field: "*/6", want: 1<<0 | 1<<6 | 1<<12 | 1<<18},
+		{field: "10-20/5", want: 1<<10 | 1<<15 | 1<<20},
+		{field: "0,12-13", want: 1<<0 | 1<<12 | 1<<13},
+		{field: "*/0", wantErr: true},
+		{field: "*/x", wantErr: true},
+		{field: "x", wantErr: true},
+		{field: "1-x", wantErr: true},
+		{field: "17-9", wantErr: true},
+		{field: "24", wantErr: true},
+		{field: "-1", wantErr: true},
+		{field: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			got, err := parseCronField(tt.field, 0, 23)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCronField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseCronField() = %b, want %b", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2026-03-02 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.March, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"08:00-18:00", at(2, 8, 0), true},
+		{"08:00-18:00", at(2, 17, 59), true},
+		{"08:00-18:00", at(2, 18, 0), false},
+		{"08:00-18:00", at(2, 7, 59), false},
+		{"22:00-06:00", at(2, 23, 0), true},
+		{"22:00-06:00", at(2, 5, 59), true},
+		{"22:00-06:00", at(2, 12, 0), false},
+		{"*/15 * * * *", at(2, 10, 45), true},
+		{"*/15 * * * *", at(2, 10, 46), false},
+		{"* 9-17 * * 1-5", at(2, 9, 30), true},
+		{"* 9-17 * * 1-5", at(7, 9, 30), false},
+		{"* * * * 0", at(8, 12, 0), true},
+		{"* * * * 7", at(8, 12, 0), true},
+		{"* * * 4 *", at(2, 12, 0), false},
+		// With both days restricted, either of them matches.
+		{"* * 1 * 1", at(2, 12, 0), true},
+		{"* * 1 * 1", at(1, 12, 0), true},
+		{"* * 1 * 1", at(3, 12, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window+" "+tt.t.Format("Mon 15:04"), func(t *testing.T) {
+			w, err := parseWindow(tt.window)
+			if err != nil {
+				t.Fatalf("parseWindow() error = %v", err)
+			}
+			if got := w.contains(tt.t); got != tt.want {
+				t.Errorf("contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIOPriority(t *testing.T) {
+	tests := []struct {
+		s       string
+		class   int
+		level   int
+		wantErr bool
+	}{
+		{s: "idle", class: IOPriorityIdle},
+		{s: "best-effort", class: IOPriorityBestEffort, level: 4},
+		{s: "best-effort:0", class: IOPriorityBestEffort, level: 0},
+		{s: "realtime:7", class: IOPriorityRealtime, level: 7},
+		{s: "realtime:8", wantErr: true},
+		{s: "idle:1", wantErr: true},
+		{s: "best-effort:x", wantErr: true},
+		{s: "low", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			class, level, err := ParseIOPriority(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIOPriority() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (class != tt.class || level != tt.level) {
+				t.Errorf("ParseIOPriority() = %d, %d, want %d, %d", class, level, tt.class, tt.level)
+			}
+		})
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"ping", []string{"ping"}},
+		{"ping -c 1 localhost", []string{"ping", "-c", "1", "localhost"}},
+		{`"C:\Program Files\check.exe" -v`, []string{`C:\Program Files\check.exe`, "-v"}},
+		{`echo "a b"c`, []string{"echo", "a bc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := SplitCommand(tt.command); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworksContains(t *testing.T) {
+	c, err := loadConfig(t, "access:\n  probe: [10.0.0.0/8, 192.0.2.1, 2001:db8::1]\n")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	probe := c.Access.Probe
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"::ffff:10.1.2.3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := probe.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// Dedupe makes formatted output valid exposition, in place,
+// where a script repeated itself: of series that appear several
+// times, only one sample is kept, chosen by policy, and only the
+// first HELP and TYPE line of every metric is kept. With the fail
+// policy, duplicates are a parse error instead, and so are
+// conflicting TYPE lines with every policy.
+func Dedupe(output *bytes.Buffer, policy string) error {
+	lines := strings.Split(output.String(), "\n")
+	types := make(map[string]string)
+	helps := make(map[string]bool)
+	seen := make(map[string]int)
+	keep := make([]bool, len(lines))
+	changed := false
+
+	for i, line := range lines {
+		keep[i] = true
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '#' {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "TYPE":
+				typ := ""
+				if len(fields) > 3 {
+					typ = fields[3]
+				}
+				if t, ok := types[fields[2]]; ok {
+					if t != typ {
+						return &Error{Err: fmt.Errorf("conflicting types %s and %s for metric %s", t, typ, fields[2])}
+					}
+					keep[i], changed = false, true
+				}
+				types[fields[2]] = typ
+			case "HELP":
+				if helps[fields[2]] {
+					keep[i], changed = false, true
+				}
+				helps[fields[2]] = true
+			}
+			continue
+		}
+
+		key, rest, ok := seriesKey(line)
+		if !ok {
+			continue
+		}
+		first, dup := seen[key]
+		if !dup {
+			seen[key] = i
+			continue
+		}
+
+		keep[i], changed = false, true
+		switch policy {
+		case config.DuplicateSeriesFail:
+			return &Error{Err: fmt.Errorf("duplicate series %s", key)}
+		case config.DuplicateSeriesLast:
+			lines[first] = line
+		case config.DuplicateSeriesSum:
+			// The sum keeps the timestamp and exemplar of
+			// the first sample.
+			_, firstRest, _ := seriesKey(lines[first])
+			a, errA := strconv.ParseFloat(strings.Fields(firstRest)[0], 64)
+			b, errB := strconv.ParseFloat(strings.Fields(rest)[0], 64)
+			if errA == nil && errB == nil {
+				n := len(firstRest)
+				if end := strings.IndexAny(firstRest, " \t"); end >= 0 {
+					n = end
+				}
+				start := len(lines[first]) - len(firstRest)
+				lines[first] = lines[first][:start] + strconv.FormatFloat(a+b, 'g', -1, 64) + lines[first][start+n:]
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	kept := lines[:0]
+	for i, line := range lines {
+		if keep[i] {
+			kept = append(kept, line)
+		}
+	}
+	output.Reset()
+	output.WriteString(strings.Join(kept, "\n"))
+	return nil
+}
+
+// seriesKey returns the identity of the series of a formatted sample
+// line, with its labels sorted, and the rest of the line after the
+// series: the value and any timestamp and exemplar.
+func seriesKey(line string) (string, string, bool) {
+	i := strings.Index(line, "{")
+	sample, _ := SplitExemplar(line)
+	j := strings.LastIndex(sample, "}")
+	if i <= 0 || j < i {
+		return "", "", false
+	}
+	labels, err := ParseLabels(line[i : j+1])
+	if err != nil {
+		return "", "", false
+	}
+	sort.SliceStable(labels, func(a, b int) bool { return labels[a].Name < labels[b].Name })
+	return line[:i] + FormatLabels(labels), strings.TrimLeft(line[j+1:], " \t"), true
+}
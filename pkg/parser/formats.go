@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// A Parser converts the output of scripts in one format to the
+// exposition format, which is then formatted like the output of any
+// other script. It returns an *Error for output it can't convert.
+type Parser interface {
+	Parse(sc *config.ScriptConfig, output string) (string, error)
+}
+
+// A StatusParser is a Parser for a format that gives meaning to the
+// exit statuses of scripts, as returned by runner.ExitCode, so that
+// the output of scripts that failed is converted as well. ParseStatus
+// returns false for exit statuses that mean the script failed after
+// all.
+type StatusParser interface {
+	Parser
+	ParseStatus(sc *config.ScriptConfig, output string, status int) (string, bool)
+}
+
+// Func is a Parser that is just a function.
+type Func func(sc *config.ScriptConfig, output string) (string, error)
+
+// Parse calls f(sc, output).
+func (f Func) Parse(sc *config.ScriptConfig, output string) (string, error) {
+	return f(sc, output)
+}
+
+var (
+	parsersMu sync.RWMutex
+	parsers   = make(map[string]Parser)
+)
+
+// Register makes a parser available for the output of scripts in a
+// format, and the format known to the configuration. Programs using
+// the packages register their own parsers this way, usually in an
+// init function. It panics if there already is a parser for the
+// format.
+func Register(name string, p Parser) {
+	parsersMu.Lock()
+	defer parsersMu.Unlock()
+	if p == nil {
+		panic("parser: Register parser is nil")
+	}
+	if _, ok := parsers[name]; ok {
+		panic(fmt.Sprintf("parser: Register called twice for format %s", name))
+	}
+	parsers[name] = p
+	config.RegisterFormat(name)
+}
+
+// Lookup returns the parser for output in a format, or nil if none
+// was registered.
+func Lookup(name string) Parser {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+	return parsers[name]
+}
+
+// Formats returns the formats that parsers were registered for,
+// sorted.
+func Formats() []string {
+	parsersMu.RLock()
+	defer parsersMu.RUnlock()
+	var formats []string
+	for name := range parsers {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// The parsers of the built-in formats. Output in the exposition
+// format, and raw output, is passed through as it is.
+func init() {
+	passThrough := Func(func(_ *config.ScriptConfig, output string) (string, error) {
+		return output, nil
+	})
+	Register(config.FormatPrometheus, passThrough)
+	Register(config.FormatRaw, passThrough)
+	Register(config.FormatJSON, Func(func(sc *config.ScriptConfig, output string) (string, error) {
+		output, err := ConvertJSON(output, sc.JSON)
+		if err != nil {
+			return "", &Error{Err: err}
+		}
+		return output, nil
+	}))
+	Register(config.FormatNagios, nagiosParser{})
+	Register(config.FormatInflux, Func(func(_ *config.ScriptConfig, output string) (string, error) {
+		return ConvertInflux(output), nil
+	}))
+	Register(config.FormatStatsd, Func(func(_ *config.ScriptConfig, output string) (string, error) {
+		return ConvertStatsd(output), nil
+	}))
+	Register(config.FormatOpenMetrics, Func(func(_ *config.ScriptConfig, output string) (string, error) {
+		return ConvertOpenMetrics(output), nil
+	}))
+}
@@ -0,0 +1,226 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// parserTest is a test of the parser of a format: the output of a
+// script, and the exposition it should be converted to.
+type parserTest struct {
+	name   string
+	output string
+	want   string
+}
+
+// runParserTests converts the output of every test with the parser
+// of a format.
+func runParserTests(t *testing.T, format string, sc *config.ScriptConfig, tests []parserTest) {
+	t.Helper()
+	p := Lookup(format)
+	if p == nil {
+		t.Fatalf("no parser for format %s", format)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Parse(sc, tt.output)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusParser(t *testing.T) {
+	runParserTests(t, config.FormatPrometheus, &config.ScriptConfig{}, []parserTest{
+		{"empty", "", ""},
+		{"samples", "# TYPE a gauge\na{x=\"1\"} 1\nb 2\n", "# TYPE a gauge\na{x=\"1\"} 1\nb 2\n"},
+		{"invalid", "not exposition", "not exposition"},
+	})
+}
+
+func TestRawParser(t *testing.T) {
+	runParserTests(t, config.FormatRaw, &config.ScriptConfig{}, []parserTest{
+		{"empty", "", ""},
+		{"anything", "whatever\n\x00", "whatever\n\x00"},
+	})
+}
+
+func TestJSONParser(t *testing.T) {
+	sc := &config.ScriptConfig{JSON: &config.JSONConfig{Metrics: []config.JSONMetricConfig{
+		{Name: "up", Help: "Is it up.", Type: "gauge", Path: "up"},
+		{Name: "disk_free_bytes", Path: "disks.*", Value: "free", Labels: map[string]string{"mount": "path"}},
+	}}}
+	runParserTests(t, config.FormatJSON, sc, []parserTest{
+		{
+			"values",
+			`{"up": true, "disks": [{"path": "/", "free": 10}, {"path": "/var", "free": "20"}]}`,
+			"# HELP up Is it up.\n# TYPE up gauge\nup{} 1\ndisk_free_bytes{mount=\"/\"} 10\ndisk_free_bytes{mount=\"/var\"} 20\n",
+		},
+		{
+			"missing values",
+			`{"disks": [{"path": "/"}]}`,
+			"# HELP up Is it up.\n# TYPE up gauge\n",
+		},
+		{
+			"not numbers",
+			`{"up": "yes", "disks": [{"path": "/", "free": null}]}`,
+			"# HELP up Is it up.\n# TYPE up gauge\n",
+		},
+	})
+
+	_, err := Lookup(config.FormatJSON).Parse(sc, "{")
+	if _, ok := err.(*Error); !ok {
+		t.Errorf("Parse() of invalid JSON error = %v, want *Error", err)
+	}
+}
+
+func TestNagiosParser(t *testing.T) {
+	header := scriptStatusHelp + "\n" + scriptStatusType + "\n"
+	perfdata := scriptPerfdataHelp + "\n" + scriptPerfdataType + "\n"
+	tests := []struct {
+		name   string
+		output string
+		status int
+		want   string
+		ok     bool
+	}{
+		{"ok", "OK - all fine", 0, header + "script_status{} 0\n", true},
+		{"critical", "CRITICAL - down", 2, header + "script_status{} 2\n", true},
+		{"unknown", "UNKNOWN", 3, header + "script_status{} 3\n", true},
+		{"failed", "oops", 4, "", false},
+		{"killed", "", -1, "", false},
+		{
+			"perfdata",
+			"OK | time=12ms;100;200;0 'free space'=1KB",
+			0,
+			header + "script_status{} 0\n" + perfdata +
+				"script_perfdata{label=\"time\",unit=\"seconds\"} 0.012\n" +
+				"script_perfdata_warning{label=\"time\",unit=\"seconds\"} 0.1\n" +
+				"script_perfdata_critical{label=\"time\",unit=\"seconds\"} 0.2\n" +
+				"script_perfdata_min{label=\"time\",unit=\"seconds\"} 0\n" +
+				"script_perfdata{label=\"free space\",unit=\"bytes\"} 1024\n",
+			true,
+		},
+		{
+			"long output",
+			"WARNING - slow\nsee below | load=2\nmore=3",
+			1,
+			header + "script_status{} 1\n" + perfdata +
+				"script_perfdata{label=\"load\",unit=\"\"} 2\n" +
+				"script_perfdata{label=\"more\",unit=\"\"} 3\n",
+			true,
+		},
+		{
+			"unknown unit",
+			"OK | a=1furlong",
+			0,
+			header + "script_status{} 0\n",
+			true,
+		},
+	}
+
+	p, ok := Lookup(config.FormatNagios).(StatusParser)
+	if !ok {
+		t.Fatal("the nagios parser is not a StatusParser")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := p.ParseStatus(&config.ScriptConfig{}, tt.output, tt.status)
+			if ok != tt.ok {
+				t.Fatalf("ParseStatus() ok = %v, want %v", ok, tt.ok)
+			}
+			if got != tt.want {
+				t.Errorf("ParseStatus() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfluxParser(t *testing.T) {
+	runParserTests(t, config.FormatInflux, &config.ScriptConfig{}, []parserTest{
+		{"empty", "", ""},
+		{"value field", "temperature,room=kitchen value=21.5", "temperature{room=\"kitchen\"} 21.5\n"},
+		{
+			"fields and tags",
+			"cpu,host=a,core=0 usage=0.5,idle=99i,busy=true 1600000000000000000",
+			"cpu_usage{core=\"0\",host=\"a\"} 0.5\ncpu_idle{core=\"0\",host=\"a\"} 99\ncpu_busy{core=\"0\",host=\"a\"} 1\n",
+		},
+		{"escapes", `disk\ io,path=/var\ log value=1`, "disk_io{path=\"/var log\"} 1\n"},
+		{"string fields", `event,kind=x msg="hi",n=1`, "event_n{kind=\"x\"} 1\n"},
+		{"comments and junk", "# comment\njunk\n\nm value=1", "m{} 1\n"},
+	})
+}
+
+func TestStatsdParser(t *testing.T) {
+	runParserTests(t, config.FormatStatsd, &config.ScriptConfig{}, []parserTest{
+		{"empty", "", ""},
+		{"counters", "hits:1|c\nhits:2|c|@0.5", "hits{} 5\n"},
+		{"gauges", "temp:10|g\ntemp:+5|g\ntemp:-3|g", "temp{} 12\n"},
+		{"timers", "req.time:10|ms\nreq.time:30|ms", "req_time_count{} 2\nreq_time_sum{} 40\n"},
+		{"sets", "users:a|s\nusers:b|s\nusers:a|s", "users{} 2\n"},
+		{"tags", "hits:1|c|#env:prod,dc:x", "hits{dc=\"x\",env=\"prod\"} 1\n"},
+		{"junk", "nothing\nnokind:1\nodd:1|q\n", ""},
+	})
+}
+
+func TestOpenMetricsParser(t *testing.T) {
+	runParserTests(t, config.FormatOpenMetrics, &config.ScriptConfig{}, []parserTest{
+		{"empty", "# EOF\n", ""},
+		{
+			"counter",
+			"# TYPE requests counter\n# HELP requests Requests \\\"served\\\".\n# UNIT requests requests\nrequests_total{code=\"200\"} 3 # {trace_id=\"abc\"} 1 1600000000.5\nrequests_created{code=\"200\"} 1600000000\n# EOF\n",
+			"# TYPE requests_total counter\n# HELP requests_total Requests \"served\".\nrequests_total{code=\"200\"} 3 # {trace_id=\"abc\"} 1 1600000000.5\n",
+		},
+		{
+			"gauge with timestamp",
+			"# TYPE temp gauge\ntemp 21.5 1600000000.25\n# EOF\n",
+			"# TYPE temp gauge\ntemp{} 21.5 1600000000250\n",
+		},
+		{
+			"histogram",
+			"# TYPE lat histogram\nlat_bucket{le=\"1\"} 2\nlat_bucket{le=\"+Inf\"} 3\nlat_sum 4\nlat_count 3\nlat_created 1\n# EOF\n",
+			"# TYPE lat histogram\nlat_bucket{le=\"1\"} 2\nlat_bucket{le=\"+Inf\"} 3\nlat_sum{} 4\nlat_count{} 3\n",
+		},
+		{
+			"info and stateset",
+			"# TYPE build info\nbuild_info{version=\"1\"} 1\n# TYPE state stateset\nstate{state=\"a\"} 1\nstate{state=\"b\"} 0\n# EOF\n",
+			"# TYPE build_info gauge\nbuild_info{version=\"1\"} 1\n# TYPE state gauge\nstate{state=\"a\"} 1\nstate{state=\"b\"} 0\n",
+		},
+		{
+			"unknown and gauge histogram",
+			"# TYPE x unknown\nx 1\n# TYPE q gaugehistogram\nq_bucket{le=\"+Inf\"} 1\nq_gcount 1\nq_gsum 2\n# EOF\n",
+			"# TYPE x untyped\nx{} 1\nq_bucket{le=\"+Inf\"} 1\nq_gcount{} 1\nq_gsum{} 2\n",
+		},
+		{
+			"after EOF",
+			"a 1\n# EOF\nb 2\n",
+			"a{} 1\n",
+		},
+		{
+			"invalid lines",
+			"{x=\"1\"} 1\na\nb 1 2 3\nc 1 nope\nd 4\n",
+			"d{} 4\n",
+		},
+	})
+}
+
+func TestRegister(t *testing.T) {
+	Register("test_suffix", Func(func(_ *config.ScriptConfig, output string) (string, error) {
+		return output + " 1\n", nil
+	}))
+	runParserTests(t, "test_suffix", &config.ScriptConfig{}, []parserTest{
+		{"registered", "custom", "custom 1\n"},
+	})
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Register() twice did not panic")
+		}
+	}()
+	Register(config.FormatJSON, Func(nil))
+}
@@ -0,0 +1,99 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConvertInflux converts InfluxDB line protocol output to the
+// exposition format. Every numeric or boolean field of a measurement
+// becomes a sample named <measurement>_<field>, or just <measurement>
+// for fields called 'value', with the tags of the measurement as
+// labels. String fields and timestamps are ignored, as are lines we
+// can't parse.
+func ConvertInflux(output string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		parts := splitEscaped(line, ' ')
+		if len(parts) < 2 {
+			continue
+		}
+		key := splitEscaped(parts[0], ',')
+		measurement := SanitizeName(unescapeInflux(key[0]))
+		var labels []Label
+		for _, tag := range key[1:] {
+			kv := splitEscaped(tag, '=')
+			if len(kv) != 2 {
+				continue
+			}
+			labels = append(labels, Label{Name: SanitizeName(unescapeInflux(kv[0])), Value: unescapeInflux(kv[1])})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		for _, field := range splitEscaped(parts[1], ',') {
+			kv := splitEscaped(field, '=')
+			if len(kv) != 2 {
+				continue
+			}
+			value, ok := influxValue(kv[1])
+			if !ok {
+				continue
+			}
+			name := measurement
+			if f := SanitizeName(unescapeInflux(kv[0])); f != "value" {
+				name += "_" + f
+			}
+			fmt.Fprintf(&b, "%s%s %s\n", name, FormatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+	return b.String()
+}
+
+// influxValue returns the numeric value of a line protocol field
+// value: a float, an integer with an 'i' or 'u' suffix, or a boolean.
+func influxValue(v string) (float64, bool) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true
+	}
+	if strings.HasSuffix(v, "i") || strings.HasSuffix(v, "u") {
+		v = v[:len(v)-1]
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return f, err == nil
+}
+
+// splitEscaped splits s at every sep that isn't escaped with a
+// backslash or inside double quotes.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var influxUnescaper = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\"`, `"`, `\\`, `\`)
+
+func unescapeInflux(s string) string {
+	return influxUnescaper.Replace(s)
+}
@@ -0,0 +1,134 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// ConvertJSON converts the JSON output of a script to the exposition
+// format, according to its mapping. Values that can't be found or
+// aren't numbers (or booleans, or strings holding numbers) are
+// skipped.
+func ConvertJSON(output string, jc *config.JSONConfig) (string, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(output), &doc); err != nil {
+		return "", fmt.Errorf("invalid JSON output: %s", err)
+	}
+
+	var b strings.Builder
+	for _, m := range jc.Metrics {
+		if m.Help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", m.Name, EscapeHelp(m.Help))
+		}
+		if m.Type != "" {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", m.Name, m.Type)
+		}
+
+		var names []string
+		for k := range m.Labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		for _, v := range jsonPath(doc, m.Path) {
+			value, ok := jsonNumber(jsonPathOne(v, m.Value))
+			if !ok {
+				continue
+			}
+			var labels []Label
+			for _, k := range names {
+				lv, _ := jsonString(jsonPathOne(v, m.Labels[k]))
+				labels = append(labels, Label{Name: k, Value: lv})
+			}
+			fmt.Fprintf(&b, "%s%s %s\n", m.Name, FormatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+	return b.String(), nil
+}
+
+// jsonPath returns the values that a path selects in a JSON document.
+// Paths are '.' separated lists of object keys and array indexes,
+// optionally starting with '$'; '*' selects every element of an
+// array or every value of an object; '[n]' and '[*]' can also be
+// used for arrays. The empty path selects the document itself.
+func jsonPath(doc interface{}, path string) []interface{} {
+	path = strings.TrimPrefix(path, "$")
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+
+	cur := []interface{}{doc}
+	for _, seg := range strings.Split(path, ".") {
+		if seg == "" {
+			continue
+		}
+		var next []interface{}
+		for _, v := range cur {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				if seg == "*" {
+					var keys []string
+					for k := range t {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					for _, k := range keys {
+						next = append(next, t[k])
+					}
+				} else if e, ok := t[seg]; ok {
+					next = append(next, e)
+				}
+			case []interface{}:
+				if seg == "*" {
+					next = append(next, t...)
+				} else if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(t) {
+					next = append(next, t[i])
+				}
+			}
+		}
+		cur = next
+	}
+	return cur
+}
+
+// jsonPathOne returns the first value a path selects, or nil.
+func jsonPathOne(doc interface{}, path string) interface{} {
+	if vs := jsonPath(doc, path); len(vs) > 0 {
+		return vs[0]
+	}
+	return nil
+}
+
+// jsonNumber returns the numeric value of a JSON value.
+func jsonNumber(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case bool:
+		if t {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// jsonString returns a JSON value as a label value.
+func jsonString(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	}
+	return "", false
+}
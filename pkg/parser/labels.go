@@ -0,0 +1,172 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// A Label is a label name and value of a sample. Samples keep their
+// labels as a slice in the order they were written, since some
+// scripts repeat label names and we don't want to lose those.
+type Label struct {
+	Name  string
+	Value string
+}
+
+var errBadLabels = errors.New("malformed label set")
+
+// ParseLabels parses a label set as it appears in the exposition
+// format, '{name="value",...}', including the braces.
+func ParseLabels(s string) ([]Label, error) {
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, errBadLabels
+	}
+	s = s[1 : len(s)-1]
+
+	var labels []Label
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return labels, nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 1 {
+			return nil, errBadLabels
+		}
+		name := strings.TrimSpace(s[:eq])
+		if !ValidLabelName(name) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if s == "" || s[0] != '"' {
+			return nil, errBadLabels
+		}
+
+		// Find the closing quote, processing escapes on the way.
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				value.WriteByte(s[i])
+				continue
+			}
+			i++
+			if i == len(s) {
+				return nil, errBadLabels
+			}
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case '\\', '"':
+				value.WriteByte(s[i])
+			default:
+				return nil, errBadLabels
+			}
+		}
+		if i == len(s) {
+			return nil, errBadLabels
+		}
+		labels = append(labels, Label{Name: name, Value: value.String()})
+
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if s == "" {
+			return labels, nil
+		}
+		if s[0] != ',' {
+			return nil, errBadLabels
+		}
+		s = s[1:]
+	}
+}
+
+// ValidLabelName reports whether name is a valid Prometheus label
+// name, by the same rules as the configuration.
+func ValidLabelName(name string) bool {
+	return config.ValidLabelName(name)
+}
+
+// ValidMetricName reports whether name is a valid Prometheus metric
+// name, by the same rules as the configuration.
+func ValidMetricName(name string) bool {
+	return config.ValidMetricName(name)
+}
+
+// SanitizeName turns a name from another metrics format into a valid
+// Prometheus label name, which is also a valid metric name, by
+// replacing invalid characters with '_' and prefixing names that
+// start with a digit with it.
+func SanitizeName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// EscapeHelp escapes the text of a HELP line for the exposition
+// format.
+func EscapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+// FormatLabels formats a label set for the exposition format. An
+// empty label set is written as '{}', like we always have.
+func FormatLabels(labels []Label) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// GetLabel returns the value of the first label with a name, or ""
+// if there is none.
+func GetLabel(labels []Label, name string) string {
+	for _, l := range labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// SetLabel sets the value of a label, replacing all labels with the
+// same name. Setting a label to "" removes it.
+func SetLabel(labels []Label, name, value string) []Label {
+	out := labels[:0:0]
+	done := false
+	for _, l := range labels {
+		if l.Name != name {
+			out = append(out, l)
+		} else if !done && value != "" {
+			out = append(out, Label{Name: name, Value: value})
+			done = true
+		}
+	}
+	if !done && value != "" {
+		out = append(out, Label{Name: name, Value: value})
+	}
+	return out
+}
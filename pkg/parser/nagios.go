@@ -0,0 +1,167 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// Nagios plugins report their result through their exit status,
+// from 0 (OK) to 3 (UNKNOWN).
+const nagiosUnknown = 3
+
+const (
+	scriptStatusHelp   = "# HELP script_status Nagios plugin status (0 = OK, 1 = WARNING, 2 = CRITICAL, 3 = UNKNOWN)."
+	scriptStatusType   = "# TYPE script_status gauge"
+	scriptPerfdataHelp = "# HELP script_perfdata Nagios plugin performance data, converted to base units."
+	scriptPerfdataType = "# TYPE script_perfdata gauge"
+)
+
+// Units of Nagios performance data, with the base unit we convert
+// them to and the factor to do so.
+var nagiosUnits = map[string]struct {
+	unit   string
+	factor float64
+}{
+	"":   {"", 1},
+	"s":  {"seconds", 1},
+	"ms": {"seconds", 1e-3},
+	"us": {"seconds", 1e-6},
+	"%":  {"percent", 1},
+	"B":  {"bytes", 1},
+	"KB": {"bytes", 1 << 10},
+	"MB": {"bytes", 1 << 20},
+	"GB": {"bytes", 1 << 30},
+	"TB": {"bytes", 1 << 40},
+	"c":  {"counter", 1},
+}
+
+// ConvertNagios converts the output and exit status of a Nagios
+// plugin to the exposition format. Every status that a plugin can
+// report counts as a successful run, and is exported as
+// script_status; the performance data becomes script_perfdata
+// samples, labeled with its label and unit, plus samples for the
+// thresholds and limits that are plain numbers. It returns false for
+// other exit statuses, which mean the plugin failed.
+func ConvertNagios(output string, status int) (string, bool) {
+	if status < 0 || status > nagiosUnknown {
+		return "", false
+	}
+
+	// Performance data follows the first '|' of the first line,
+	// and the first '|' of any further line, after which the rest
+	// of the output is performance data.
+	var perfdata []string
+	lines := strings.Split(output, "\n")
+	if i := strings.Index(lines[0], "|"); i >= 0 {
+		perfdata = append(perfdata, lines[0][i+1:])
+	}
+	for n, line := range lines[1:] {
+		if i := strings.Index(line, "|"); i >= 0 {
+			perfdata = append(perfdata, line[i+1:])
+			perfdata = append(perfdata, lines[n+2:]...)
+			break
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n%s_status{} %d\n", scriptStatusHelp, scriptStatusType, namespace, status)
+	samples := parsePerfdata(strings.Join(perfdata, " "))
+	if len(samples) > 0 {
+		fmt.Fprintf(&b, "%s\n%s\n", scriptPerfdataHelp, scriptPerfdataType)
+		for _, s := range samples {
+			b.WriteString(s)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String(), true
+}
+
+// nagiosParser is the parser of the nagios format.
+type nagiosParser struct{}
+
+func (nagiosParser) Parse(_ *config.ScriptConfig, output string) (string, error) {
+	output, _ = ConvertNagios(output, 0)
+	return output, nil
+}
+
+func (nagiosParser) ParseStatus(_ *config.ScriptConfig, output string, status int) (string, bool) {
+	return ConvertNagios(output, status)
+}
+
+// parsePerfdata parses Nagios performance data, which is a space
+// separated list of 'label'=value[unit];[warn];[crit];[min];[max],
+// into samples. Entries we can't parse are skipped.
+func parsePerfdata(perfdata string) []string {
+	var samples []string
+	for _, entry := range splitPerfdata(perfdata) {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			continue
+		}
+		name := strings.Trim(entry[:i], "'")
+		fields := strings.Split(entry[i+1:], ";")
+
+		v := fields[0]
+		j := strings.IndexFunc(v, func(r rune) bool {
+			return !strings.ContainsRune("0123456789.-+eE", r)
+		})
+		unit := ""
+		if j >= 0 {
+			v, unit = v[:j], v[j:]
+		}
+		u, ok := nagiosUnits[unit]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+
+		labels := []Label{{Name: "label", Value: name}, {Name: "unit", Value: u.unit}}
+		samples = append(samples, fmt.Sprintf("%s_perfdata%s %s", namespace, FormatLabels(labels), strconv.FormatFloat(value*u.factor, 'g', -1, 64)))
+
+		// Thresholds may be ranges, which we don't try to
+		// represent.
+		for k, kind := range []string{"warning", "critical", "min", "max"} {
+			if k+1 >= len(fields) {
+				break
+			}
+			t, err := strconv.ParseFloat(fields[k+1], 64)
+			if err != nil {
+				continue
+			}
+			samples = append(samples, fmt.Sprintf("%s_perfdata_%s%s %s", namespace, kind, FormatLabels(labels), strconv.FormatFloat(t*u.factor, 'g', -1, 64)))
+		}
+	}
+	return samples
+}
+
+// splitPerfdata splits performance data into its entries, keeping
+// spaces in quoted labels.
+func splitPerfdata(perfdata string) []string {
+	var entries []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range perfdata {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if cur.Len() > 0 {
+				entries = append(entries, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if cur.Len() > 0 {
+		entries = append(entries, cur.String())
+	}
+	return entries
+}
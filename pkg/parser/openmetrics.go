@@ -0,0 +1,350 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SplitExemplar splits a sample line into the sample and its
+// exemplar, which starts at the first '#' outside of label values.
+func SplitExemplar(line string) (string, string) {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quoted && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			quoted = !quoted
+		case !quoted && line[i] == '#':
+			return strings.TrimRight(line[:i], " \t"), line[i:]
+		}
+	}
+	return line, ""
+}
+
+// maxExemplarRunes is the maximum combined length of the label names
+// and values of an exemplar in OpenMetrics.
+const maxExemplarRunes = 128
+
+// ValidExemplar reports whether an exemplar, including its leading
+// '#', is valid in OpenMetrics: '# {labels} value [timestamp]', where
+// the timestamp is in seconds.
+func ValidExemplar(exemplar string) bool {
+	s := strings.TrimLeft(strings.TrimPrefix(exemplar, "#"), " \t")
+	j := strings.LastIndex(s, "}")
+	if j < 0 {
+		return false
+	}
+	labels, err := ParseLabels(s[:j+1])
+	if err != nil {
+		return false
+	}
+	n := 0
+	for _, l := range labels {
+		n += utf8.RuneCountInString(l.Name) + utf8.RuneCountInString(l.Value)
+	}
+	if n > maxExemplarRunes || !utf8.ValidString(s[:j+1]) {
+		return false
+	}
+
+	rest := strings.Fields(s[j+1:])
+	if len(rest) == 0 || len(rest) > 2 {
+		return false
+	}
+	for _, f := range rest {
+		if _, err := strconv.ParseFloat(f, 64); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// StripExemplars removes exemplars from output for the text format,
+// which doesn't support them.
+func StripExemplars(output string) string {
+	if !strings.Contains(output, "# {") {
+		return output
+	}
+
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if line != "" && line[0] != '#' {
+			lines[i], _ = SplitExemplar(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// An omFamily is a metric family of OpenMetrics output.
+type omFamily struct {
+	name, typ, help string
+	samples         []string
+}
+
+// TypeSuffixes are the suffixes of the samples of metric families, by
+// type.
+var TypeSuffixes = map[string][]string{
+	"counter":   {"_total", "_created"},
+	"histogram": {"_bucket", "_sum", "_count", "_created"},
+	"summary":   {"_sum", "_count", "_created"},
+}
+
+// ToOpenMetrics converts formatted probe output to the OpenMetrics
+// format. Samples are grouped into their metric families, which have
+// to be contiguous, the names of counters get their '_total' suffix,
+// and untyped metrics become 'unknown'. Timestamps are converted from
+// milliseconds to seconds and exemplars of counters and histogram
+// buckets are kept if asked for; otherwise both are dropped, as are
+// samples without a valid value and comments other than HELP and TYPE.
+func ToOpenMetrics(output string, exemplars, timestamps bool) string {
+	var families []*omFamily
+	byName := make(map[string]*omFamily)
+	family := func(name string) *omFamily {
+		f := byName[name]
+		if f == nil {
+			f = &omFamily{name: name, typ: "unknown"}
+			byName[name] = f
+			families = append(families, f)
+		}
+		return f
+	}
+
+	// Metadata comes first, since we need the types of families to
+	// find the family of samples and there's no guarantee that
+	// scripts put it before their samples.
+	lines := strings.Split(output, "\n")
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 4 || fields[0] != "#" {
+			continue
+		}
+		switch fields[1] {
+		case "TYPE":
+			name, typ := fields[2], strings.TrimSpace(fields[3])
+			if typ == "untyped" {
+				typ = "unknown"
+			}
+			if typ == "counter" {
+				name = strings.TrimSuffix(name, "_total")
+			}
+			family(name).typ = typ
+		}
+	}
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) == 4 && fields[0] == "#" && fields[1] == "HELP" {
+			name := fields[2]
+			if f, ok := byName[strings.TrimSuffix(name, "_total")]; ok && f.typ == "counter" {
+				name = f.name
+			}
+			family(name).help = fields[3]
+		}
+	}
+
+	for _, line := range lines {
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		sample, exemplar := SplitExemplar(line)
+		i := strings.Index(sample, "{")
+		j := strings.LastIndex(sample, "}")
+		if i <= 0 || j < i {
+			continue
+		}
+		name, labels := sample[:i], sample[i:j+1]
+		rest := strings.Fields(sample[j+1:])
+		if len(rest) == 0 || len(rest) > 2 {
+			continue
+		}
+		value, ok := omValue(rest[0])
+		if !ok {
+			continue
+		}
+
+		f, suffix := sampleFamily(byName, name)
+		if f == nil {
+			f = family(name)
+		}
+		if f.typ == "counter" && suffix == "" {
+			name += "_total"
+			suffix = "_total"
+		}
+
+		s := name + labels + " " + value
+		if timestamps && len(rest) == 2 {
+			if ts, err := strconv.ParseInt(rest[1], 10, 64); err == nil {
+				s += " " + strconv.FormatFloat(float64(ts)/1000, 'f', -1, 64)
+			}
+		}
+		if exemplars && exemplar != "" && (suffix == "_total" || suffix == "_bucket") {
+			s += " " + exemplar
+		}
+		f.samples = append(f.samples, s)
+	}
+
+	var b strings.Builder
+	for _, f := range families {
+		if f.help == "" && len(f.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+		if f.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		}
+		for _, s := range f.samples {
+			b.WriteString(s)
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString("# EOF\n")
+	return b.String()
+}
+
+// sampleFamily returns the typed metric family that a sample belongs
+// to, and the suffix of the sample name within it, or nil.
+func sampleFamily(byName map[string]*omFamily, name string) (*omFamily, string) {
+	if f, ok := byName[name]; ok {
+		return f, ""
+	}
+	for typ, suffixes := range TypeSuffixes {
+		for _, suffix := range suffixes {
+			if !strings.HasSuffix(name, suffix) {
+				continue
+			}
+			if f, ok := byName[strings.TrimSuffix(name, suffix)]; ok && f.typ == typ {
+				return f, suffix
+			}
+		}
+	}
+	return nil, ""
+}
+
+// omValue returns a sample value in the form OpenMetrics wants, if
+// it's valid.
+func omValue(v string) (string, bool) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return "", false
+	}
+	switch {
+	case math.IsNaN(f):
+		return "NaN", true
+	case math.IsInf(f, 1):
+		return "+Inf", true
+	case math.IsInf(f, -1):
+		return "-Inf", true
+	}
+	return v, true
+}
+
+// ConvertOpenMetrics converts OpenMetrics output to the exposition
+// format, for programs that only write OpenMetrics. Counters are named
+// after their '_total' samples and info metrics after their '_info'
+// samples, info metrics and statesets become gauges, and gauge
+// histograms lose their type, since the exposition format has none
+// of these. Timestamps are converted from seconds to milliseconds and
+// exemplars are kept; '_created' samples, UNIT comments and anything
+// after '# EOF' are dropped. Samples without labels get an empty
+// label set, as the output of scripts needs.
+func ConvertOpenMetrics(output string) string {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if line == "# EOF" {
+			lines = lines[:i]
+			break
+		}
+	}
+
+	types := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+		}
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 4 || fields[0] != "#" {
+				continue
+			}
+			name, typ, ok := omToTextFamily(fields[2], types[fields[2]])
+			if !ok {
+				continue
+			}
+			switch fields[1] {
+			case "HELP":
+				fmt.Fprintf(&b, "# HELP %s %s\n", name, strings.ReplaceAll(fields[3], `\"`, `"`))
+			case "TYPE":
+				fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+			}
+			continue
+		}
+
+		sample, exemplar := SplitExemplar(line)
+		end := strings.IndexAny(sample, "{ ")
+		if end <= 0 {
+			continue
+		}
+		name, series := sample[:end], sample[:end]+"{}"
+		if sample[end] == '{' {
+			end = strings.LastIndex(sample, "}") + 1
+			if end <= 0 {
+				continue
+			}
+			series = sample[:end]
+		}
+		if base := strings.TrimSuffix(name, "_created"); base != name {
+			switch types[base] {
+			case "counter", "histogram", "summary", "gaugehistogram":
+				continue
+			}
+		}
+
+		rest := strings.Fields(sample[end:])
+		if len(rest) == 0 || len(rest) > 2 {
+			continue
+		}
+		s := series + " " + rest[0]
+		if len(rest) == 2 {
+			ts, err := strconv.ParseFloat(rest[1], 64)
+			if err != nil {
+				continue
+			}
+			s += " " + strconv.FormatInt(int64(math.Round(ts*1000)), 10)
+		}
+		b.WriteString(s)
+		if exemplar != "" {
+			b.WriteString(" " + exemplar)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// omToTextFamily returns the name and type in the exposition format of
+// an OpenMetrics metric family with a type, and false for families
+// that can't have metadata there.
+func omToTextFamily(name, typ string) (string, string, bool) {
+	switch typ {
+	case "counter":
+		return name + "_total", typ, true
+	case "info":
+		return name + "_info", "gauge", true
+	case "stateset":
+		return name, "gauge", true
+	case "gauge", "histogram", "summary":
+		return name, typ, true
+	case "unknown", "":
+		return name, "untyped", true
+	}
+	return "", "", false
+}
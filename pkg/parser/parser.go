@@ -0,0 +1,19 @@
+// Package parser converts and checks the output of scripts: it
+// converts the formats that scripts may write into the Prometheus
+// exposition format, parses and formats label sets, relabels samples
+// and converts exposition to OpenMetrics.
+package parser
+
+// namespace is the namespace of the metrics that conversions create,
+// which is the exporter's namespace for metrics about scripts.
+const namespace = "script"
+
+// Error is returned for output that can't be converted, or that
+// isn't valid exposition.
+type Error struct {
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
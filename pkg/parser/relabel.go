@@ -0,0 +1,91 @@
+package parser
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// nameLabel is the pseudo-label that holds the metric name during
+// relabeling, as in Prometheus.
+const nameLabel = "__name__"
+
+// Relabel applies relabeling rules to the name and labels of a
+// sample. It returns the new name and labels, and false if the
+// sample is dropped.
+func Relabel(name string, labels []Label, rules []*config.RelabelConfig) (string, []Label, bool) {
+	lset := append([]Label{{Name: nameLabel, Value: name}}, labels...)
+
+	for _, r := range rules {
+		var ok bool
+		lset, ok = relabelOne(lset, r)
+		if !ok {
+			return "", nil, false
+		}
+	}
+
+	name = GetLabel(lset, nameLabel)
+	if !ValidMetricName(name) {
+		return "", nil, false
+	}
+	return name, SetLabel(lset, nameLabel, ""), true
+}
+
+func relabelOne(lset []Label, r *config.RelabelConfig) ([]Label, bool) {
+	values := make([]string, 0, len(r.SourceLabels))
+	for _, ln := range r.SourceLabels {
+		values = append(values, GetLabel(lset, ln))
+	}
+	val := strings.Join(values, r.SeparatorString())
+	re := r.Regexp()
+
+	switch r.Action {
+	case config.RelabelDrop:
+		if re.MatchString(val) {
+			return nil, false
+		}
+	case config.RelabelKeep:
+		if !re.MatchString(val) {
+			return nil, false
+		}
+	case config.RelabelReplace:
+		idx := re.FindStringSubmatchIndex(val)
+		if idx == nil {
+			break
+		}
+		target := string(re.ExpandString(nil, r.TargetLabel, val, idx))
+		if !ValidLabelName(target) {
+			break
+		}
+		res := string(re.ExpandString(nil, r.ReplacementString(), val, idx))
+		lset = SetLabel(lset, target, res)
+	case config.RelabelHashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % r.Modulus
+		lset = SetLabel(lset, r.TargetLabel, strconv.FormatUint(mod, 10))
+	case config.RelabelLabelMap:
+		out := append([]Label(nil), lset...)
+		for _, l := range lset {
+			if re.MatchString(l.Name) {
+				res := re.ReplaceAllString(l.Name, r.ReplacementString())
+				out = SetLabel(out, res, l.Value)
+			}
+		}
+		lset = out
+	case config.RelabelLabelDrop, config.RelabelLabelKeep:
+		out := lset[:0:0]
+		for _, l := range lset {
+			// The metric name is never dropped this way.
+			match := re.MatchString(l.Name)
+			if l.Name == nameLabel || match == (r.Action == config.RelabelLabelKeep) {
+				out = append(out, l)
+			}
+		}
+		lset = out
+	}
+
+	return lset, true
+}
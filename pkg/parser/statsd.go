@@ -0,0 +1,122 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A statsdMetric accumulates the statsd lines for one series.
+type statsdMetric struct {
+	kind   string
+	labels []Label
+	value  float64
+	count  int
+	set    map[string]bool
+}
+
+// ConvertStatsd converts statsd output to the exposition format.
+// Since all lines come from a single run, they are aggregated the way
+// a statsd server aggregates one flush interval: counters ('c') are
+// summed, taking sample rates into account, gauges ('g') keep their
+// last value, with '+' and '-' values adjusting it, timers and
+// histograms ('ms', 'h' and 'd') become <name>_count and <name>_sum
+// samples, and sets ('s') count their distinct values. Names have '.'
+// and other invalid characters replaced with '_', and DogStatsD style
+// '#name:value,...' tags become labels. Lines we can't parse are
+// ignored.
+func ConvertStatsd(output string) string {
+	metrics := make(map[string]*statsdMetric)
+	var order []string
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			continue
+		}
+		name := SanitizeName(line[:i])
+		fields := strings.Split(line[i+1:], "|")
+		if len(fields) < 2 {
+			continue
+		}
+		v, kind := fields[0], fields[1]
+
+		rate := 1.0
+		var labels []Label
+		for _, f := range fields[2:] {
+			switch {
+			case strings.HasPrefix(f, "@"):
+				if r, err := strconv.ParseFloat(f[1:], 64); err == nil && r > 0 {
+					rate = r
+				}
+			case strings.HasPrefix(f, "#"):
+				for _, tag := range strings.Split(f[1:], ",") {
+					kv := strings.SplitN(tag, ":", 2)
+					if len(kv) == 2 {
+						labels = append(labels, Label{Name: SanitizeName(kv[0]), Value: kv[1]})
+					}
+				}
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		switch kind {
+		case "h", "d":
+			kind = "ms"
+		case "c", "g", "ms", "s":
+		default:
+			continue
+		}
+
+		key := name + FormatLabels(labels)
+		m := metrics[key]
+		if m == nil {
+			m = &statsdMetric{kind: kind, labels: labels, set: make(map[string]bool)}
+			metrics[key] = m
+			order = append(order, key)
+		} else if m.kind != kind {
+			continue
+		}
+
+		if kind == "s" {
+			m.set[v] = true
+			continue
+		}
+		value, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		switch kind {
+		case "c":
+			m.value += value / rate
+		case "g":
+			if v[0] == '+' || v[0] == '-' {
+				m.value += value
+			} else {
+				m.value = value
+			}
+		case "ms":
+			m.value += value
+			m.count++
+		}
+	}
+
+	var b strings.Builder
+	for _, key := range order {
+		m := metrics[key]
+		name := key[:strings.Index(key, "{")]
+		labels := FormatLabels(m.labels)
+		switch m.kind {
+		case "s":
+			fmt.Fprintf(&b, "%s%s %d\n", name, labels, len(m.set))
+		case "ms":
+			fmt.Fprintf(&b, "%s_count%s %d\n", name, labels, m.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(m.value, 'g', -1, 64))
+		default:
+			fmt.Fprintf(&b, "%s%s %s\n", name, labels, strconv.FormatFloat(m.value, 'g', -1, 64))
+		}
+	}
+	return b.String()
+}
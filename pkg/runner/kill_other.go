@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package runner
+
+import (
+	"os/exec"
+	"time"
+)
+
+// setKill does nothing, since there are no signals or process groups
+// here; programs are always killed right away.
+func setKill(cmd *exec.Cmd, signal string, grace time.Duration) (done func()) {
+	return func() {}
+}
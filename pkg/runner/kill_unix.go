@@ -0,0 +1,64 @@
+//go:build !windows && !plan9
+
+package runner
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killSignals are the signals that KillSignal can name.
+var killSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// setKill makes cmd run in a process group of its own, which is killed
+// with all of the children that cmd left behind once its context is
+// done: right away if grace is zero, and otherwise grace after cmd
+// was sent signal, or once cmd has exited if that is sooner. It
+// returns a function that must be called after cmd was waited for, so
+// that a process group that gets the same ID later isn't killed.
+func setKill(cmd *exec.Cmd, signal string, grace time.Duration) (done func()) {
+	sig, ok := killSignals[signal]
+	if !ok {
+		sig = syscall.SIGTERM
+	}
+
+	attr := &syscall.SysProcAttr{}
+	if cmd.SysProcAttr != nil {
+		*attr = *cmd.SysProcAttr
+	}
+	attr.Setpgid = true
+	cmd.SysProcAttr = attr
+
+	// Cancel is only called before Wait returns, so done sees the
+	// timer it started.
+	var pgid int
+	var timer *time.Timer
+	cmd.Cancel = func() error {
+		pgid = cmd.Process.Pid
+		if grace <= 0 {
+			sig = syscall.SIGKILL
+		} else {
+			timer = time.AfterFunc(grace, func() { syscall.Kill(-pgid, syscall.SIGKILL) })
+		}
+		err := syscall.Kill(-pgid, sig)
+		if err == syscall.ESRCH {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	cmd.WaitDelay = grace + WaitDelay
+	return func() {
+		if timer != nil && timer.Stop() {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+	}
+}
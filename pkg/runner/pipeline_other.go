@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package runner
+
+// brokenPipe reports false, since programs aren't killed by SIGPIPE
+// here.
+func brokenPipe(err error) bool {
+	return false
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+
+package runner
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// brokenPipe reports whether a program was killed by SIGPIPE, because
+// whatever read its output stopped reading.
+func brokenPipe(err error) bool {
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE
+}
@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Pooled commands trade some memory that stays allocated between runs
+// for less garbage per run.
+
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}
+
+	programsMu    sync.Mutex
+	programsCache = make(map[string]string)
+)
+
+// lookProgram resolves a program name through $PATH once and then
+// remembers the result. Programs given by path are returned as-is.
+func lookProgram(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+
+	programsMu.Lock()
+	defer programsMu.Unlock()
+	if p, ok := programsCache[name]; ok {
+		return p
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		// Let running it fail with a sensible error.
+		return name
+	}
+	programsCache[name] = p
+	return p
+}
+
+// forgetProgram removes a program from the lookup cache, so that it
+// is looked up again after it failed to run (for example because it
+// has moved).
+func forgetProgram(name string) {
+	programsMu.Lock()
+	delete(programsCache, name)
+	programsMu.Unlock()
+}
+
+// runPooled is Run for pooled commands. It captures the output in a
+// pooled buffer and avoids looking up the program in $PATH for every
+// execution.
+func runPooled(ctx context.Context, c Command, stdin []byte, maxBytes int64, usage *Usage) (string, bool, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	// A resolved path skips the $PATH lookup in exec, but the
+	// script should still see the name it was configured with.
+	args := c.Args
+	cmd := exec.CommandContext(ctx, lookProgram(args[0]), args[1:]...)
+	cmd.Args = args
+	cmd.Dir = c.Dir
+	cmd.SysProcAttr = c.Attr
+	cmd.Env = c.environ()
+	cmd.Stdin = stdinReader(stdin)
+	stdout := &LimitedWriter{w: buf, max: maxBytes}
+	cmd.Stdout = stdout
+	cmd.Stderr = c.Stderr
+	cmd.WaitDelay = WaitDelay
+	err := pipeline(ctx, cmd, c, true)
+	stdout.Flush()
+	usage.record(cmd.ProcessState)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			forgetProgram(args[0])
+		}
+		return buf.String(), stdout.truncated, err
+	}
+
+	return buf.String(), stdout.truncated, nil
+}
@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// A Script is one run of a script: its configuration, the values of
+// the 'params' parameter of the probe request, which a runner adds to
+// the script command, its standard input, or nil for none, and the
+// environment variables it gets on top of ours. Runners stop the
+// script once it has run for Timeout, unless that is zero, or once
+// Context is done, because nobody waits for the run any more, and
+// return at most MaxBytes bytes of its output, unless that is zero. If
+// Usage isn't nil, runners that start processes record their resource
+// usage in it, and if Stderr isn't, they send their standard error to
+// it, like Command.
+type Script struct {
+	Config   *config.ScriptConfig
+	Params   []string
+	Stdin    []byte
+	Env      []string
+	Timeout  time.Duration
+	Context  context.Context
+	MaxBytes int64
+	Usage    *Usage
+	Stderr   io.Writer
+}
+
+// A Runner runs the scripts of one type. Run returns the output of a
+// script, whether it was truncated, and the error from running it;
+// like Run, runners return the output of scripts that failed along with
+// the error, for formats that give meaning to it.
+type Runner interface {
+	Run(s *Script) (string, bool, error)
+}
+
+// A Streamer is a Runner that can also hand the output of a script to
+// consume while it runs instead of collecting it, so that large output
+// in the exposition format is never held in memory as a whole.
+type Streamer interface {
+	Runner
+	Stream(s *Script, consume func(io.Reader)) (bool, error)
+}
+
+// Func is a Runner that is just a function.
+type Func func(s *Script) (string, bool, error)
+
+// Run calls f(s).
+func (f Func) Run(s *Script) (string, bool, error) {
+	return f(s)
+}
+
+var (
+	runnersMu sync.RWMutex
+	runners   = make(map[string]Runner)
+)
+
+// Register makes a runner available for the scripts of a type, and
+// the type known to the configuration. Programs using the packages
+// register their own runners this way, usually in an init function.
+// It panics if there already is a runner for the type.
+func Register(name string, r Runner) {
+	runnersMu.Lock()
+	defer runnersMu.Unlock()
+	if r == nil {
+		panic("runner: Register runner is nil")
+	}
+	if _, ok := runners[name]; ok {
+		panic(fmt.Sprintf("runner: Register called twice for type %s", name))
+	}
+	runners[name] = r
+	config.RegisterType(name)
+}
+
+// Lookup returns the runner for the scripts of a type, or nil if none
+// was registered.
+func Lookup(name string) Runner {
+	runnersMu.RLock()
+	defer runnersMu.RUnlock()
+	return runners[name]
+}
+
+// Types returns the types that runners were registered for, sorted.
+func Types() []string {
+	runnersMu.RLock()
+	defer runnersMu.RUnlock()
+	var types []string
+	for name := range runners {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,391 @@
+// Package runner runs the programs of scripts: a command line, with
+// its output fed through further command lines like a shell pipeline,
+// limited in how long it may run and how much output it may write.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// WaitDelay is how long we wait for a killed script's output to be
+// closed before giving up on it. Scripts may leave children behind
+// that still hold their stdout open.
+const WaitDelay = time.Second
+
+// TimeoutError is returned by Run for scripts that were killed
+// because they ran longer than their timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.Timeout)
+}
+
+// A Command is what runs a script: the command line of its program,
+// the command lines that its output is fed through, if any, the
+// directory they run in, or "" for ours, the attributes of their
+// processes, such as the namespaces of a sandbox, and environment
+// variables they get on top of ours. Pooled commands are run the way
+// the high-frequency mode wants: programs are looked up in $PATH only
+// once, and output is collected in pooled buffers. Every process of a
+// command runs in a process group of its own, which is killed with it.
+// With a KillGrace, the processes of a command that is killed first
+// get KillSignal, which is SIGTERM if it's "", and their process
+// groups are only killed once KillGrace has passed. Their standard
+// error goes to Stderr, which must be safe for concurrent use, or is
+// discarded if it's nil.
+type Command struct {
+	Args       []string
+	Stages     [][]string
+	Dir        string
+	Attr       *syscall.SysProcAttr
+	Env        []string
+	Pooled     bool
+	KillSignal string
+	KillGrace  time.Duration
+	Stderr     io.Writer
+}
+
+// environ returns the environment of the processes of a command, or
+// nil for ours.
+func (c Command) environ() []string {
+	if len(c.Env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), c.Env...)
+}
+
+// A LimitedWriter writes at most max bytes to w, or all of them if max
+// is zero, and discards the rest, so that scripts with huge output
+// neither use up our memory nor block on a full pipe. It only writes
+// complete lines, so that truncated output doesn't end in a partial
+// line; Flush writes the last line if it doesn't end in a newline.
+type LimitedWriter struct {
+	w         io.Writer
+	max       int64
+	written   int64
+	pending   []byte
+	truncated bool
+}
+
+// NewLimitedWriter returns a LimitedWriter that writes at most max
+// bytes to w.
+func NewLimitedWriter(w io.Writer, max int64) *LimitedWriter {
+	return &LimitedWriter{w: w, max: max}
+}
+
+func (l *LimitedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if l.truncated {
+		return n, nil
+	}
+	if l.max > 0 && l.written+int64(n) > l.max {
+		p = p[:l.max-l.written]
+		l.truncated = true
+	}
+	l.written += int64(len(p))
+
+	i := bytes.LastIndexByte(p, '\n')
+	if i >= 0 {
+		if len(l.pending) > 0 {
+			if _, err := l.w.Write(l.pending); err != nil {
+				return 0, err
+			}
+			l.pending = l.pending[:0]
+		}
+		if _, err := l.w.Write(p[:i+1]); err != nil {
+			return 0, err
+		}
+	}
+	if l.truncated {
+		l.pending = nil
+	} else {
+		l.pending = append(l.pending, p[i+1:]...)
+	}
+	return n, nil
+}
+
+// Flush writes the last line of the output if it's incomplete and the
+// output wasn't truncated.
+func (l *LimitedWriter) Flush() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	_, err := l.w.Write(l.pending)
+	l.pending = nil
+	return err
+}
+
+// Truncated reports whether output was discarded.
+func (l *LimitedWriter) Truncated() bool {
+	return l.truncated
+}
+
+// Run runs a command, with stdin as its standard input if it isn't
+// nil, and returns its standard output, of which it reads at most
+// maxBytes bytes unless that is zero, and whether the output was
+// truncated because of that. If usage isn't nil, the resource usage
+// of the program is recorded in it. If timeout is not zero the
+// program is killed once it has run for that long. The output of
+// programs that exit with a non-zero status is returned along with
+// the error.
+func Run(c Command, stdin []byte, timeout time.Duration, maxBytes int64, usage *Usage) (string, bool, error) {
+	return RunContext(context.Background(), c, stdin, timeout, maxBytes, usage)
+}
+
+// RunContext is Run, but the program is also killed once ctx is done,
+// for example because nobody waits for its output any more, and the
+// error of ctx is returned then. Programs that Stop killed return
+// ErrStopped.
+func RunContext(parent context.Context, c Command, stdin []byte, timeout time.Duration, maxBytes int64, usage *Usage) (string, bool, error) {
+	ctx, cancel := withStop(parent)
+	defer cancel()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var output string
+	var truncated bool
+	var err error
+	if c.Pooled {
+		output, truncated, err = runPooled(ctx, c, stdin, maxBytes, usage)
+	} else {
+		var buf bytes.Buffer
+		stdout := &LimitedWriter{w: &buf, max: maxBytes}
+		cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+		cmd.Dir = c.Dir
+		cmd.SysProcAttr = c.Attr
+		cmd.Env = c.environ()
+		cmd.Stdin = stdinReader(stdin)
+		cmd.Stdout = stdout
+		cmd.Stderr = c.Stderr
+		cmd.WaitDelay = WaitDelay
+		err = pipeline(ctx, cmd, c, false)
+		stdout.Flush()
+		usage.record(cmd.ProcessState)
+		output, truncated = buf.String(), stdout.truncated
+	}
+
+	if err != nil {
+		if perr := parent.Err(); perr != nil {
+			return "", false, perr
+		}
+		if err == ErrStopped || stopping.Err() != nil {
+			return "", false, ErrStopped
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", false, &TimeoutError{Timeout: timeout}
+		}
+		return output, truncated, err
+	}
+
+	return output, truncated, nil
+}
+
+// Stream runs a command like Run, but hands its standard output to
+// consume while the program runs instead of collecting it, and
+// returns whether the output was truncated.
+func Stream(c Command, stdin []byte, timeout time.Duration, maxBytes int64, usage *Usage, consume func(io.Reader)) (bool, error) {
+	return StreamContext(context.Background(), c, stdin, timeout, maxBytes, usage, consume)
+}
+
+// StreamContext is Stream, but the program is also killed once ctx is
+// done, like with RunContext.
+func StreamContext(parent context.Context, c Command, stdin []byte, timeout time.Duration, maxBytes int64, usage *Usage, consume func(io.Reader)) (bool, error) {
+	ctx, cancel := withStop(parent)
+	defer cancel()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	args := c.Args
+	program := args[0]
+	if c.Pooled {
+		program = lookProgram(program)
+	}
+
+	// Output that consume doesn't read is discarded, so that the
+	// program never blocks on us.
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		consume(pr)
+		io.Copy(ioutil.Discard, pr)
+		close(done)
+	}()
+
+	stdout := &LimitedWriter{w: pw, max: maxBytes}
+	cmd := exec.CommandContext(ctx, program, args[1:]...)
+	cmd.Args = args
+	cmd.Dir = c.Dir
+	cmd.SysProcAttr = c.Attr
+	cmd.Env = c.environ()
+	cmd.Stdin = stdinReader(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = c.Stderr
+	cmd.WaitDelay = WaitDelay
+	err := pipeline(ctx, cmd, c, c.Pooled)
+	stdout.Flush()
+	usage.record(cmd.ProcessState)
+	pw.Close()
+	<-done
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok && c.Pooled {
+			forgetProgram(args[0])
+		}
+		if perr := parent.Err(); perr != nil {
+			return false, perr
+		}
+		if err == ErrStopped || stopping.Err() != nil {
+			return false, ErrStopped
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return false, &TimeoutError{Timeout: timeout}
+		}
+		return stdout.truncated, err
+	}
+
+	return stdout.truncated, nil
+}
+
+// Pipeline runs cmd with its output fed through the commands of the
+// stages of c, one after the other in the same directory and with the
+// same process attributes and environment, and the output of the last
+// one going where that of cmd would; the commands are connected
+// directly, like in a shell pipeline. They are killed the way c says.
+// It waits for all commands to exit and returns the error of the
+// first one that failed, so that a failing filter fails the script.
+// Once Stop was called, it returns ErrStopped without running them.
+func Pipeline(ctx context.Context, cmd *exec.Cmd, c Command) error {
+	return pipeline(ctx, cmd, c, false)
+}
+
+// pipeline is Pipeline, but with lookup, programs are found through
+// the cache of pooled commands.
+func pipeline(ctx context.Context, cmd *exec.Cmd, c Command, lookup bool) error {
+	release, err := track()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	done := setKill(cmd, c.KillSignal, c.KillGrace)
+	defer done()
+	if len(c.Stages) == 0 {
+		return cmd.Run()
+	}
+
+	cmds := []*exec.Cmd{cmd}
+	var pipes []*os.File
+	defer func() {
+		for _, f := range pipes {
+			f.Close()
+		}
+	}()
+	stdout := cmd.Stdout
+	for _, args := range c.Stages {
+		program := args[0]
+		if lookup {
+			program = lookProgram(program)
+		}
+		next := exec.CommandContext(ctx, program, args[1:]...)
+		next.Args = args
+		next.Dir = cmd.Dir
+		next.SysProcAttr = cmd.SysProcAttr
+		next.Env = cmd.Env
+		next.Stderr = cmd.Stderr
+		next.WaitDelay = WaitDelay
+		defer setKill(next, c.KillSignal, c.KillGrace)()
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		pipes = append(pipes, r, w)
+		cmds[len(cmds)-1].Stdout = w
+		next.Stdin = r
+		cmds = append(cmds, next)
+	}
+	cmds[len(cmds)-1].Stdout = stdout
+
+	// Our ends of the pipes are closed once every command has
+	// started, so that commands see the end of their input, or
+	// can't write any more, when their neighbours exit. Commands
+	// that started are killed if a later one can't be started.
+	started := 0
+	for _, p := range cmds {
+		if err = p.Start(); err != nil {
+			break
+		}
+		started++
+	}
+	for _, f := range pipes {
+		f.Close()
+	}
+	pipes = nil
+	if err != nil {
+		for _, p := range cmds[:started] {
+			p.Process.Kill()
+		}
+	}
+	// Commands that are killed because a later one exited without
+	// reading all of their output, as 'head' does, haven't failed.
+	for i, p := range cmds[:started] {
+		werr := p.Wait()
+		if i < len(cmds)-1 && brokenPipe(werr) {
+			werr = nil
+		}
+		if err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// stdinReader returns the standard input for a program, which is
+// nothing (/dev/null) if stdin is nil.
+func stdinReader(stdin []byte) io.Reader {
+	if stdin == nil {
+		return nil
+	}
+	return bytes.NewReader(stdin)
+}
+
+// ExitCode returns the exit status of a script from the error that
+// running it returned: 0 for success, the exit status if the script
+// exited with one, and -1 if it did not exit normally.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+	if es, ok := err.(*ExitStatusError); ok {
+		return es.Status
+	}
+	return -1
+}
+
+// ExitStatusError is returned by runners for scripts that don't run as
+// processes of their own, but report an exit status other than zero.
+type ExitStatusError struct {
+	Status int
+}
+
+func (e *ExitStatusError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
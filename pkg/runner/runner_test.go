@@ -0,0 +1,260 @@
+//go:build !windows && !plan9
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		c         Command
+		stdin     []byte
+		timeout   time.Duration
+		maxBytes  int64
+		want      string
+		truncated bool
+		exitCode  int
+		timedOut  bool
+	}{
+		{name: "output", c: Command{Args: []string{"echo", "up 1"}}, want: "up 1\n"},
+		{name: "stdin", c: Command{Args: []string{"cat"}}, stdin: []byte("from stdin\n"), want: "from stdin\n"},
+		{name: "no stdin", c: Command{Args: []string{"cat"}}, want: ""},
+		{name: "environment", c: Command{Args: []string{"sh", "-c", "echo $PROBE"}, Env: []string{"PROBE=yes"}}, want: "yes\n"},
+		{name: "directory", c: Command{Args: []string{"pwd"}, Dir: "/"}, want: "/\n"},
+		{name: "exit status", c: Command{Args: []string{"sh", "-c", "echo partial; exit 3"}}, want: "partial\n", exitCode: 3},
+		{name: "truncated", c: Command{Args: []string{"printf", "one\ntwo\nthree\n"}}, maxBytes: 10, want: "one\ntwo\n", truncated: true},
+		{name: "last line without newline", c: Command{Args: []string{"printf", "one\ntwo"}}, want: "one\ntwo"},
+		{name: "pipeline", c: Command{Args: []string{"printf", "b\na\n"}, Stages: [][]string{{"sort"}, {"head", "-n", "1"}}}, want: "a\n"},
+		{name: "pipeline reading part of the output", c: Command{Args: []string{"yes"}, Stages: [][]string{{"head", "-n", "2"}}}, want: "y\ny\n"},
+		{name: "failing stage", c: Command{Args: []string{"echo", "a"}, Stages: [][]string{{"sh", "-c", "cat; exit 4"}}}, want: "a\n", exitCode: 4},
+		{name: "pooled", c: Command{Args: []string{"echo", "pooled"}, Pooled: true}, want: "pooled\n"},
+		{name: "pooled truncated", c: Command{Args: []string{"printf", "one\ntwo\n"}, Pooled: true}, maxBytes: 5, want: "one\n", truncated: true},
+		{name: "timeout", c: Command{Args: []string{"sleep", "10"}}, timeout: 100 * time.Millisecond, exitCode: -1, timedOut: true},
+		{name: "pooled timeout", c: Command{Args: []string{"sleep", "10"}, Pooled: true}, timeout: 100 * time.Millisecond, exitCode: -1, timedOut: true},
+		{name: "pipeline timeout", c: Command{Args: []string{"sleep", "10"}, Stages: [][]string{{"cat"}}}, timeout: 100 * time.Millisecond, exitCode: -1, timedOut: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			got, truncated, err := Run(tt.c, tt.stdin, tt.timeout, tt.maxBytes, nil)
+			if code := ExitCode(err); code != tt.exitCode {
+				t.Errorf("Run() error = %v, want exit code %d", err, tt.exitCode)
+			}
+			var te *TimeoutError
+			if timedOut := errors.As(err, &te); timedOut != tt.timedOut {
+				t.Errorf("Run() error = %v, want a timeout: %v", err, tt.timedOut)
+			}
+			if tt.timedOut && time.Since(start) > 5*time.Second {
+				t.Errorf("Run() took %s to time out", time.Since(start))
+			}
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("Run() = %q, %v, want %q, %v", got, truncated, tt.want, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestRunNotFound(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		_, _, err := Run(Command{Args: []string{"./does-not-exist"}, Pooled: pooled}, nil, 0, 0, nil)
+		if err == nil || ExitCode(err) != -1 {
+			t.Errorf("Run() of a missing program (pooled %v) error = %v", pooled, err)
+		}
+	}
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err := RunContext(ctx, Command{Args: []string{"sleep", "10"}}, nil, time.Minute, 0, nil)
+	if err != context.Canceled {
+		t.Errorf("RunContext() error = %v, want %v", err, context.Canceled)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("RunContext() took %s after it was canceled", time.Since(start))
+	}
+}
+
+func TestRunKill(t *testing.T) {
+	tests := []struct {
+		name     string
+		c        Command
+		stderr   string
+		minDelay time.Duration
+	}{
+		// The script gets to clean up, within the grace period.
+		{name: "signal", c: Command{Args: []string{"sh", "-c", "trap 'echo cleaned up >&2; exit 1' TERM; sleep 10 & wait"}, KillGrace: 5 * time.Second}, stderr: "cleaned up\n"},
+		{name: "other signal", c: Command{Args: []string{"sh", "-c", "trap 'echo interrupted >&2; exit 1' INT; sleep 10 >/dev/null 2>&1 & wait"}, KillSignal: "SIGINT", KillGrace: 5 * time.Second}, stderr: "interrupted\n"},
+		// Scripts that ignore the signal are killed once it's over.
+		{name: "ignored signal", c: Command{Args: []string{"sh", "-c", "trap '' TERM; sleep 10; echo survived >&2"}, KillGrace: 500 * time.Millisecond}, minDelay: 500 * time.Millisecond},
+		{name: "without grace", c: Command{Args: []string{"sh", "-c", "trap 'echo cleaned up >&2' TERM; sleep 10"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			tt.c.Stderr = &stderr
+			start := time.Now()
+			got, _, err := Run(tt.c, nil, 200*time.Millisecond, 0, nil)
+			elapsed := time.Since(start)
+			var te *TimeoutError
+			if !errors.As(err, &te) || te.Timeout != 200*time.Millisecond {
+				t.Errorf("Run() error = %v, want a timeout", err)
+			}
+			// The output of killed scripts is dropped.
+			if got != "" {
+				t.Errorf("Run() = %q, want no output", got)
+			}
+			if stderr.String() != tt.stderr {
+				t.Errorf("standard error = %q, want %q", stderr.String(), tt.stderr)
+			}
+			if elapsed < 200*time.Millisecond+tt.minDelay || elapsed > 4*time.Second {
+				t.Errorf("Run() took %s", elapsed)
+			}
+		})
+	}
+}
+
+// alive returns whether the process with pid is running, rather than
+// gone or a zombie.
+func alive(t *testing.T, pid string) bool {
+	t.Helper()
+	out, err := exec.Command("ps", "-o", "stat=", "-p", pid).Output()
+	return err == nil && !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+}
+
+func TestRunKillsChildren(t *testing.T) {
+	// The child ignores the signal and outlives the script unless its
+	// process group is killed.
+	child := `(trap '' TERM; exec sleep 10) >/dev/null 2>&1 & echo $! >"$PIDFILE"; `
+	tests := []struct {
+		name  string
+		c     Command
+		grace time.Duration
+	}{
+		{name: "without grace", c: Command{Args: []string{"sh", "-c", child + "wait"}}},
+		{name: "with grace", c: Command{Args: []string{"sh", "-c", child + "wait"}}, grace: 500 * time.Millisecond},
+		// The process group goes once the script has exited, not
+		// only when the grace period is over.
+		{name: "exited within grace", c: Command{Args: []string{"sh", "-c", child + "trap 'exit 1' TERM; wait"}}, grace: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "pid")
+			tt.c.Env = []string{"PIDFILE=" + pidFile}
+			tt.c.KillGrace = tt.grace
+			start := time.Now()
+			Run(tt.c, nil, 200*time.Millisecond, 0, nil)
+			if elapsed := time.Since(start); elapsed > 4*time.Second {
+				t.Errorf("Run() took %s", elapsed)
+			}
+			b, err := ioutil.ReadFile(pidFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pid := strings.TrimSpace(string(b))
+			deadline := time.Now().Add(time.Second)
+			for alive(t, pid) {
+				if time.Now().After(deadline) {
+					t.Fatalf("child %s is still running", pid)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	var lines []string
+	truncated, err := Stream(Command{Args: []string{"printf", "one\ntwo\nthree\n"}, Stages: [][]string{{"cat"}}}, nil, time.Second, 9, nil, func(r io.Reader) {
+		b, _ := ioutil.ReadAll(r)
+		lines = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	})
+	if err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+	if !truncated || strings.Join(lines, ",") != "one,two" {
+		t.Errorf("Stream() read %q, truncated %v", lines, truncated)
+	}
+
+	// Output that consume doesn't read doesn't block the program.
+	_, err = Stream(Command{Args: []string{"head", "-c", "1000000", "/dev/zero"}}, nil, 5*time.Second, 0, nil, func(io.Reader) {})
+	if err != nil {
+		t.Errorf("Stream() without reading error = %v", err)
+	}
+
+	_, err = Stream(Command{Args: []string{"sleep", "10"}}, nil, 100*time.Millisecond, 0, nil, func(io.Reader) {})
+	var te *TimeoutError
+	if !errors.As(err, &te) {
+		t.Errorf("Stream() error = %v, want a timeout", err)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int64
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{"unlimited", 0, []string{"a\n", "b", "c\n"}, "a\nbc\n", false},
+		{"within the limit", 10, []string{"a\nb\n"}, "a\nb\n", false},
+		{"exactly the limit", 4, []string{"a\nb\n"}, "a\nb\n", false},
+		{"partial last line", 5, []string{"a\nb\ncd\n"}, "a\nb\n", true},
+		{"across writes", 5, []string{"a\n", "b\n", "cd\n"}, "a\nb\n", true},
+		{"incomplete line", 0, []string{"a\nb"}, "a\nb", false},
+		{"first line too long", 3, []string{"abcd\n"}, "", true},
+		{"writes after truncation", 2, []string{"a\nb\n", "c\n"}, "a\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewLimitedWriter(&buf, tt.max)
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write() = %d, %v, want %d, nil", n, err, len(s))
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+			if buf.String() != tt.want || w.Truncated() != tt.truncated {
+				t.Errorf("wrote %q, truncated %v, want %q, %v", buf.String(), w.Truncated(), tt.want, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 5").Run()
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, 0},
+		{"exit status", exitErr, 5},
+		{"exit status of a runner", &ExitStatusError{Status: 2}, 2},
+		{"timeout", &TimeoutError{Timeout: time.Second}, -1},
+		{"other error", errors.New("not found"), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrStopped is returned for commands that were killed, or not
+// started, because Stop was called.
+var ErrStopped = errors.New("killed because the exporter is stopping")
+
+// The running commands, which Stop kills and waits for. allDone is
+// closed once Stop was called and the last of them has exited.
+var (
+	stopping, stopAll = context.WithCancel(context.Background())
+
+	runningMu sync.Mutex
+	stopped   bool
+	running   int
+	allDone   = make(chan struct{})
+)
+
+// Stop kills the programs of all running commands in the way their
+// Command says, as if their context were done, so that programs with
+// a KillGrace can clean up and no process group is left behind when
+// we exit. It waits until they have exited or ctx is done. Commands
+// aren't started any more once Stop was called.
+func Stop(ctx context.Context) error {
+	runningMu.Lock()
+	if !stopped {
+		stopped = true
+		stopAll()
+		if running == 0 {
+			close(allDone)
+		}
+	}
+	runningMu.Unlock()
+
+	select {
+	case <-allDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withStop returns a context that is also done once Stop is called.
+func withStop(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	unregister := context.AfterFunc(stopping, cancel)
+	return ctx, func() {
+		unregister()
+		cancel()
+	}
+}
+
+// track counts a command as running until release is called, unless
+// Stop was called already.
+func track() (release func(), err error) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if stopped {
+		return nil, ErrStopped
+	}
+	running++
+	return func() {
+		runningMu.Lock()
+		defer runningMu.Unlock()
+		if running--; stopped && running == 0 {
+			close(allDone)
+		}
+	}, nil
+}
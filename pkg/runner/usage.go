@@ -0,0 +1,26 @@
+package runner
+
+import (
+	"os"
+)
+
+// Usage is what a run of a script cost. The maximum resident set size
+// isn't available everywhere.
+type Usage struct {
+	Known      bool
+	UserTime   float64
+	SystemTime float64
+	MaxRSS     int64
+}
+
+// record records the resource usage of a program that has exited.
+// It can be called on a nil Usage, and does nothing then.
+func (u *Usage) record(ps *os.ProcessState) {
+	if u == nil || ps == nil {
+		return
+	}
+	u.Known = true
+	u.UserTime = ps.UserTime().Seconds()
+	u.SystemTime = ps.SystemTime().Seconds()
+	u.MaxRSS = maxRSS(ps)
+}
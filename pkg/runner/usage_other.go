@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package runner
+
+import (
+	"os"
+)
+
+// maxRSS returns 0, since we don't know the maximum resident set size
+// of programs here.
+func maxRSS(ps *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+
+package runner
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// maxRSS returns the maximum resident set size of an exited program
+// in bytes, or 0 if it isn't known. Darwin reports it in bytes, other
+// Unixes in kilobytes.
+func maxRSS(ps *os.ProcessState) int64 {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	if runtime.GOOS == "darwin" {
+		return int64(ru.Maxrss)
+	}
+	return int64(ru.Maxrss) * 1024
+}
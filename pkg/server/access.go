@@ -0,0 +1,72 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// ClientIP returns the address of the client of a request. Requests
+// from trusted proxies are from the last address in X-Forwarded-For
+// that isn't a trusted proxy itself. Requests on unix sockets, which
+// have no address, are from the proxy that forwarded them or else
+// from nil, a local client.
+func ClientIP(r *http.Request, trusted config.Networks) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && !trusted.Contains(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trusted.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// RestrictTo returns middleware that only lets clients in the
+// networks that list picks from the running configuration through,
+// and rejects everyone else before authentication.
+func (a *Auth) RestrictTo(list func(*config.Config) config.Networks) func(http.HandlerFunc) http.HandlerFunc {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			c := a.config()
+			nets := list(c)
+			if len(nets) == 0 {
+				h(w, r)
+				return
+			}
+
+			ip := ClientIP(r, c.Access.TrustedProxies)
+			if ip != nil && !nets.Contains(ip) {
+				log.Printf("Access from %s to %s denied\n", ip, r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+		}
+	}
+}
+
+// The networks of a configuration for the endpoints of the exporter,
+// for RestrictTo.
+func ProbeNetworks(c *config.Config) config.Networks   { return c.Access.Probe }
+func MetricsNetworks(c *config.Config) config.Networks { return c.Access.Metrics }
+func AdminNetworks(c *config.Config) config.Networks   { return c.Access.Admin }
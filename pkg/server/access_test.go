@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// networks returns the networks of a list in CIDR notation.
+func networks(t *testing.T, list ...string) config.Networks {
+	t.Helper()
+	var n config.Networks
+	for _, s := range list {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n = append(n, ipnet)
+	}
+	return n
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := networks(t, "10.0.0.0/8", "2001:db8::/32")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		trusted    config.Networks
+		want       string
+	}{
+		{"direct", "192.0.2.1:51234", nil, trusted, "192.0.2.1"},
+		{"forwarded by an untrusted client", "192.0.2.1:51234", []string{"198.51.100.1"}, trusted, "192.0.2.1"},
+		{"no trusted proxies", "10.0.0.1:51234", []string{"198.51.100.1"}, nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1:51234", []string{"198.51.100.1"}, trusted, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:51234", nil, trusted, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:51234", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, trusted, "198.51.100.1"},
+		// Hops before the first untrusted one may be made up by the client.
+		{"spoofed hops", "10.0.0.1:51234", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, trusted, "198.51.100.1"},
+		{"several headers", "10.0.0.1:51234", []string{"203.0.113.9", "198.51.100.1, 10.0.0.2"}, trusted, "198.51.100.1"},
+		{"only trusted hops", "10.0.0.1:51234", []string{"10.0.0.2"}, trusted, "10.0.0.2"},
+		{"invalid hop", "10.0.0.1:51234", []string{"198.51.100.1, unknown"}, trusted, "10.0.0.1"},
+		{"invalid hop before a trusted one", "10.0.0.1:51234", []string{"unknown, 10.0.0.2"}, trusted, "10.0.0.2"},
+		{"ipv6 trusted proxy", "[2001:db8::1]:51234", []string{"2001:db8:ffff::1, 2001:db8::2"}, trusted, "2001:db8:ffff::1"},
+		{"ipv6 direct", "[2001:db9::1]:51234", []string{"198.51.100.1"}, trusted, "2001:db9::1"},
+		{"without port", "10.0.0.1", []string{"198.51.100.1"}, trusted, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/probe", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, h := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", h)
+			}
+			if got := ClientIP(r, tt.trusted); got.String() != tt.want {
+				t.Errorf("ClientIP() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestrictTo(t *testing.T) {
+	c := &config.Config{}
+	c.Access.Probe = networks(t, "192.0.2.0/24")
+	c.Access.TrustedProxies = networks(t, "10.0.0.0/8")
+	auth := NewAuth(func() *config.Config { return c })
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		name       string
+		list       func(*config.Config) config.Networks
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"allowed", ProbeNetworks, "192.0.2.1:51234", "", http.StatusOK},
+		{"denied", ProbeNetworks, "198.51.100.1:51234", "", http.StatusForbidden},
+		{"allowed behind a trusted proxy", ProbeNetworks, "10.0.0.1:51234", "192.0.2.1", http.StatusOK},
+		{"denied behind a trusted proxy", ProbeNetworks, "10.0.0.1:51234", "198.51.100.1", http.StatusForbidden},
+		{"forwarded by an untrusted client", ProbeNetworks, "198.51.100.1:51234", "192.0.2.1", http.StatusForbidden},
+		{"no networks", MetricsNetworks, "198.51.100.1:51234", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/probe", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			Use(ok, auth.RestrictTo(tt.list))(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+// Package server authenticates the requests of the HTTP server of the
+// exporter: with basic authentication, bearer tokens or OAuth 2.0
+// tokens, and by the networks that clients may connect from, as
+// middleware for its handlers.
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// An Auth authenticates requests and restricts where they may come
+// from by the running configuration, which it gets from config for
+// every request, so that reloads take effect right away.
+type Auth struct {
+	config func() *config.Config
+}
+
+// NewAuth returns an Auth for the configuration that config returns.
+func NewAuth(config func() *config.Config) *Auth {
+	return &Auth{config: config}
+}
+
+// Use wraps a handler in middleware, the first of which is innermost.
+func Use(h http.HandlerFunc, middleware ...func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
+	for _, m := range middleware {
+		h = m(h)
+	}
+
+	return h
+}
+
+// For returns middleware that authenticates requests to endpoint if
+// the running configuration requires that.
+func (a *Auth) For(endpoint string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		authenticated := a.Required(h)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if a.config().AuthRequired(endpoint) {
+				authenticated(w, r)
+				return
+			}
+			h(w, r)
+		}
+	}
+}
+
+// Required returns middleware that authenticates every request with
+// the authentication of the running configuration.
+func (a *Auth) Required(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		exporterConfig := a.config()
+
+		// Basic authentication
+		if exporterConfig.BasicAuth.Active {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+
+			username, password, authOK := r.BasicAuth()
+			if !authOK {
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+
+			if username != exporterConfig.BasicAuth.Username || password != exporterConfig.BasicAuth.Password {
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// Authentication using bearer token
+		if exporterConfig.BearerAuth.Active {
+			token, ok := bearerToken(r)
+			if !ok || checkJWT(exporterConfig, token) != nil {
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// Authentication using OAuth 2.0 tokens of an identity provider
+		if exporterConfig.OAuth2.Active {
+			token, ok := bearerToken(r)
+			if !ok || checkOAuth2(exporterConfig, token) != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="Restricted"`)
+				http.Error(w, "Not authorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	}
+}
+
+// bearerToken returns the bearer token of the Authorization header of
+// a request.
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// checkJWT validates jwt tokens. A token is valid if any of the keys
+// for its signing method verifies it.
+func checkJWT(c *config.Config, jwtToken string) error {
+	var parser jwt.Parser
+	unverified, _, err := parser.ParseUnverified(jwtToken, jwt.MapClaims{})
+	if err != nil {
+		return err
+	}
+	keys, err := jwtKeys(c, unverified)
+	if err != nil {
+		return err
+	}
+
+	err = errors.New("no key to verify the token with")
+	for _, key := range keys {
+		var token *jwt.Token
+		token, err = jwt.Parse(jwtToken, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if err != nil {
+			continue
+		}
+		if _, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+			return nil
+		}
+		err = errors.New("not authorized")
+	}
+
+	return err
+}
+
+// jwtKeys returns the keys that may verify a token, by its signing
+// method. HMAC keys are only ever used as such, so that public keys
+// can't be abused as HMAC secrets. Keys of the JSON Web Key Set are
+// chosen by the key ID of the token, if it has one.
+func jwtKeys(c *config.Config, token *jwt.Token) ([]interface{}, error) {
+	var keys []interface{}
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if c.BearerAuth.SigningKey != "" {
+			keys = append(keys, []byte(c.BearerAuth.SigningKey))
+		}
+		for _, k := range c.BearerAuth.SigningKeys {
+			keys = append(keys, []byte(k))
+		}
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		for _, k := range c.BearerPublicKeys() {
+			keys = append(keys, k)
+		}
+		if c.BearerAuth.JWKSURL != "" {
+			kid, _ := token.Header["kid"].(string)
+			for _, k := range jwksKeys(c.BearerAuth.JWKSURL, c.BearerAuth.JWKSRefresh, kid) {
+				keys = append(keys, k)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return keys, nil
+}
+
+// CreateJWT creates a bearer token signed with the signing key of a
+// configuration.
+func CreateJWT(c *config.Config) (string, error) {
+	if c.BearerAuth.SigningKey == "" {
+		return "", errors.New("bearerAuth: signingKey is required to create tokens")
+	}
+	token := jwt.New(jwt.SigningMethodHS256)
+	tokenString, err := token.SignedString([]byte(c.BearerAuth.SigningKey))
+	return tokenString, err
+}
+
+// ClientCATLSConfig returns a TLS configuration that verifies client
+// certificates against the CA certificates in file, if clients
+// present one. Clients without a certificate are still accepted,
+// since client certificates are only used to identify clients.
+func ClientCATLSConfig(file string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no CA certificates found in %s", file)
+	}
+
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
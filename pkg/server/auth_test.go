@@ -0,0 +1,244 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// loadConfig loads a configuration file with the given contents, in a
+// directory of its own that also has the files, by name, that it
+// refers to as {dir}/name.
+func loadConfig(t *testing.T, text string, files map[string][]byte) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(strings.ReplaceAll(text, "{dir}", dir)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &config.Config{}
+	if err := c.LoadConfig(file); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	return c
+}
+
+// signToken returns a token with claims, signed with key by method,
+// and with the key ID kid in its header if it isn't "".
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// publicKeyPEM returns a public key in the PEM format of
+// bearerAuth.publicKeyFile.
+func publicKeyPEM(t *testing.T, key interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestCheckJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := publicKeyPEM(t, &rsaKey.PublicKey)
+	files := map[string][]byte{"rsa.pem": rsaPEM, "ec.pem": publicKeyPEM(t, &ecKey.PublicKey)}
+
+	hmac := loadConfig(t, `
+bearerAuth:
+  active: true
+  signingKey: current
+  signingKeys: [previous, older]
+`, files)
+	rsaOnly := loadConfig(t, `
+bearerAuth:
+  active: true
+  publicKeyFile: {dir}/rsa.pem
+`, files)
+	ecOnly := loadConfig(t, `
+bearerAuth:
+  active: true
+  publicKeyFile: {dir}/ec.pem
+`, files)
+
+	now := time.Now()
+	valid := jwt.MapClaims{"sub": "prometheus", "exp": now.Add(time.Hour).Unix()}
+	tests := []struct {
+		name  string
+		c     *config.Config
+		token string
+		ok    bool
+	}{
+		{"current hmac key", hmac, signToken(t, jwt.SigningMethodHS256, []byte("current"), "", valid), true},
+		{"rotated hmac key", hmac, signToken(t, jwt.SigningMethodHS256, []byte("previous"), "", valid), true},
+		{"oldest rotated hmac key", hmac, signToken(t, jwt.SigningMethodHS512, []byte("older"), "", valid), true},
+		{"unknown hmac key", hmac, signToken(t, jwt.SigningMethodHS256, []byte("stolen"), "", valid), false},
+		{"no claims", hmac, signToken(t, jwt.SigningMethodHS256, []byte("current"), "", jwt.MapClaims{}), true},
+		{"expired", hmac, signToken(t, jwt.SigningMethodHS256, []byte("current"), "", jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}), false},
+		{"not valid yet", hmac, signToken(t, jwt.SigningMethodHS256, []byte("current"), "", jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()}), false},
+		{"valid since", hmac, signToken(t, jwt.SigningMethodHS256, []byte("current"), "", jwt.MapClaims{"nbf": now.Add(-time.Hour).Unix()}), true},
+		{"rsa key", rsaOnly, signToken(t, jwt.SigningMethodRS256, rsaKey, "", valid), true},
+		{"rsa-pss key", rsaOnly, signToken(t, jwt.SigningMethodPS256, rsaKey, "", valid), true},
+		{"other rsa key", rsaOnly, signToken(t, jwt.SigningMethodRS256, otherRSAKey, "", valid), false},
+		{"expired rsa", rsaOnly, signToken(t, jwt.SigningMethodRS256, rsaKey, "", jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}), false},
+		// The public key must never be usable as an HMAC secret.
+		{"hmac with the rsa public key", rsaOnly, signToken(t, jwt.SigningMethodHS256, rsaPEM, "", valid), false},
+		{"hmac without hmac keys", rsaOnly, signToken(t, jwt.SigningMethodHS256, []byte("current"), "", valid), false},
+		{"rsa without public keys", hmac, signToken(t, jwt.SigningMethodRS256, rsaKey, "", valid), false},
+		{"ecdsa key", ecOnly, signToken(t, jwt.SigningMethodES256, ecKey, "", valid), true},
+		{"rsa against an ecdsa key", ecOnly, signToken(t, jwt.SigningMethodRS256, rsaKey, "", valid), false},
+		{"unsigned", hmac, signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", valid), false},
+		{"garbage", hmac, "not.a.token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJWT(tt.c, tt.token)
+			if tt.ok && err != nil {
+				t.Errorf("checkJWT() error = %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("checkJWT() accepted the token")
+			}
+		})
+	}
+}
+
+func TestCreateJWT(t *testing.T) {
+	c := &config.Config{}
+	if _, err := CreateJWT(c); err == nil {
+		t.Error("CreateJWT() without a signing key succeeded")
+	}
+	c.BearerAuth.SigningKey = "current"
+	token, err := CreateJWT(c)
+	if err != nil {
+		t.Fatalf("CreateJWT() error = %v", err)
+	}
+	if err := checkJWT(c, token); err != nil {
+		t.Errorf("checkJWT() of a created token error = %v", err)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	c := &config.Config{}
+	c.BasicAuth.Active = true
+	c.BasicAuth.Username = "prometheus"
+	c.BasicAuth.Password = "secret"
+	c.AuthEndpoints = []string{config.EndpointProbe}
+	auth := NewAuth(func() *config.Config { return c })
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+
+	tests := []struct {
+		name     string
+		endpoint string
+		user     string
+		password string
+		want     int
+	}{
+		{"authenticated", config.EndpointProbe, "prometheus", "secret", http.StatusOK},
+		{"wrong password", config.EndpointProbe, "prometheus", "guess", http.StatusUnauthorized},
+		{"wrong user", config.EndpointProbe, "grafana", "secret", http.StatusUnauthorized},
+		{"unauthenticated", config.EndpointProbe, "", "", http.StatusUnauthorized},
+		{"endpoint without authentication", config.EndpointMetrics, "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			Use(ok, auth.For(tt.endpoint))(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+
+	// Changes of the configuration take effect right away.
+	c = &config.Config{}
+	w := httptest.NewRecorder()
+	Use(ok, auth.Required)(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status without authentication = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestBearerAuthMiddleware(t *testing.T) {
+	c := &config.Config{}
+	c.BearerAuth.Active = true
+	c.BearerAuth.SigningKey = "current"
+	auth := NewAuth(func() *config.Config { return c })
+	h := Use(func(w http.ResponseWriter, r *http.Request) {}, auth.Required)
+	token, err := CreateJWT(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"valid token", "Bearer " + token, http.StatusOK},
+		{"lowercase scheme", "bearer " + token, http.StatusOK},
+		{"invalid token", "Bearer " + token + "x", http.StatusUnauthorized},
+		{"no token", "Bearer ", http.StatusUnauthorized},
+		{"basic authentication", "Basic cHJvbWV0aGV1czpzZWNyZXQ=", http.StatusUnauthorized},
+		{"no header", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// fetchTimeout is how long fetching a JSON Web Key Set, a
+	// discovery document or an introspection may take.
+	fetchTimeout = 10 * time.Second
+
+	// jwksMinInterval is how long we wait at least between fetches
+	// of a key set, so that tokens with unknown key IDs can't make
+	// us fetch it for every request.
+	jwksMinInterval = time.Minute
+
+	// maxFetchBytes is the largest document we read from them.
+	maxFetchBytes = 1024 * 1024
+)
+
+// A jsonWebKey is a key of a JSON Web Key Set, of which we use RSA
+// and EC keys for signatures.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// A webKey is a usable key of a key set.
+type webKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// A keySet is a JSON Web Key Set as last fetched, and when we last
+// tried to fetch it. fetching is closed once the fetch that is under
+// way, if any, is done.
+type keySet struct {
+	keys     []webKey
+	fetched  time.Time
+	tried    time.Time
+	fetching chan struct{}
+}
+
+// The key sets that tokens were verified with, by URL. The lock isn't
+// held while a key set is fetched, so that a slow key set only holds
+// up the requests that need keys that we don't have yet.
+var (
+	jwksMu  sync.Mutex
+	keySets = make(map[string]*keySet)
+)
+
+// jwksKeys returns the keys of the JSON Web Key Set at url that have
+// the key ID kid, or all of them if kid is "". The key set is fetched
+// again once it's older than refresh, or if it has no key with kid,
+// but not more often than jwksMinInterval, and only once at a time;
+// while it's fetched, the keys that we have are returned, or if there
+// are none, the fetch is waited for. If it can't be fetched, the keys
+// that we have are used.
+func jwksKeys(url string, refresh time.Duration, kid string) []crypto.PublicKey {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+
+	ks := keySets[url]
+	if ks == nil {
+		ks = &keySet{}
+		keySets[url] = ks
+	}
+	find := func() []crypto.PublicKey {
+		var keys []crypto.PublicKey
+		for _, k := range ks.keys {
+			if kid == "" || k.kid == kid {
+				keys = append(keys, k.key)
+			}
+		}
+		return keys
+	}
+
+	keys := find()
+	if ks.fetching != nil {
+		if len(keys) == 0 {
+			done := ks.fetching
+			jwksMu.Unlock()
+			<-done
+			jwksMu.Lock()
+			keys = find()
+		}
+		return keys
+	}
+	if (len(keys) > 0 && time.Since(ks.fetched) < refresh) || time.Since(ks.tried) < jwksMinInterval {
+		return keys
+	}
+
+	ks.tried = time.Now()
+	done := make(chan struct{})
+	ks.fetching = done
+	jwksMu.Unlock()
+	fetched, err := fetchJWKS(url)
+	jwksMu.Lock()
+	ks.fetching = nil
+	close(done)
+	if err != nil {
+		log.Printf("Can't fetch the JSON Web Key Set %s: %s\n", url, err.Error())
+		return keys
+	}
+	ks.keys, ks.fetched = fetched, time.Now()
+	return find()
+}
+
+// fetchJWKS fetches a JSON Web Key Set and returns its keys for
+// signatures. Keys we can't use are skipped.
+func fetchJWKS(url string) ([]webKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(url, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []webKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping key %q of the JSON Web Key Set %s: %s\n", jwk.Kid, url, err.Error())
+			continue
+		}
+		keys = append(keys, webKey{kid: jwk.Kid, key: key})
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key of a RSA or EC web key.
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeKeyInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeKeyInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeKeyInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeKeyInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// decodeKeyInt decodes an integer of a web key, in unpadded base64url.
+func decodeKeyInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// getJSON fetches a JSON document from url into v.
+func getJSON(url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return doJSON(req, v)
+}
+
+// doJSON sends a request and decodes the JSON document of its
+// response into v.
+func doJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("User-Agent", "script_exporter")
+	client := &http.Client{Timeout: fetchTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errors.New(res.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxFetchBytes))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// rsaJWK returns an RSA public key as a web key with a key ID.
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// ecJWK returns an EC public key as a web key with a key ID.
+func ecJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Crv: key.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+// serveJWKS returns a server of a JSON Web Key Set with keys.
+func serveJWKS(t *testing.T, keys ...jsonWebKey) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestCheckJWTWithJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption := rsaJWK("enc", &otherRSAKey.PublicKey)
+	encryption.Use = "enc"
+	s := serveJWKS(t, rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey), encryption)
+
+	c := &config.Config{}
+	c.BearerAuth.Active = true
+	c.BearerAuth.JWKSURL = s.URL
+	c.BearerAuth.JWKSRefresh = time.Hour
+
+	valid := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"rsa key by kid", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", valid), true},
+		{"ecdsa key by kid", signToken(t, jwt.SigningMethodES256, ecKey, "ec", valid), true},
+		{"without kid", signToken(t, jwt.SigningMethodRS256, rsaKey, "", valid), true},
+		{"unknown kid", signToken(t, jwt.SigningMethodRS256, rsaKey, "rotated-away", valid), false},
+		{"kid of another key", signToken(t, jwt.SigningMethodRS256, rsaKey, "ec", valid), false},
+		{"key for encryption", signToken(t, jwt.SigningMethodRS256, otherRSAKey, "enc", valid), false},
+		{"expired", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), false},
+		{"not valid yet", signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()}), false},
+		{"hmac with the kid of an rsa key", signToken(t, jwt.SigningMethodHS256, []byte("secret"), "rsa", valid), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJWT(c, tt.token)
+			if tt.ok && err != nil {
+				t.Errorf("checkJWT() error = %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("checkJWT() accepted the token")
+			}
+		})
+	}
+}
+
+func TestJWKSKeysDoesNotBlockOnSlowKeySets(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{rsaJWK("slow", &key.PublicKey)}})
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := serveJWKS(t, rsaJWK("fast", &key.PublicKey))
+
+	fetched := make(chan int, 1)
+	go func() {
+		fetched <- len(jwksKeys(slow.URL, time.Hour, "slow"))
+	}()
+	// Wait until the slow fetch is under way.
+	for {
+		jwksMu.Lock()
+		ks := keySets[slow.URL]
+		busy := ks != nil && ks.fetching != nil
+		jwksMu.Unlock()
+		if busy {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		done <- len(jwksKeys(fast.URL, time.Hour, "fast"))
+	}()
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Errorf("jwksKeys() of the fast key set returned %d keys, want 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("jwksKeys() of the fast key set waited for the slow one")
+	}
+
+	release <- struct{}{}
+	if n := <-fetched; n != 1 {
+		t.Errorf("jwksKeys() of the slow key set returned %d keys, want 1", n)
+	}
+}
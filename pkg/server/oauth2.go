@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+// oidcRefresh is how often the discovery document and the key set of
+// an OpenID Connect issuer are fetched again.
+const oidcRefresh = time.Hour
+
+// maxIntrospectedTokens is the number of remembered introspections
+// above which we drop the expired ones.
+const maxIntrospectedTokens = 1024
+
+// An oidcDiscovery is the part of the discovery document of an OpenID
+// Connect issuer that we use, and when it was last fetched.
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+
+	fetched time.Time
+	tried   time.Time
+}
+
+// An introspectedToken is the remembered result of introspecting a
+// token.
+type introspectedToken struct {
+	err     error
+	expires time.Time
+}
+
+var (
+	oidcMu   sync.Mutex
+	oidcDocs = make(map[string]*oidcDiscovery)
+
+	// Introspected tokens by their hash.
+	introspectedMu sync.Mutex
+	introspected   = make(map[[sha256.Size]byte]introspectedToken)
+)
+
+// checkOAuth2 validates a bearer token with the OpenID Connect issuer
+// or the introspection endpoint of the configuration.
+func checkOAuth2(c *config.Config, token string) error {
+	if c.OAuth2.Issuer != "" {
+		return checkOIDCToken(c, token)
+	}
+	return checkIntrospectedToken(c, token)
+}
+
+// checkOIDCToken validates a JSON Web Token of an OpenID Connect
+// issuer: it must be signed with a key of the issuer, be issued by it
+// for our audience with our scopes and not be expired.
+func checkOIDCToken(c *config.Config, token string) error {
+	var parser jwt.Parser
+	unverified, _, err := parser.ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return err
+	}
+	switch unverified.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+	default:
+		return fmt.Errorf("unexpected signing method: %v", unverified.Header["alg"])
+	}
+
+	jwksURI, err := oidcJWKSURI(c.OAuth2.Issuer)
+	if err != nil {
+		return err
+	}
+	kid, _ := unverified.Header["kid"].(string)
+	err = errors.New("no key to verify the token with")
+	for _, key := range jwksKeys(jwksURI, oidcRefresh, kid) {
+		var t *jwt.Token
+		t, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if err != nil {
+			continue
+		}
+		claims, ok := t.Claims.(jwt.MapClaims)
+		if !ok || !t.Valid {
+			return errors.New("not authorized")
+		}
+		if iss, _ := claims["iss"].(string); iss != c.OAuth2.Issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+		if !hasAudience(claims["aud"], c.OAuth2.Audience) {
+			return errors.New("token is not for our audience")
+		}
+		scope := claims["scope"]
+		if scope == nil {
+			scope = claims["scp"]
+		}
+		if !hasScopes(scope, c.OAuth2.Scopes) {
+			return errors.New("token lacks a required scope")
+		}
+		return nil
+	}
+	return err
+}
+
+// oidcJWKSURI returns the URL of the key set of an OpenID Connect
+// issuer, from its discovery document. The document is fetched again
+// every oidcRefresh, but not more often than jwksMinInterval if that
+// fails.
+func oidcJWKSURI(issuer string) (string, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+
+	d := oidcDocs[issuer]
+	if d == nil {
+		d = &oidcDiscovery{}
+		oidcDocs[issuer] = d
+	}
+	if (d.JWKSURI != "" && time.Since(d.fetched) < oidcRefresh) || time.Since(d.tried) < jwksMinInterval {
+		if d.JWKSURI == "" {
+			return "", errors.New("no discovery document")
+		}
+		return d.JWKSURI, nil
+	}
+
+	d.tried = time.Now()
+	var doc oidcDiscovery
+	err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err == nil && doc.Issuer != issuer {
+		err = fmt.Errorf("discovery document is for the issuer %s", doc.Issuer)
+	}
+	if err == nil && doc.JWKSURI == "" {
+		err = errors.New("discovery document has no jwks_uri")
+	}
+	if err != nil {
+		log.Printf("Can't fetch the discovery document of %s: %s\n", issuer, err.Error())
+		if d.JWKSURI == "" {
+			return "", err
+		}
+		return d.JWKSURI, nil
+	}
+	d.JWKSURI, d.fetched = doc.JWKSURI, time.Now()
+	return d.JWKSURI, nil
+}
+
+// checkIntrospectedToken validates a token with an RFC 7662
+// introspection endpoint: it must be active, have our scopes and, if
+// we have an audience, be for it. Results are remembered for the cache duration,
+// but valid tokens at most until they expire.
+func checkIntrospectedToken(c *config.Config, token string) error {
+	o := &c.OAuth2
+	h := sha256.Sum256([]byte(token))
+	now := time.Now()
+	introspectedMu.Lock()
+	it, ok := introspected[h]
+	introspectedMu.Unlock()
+	if ok && now.Before(it.expires) {
+		return it.err
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, o.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+	var res struct {
+		Active bool        `json:"active"`
+		Aud    interface{} `json:"aud"`
+		Scope  string      `json:"scope"`
+		Exp    int64       `json:"exp"`
+	}
+	if err := doJSON(req, &res); err != nil {
+		// Failures of the endpoint aren't remembered, so that
+		// tokens work again as soon as it does.
+		log.Printf("Can't introspect token: %s\n", err.Error())
+		return err
+	}
+
+	it = introspectedToken{expires: now.Add(o.CacheDuration)}
+	switch {
+	case !res.Active:
+		it.err = errors.New("token is not active")
+	case o.Audience != "" && !hasAudience(res.Aud, o.Audience):
+		it.err = errors.New("token is not for our audience")
+	case !hasScopes(res.Scope, o.Scopes):
+		it.err = errors.New("token lacks a required scope")
+	case res.Exp > 0 && time.Unix(res.Exp, 0).Before(it.expires):
+		it.expires = time.Unix(res.Exp, 0)
+	}
+
+	introspectedMu.Lock()
+	defer introspectedMu.Unlock()
+	if len(introspected) >= maxIntrospectedTokens {
+		for k, t := range introspected {
+			if now.After(t.expires) {
+				delete(introspected, k)
+			}
+		}
+	}
+	introspected[h] = it
+	return it.err
+}
+
+// hasAudience reports whether the audience of a token, a string or a
+// list of them, includes audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, _ := v.(string); s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasScopes reports whether the scopes of a token, a space-separated
+// string or a list of them, include all of scopes.
+func hasScopes(scope interface{}, scopes []string) bool {
+	have := make(map[string]bool)
+	switch s := scope.(type) {
+	case string:
+		for _, v := range strings.Fields(s) {
+			have[v] = true
+		}
+	case []interface{}:
+		for _, v := range s {
+			if v, ok := v.(string); ok {
+				have[v] = true
+			}
+		}
+	}
+	for _, s := range scopes {
+		if !have[s] {
+			return false
+		}
+	}
+	return true
+}
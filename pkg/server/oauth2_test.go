@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/ricoberger/script_exporter/pkg/config"
+)
+
+func TestCheckOIDCToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{rsaJWK("a", &key.PublicKey)}})
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	issuer = s.URL
+
+	c := &config.Config{}
+	c.OAuth2.Active = true
+	c.OAuth2.Issuer = issuer
+	c.OAuth2.Audience = "script-exporter"
+	c.OAuth2.Scopes = []string{"probe"}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(change map[string]interface{}) jwt.MapClaims {
+		claims := jwt.MapClaims{"iss": issuer, "aud": "script-exporter", "scope": "openid probe", "exp": exp}
+		for k, v := range change {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", signToken(t, jwt.SigningMethodRS256, key, "a", claims(nil)), true},
+		{"one of the audiences", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"aud": []string{"other", "script-exporter"}})), true},
+		{"scopes as scp", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"scope": nil, "scp": []string{"probe"}})), true},
+		{"other audience", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"aud": "other"})), false},
+		{"no audience", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"aud": nil})), false},
+		{"other issuer", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"missing scope", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"scope": "openid"})), false},
+		{"no scopes", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"scope": nil})), false},
+		{"expired", signToken(t, jwt.SigningMethodRS256, key, "a", claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), false},
+		{"other key", signToken(t, jwt.SigningMethodRS256, otherKey, "a", claims(nil)), false},
+		{"unknown kid", signToken(t, jwt.SigningMethodRS256, key, "b", claims(nil)), false},
+		{"hmac", signToken(t, jwt.SigningMethodHS256, []byte("secret"), "a", claims(nil)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOAuth2(c, tt.token)
+			if tt.ok && err != nil {
+				t.Errorf("checkOAuth2() error = %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("checkOAuth2() accepted the token")
+			}
+		})
+	}
+}
+
+func TestCheckOIDCTokenWithoutDiscovery(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+	c := &config.Config{}
+	c.OAuth2.Issuer = s.URL
+	c.OAuth2.Audience = "script-exporter"
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, jwt.SigningMethodRS256, key, "", jwt.MapClaims{"iss": s.URL, "aud": "script-exporter"})
+	if err := checkOAuth2(c, token); err == nil {
+		t.Error("checkOAuth2() without a discovery document accepted the token")
+	}
+}
+
+func TestCheckIntrospectedToken(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "exporter" || secret != "secret" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		token := r.PostFormValue("token")
+		mu.Lock()
+		requests[token]++
+		mu.Unlock()
+		res := map[string]interface{}{"active": true, "aud": "script-exporter", "scope": "metrics probe"}
+		switch token {
+		case "inactive":
+			res = map[string]interface{}{"active": false}
+		case "other-audience":
+			res["aud"] = []string{"other"}
+		case "one-of-the-audiences":
+			res["aud"] = []string{"other", "script-exporter"}
+		case "missing-scope":
+			res["scope"] = "metrics"
+		case "expiring":
+			res["exp"] = time.Now().Add(-time.Second).Unix()
+		case "failing":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		case "garbage":
+			w.Write([]byte("<html>"))
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer s.Close()
+
+	c := &config.Config{}
+	c.OAuth2.Active = true
+	c.OAuth2.IntrospectionURL = s.URL
+	c.OAuth2.ClientID = "exporter"
+	c.OAuth2.ClientSecret = "secret"
+	c.OAuth2.Audience = "script-exporter"
+	c.OAuth2.Scopes = []string{"probe"}
+	c.OAuth2.CacheDuration = time.Hour
+
+	tests := []struct {
+		token string
+		ok    bool
+	}{
+		{"active", true},
+		{"one-of-the-audiences", true},
+		{"inactive", false},
+		{"other-audience", false},
+		{"missing-scope", false},
+		{"failing", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			// The second check is answered from the cache, if the
+			// first was.
+			for i := 0; i < 2; i++ {
+				err := checkOAuth2(c, tt.token)
+				if tt.ok && err != nil {
+					t.Errorf("checkOAuth2() error = %v", err)
+				}
+				if !tt.ok && err == nil {
+					t.Error("checkOAuth2() accepted the token")
+				}
+			}
+		})
+	}
+
+	if err := checkOAuth2(c, "expiring"); err != nil {
+		t.Errorf("checkOAuth2() error = %v", err)
+	}
+	if err := checkOAuth2(c, "expiring"); err != nil {
+		t.Errorf("checkOAuth2() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for token, want := range map[string]int{
+		"active": 1, "inactive": 1, "missing-scope": 1,
+		// Failures of the endpoint aren't remembered.
+		"failing": 2, "garbage": 2,
+		// Tokens aren't remembered beyond their expiry.
+		"expiring": 2,
+	} {
+		if got := requests[token]; got != want {
+			t.Errorf("token %s was introspected %d times, want %d", token, got, want)
+		}
+	}
+}
+
+func TestHasScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		scope  interface{}
+		scopes []string
+		want   bool
+	}{
+		{"none required", nil, nil, true},
+		{"string", "openid probe metrics", []string{"probe", "metrics"}, true},
+		{"list", []interface{}{"probe", "metrics"}, []string{"metrics"}, true},
+		{"missing", "openid probe", []string{"metrics"}, false},
+		{"prefix", "probe:read", []string{"probe"}, false},
+		{"absent", nil, []string{"probe"}, false},
+		{"other type", 42.0, []string{"probe"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasScopes(tt.scope, tt.scopes); got != tt.want {
+				t.Errorf("hasScopes(%v, %q) = %v, want %v", tt.scope, tt.scopes, got, tt.want)
+			}
+		})
+	}
+}